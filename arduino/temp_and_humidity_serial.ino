@@ -11,6 +11,32 @@
 const int capacity = JSON_OBJECT_SIZE(2);
 StaticJsonDocument<capacity> doc;
 
+const char *firmwareVersion = "1.1.0";
+
+unsigned long seq = 0;
+unsigned long interval = 5000;
+unsigned long lastMeasurement = 0;
+
+void (*resetBoard)(void) = 0;
+
+// Send $<json>*<crc8> frames, read with -framing crc8
+const bool framed = false;
+
+// CRC-8/SMBUS, polynomial 0x07
+uint8_t crc8(const char *data, size_t len)
+{
+  uint8_t crc = 0;
+  for (size_t i = 0; i < len; i++)
+  {
+    crc ^= data[i];
+    for (int bit = 0; bit < 8; bit++)
+    {
+      crc = (crc & 0x80) ? (crc << 1) ^ 0x07 : crc << 1;
+    }
+  }
+  return crc;
+}
+
 void setup()
 {
   Serial.begin(115200);
@@ -19,19 +45,109 @@ void setup()
   TSL2561.init();
 }
 
-void loop()
+void send(JsonDocument &doc)
+{
+  if (framed)
+  {
+    char payload[256];
+    size_t len = serializeJson(doc, payload, sizeof(payload));
+    char checksum[3];
+    snprintf(checksum, sizeof(checksum), "%02X", crc8(payload, len));
+
+    Serial.print("$");
+    Serial.print(payload);
+    Serial.print("*");
+    Serial.print(checksum);
+  }
+  else
+  {
+    serializeJson(doc, Serial);
+  }
+
+  Serial.print("\n");
+}
+
+void measure()
 {
   StaticJsonDocument<1024> doc;
 
+  doc["ts"] = millis();
+  doc["seq"] = seq++;
+
   float temper = TH02.ReadTemperature();
   doc["temperature_celcius"] = temper;
 
   float humidity = TH02.ReadHumidity();
   doc["humidity"] = humidity;
 
-  serializeJson(doc, Serial);
+  doc["lux"] = TSL2561.readVisibleLux();
 
-  Serial.print("\n");
+  send(doc);
+}
+
+// Handles {"id":N,"cmd":"..."} commands and answers {"ack":N,"ok":...}
+void handleCommand(String line)
+{
+  line.trim();
+  if (line.startsWith("$"))
+  {
+    line = line.substring(1, line.lastIndexOf('*'));
+  }
+
+  StaticJsonDocument<256> request;
+  if (deserializeJson(request, line))
+  {
+    return;
+  }
+
+  StaticJsonDocument<256> reply;
+  reply["ack"] = request["id"];
+  reply["ok"] = true;
+
+  const char *cmd = request["cmd"] | "";
+  bool reboot = false;
+  if (strcmp(cmd, "interval") == 0 && request["value"].as<float>() >= 1)
+  {
+    interval = request["value"].as<float>() * 1000;
+    reply["interval"] = interval / 1000;
+  }
+  else if (strcmp(cmd, "read") == 0)
+  {
+    lastMeasurement = 0;
+  }
+  else if (strcmp(cmd, "version") == 0)
+  {
+    reply["version"] = firmwareVersion;
+  }
+  else if (strcmp(cmd, "reboot") == 0)
+  {
+    reboot = true;
+  }
+  else
+  {
+    reply["ok"] = false;
+    reply["error"] = "unsupported command";
+  }
+
+  send(reply);
+
+  if (reboot)
+  {
+    Serial.flush();
+    resetBoard();
+  }
+}
+
+void loop()
+{
+  if (Serial.available())
+  {
+    handleCommand(Serial.readStringUntil('\n'));
+  }
 
-  delay(5000);
+  if (lastMeasurement == 0 || millis() - lastMeasurement >= interval)
+  {
+    lastMeasurement = millis();
+    measure();
+  }
 }
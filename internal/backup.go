@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+const (
+	backupUsage  = "backup -to FILE"
+	restoreUsage = "restore -from FILE"
+
+	backupCheckInterval = 1 * time.Hour
+	backupDateLayout    = "2006-01-02"
+)
+
+var (
+	backupDir        = flag.String("backup-dir", "", "Write a daily backup of the database to this directory")
+	backupKeepDaily  = flag.Int("backup-keep-daily", 7, "Number of daily backups to keep in -backup-dir")
+	backupKeepWeekly = flag.Int("backup-keep-weekly", 4, "Number of weeks to keep the newest backup of in -backup-dir")
+)
+
+var backupDatabase = backupDatabaseImpl
+var restoreDatabase = restoreDatabaseImpl
+var startBackupScheduler = startBackupSchedulerImpl
+
+// copyDatabase copies src over dst with the SQLite online backup API. The
+// copy is a consistent snapshot, taken without stopping writers to src.
+func copyDatabase(dst, src *sql.DB) error {
+	ctx := context.Background()
+	dstConn, err := dst.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer dstConn.Close()
+	srcConn, err := src.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer srcConn.Close()
+
+	return dstConn.Raw(func(dstDriver any) error {
+		return srcConn.Raw(func(srcDriver any) error {
+			d, ok := dstDriver.(*sqlite3.SQLiteConn)
+			s, ok2 := srcDriver.(*sqlite3.SQLiteConn)
+			if !ok || !ok2 {
+				return errors.New("backup needs SQLite connections")
+			}
+			backup, err := d.Backup("main", s, "main")
+			if err != nil {
+				return err
+			}
+			if _, err := backup.Step(-1); err != nil {
+				backup.Finish()
+				return err
+			}
+			return backup.Finish()
+		})
+	})
+}
+
+// backupDatabaseImpl writes a snapshot of db to path. The snapshot is
+// written next to it first and renamed into place, so path is never a
+// partial copy.
+func backupDatabaseImpl(db *sql.DB, path string) error {
+	tmp := path + ".tmp"
+	os.Remove(tmp)
+
+	dst, err := sql.Open("sqlite3", tmp)
+	if err != nil {
+		return err
+	}
+	if err := copyDatabase(dst, db); err != nil {
+		dst.Close()
+		os.Remove(tmp)
+		return err
+	}
+	// A single self-contained file, whatever the journal mode of db
+	if _, err := dst.Exec("PRAGMA journal_mode = DELETE"); err != nil {
+		dst.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// checkBackup verifies that path is an intact Skogsnet database this
+// program can use, and returns its schema version.
+func checkBackup(path string) (int, error) {
+	if _, err := os.Stat(path); err != nil {
+		return 0, err
+	}
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	var result string
+	if err := db.QueryRow("PRAGMA integrity_check(1)").Scan(&result); err != nil {
+		return 0, fmt.Errorf("%s is not a readable SQLite database: %w", path, err)
+	}
+	if result != "ok" {
+		return 0, fmt.Errorf("%s failed the integrity check: %s", path, result)
+	}
+
+	tables := make(map[string]bool)
+	rows, err := db.Query("SELECT name FROM sqlite_master WHERE type = 'table' AND name IN ('measurements', 'schema_migrations')")
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return 0, err
+		}
+		tables[name] = true
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if !tables["measurements"] {
+		return 0, fmt.Errorf("%s has no measurements table", path)
+	}
+	if !tables["schema_migrations"] {
+		return 0, nil // from before migrations
+	}
+
+	var version int
+	if err := db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version); err != nil {
+		return 0, err
+	}
+	if version > len(migrations) {
+		return 0, fmt.Errorf("%s has schema version %d, newer than this program knows", path, version)
+	}
+	return version, nil
+}
+
+// restoreDatabaseImpl checks the backup at from and copies it over the
+// database at dbPath, after saving the current database to
+// <dbPath>.pre-restore. It returns the schema version of the backup.
+func restoreDatabaseImpl(dbPath, from string) (int, error) {
+	if filepath.Clean(dbPath) == filepath.Clean(from) {
+		return 0, errors.New("cannot restore the database from itself")
+	}
+	version, err := checkBackup(from)
+	if err != nil {
+		return 0, err
+	}
+
+	db, err := connectDatabase(dbPath)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+	if err := backupDatabase(db, dbPath+".pre-restore"); err != nil {
+		return 0, fmt.Errorf("could not save the current database: %w", err)
+	}
+
+	src, err := sql.Open("sqlite3", "file:"+from+"?mode=ro")
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+	return version, copyDatabase(db, src)
+}
+
+// backupFilePrefix names the scheduled backups after the database file,
+// e.g. measurements-2025-06-01.db.
+func backupFilePrefix() string {
+	base := filepath.Base(*dbFileName)
+	return strings.TrimSuffix(base, filepath.Ext(base)) + "-"
+}
+
+// scheduledBackup writes today's backup to dir unless it exists, then
+// deletes the backups rotation no longer keeps.
+func scheduledBackup(db *sql.DB, dir string, now time.Time) error {
+	path := filepath.Join(dir, backupFilePrefix()+now.Format(backupDateLayout)+".db")
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return err
+		}
+		if err := backupDatabase(db, path); err != nil {
+			return err
+		}
+		logInfo("Backed up database to %s", path)
+	} else if err != nil {
+		return err
+	}
+
+	removed, err := rotateBackups(dir, *backupKeepDaily, *backupKeepWeekly)
+	for _, name := range removed {
+		logInfo("Removed old backup %s", name)
+	}
+	return err
+}
+
+// rotateBackups keeps the newest keepDaily backups in dir, and the newest
+// backup of each of the last keepWeekly weeks that have one. The others are
+// deleted and their names returned.
+func rotateBackups(dir string, keepDaily, keepWeekly int) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	type backupFile struct {
+		name string
+		date time.Time
+	}
+	prefix := backupFilePrefix()
+	var backups []backupFile
+	for _, entry := range entries {
+		date, ok := strings.CutPrefix(entry.Name(), prefix)
+		if !ok || entry.IsDir() {
+			continue
+		}
+		day, err := time.Parse(backupDateLayout+".db", date)
+		if err != nil {
+			continue // not a scheduled backup
+		}
+		backups = append(backups, backupFile{entry.Name(), day})
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].date.After(backups[j].date) })
+
+	keep := make(map[string]bool)
+	weeks := make(map[[2]int]bool)
+	for i, backup := range backups {
+		if i < keepDaily {
+			keep[backup.name] = true
+		}
+		year, week := backup.date.ISOWeek()
+		if !weeks[[2]int{year, week}] && len(weeks) < keepWeekly {
+			weeks[[2]int{year, week}] = true
+			keep[backup.name] = true
+		}
+	}
+
+	var removed []string
+	for _, backup := range backups {
+		if keep[backup.name] {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, backup.name)); err != nil {
+			return removed, err
+		}
+		removed = append(removed, backup.name)
+	}
+	return removed, nil
+}
+
+// startBackupSchedulerImpl writes a backup to -backup-dir on startup and
+// every day after, until ctx is cancelled.
+func startBackupSchedulerImpl(ctx context.Context, db *sql.DB, wg *sync.WaitGroup) error {
+	if *backupKeepDaily < 1 {
+		return fmt.Errorf("invalid -backup-keep-daily %d, expected at least 1", *backupKeepDaily)
+	}
+	if *backupKeepWeekly < 0 {
+		return fmt.Errorf("invalid -backup-keep-weekly %d, expected 0 or more", *backupKeepWeekly)
+	}
+
+	dir := *backupDir
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(backupCheckInterval)
+		defer ticker.Stop()
+		for {
+			if err := scheduledBackup(db, dir, time.Now()); err != nil {
+				logError("Backup to %s failed: %v", dir, err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return nil
+}
+
+// runBackupCommand implements the backup subcommand. It is safe to run
+// while the daemon writes to the database.
+func runBackupCommand(args []string) error {
+	fs := newSubcommandFlagSet("backup", backupUsage)
+	to := fs.String("to", "", "Backup file to write")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *to == "" || fs.NArg() != 0 {
+		fs.Usage()
+		return errors.New("-to is required")
+	}
+	if filepath.Clean(*to) == filepath.Clean(*dbFileName) {
+		return errors.New("cannot back up the database onto itself")
+	}
+	if _, err := os.Stat(*dbFileName); err != nil {
+		return err
+	}
+
+	db, err := connectDatabase(*dbFileName)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := backupDatabase(db, *to); err != nil {
+		return err
+	}
+	fmt.Printf("Backed up %s to %s\n", *dbFileName, *to)
+	return nil
+}
+
+// runRestoreCommand implements the restore subcommand.
+func runRestoreCommand(args []string) error {
+	fs := newSubcommandFlagSet("restore", restoreUsage)
+	from := fs.String("from", "", "Backup file to restore")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *from == "" || fs.NArg() != 0 {
+		fs.Usage()
+		return errors.New("-from is required")
+	}
+
+	version, err := restoreDatabase(*dbFileName, *from)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Restored %s from %s (schema version %d), the previous database is saved as %s.pre-restore\n", *dbFileName, *from, version, *dbFileName)
+	return nil
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func openBackupTestDB(t *testing.T, path string, temperatures ...float64) *sql.DB {
+	t.Helper()
+	db, err := openDatabase(path)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if _, err := db.Exec("PRAGMA journal_mode = WAL"); err != nil {
+		t.Fatalf("Failed to enable WAL: %v", err)
+	}
+	for i, temperature := range temperatures {
+		insertMeasurement(db, Measurement{UnixTimestamp: int64(i + 1), TemperatureCelsius: temperature}, int64(i+1))
+	}
+	return db
+}
+
+func countMeasurements(t *testing.T, path string) int {
+	t.Helper()
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatalf("Failed to open %s: %v", path, err)
+	}
+	defer db.Close()
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM measurements").Scan(&count); err != nil {
+		t.Fatalf("Failed to count measurements in %s: %v", path, err)
+	}
+	return count
+}
+
+func TestBackupDatabase(t *testing.T) {
+	dir := t.TempDir()
+	db := openBackupTestDB(t, filepath.Join(dir, "live.db"), 20, 21)
+	target := filepath.Join(dir, "backup.db")
+
+	if err := backupDatabase(db, target); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if count := countMeasurements(t, target); count != 2 {
+		t.Errorf("Expected 2 measurements in the backup, got %d", count)
+	}
+	if _, err := os.Stat(target + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("Expected no temporary file left, got %v", err)
+	}
+
+	backup, _ := sql.Open("sqlite3", target)
+	defer backup.Close()
+	var mode string
+	backup.QueryRow("PRAGMA journal_mode").Scan(&mode)
+	if mode != "delete" {
+		t.Errorf("Expected a self-contained backup, got journal mode %s", mode)
+	}
+
+	if err := backupDatabase(db, filepath.Join(dir, "missing", "backup.db")); err == nil {
+		t.Error("Expected error for a missing directory")
+	}
+}
+
+func TestCheckBackup(t *testing.T) {
+	dir := t.TempDir()
+	db := openBackupTestDB(t, filepath.Join(dir, "live.db"), 20)
+	valid := filepath.Join(dir, "valid.db")
+	backupDatabase(db, valid)
+	if version, err := checkBackup(valid); err != nil || version != len(migrations) {
+		t.Errorf("Expected schema version %d, got %d, %v", len(migrations), version, err)
+	}
+
+	garbage := filepath.Join(dir, "garbage.db")
+	os.WriteFile(garbage, []byte(strings.Repeat("not a database ", 100)), 0o644)
+	other := filepath.Join(dir, "other.db")
+	otherDB, _ := sql.Open("sqlite3", other)
+	otherDB.Exec("CREATE TABLE notes (text TEXT)")
+	otherDB.Close()
+	newer := filepath.Join(dir, "newer.db")
+	backupDatabase(db, newer)
+	newerDB, _ := sql.Open("sqlite3", newer)
+	newerDB.Exec("INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, 'future', 1)", len(migrations)+1)
+	newerDB.Close()
+
+	for _, path := range []string{filepath.Join(dir, "missing.db"), garbage, other, newer} {
+		if _, err := checkBackup(path); err == nil {
+			t.Errorf("Expected error for %s", filepath.Base(path))
+		}
+	}
+}
+
+func TestRestoreDatabase(t *testing.T) {
+	dir := t.TempDir()
+	live := filepath.Join(dir, "live.db")
+	db := openBackupTestDB(t, live, 20, 21)
+	backup := filepath.Join(dir, "backup.db")
+	backupDatabase(db, backup)
+	insertMeasurement(db, Measurement{UnixTimestamp: 3, TemperatureCelsius: 22}, 3)
+
+	version, err := restoreDatabase(live, backup)
+	if err != nil || version != len(migrations) {
+		t.Fatalf("Expected the backup to be restored, got %d, %v", version, err)
+	}
+	// The open connection sees the restored data
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM measurements").Scan(&count)
+	if count != 2 {
+		t.Errorf("Expected 2 measurements after restoring, got %d", count)
+	}
+	if count := countMeasurements(t, live+".pre-restore"); count != 3 {
+		t.Errorf("Expected the previous database to be saved with 3 measurements, got %d", count)
+	}
+
+	garbage := filepath.Join(dir, "garbage.db")
+	os.WriteFile(garbage, []byte(strings.Repeat("x", 8192)), 0o644)
+	if _, err := restoreDatabase(live, garbage); err == nil {
+		t.Error("Expected error for a damaged backup")
+	}
+	if _, err := restoreDatabase(live, live); err == nil {
+		t.Error("Expected error for restoring the database from itself")
+	}
+	db.QueryRow("SELECT COUNT(*) FROM measurements").Scan(&count)
+	if count != 2 {
+		t.Errorf("Expected a failed restore to leave the database alone, got %d measurements", count)
+	}
+}
+
+func TestRotateBackups(t *testing.T) {
+	dir := t.TempDir()
+	origDB := *dbFileName
+	*dbFileName = "/var/lib/skogsnet/measurements.db"
+	defer func() { *dbFileName = origDB }()
+
+	// Friday 2026-10-16 and the 20 days before it
+	last := time.Date(2026, 10, 16, 0, 0, 0, 0, time.UTC)
+	for i := 0; i <= 20; i++ {
+		name := "measurements-" + last.AddDate(0, 0, -i).Format(backupDateLayout) + ".db"
+		os.WriteFile(filepath.Join(dir, name), nil, 0o644)
+	}
+	os.WriteFile(filepath.Join(dir, "measurements-manual.db"), nil, 0o644)
+	os.WriteFile(filepath.Join(dir, "other-2026-01-01.db"), nil, 0o644)
+
+	removed, err := rotateBackups(dir, 3, 2)
+	if err != nil || len(removed) != 17 {
+		t.Fatalf("Expected 17 removed backups, got %d, %v", len(removed), err)
+	}
+	entries, _ := os.ReadDir(dir)
+	var kept []string
+	for _, entry := range entries {
+		kept = append(kept, entry.Name())
+	}
+	sort.Strings(kept)
+	expected := []string{
+		"measurements-2026-10-11.db", // newest of the week before
+		"measurements-2026-10-14.db",
+		"measurements-2026-10-15.db",
+		"measurements-2026-10-16.db",
+		"measurements-manual.db",
+		"other-2026-01-01.db",
+	}
+	if strings.Join(kept, " ") != strings.Join(expected, " ") {
+		t.Errorf("Expected %v to be kept, got %v", expected, kept)
+	}
+}
+
+func TestScheduledBackup(t *testing.T) {
+	quietWriterLogs(t)
+	dir := t.TempDir()
+	db := openBackupTestDB(t, filepath.Join(dir, "measurements.db"), 20)
+	backups := filepath.Join(dir, "backups")
+	origDB, origDaily, origWeekly := *dbFileName, *backupKeepDaily, *backupKeepWeekly
+	*dbFileName, *backupKeepDaily, *backupKeepWeekly = filepath.Join(dir, "measurements.db"), 2, 0
+	defer func() { *dbFileName, *backupKeepDaily, *backupKeepWeekly = origDB, origDaily, origWeekly }()
+
+	day := time.Date(2026, 10, 14, 3, 0, 0, 0, time.Local)
+	for i := 0; i < 3; i++ {
+		if err := scheduledBackup(db, backups, day.AddDate(0, 0, i)); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	}
+	// Later the same day the existing backup is kept
+	insertMeasurement(db, Measurement{UnixTimestamp: 2, TemperatureCelsius: 21}, 2)
+	scheduledBackup(db, backups, day.AddDate(0, 0, 2).Add(time.Hour))
+
+	entries, _ := os.ReadDir(backups)
+	if len(entries) != 2 || entries[0].Name() != "measurements-2026-10-15.db" || entries[1].Name() != "measurements-2026-10-16.db" {
+		t.Errorf("Expected the 2 newest daily backups, got %v", entries)
+	}
+	if count := countMeasurements(t, filepath.Join(backups, "measurements-2026-10-16.db")); count != 1 {
+		t.Errorf("Expected one backup a day, got a backup with %d measurements", count)
+	}
+}
+
+func TestStartBackupScheduler(t *testing.T) {
+	quietWriterLogs(t)
+	dir := t.TempDir()
+	db := openBackupTestDB(t, filepath.Join(dir, "measurements.db"), 20)
+	origDB, origDir, origDaily := *dbFileName, *backupDir, *backupKeepDaily
+	*dbFileName, *backupDir = filepath.Join(dir, "measurements.db"), filepath.Join(dir, "backups")
+	defer func() { *dbFileName, *backupDir, *backupKeepDaily = origDB, origDir, origDaily }()
+
+	var wg sync.WaitGroup
+	*backupKeepDaily = 0
+	if err := startBackupScheduler(context.Background(), db, &wg); err == nil {
+		t.Error("Expected error for -backup-keep-daily 0")
+	}
+	*backupKeepDaily = 7
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := startBackupScheduler(ctx, db, &wg); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	cancel()
+	wg.Wait()
+	today := filepath.Join(*backupDir, "measurements-"+time.Now().Format(backupDateLayout)+".db")
+	if _, err := os.Stat(today); err != nil {
+		t.Errorf("Expected a backup on startup, got %v", err)
+	}
+}
+
+func TestRunBackupAndRestoreCommands(t *testing.T) {
+	dir := t.TempDir()
+	live := filepath.Join(dir, "measurements.db")
+	db := openBackupTestDB(t, live, 20, 21)
+	origDB := *dbFileName
+	*dbFileName = live
+	defer func() { *dbFileName = origDB }()
+
+	run := func(cmd func([]string) error, args ...string) (string, error) {
+		stdout := os.Stdout
+		r, w, _ := os.Pipe()
+		os.Stdout = w
+		err := cmd(args)
+		w.Close()
+		os.Stdout = stdout
+		output, _ := io.ReadAll(r)
+		return string(output), err
+	}
+
+	target := filepath.Join(dir, "copy.db")
+	output, err := run(runBackupCommand, "-to", target)
+	if err != nil || !strings.Contains(output, "Backed up") || countMeasurements(t, target) != 2 {
+		t.Errorf("Unexpected backup output %q, %v", output, err)
+	}
+
+	db.Exec("DELETE FROM measurements")
+	output, err = run(runRestoreCommand, "-from", target)
+	if err != nil || !strings.Contains(output, "Restored") || !strings.Contains(output, ".pre-restore") {
+		t.Errorf("Unexpected restore output %q, %v", output, err)
+	}
+	if count := countMeasurements(t, live); count != 2 {
+		t.Errorf("Expected 2 measurements after restoring, got %d", count)
+	}
+
+	stderr := os.Stderr
+	os.Stderr, _ = os.Open(os.DevNull)
+	defer func() { os.Stderr = stderr }()
+	for _, args := range [][]string{nil, {"-to", live}, {"-to", target, "extra"}} {
+		if _, err := run(runBackupCommand, args...); err == nil {
+			t.Errorf("Expected backup error for %v", args)
+		}
+	}
+	for _, args := range [][]string{nil, {"-from", filepath.Join(dir, "missing.db")}} {
+		if _, err := run(runRestoreCommand, args...); err == nil {
+			t.Errorf("Expected restore error for %v", args)
+		}
+	}
+}
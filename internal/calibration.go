@@ -0,0 +1,455 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const calibrateUsage = "calibrate set [-offset X] [-gain Y] [-points RAW:REF,RAW:REF] [-from TIME|all] [-note TEXT] <device> <metric> | list [device] | recompute <device> [metric]"
+
+var addCalibration = addCalibrationImpl
+var calibrateMeasurement = calibrateMeasurementImpl
+var recomputeCalibration = recomputeCalibrationImpl
+
+// Calibration corrects a metric of a device as raw * Gain + Offset for the
+// measurements taken from ValidFrom until the next calibration of the same
+// metric.
+type Calibration struct {
+	ID        int64   `json:"id"`
+	DeviceID  int64   `json:"device_id"`
+	Device    string  `json:"device"`
+	Metric    string  `json:"metric"`
+	Gain      float64 `json:"gain"`
+	Offset    float64 `json:"offset"`
+	ValidFrom int64   `json:"valid_from"`
+	CreatedAt int64   `json:"created_at"`
+	Note      string  `json:"note,omitempty"`
+}
+
+func (c Calibration) apply(raw float64) float64 {
+	return raw*c.Gain + c.Offset
+}
+
+// twoPointCalibration returns the gain and offset that map the raw readings
+// of two reference points onto their reference values.
+func twoPointCalibration(raw1, ref1, raw2, ref2 float64) (float64, float64, error) {
+	if raw1 == raw2 {
+		return 0, 0, errors.New("the two raw readings must differ")
+	}
+	gain := (ref2 - ref1) / (raw2 - raw1)
+	return gain, ref1 - gain*raw1, nil
+}
+
+// parseCalibrationPoints parses "RAW:REF,RAW:REF".
+func parseCalibrationPoints(spec string) (float64, float64, error) {
+	points := strings.Split(spec, ",")
+	if len(points) != 2 {
+		return 0, 0, fmt.Errorf("invalid points %q, expected RAW:REF,RAW:REF", spec)
+	}
+	var values [4]float64
+	for i, point := range points {
+		raw, ref, ok := strings.Cut(point, ":")
+		if !ok {
+			return 0, 0, fmt.Errorf("invalid point %q, expected RAW:REF", point)
+		}
+		var err error
+		if values[2*i], err = strconv.ParseFloat(strings.TrimSpace(raw), 64); err != nil {
+			return 0, 0, fmt.Errorf("invalid raw reading %q", raw)
+		}
+		if values[2*i+1], err = strconv.ParseFloat(strings.TrimSpace(ref), 64); err != nil {
+			return 0, 0, fmt.Errorf("invalid reference value %q", ref)
+		}
+	}
+	return twoPointCalibration(values[0], values[1], values[2], values[3])
+}
+
+// parseCalibrationTime accepts "all" for the beginning of time, a date or an
+// RFC 3339 timestamp, and returns Unix milliseconds.
+func parseCalibrationTime(value string) (int64, error) {
+	if value == "all" {
+		return 0, nil
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t.UnixMilli(), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid time %q, expected all, YYYY-MM-DD, YYYY-MM-DD HH:MM:SS or RFC 3339", value)
+}
+
+// addCalibrationImpl stores a calibration. Earlier calibrations stay in the
+// history, so corrections can be re-applied to any period.
+func addCalibrationImpl(db *sql.DB, c Calibration) (int64, error) {
+	if db == nil {
+		return 0, errors.New("db is nil")
+	}
+	if c.Gain == 0 || math.IsNaN(c.Gain) || math.IsInf(c.Gain, 0) || math.IsNaN(c.Offset) || math.IsInf(c.Offset, 0) {
+		return 0, errors.New("gain must be a non-zero number and offset a number")
+	}
+	result, err := db.Exec(
+		"INSERT INTO calibrations (device_id, metric, gain, offset, valid_from, created_at, note) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		c.DeviceID, c.Metric, c.Gain, c.Offset, c.ValidFrom, time.Now().UnixMilli(), c.Note,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// listCalibrations returns the calibration history, of one device when
+// deviceID is not 0, ordered by device, metric and start.
+func listCalibrations(db *sql.DB, deviceID int64) ([]Calibration, error) {
+	rows, err := db.Query(`
+		SELECT c.id, c.device_id, d.name, c.metric, c.gain, c.offset, c.valid_from, c.created_at, COALESCE(c.note, '')
+		FROM calibrations c JOIN devices d ON d.id = c.device_id
+		WHERE ? = 0 OR c.device_id = ?
+		ORDER BY d.name, c.metric, c.valid_from, c.id
+	`, deviceID, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var calibrations []Calibration
+	for rows.Next() {
+		var c Calibration
+		if err := rows.Scan(&c.ID, &c.DeviceID, &c.Device, &c.Metric, &c.Gain, &c.Offset, &c.ValidFrom, &c.CreatedAt, &c.Note); err != nil {
+			return nil, err
+		}
+		calibrations = append(calibrations, c)
+	}
+	return calibrations, rows.Err()
+}
+
+// activeCalibrations returns the calibration of each metric of the device
+// that applies at timestamp.
+func activeCalibrations(db *sql.DB, deviceID, timestamp int64) (map[string]Calibration, error) {
+	rows, err := db.Query(`
+		SELECT id, metric, gain, offset, valid_from
+		FROM calibrations
+		WHERE device_id = ? AND valid_from <= ?
+		ORDER BY valid_from, id
+	`, deviceID, timestamp)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	active := make(map[string]Calibration)
+	for rows.Next() {
+		c := Calibration{DeviceID: deviceID}
+		if err := rows.Scan(&c.ID, &c.Metric, &c.Gain, &c.Offset, &c.ValidFrom); err != nil {
+			return nil, err
+		}
+		active[c.Metric] = c // later ones replace earlier ones
+	}
+	return active, rows.Err()
+}
+
+// calibrateMeasurementImpl applies the calibrations active at the time of
+// the measurement and keeps the raw values in m.Raw.
+func calibrateMeasurementImpl(db *sql.DB, m *Measurement) error {
+	if db == nil || m.DeviceID == 0 {
+		return nil
+	}
+	active, err := activeCalibrations(db, m.DeviceID, m.UnixTimestamp)
+	if err != nil || len(active) == 0 {
+		return err
+	}
+
+	m.Raw = make(map[string]float64)
+	for metric, c := range active {
+		if m.Missing[metric] {
+			continue
+		}
+		switch metric {
+		case temperatureField:
+			m.Raw[metric] = m.TemperatureCelsius
+			m.TemperatureCelsius = c.apply(m.TemperatureCelsius)
+		case humidityField:
+			m.Raw[metric] = m.HumidityPercentage
+			m.HumidityPercentage = c.apply(m.HumidityPercentage)
+		default:
+			if value, ok := m.Metrics[metric]; ok {
+				m.Raw[metric] = value
+				m.Metrics[metric] = c.apply(value)
+			}
+		}
+	}
+	return nil
+}
+
+// rawValue returns the reading of a field before calibration, or nil when
+// the field was stored uncalibrated.
+func (m Measurement) rawValue(field string) any {
+	if raw, ok := m.Raw[field]; ok {
+		return raw
+	}
+	return nil
+}
+
+// measurementColumns maps the calibrated fields stored in the measurements
+// table to their value and raw value columns.
+var measurementColumns = map[string][2]string{
+	temperatureField: {"temperature", "raw_temperature"},
+	humidityField:    {"humidity", "raw_humidity"},
+}
+
+// recomputeCalibrationImpl re-applies the calibration history of a device
+// to its stored measurements, of one metric or of all calibrated metrics
+// when metric is empty. Values before the first calibration of a metric are
+// restored to their raw readings, and the rollups of the device are rebuilt
+// to match. It returns the number of updated values.
+func recomputeCalibrationImpl(db *sql.DB, deviceID int64, metric string) (int64, error) {
+	if db == nil {
+		return 0, errors.New("db is nil")
+	}
+	calibrations, err := listCalibrations(db, deviceID)
+	if err != nil {
+		return 0, err
+	}
+	byMetric := make(map[string][]Calibration)
+	for _, c := range calibrations {
+		if metric == "" || c.Metric == metric {
+			byMetric[c.Metric] = append(byMetric[c.Metric], c)
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var updated int64
+	for name, history := range byMetric {
+		// Periods: before the first calibration, then one per calibration
+		periods := append([]Calibration{{Gain: 1, ValidFrom: math.MinInt64}}, history...)
+		for i, c := range periods {
+			until := int64(math.MaxInt64)
+			if i+1 < len(periods) {
+				until = periods[i+1].ValidFrom
+			}
+			n, err := applyCalibrationPeriod(tx, deviceID, name, c, until, i == 0)
+			if err != nil {
+				return 0, err
+			}
+			updated += n
+		}
+	}
+	if updated > 0 {
+		if err := rebuildRollups(tx, deviceID); err != nil {
+			return 0, err
+		}
+	}
+	return updated, tx.Commit()
+}
+
+// applyCalibrationPeriod recomputes the values of a metric measured from
+// c.ValidFrom until until from their raw values. restore writes back the raw
+// readings of values calibrated before instead.
+func applyCalibrationPeriod(tx *sql.Tx, deviceID int64, metric string, c Calibration, until int64, restore bool) (int64, error) {
+	table, value, raw := "measurement_values", "value", "raw_value"
+	where := "metric = ? AND measurement_id IN (SELECT id FROM measurements WHERE device_id = ? AND timestamp >= ? AND timestamp < ?)"
+	args := []any{metric, deviceID, c.ValidFrom, until}
+	if columns, ok := measurementColumns[metric]; ok {
+		table, value, raw = "measurements", columns[0], columns[1]
+		where = "device_id = ? AND timestamp >= ? AND timestamp < ?"
+		args = args[1:]
+	}
+
+	var query string
+	if restore {
+		query = fmt.Sprintf("UPDATE %[1]s SET %[2]s = %[3]s, %[3]s = NULL WHERE %[3]s IS NOT NULL AND %[4]s", table, value, raw, where)
+	} else {
+		query = fmt.Sprintf("UPDATE %[1]s SET %[3]s = COALESCE(%[3]s, %[2]s), %[2]s = COALESCE(%[3]s, %[2]s) * ? + ? WHERE %[4]s", table, value, raw, where)
+		args = append([]any{c.Gain, c.Offset}, args...)
+	}
+
+	result, err := tx.Exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// runCalibrateCommand implements the calibrate subcommand.
+func runCalibrateCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: %s", calibrateUsage)
+	}
+	switch args[0] {
+	case "set":
+		return runCalibrateSet(args[1:])
+	case "list":
+		return runCalibrateList(args[1:])
+	case "recompute":
+		return runCalibrateRecompute(args[1:])
+	}
+	return fmt.Errorf("unknown calibrate action %q, expected set, list or recompute", args[0])
+}
+
+func runCalibrateSet(args []string) error {
+	fs := newSubcommandFlagSet("calibrate set", calibrateUsage)
+	offset := fs.Float64("offset", 0, "Added to the raw value after the gain")
+	gain := fs.Float64("gain", 1, "Factor the raw value is multiplied with")
+	points := fs.String("points", "", "Two-point calibration as RAW:REF,RAW:REF, instead of -offset and -gain")
+	from := fs.String("from", "", "Apply to measurements from this time, or all (default now)")
+	note := fs.String("note", "", "Note stored with the calibration, e.g. the reference used")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return errors.New("device and metric are required")
+	}
+
+	metric, err := metricField(fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	c := Calibration{Metric: metric, Gain: *gain, Offset: *offset, ValidFrom: time.Now().UnixMilli(), Note: *note}
+	if *points != "" {
+		if flagSetWasSet(fs, "offset") || flagSetWasSet(fs, "gain") {
+			return errors.New("use either -points or -offset and -gain")
+		}
+		if c.Gain, c.Offset, err = parseCalibrationPoints(*points); err != nil {
+			return err
+		}
+		if c.Note == "" {
+			c.Note = "two-point " + *points
+		}
+	}
+	if *from != "" {
+		if c.ValidFrom, err = parseCalibrationTime(*from); err != nil {
+			return err
+		}
+	}
+
+	db, err := openDatabase(*dbFileName)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	device, err := lookupDevice(db, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	c.DeviceID = device.ID
+	if _, err := addCalibration(db, c); err != nil {
+		return err
+	}
+
+	fmt.Printf("%s %s: raw * %g + %g from %s\n", device.Name, metric, c.Gain, c.Offset, formatCalibrationTime(c.ValidFrom))
+	if c.ValidFrom < time.Now().UnixMilli()-1000 {
+		fmt.Printf("Run '%s calibrate recompute %s %s' to apply it to stored measurements\n", os.Args[0], device.Name, metric)
+	}
+	return nil
+}
+
+func runCalibrateList(args []string) error {
+	fs := newSubcommandFlagSet("calibrate list", calibrateUsage)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 1 {
+		fs.Usage()
+		return fmt.Errorf("unexpected arguments %v", fs.Args()[1:])
+	}
+
+	db, err := openDatabase(*dbFileName)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var deviceID int64
+	if fs.NArg() == 1 {
+		device, err := lookupDevice(db, fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		deviceID = device.ID
+	}
+	calibrations, err := listCalibrations(db, deviceID)
+	if err != nil {
+		return err
+	}
+	if len(calibrations) == 0 {
+		fmt.Println("No calibrations")
+		return nil
+	}
+	for _, c := range calibrations {
+		fmt.Printf("%-20s %-20s gain %-10g offset %-10g from %s", c.Device, c.Metric, c.Gain, c.Offset, formatCalibrationTime(c.ValidFrom))
+		if c.Note != "" {
+			fmt.Printf("  %s", c.Note)
+		}
+		fmt.Println()
+	}
+	return nil
+}
+
+func runCalibrateRecompute(args []string) error {
+	fs := newSubcommandFlagSet("calibrate recompute", calibrateUsage)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		fs.Usage()
+		return errors.New("device is required")
+	}
+
+	var metric string
+	if fs.NArg() == 2 {
+		var err error
+		if metric, err = metricField(fs.Arg(1)); err != nil {
+			return err
+		}
+	}
+	if *dbDriver != driverSQLite {
+		return fmt.Errorf("recompute rewrites the measurements in -db, not supported with -db-driver %s", *dbDriver)
+	}
+
+	db, err := openDatabase(*dbFileName)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	device, err := lookupDevice(db, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	updated, err := recomputeCalibration(db, device.ID, metric)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Recomputed %d value(s) of %s\n", updated, device.Name)
+	return nil
+}
+
+func formatCalibrationTime(ms int64) string {
+	if ms == 0 {
+		return "the beginning"
+	}
+	return time.UnixMilli(ms).Format("2006-01-02 15:04:05")
+}
+
+// flagSetWasSet reports whether the flag was given on the command line.
+func flagSetWasSet(fs *flag.FlagSet, name string) bool {
+	set := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"database/sql"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"testing"
+)
+
+func openCalibrationTestDB(t *testing.T, path string) (*sql.DB, Device) {
+	t.Helper()
+	db, err := openDatabase(path)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+		os.Remove(path)
+	})
+	device := Device{Name: "greenhouse", Port: "/dev/ttyACM0"}
+	if err := registerDevice(db, &device); err != nil {
+		t.Fatalf("Failed to register device: %v", err)
+	}
+	return db, device
+}
+
+func closeTo(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+func TestParseCalibrationPoints(t *testing.T) {
+	gain, offset, err := parseCalibrationPoints("0.4:0, 99.1:100")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !closeTo(0.4*gain+offset, 0) || !closeTo(99.1*gain+offset, 100) {
+		t.Errorf("Expected the points to map onto their references, got gain %g offset %g", gain, offset)
+	}
+
+	for _, spec := range []string{"", "1:2", "1:2,3", "a:1,2:3", "1:b,2:3", "5:1,5:2", "1:2,3:4,5:6"} {
+		if _, _, err := parseCalibrationPoints(spec); err == nil {
+			t.Errorf("Expected error for %q", spec)
+		}
+	}
+}
+
+func TestParseCalibrationTime(t *testing.T) {
+	if ms, err := parseCalibrationTime("all"); err != nil || ms != 0 {
+		t.Errorf("Expected all to be 0, got %d, %v", ms, err)
+	}
+	ms, err := parseCalibrationTime("2024-05-01T12:00:00Z")
+	if err != nil || ms != 1714564800000 {
+		t.Errorf("Unexpected RFC 3339 result %d, %v", ms, err)
+	}
+	if _, err := parseCalibrationTime("2024-05-01"); err != nil {
+		t.Errorf("Expected a date to parse, got %v", err)
+	}
+	if _, err := parseCalibrationTime("yesterday"); err == nil {
+		t.Error("Expected error for yesterday")
+	}
+}
+
+func TestAddCalibration_RejectsInvalid(t *testing.T) {
+	db, device := openCalibrationTestDB(t, "test_calibration_invalid.db")
+	for _, c := range []Calibration{
+		{DeviceID: device.ID, Metric: "lux", Gain: 0},
+		{DeviceID: device.ID, Metric: "lux", Gain: math.NaN()},
+		{DeviceID: device.ID, Metric: "lux", Gain: 1, Offset: math.Inf(1)},
+	} {
+		if _, err := addCalibration(db, c); err == nil {
+			t.Errorf("Expected error for %+v", c)
+		}
+	}
+	if _, err := addCalibration(nil, Calibration{Gain: 1}); err == nil {
+		t.Error("Expected error for nil db")
+	}
+}
+
+func TestCalibrateMeasurement(t *testing.T) {
+	db, device := openCalibrationTestDB(t, "test_calibrate_measurement.db")
+	for _, c := range []Calibration{
+		{DeviceID: device.ID, Metric: temperatureField, Gain: 1, Offset: -0.5, ValidFrom: 1000},
+		{DeviceID: device.ID, Metric: temperatureField, Gain: 1, Offset: -0.8, ValidFrom: 2000},
+		{DeviceID: device.ID, Metric: "lux", Gain: 2, ValidFrom: 0},
+	} {
+		if _, err := addCalibration(db, c); err != nil {
+			t.Fatalf("Failed to add calibration: %v", err)
+		}
+	}
+
+	m := Measurement{UnixTimestamp: 1500, DeviceID: device.ID, TemperatureCelsius: 20, HumidityPercentage: 50, Metrics: map[string]float64{"lux": 100}}
+	if err := calibrateMeasurement(db, &m); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !closeTo(m.TemperatureCelsius, 19.5) || m.HumidityPercentage != 50 || m.Metrics["lux"] != 200 {
+		t.Errorf("Unexpected calibrated measurement %+v", m)
+	}
+	if m.Raw[temperatureField] != 20 || m.Raw["lux"] != 100 {
+		t.Errorf("Expected raw values to be kept, got %v", m.Raw)
+	}
+	if _, ok := m.Raw[humidityField]; ok {
+		t.Error("Expected uncalibrated humidity to have no raw value")
+	}
+
+	later := Measurement{UnixTimestamp: 2500, DeviceID: device.ID, TemperatureCelsius: 20}
+	calibrateMeasurement(db, &later)
+	if !closeTo(later.TemperatureCelsius, 19.2) {
+		t.Errorf("Expected the newer calibration to apply, got %v", later.TemperatureCelsius)
+	}
+
+	before := Measurement{UnixTimestamp: 500, DeviceID: device.ID, TemperatureCelsius: 20}
+	calibrateMeasurement(db, &before)
+	if before.TemperatureCelsius != 20 || before.Raw[temperatureField] != 0 {
+		t.Errorf("Expected no temperature calibration before the first one, got %+v", before)
+	}
+
+	missing := Measurement{UnixTimestamp: 1500, DeviceID: device.ID, HumidityPercentage: 50, Missing: map[string]bool{temperatureField: true}}
+	calibrateMeasurement(db, &missing)
+	if missing.TemperatureCelsius != 0 || missing.Raw[temperatureField] != 0 {
+		t.Errorf("Expected a missing temperature to stay uncalibrated, got %+v", missing)
+	}
+
+	other := Measurement{UnixTimestamp: 1500, DeviceID: device.ID + 1, TemperatureCelsius: 20}
+	calibrateMeasurement(db, &other)
+	if other.TemperatureCelsius != 20 || other.Raw != nil {
+		t.Errorf("Expected other devices to be unaffected, got %+v", other)
+	}
+}
+
+func TestInsertMeasurement_StoresRawValues(t *testing.T) {
+	db, device := openCalibrationTestDB(t, "test_calibration_raw.db")
+	m := Measurement{
+		UnixTimestamp:      1000,
+		DeviceID:           device.ID,
+		TemperatureCelsius: 19.5,
+		HumidityPercentage: 50,
+		Metrics:            map[string]float64{"lux": 200, "co2": 400},
+		Raw:                map[string]float64{temperatureField: 20, "lux": 100},
+	}
+	if err := insertMeasurement(db, m, m.UnixTimestamp); err != nil {
+		t.Fatalf("Failed to insert measurement: %v", err)
+	}
+
+	var rawTemperature, rawHumidity, rawLux, rawCO2 sql.NullFloat64
+	db.QueryRow("SELECT raw_temperature, raw_humidity FROM measurements").Scan(&rawTemperature, &rawHumidity)
+	db.QueryRow("SELECT raw_value FROM measurement_values WHERE metric = 'lux'").Scan(&rawLux)
+	db.QueryRow("SELECT raw_value FROM measurement_values WHERE metric = 'co2'").Scan(&rawCO2)
+	if rawTemperature.Float64 != 20 || rawHumidity.Valid || rawLux.Float64 != 100 || rawCO2.Valid {
+		t.Errorf("Unexpected raw columns %v %v %v %v", rawTemperature, rawHumidity, rawLux, rawCO2)
+	}
+}
+
+func TestRecomputeCalibration(t *testing.T) {
+	db, device := openCalibrationTestDB(t, "test_calibration_recompute.db")
+	for _, ts := range []int64{500, 1500, 2500} {
+		m := Measurement{UnixTimestamp: ts, DeviceID: device.ID, TemperatureCelsius: 20, HumidityPercentage: 50, Metrics: map[string]float64{"lux": 100}}
+		if err := insertMeasurement(db, m, ts); err != nil {
+			t.Fatalf("Failed to insert measurement: %v", err)
+		}
+	}
+
+	temperatures := func() []float64 {
+		rows, err := db.Query("SELECT temperature FROM measurements ORDER BY timestamp")
+		if err != nil {
+			t.Fatalf("Query failed: %v", err)
+		}
+		defer rows.Close()
+		var values []float64
+		for rows.Next() {
+			var v float64
+			rows.Scan(&v)
+			values = append(values, v)
+		}
+		return values
+	}
+
+	addCalibration(db, Calibration{DeviceID: device.ID, Metric: temperatureField, Gain: 1, Offset: -0.5, ValidFrom: 1000})
+	addCalibration(db, Calibration{DeviceID: device.ID, Metric: "lux", Gain: 2, ValidFrom: 2000})
+	updated, err := recomputeCalibration(db, device.ID, "")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if updated != 3 {
+		t.Errorf("Expected 3 updated values, got %d", updated)
+	}
+	if got := temperatures(); !closeTo(got[0], 20) || !closeTo(got[1], 19.5) || !closeTo(got[2], 19.5) {
+		t.Errorf("Unexpected temperatures %v", got)
+	}
+	var lux, rawLux float64
+	db.QueryRow("SELECT v.value, v.raw_value FROM measurement_values v JOIN measurements m ON m.id = v.measurement_id WHERE m.timestamp = 2500").Scan(&lux, &rawLux)
+	if lux != 200 || rawLux != 100 {
+		t.Errorf("Expected lux 200 from raw 100, got %v from %v", lux, rawLux)
+	}
+
+	// Recomputing again starts from the raw values instead of compounding
+	addCalibration(db, Calibration{DeviceID: device.ID, Metric: temperatureField, Gain: 1, Offset: -1, ValidFrom: 2000})
+	if _, err := recomputeCalibration(db, device.ID, temperatureField); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if got := temperatures(); !closeTo(got[0], 20) || !closeTo(got[1], 19.5) || !closeTo(got[2], 19) {
+		t.Errorf("Unexpected temperatures after second calibration %v", got)
+	}
+
+	// A calibration from the beginning replaces the earlier history
+	addCalibration(db, Calibration{DeviceID: device.ID, Metric: temperatureField, Gain: 1, ValidFrom: 0})
+	db.Exec("DELETE FROM calibrations WHERE metric = ? AND valid_from > 0", temperatureField)
+	if _, err := recomputeCalibration(db, device.ID, temperatureField); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if got := temperatures(); !closeTo(got[0], 20) || !closeTo(got[1], 20) || !closeTo(got[2], 20) {
+		t.Errorf("Expected raw temperatures to be restored, got %v", got)
+	}
+}
+
+func TestRunCalibrateCommand(t *testing.T) {
+	tmpDB := "test_calibrate_command.db"
+	defer os.Remove(tmpDB)
+	origDB := *dbFileName
+	*dbFileName = tmpDB
+	defer func() { *dbFileName = origDB }()
+
+	db, err := openDatabase(tmpDB)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	device := Device{Name: "cellar", Port: "/dev/ttyUSB0"}
+	registerDevice(db, &device)
+	insertMeasurement(db, Measurement{UnixTimestamp: 1000, DeviceID: device.ID, TemperatureCelsius: 10, HumidityPercentage: 80}, 1000)
+	db.Close()
+
+	run := func(args ...string) (string, error) {
+		stdout := os.Stdout
+		r, w, _ := os.Pipe()
+		os.Stdout = w
+		err := runCalibrateCommand(args)
+		w.Close()
+		os.Stdout = stdout
+		output, _ := io.ReadAll(r)
+		return string(output), err
+	}
+
+	if _, err := run("set", "-points", "10:12,20:21", "-from", "all", "cellar", "temperature"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if _, err := run("set", "-offset", "-2", "-from", "all", "-note", "hygrometer kit", "cellar", "humidity"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	output, err := run("list")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !strings.Contains(output, "temperature_celcius") || !strings.Contains(output, "gain 0.9") || !strings.Contains(output, "hygrometer kit") {
+		t.Errorf("Unexpected list output %q", output)
+	}
+
+	output, err = run("recompute", "cellar")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !strings.Contains(output, "Recomputed 2 value(s) of cellar") {
+		t.Errorf("Unexpected recompute output %q", output)
+	}
+
+	db, _ = openDatabase(tmpDB)
+	defer db.Close()
+	var temperature, humidity float64
+	db.QueryRow("SELECT temperature, humidity FROM measurements").Scan(&temperature, &humidity)
+	if !closeTo(temperature, 12) || humidity != 78 {
+		t.Errorf("Expected recomputed values 12 and 78, got %v and %v", temperature, humidity)
+	}
+
+	stderr := os.Stderr
+	os.Stderr, _ = os.Open(os.DevNull)
+	defer func() { os.Stderr = stderr }()
+	for _, args := range [][]string{
+		nil,
+		{"drift"},
+		{"set", "cellar"},
+		{"set", "-points", "1:2,3:4", "-gain", "2", "cellar", "humidity"},
+		{"set", "-from", "soon", "cellar", "humidity"},
+		{"set", "nowhere", "humidity"},
+		{"recompute"},
+	} {
+		if _, err := run(args...); err == nil {
+			t.Errorf("Expected error for %v", args)
+		}
+	}
+}
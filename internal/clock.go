@@ -0,0 +1,180 @@
+package main
+
+import (
+	"sync"
+)
+
+const (
+	// clockOffsetWindow is the number of recent samples the clock offset
+	// estimate is taken from, so slow drift of the device clock is followed.
+	clockOffsetWindow = 32
+	// seqDuplicateWindow is how far back a repeated seq is treated as a
+	// duplicate; anything further back means the device restarted counting.
+	seqDuplicateWindow = 16
+)
+
+type seqEvent int
+
+const (
+	seqFirst seqEvent = iota
+	seqInOrder
+	seqGap
+	seqDuplicate
+	seqReboot
+)
+
+// deviceClock tracks the seq counter and clock offset of one device across
+// reconnects.
+type deviceClock struct {
+	mu      sync.Mutex
+	hasSeq  bool
+	lastSeq int64
+	lastTS  int64
+	offsets []int64         // received - device timestamp of recent samples
+	seqTS   map[int64]int64 // device timestamp by seq, within the duplicate window
+}
+
+type clockRegistry struct {
+	mu     sync.Mutex
+	clocks map[string]*deviceClock
+}
+
+var deviceClocks = newClockRegistry()
+
+func newClockRegistry() *clockRegistry {
+	return &clockRegistry{clocks: make(map[string]*deviceClock)}
+}
+
+func (r *clockRegistry) get(device string) *deviceClock {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	clock, ok := r.clocks[device]
+	if !ok {
+		clock = &deviceClock{}
+		r.clocks[device] = clock
+	}
+	return clock
+}
+
+// checkSeq classifies seq against the last one seen and returns the number
+// of measurements missed for a gap. deviceTS is the ts sent along, if any.
+func (c *deviceClock) checkSeq(seq int64, deviceTS *int64) (seqEvent, int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.hasSeq {
+		c.hasSeq = true
+		c.lastSeq = seq
+		c.recordSeqTS(seq, deviceTS)
+		return seqFirst, 0
+	}
+
+	last := c.lastSeq
+	switch {
+	case seq == last+1:
+		c.lastSeq = seq
+		c.recordSeqTS(seq, deviceTS)
+		return seqInOrder, 0
+	case seq > last+1:
+		c.lastSeq = seq
+		c.recordSeqTS(seq, deviceTS)
+		return seqGap, seq - last - 1
+	case seq != 0 && last-seq < seqDuplicateWindow && c.isRepeat(seq, deviceTS):
+		return seqDuplicate, 0
+	default:
+		// The counter started over, so the device clock did too
+		c.lastSeq = seq
+		c.offsets = nil
+		c.seqTS = nil
+		c.recordSeqTS(seq, deviceTS)
+		return seqReboot, 0
+	}
+}
+
+// isRepeat reports whether a seq within the duplicate window is a repeat of
+// the reading seen with it. With a ts, a repeat carries the same ts as the
+// original; a different one, usually a clock that went backwards, means the
+// device restarted and its seq 0 was lost.
+func (c *deviceClock) isRepeat(seq int64, deviceTS *int64) bool {
+	if deviceTS == nil {
+		return true
+	}
+	ts, ok := c.seqTS[seq]
+	return ok && ts == *deviceTS
+}
+
+// recordSeqTS remembers the ts of seq for isRepeat and forgets those that
+// fell out of the duplicate window.
+func (c *deviceClock) recordSeqTS(seq int64, deviceTS *int64) {
+	if deviceTS == nil {
+		return
+	}
+	if c.seqTS == nil {
+		c.seqTS = make(map[int64]int64)
+	}
+	c.seqTS[seq] = *deviceTS
+	for s := range c.seqTS {
+		if seq-s >= seqDuplicateWindow {
+			delete(c.seqTS, s)
+		}
+	}
+}
+
+// correct maps a device timestamp onto the local clock. The offset is the
+// smallest received - device difference of recent samples: transmission and
+// buffering delays only ever add to it, so the minimum is the closest to the
+// true clock offset. The result is never later than receivedAt.
+func (c *deviceClock) correct(deviceTS, receivedAt int64) (int64, int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if deviceTS < c.lastTS {
+		// The device clock went backwards; older offsets no longer apply
+		c.offsets = nil
+	}
+	c.lastTS = deviceTS
+
+	c.offsets = append(c.offsets, receivedAt-deviceTS)
+	if len(c.offsets) > clockOffsetWindow {
+		c.offsets = c.offsets[len(c.offsets)-clockOffsetWindow:]
+	}
+
+	offset := c.offsets[0]
+	for _, o := range c.offsets[1:] {
+		offset = min(offset, o)
+	}
+
+	return min(deviceTS+offset, receivedAt), offset
+}
+
+// applyDeviceClock sets the measurement timestamp from the device supplied
+// ts and checks its seq. It reports false for duplicates, which must not be
+// stored again.
+func applyDeviceClock(device Device, m *Measurement, receivedAt int64) bool {
+	clock := deviceClocks.get(device.Name)
+	m.ReceivedTimestamp = receivedAt
+	m.UnixTimestamp = receivedAt
+
+	if m.Sequence != nil {
+		event, missed := clock.checkSeq(*m.Sequence, m.DeviceTimestamp)
+		deviceStatuses.recordSeq(device, event, missed)
+		switch event {
+		case seqGap:
+			logWarn("Device %s jumped to seq %d: %d measurement(s) missed", device.Name, *m.Sequence, missed)
+		case seqDuplicate:
+			throttledLogWarn(&lastDuplicateWarn, "Dropping duplicate seq %d from %s", *m.Sequence, device.Name)
+			return false
+		case seqReboot:
+			logInfo("Device %s restarted its seq counter at %d", device.Name, *m.Sequence)
+		}
+	}
+
+	if m.DeviceTimestamp != nil {
+		corrected, offset := clock.correct(*m.DeviceTimestamp, receivedAt)
+		m.UnixTimestamp = corrected
+		deviceStatuses.setClockOffset(device, offset)
+	}
+
+	return true
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeviceClock_CheckSeq(t *testing.T) {
+	clock := &deviceClock{}
+
+	steps := []struct {
+		seq    int64
+		event  seqEvent
+		missed int64
+	}{
+		{10, seqFirst, 0},
+		{11, seqInOrder, 0},
+		{15, seqGap, 3},
+		{15, seqDuplicate, 0},
+		{13, seqDuplicate, 0},
+		{16, seqInOrder, 0},
+		{0, seqReboot, 0},
+		{1, seqInOrder, 0},
+	}
+	for _, step := range steps {
+		event, missed := clock.checkSeq(step.seq, nil)
+		if event != step.event || missed != step.missed {
+			t.Errorf("seq %d: expected (%d, %d), got (%d, %d)", step.seq, step.event, step.missed, event, missed)
+		}
+	}
+}
+
+func TestDeviceClock_CheckSeq_RebootWithoutZero(t *testing.T) {
+	clock := &deviceClock{}
+	clock.checkSeq(5000, nil)
+	if event, _ := clock.checkSeq(3, nil); event != seqReboot {
+		t.Errorf("Expected a large step back to be a reboot, got %d", event)
+	}
+}
+
+func TestDeviceClock_CheckSeq_RebootWithLostZero(t *testing.T) {
+	clock := &deviceClock{}
+	ts := func(v int64) *int64 { return &v }
+
+	clock.checkSeq(1, ts(2_000))
+	clock.checkSeq(2, ts(4_000))
+	clock.checkSeq(3, ts(6_000))
+
+	// A repeat of seq 2 carries its original ts
+	if event, _ := clock.checkSeq(2, ts(4_000)); event != seqDuplicate {
+		t.Errorf("Expected a repeated seq with its ts to be a duplicate, got %d", event)
+	}
+
+	// The device restarted and the line with seq 0 was lost
+	if event, _ := clock.checkSeq(1, ts(2_100)); event != seqReboot {
+		t.Errorf("Expected a lower seq with a new ts to be a reboot, got %d", event)
+	}
+	if event, _ := clock.checkSeq(2, ts(4_100)); event != seqInOrder {
+		t.Errorf("Expected the readings after the reboot to be kept, got %d", event)
+	}
+}
+
+func TestDeviceClock_Correct(t *testing.T) {
+	clock := &deviceClock{}
+
+	// Device uptime clock, first sample arrives 50ms after it was taken
+	ts, offset := clock.correct(1_000, 1_000_050)
+	if ts != 1_000_050 || offset != 999_050 {
+		t.Errorf("Unexpected first correction: ts=%d offset=%d", ts, offset)
+	}
+
+	// A sample delivered with only 10ms delay tightens the offset
+	ts, offset = clock.correct(6_000, 1_005_010)
+	if ts != 1_005_010 || offset != 999_010 {
+		t.Errorf("Unexpected correction: ts=%d offset=%d", ts, offset)
+	}
+
+	// A buffered sample arriving 30s late keeps its original time
+	ts, _ = clock.correct(11_000, 1_040_000)
+	if ts != 1_010_010 {
+		t.Errorf("Expected buffered sample at 1010010, got %d", ts)
+	}
+}
+
+func TestDeviceClock_Correct_ClockReset(t *testing.T) {
+	clock := &deviceClock{}
+	clock.correct(500_000, 1_000_000)
+
+	// The device restarted and its uptime clock began again at zero
+	ts, offset := clock.correct(100, 2_000_000)
+	if ts != 2_000_000 || offset != 1_999_900 {
+		t.Errorf("Expected offsets to be reset, got ts=%d offset=%d", ts, offset)
+	}
+}
+
+func TestDeviceClock_Correct_NeverInFuture(t *testing.T) {
+	clock := &deviceClock{}
+	clock.correct(1_000, 2_000)
+
+	// The device clock runs fast, so the estimate would land in the future
+	ts, _ := clock.correct(5_000, 5_500)
+	if ts > 5_500 {
+		t.Errorf("Expected timestamp clamped to receive time, got %d", ts)
+	}
+}
+
+func TestApplyDeviceClock(t *testing.T) {
+	origClocks := deviceClocks
+	origStatuses := deviceStatuses
+	origLogWarn := throttledLogWarn
+	deviceClocks = newClockRegistry()
+	deviceStatuses = newStatusRegistry()
+	throttledLogWarn = func(last *time.Time, format string, v ...any) {}
+	defer func() {
+		deviceClocks = origClocks
+		deviceStatuses = origStatuses
+		throttledLogWarn = origLogWarn
+	}()
+
+	device := Device{Name: "greenhouse"}
+	seq := int64(1)
+	ts := int64(60_000)
+
+	m := Measurement{Sequence: &seq, DeviceTimestamp: &ts}
+	if !applyDeviceClock(device, &m, 1_000_000) {
+		t.Fatal("Expected first measurement to be kept")
+	}
+	if m.ReceivedTimestamp != 1_000_000 || m.UnixTimestamp != 1_000_000 {
+		t.Errorf("Unexpected timestamps: %+v", m)
+	}
+
+	duplicate := Measurement{Sequence: &seq, DeviceTimestamp: &ts}
+	if applyDeviceClock(device, &duplicate, 1_000_100) {
+		t.Error("Expected duplicate seq to be dropped")
+	}
+
+	plain := Measurement{}
+	if !applyDeviceClock(device, &plain, 1_000_200) || plain.UnixTimestamp != 1_000_200 {
+		t.Errorf("Expected measurement without ts to use receive time, got %+v", plain)
+	}
+
+	status := deviceStatuses.snapshot()[0]
+	if status.Duplicates != 1 || status.ClockOffset == nil || *status.ClockOffset != 940_000 {
+		t.Errorf("Unexpected status: %+v", status)
+	}
+}
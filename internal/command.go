@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	deviceCommandTimeout = 5 * time.Second
+	deviceCommandUsage   = "device [-server URL] [-token TOKEN] <device> interval SECONDS|read|version|reboot"
+)
+
+// Commands understood by the firmware. A command is written to the device as
+// {"id":7,"cmd":"interval","value":30} and answered with a line carrying the
+// same id in "ack", e.g. {"ack":7,"ok":true}.
+const (
+	commandInterval = "interval" // set the sample interval in seconds
+	commandRead     = "read"     // take a measurement immediately
+	commandVersion  = "version"  // report the firmware version
+	commandReboot   = "reboot"   // restart the board
+)
+
+var (
+	errDeviceNotConnected = errors.New("device not connected")
+	errCommandTimeout     = errors.New("device did not answer in time")
+	errCommandFailed      = errors.New("device rejected command")
+)
+
+var sendDeviceCommand = sendDeviceCommandImpl
+
+type DeviceCommand struct {
+	Command string   `json:"command"`
+	Value   *float64 `json:"value,omitempty"`
+}
+
+func (c DeviceCommand) validate() error {
+	switch c.Command {
+	case commandInterval:
+		// The firmware ignores intervals below a second
+		if c.Value == nil || *c.Value < 1 {
+			return fmt.Errorf("%s needs a value of at least 1 second", c.Command)
+		}
+	case commandRead, commandVersion, commandReboot:
+		if c.Value != nil {
+			return fmt.Errorf("%s takes no value", c.Command)
+		}
+	default:
+		return fmt.Errorf("unknown command %q, expected %s, %s, %s or %s", c.Command, commandInterval, commandRead, commandVersion, commandReboot)
+	}
+	return nil
+}
+
+// commandChannel writes commands to one connected device and matches the
+// replies read by readDeviceLoop to the waiting callers.
+type commandChannel struct {
+	device  Device
+	mu      sync.Mutex
+	w       io.Writer
+	nextID  int64
+	pending map[int64]chan map[string]any
+	closed  chan struct{}
+}
+
+type commandRegistry struct {
+	mu       sync.Mutex
+	channels map[string]*commandChannel
+}
+
+var deviceCommandChannels = newCommandRegistry()
+
+func newCommandRegistry() *commandRegistry {
+	return &commandRegistry{channels: make(map[string]*commandChannel)}
+}
+
+func newCommandChannel(device Device, w io.Writer) *commandChannel {
+	return &commandChannel{
+		device:  device,
+		w:       w,
+		pending: make(map[int64]chan map[string]any),
+		closed:  make(chan struct{}),
+	}
+}
+
+func (r *commandRegistry) attach(c *commandChannel) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.channels[c.device.Name] = c
+}
+
+// detach removes the channel if it is still the current one for its device
+// and fails the commands waiting on it.
+func (r *commandRegistry) detach(c *commandChannel) {
+	r.mu.Lock()
+	if r.channels[c.device.Name] == c {
+		delete(r.channels, c.device.Name)
+	}
+	r.mu.Unlock()
+	close(c.closed)
+}
+
+func (r *commandRegistry) get(name string) *commandChannel {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.channels[name]
+}
+
+// send writes the command and waits for the matching reply.
+func (c *commandChannel) send(ctx context.Context, cmd DeviceCommand, timeout time.Duration) (map[string]any, error) {
+	reply := make(chan map[string]any, 1)
+
+	c.mu.Lock()
+	c.nextID++
+	id := c.nextID
+	c.pending[id] = reply
+	request := map[string]any{"id": id, "cmd": cmd.Command}
+	if cmd.Value != nil {
+		request["value"] = *cmd.Value
+	}
+	line, err := json.Marshal(request)
+	if err == nil {
+		framed := string(line)
+		if c.device.Framing == framingCRC8 {
+			framed = encodeFrame(framed)
+		}
+		_, err = io.WriteString(c.w, framed+"\n")
+	}
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+	}()
+	if err != nil {
+		return nil, fmt.Errorf("failed to write command: %w", err)
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case fields := <-reply:
+		if ok, _ := fields["ok"].(bool); !ok {
+			message, _ := fields["error"].(string)
+			return fields, fmt.Errorf("%w: %s", errCommandFailed, message)
+		}
+		return fields, nil
+	case <-timer.C:
+		return nil, errCommandTimeout
+	case <-c.closed:
+		return nil, errDeviceNotConnected
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// deliver hands a reply line to the command waiting for it. It reports false
+// when the line is not a command reply and should be read as a measurement.
+func (c *commandChannel) deliver(payload string) bool {
+	if !strings.Contains(payload, `"ack"`) {
+		return false
+	}
+	var fields map[string]any
+	if err := json.Unmarshal([]byte(payload), &fields); err != nil {
+		return false
+	}
+	ack, ok := fields["ack"].(float64)
+	if !ok {
+		return false
+	}
+
+	c.mu.Lock()
+	reply, waiting := c.pending[int64(ack)]
+	c.mu.Unlock()
+	if !waiting {
+		logWarn("Ignoring reply to unknown command %v from %s", fields["ack"], c.device.Name)
+		return true
+	}
+	delete(fields, "ack")
+	select {
+	case reply <- fields:
+	default: // repeated reply to the same command
+	}
+	return true
+}
+
+// sendDeviceCommandImpl sends a command to a device read by this process.
+func sendDeviceCommandImpl(ctx context.Context, device string, cmd DeviceCommand) (map[string]any, error) {
+	if err := cmd.validate(); err != nil {
+		return nil, err
+	}
+	channel := deviceCommandChannels.get(device)
+	if channel == nil {
+		return nil, errDeviceNotConnected
+	}
+	logInfo("Sending %s command to %s", cmd.Command, device)
+	return channel.send(ctx, cmd, deviceCommandTimeout)
+}
+
+// runDeviceCommand implements the device subcommand. The serial port is held
+// by the running daemon, so the command is sent through its dashboard server.
+func runDeviceCommand(args []string) error {
+	fs := newSubcommandFlagSet("device", deviceCommandUsage)
+	server := fs.String("server", "http://localhost:8080", "Address of the running skogsnet_v2 dashboard server")
+	token := fs.String("token", os.Getenv("SKOGSNET_TOKEN"), "Token issued for the device with the token command (default from the SKOGSNET_TOKEN environment variable)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 2 {
+		fs.Usage()
+		return errors.New("device name and command are required")
+	}
+
+	device := fs.Arg(0)
+	cmd := DeviceCommand{Command: fs.Arg(1)}
+	if fs.NArg() > 2 {
+		value, err := strconv.ParseFloat(fs.Arg(2), 64)
+		if err != nil {
+			return fmt.Errorf("invalid value %q", fs.Arg(2))
+		}
+		cmd.Value = &value
+	}
+	if fs.NArg() > 3 {
+		return fmt.Errorf("unexpected arguments %v", fs.Args()[3:])
+	}
+	if err := cmd.validate(); err != nil {
+		return err
+	}
+
+	if *token == "" {
+		return errors.New("a token issued for the device is required, see the token command")
+	}
+
+	reply, err := postDeviceCommand(*server, *token, device, cmd)
+	if err != nil {
+		return err
+	}
+	printCommandReply(reply)
+	return nil
+}
+
+func postDeviceCommand(server, token, device string, cmd DeviceCommand) (map[string]any, error) {
+	body, err := json.Marshal(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint := strings.TrimRight(server, "/") + "/api/devices/" + url.PathEscape(device) + "/commands"
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	client := &http.Client{Timeout: 2 * deviceCommandTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("is skogsnet_v2 running with -dashboard? %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+
+	var result struct {
+		Reply map[string]any `json:"reply"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("invalid response: %w", err)
+	}
+	return result.Reply, nil
+}
+
+// printCommandReply prints the fields of a reply other than the ok flag.
+func printCommandReply(reply map[string]any) {
+	keys := make([]string, 0, len(reply))
+	for key := range reply {
+		if key != "ok" {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		fmt.Println("OK")
+		return
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Printf("%s: %v\n", key, reply[key])
+	}
+}
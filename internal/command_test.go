@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// deviceEmulator answers the commands written to it like the firmware does.
+type deviceEmulator struct {
+	mu      sync.Mutex
+	written []string
+	channel *commandChannel
+	answer  func(request map[string]any) string
+}
+
+func (d *deviceEmulator) Write(p []byte) (int, error) {
+	d.mu.Lock()
+	d.written = append(d.written, string(p))
+	d.mu.Unlock()
+
+	var request map[string]any
+	if err := json.Unmarshal(p, &request); err == nil && d.answer != nil {
+		go d.channel.deliver(d.answer(request))
+	}
+	return len(p), nil
+}
+
+func newDeviceEmulator(device Device, answer func(request map[string]any) string) *deviceEmulator {
+	emulator := &deviceEmulator{answer: answer}
+	emulator.channel = newCommandChannel(device, emulator)
+	return emulator
+}
+
+func floatPtr(v float64) *float64 { return &v }
+
+func TestDeviceCommand_Validate(t *testing.T) {
+	valid := []DeviceCommand{
+		{Command: commandInterval, Value: floatPtr(30)},
+		{Command: commandRead},
+		{Command: commandVersion},
+		{Command: commandReboot},
+	}
+	for _, cmd := range valid {
+		if err := cmd.validate(); err != nil {
+			t.Errorf("Expected %+v to be valid, got %v", cmd, err)
+		}
+	}
+
+	invalid := []DeviceCommand{
+		{Command: commandInterval},
+		{Command: commandInterval, Value: floatPtr(0)},
+		{Command: commandInterval, Value: floatPtr(0.5)},
+		{Command: commandVersion, Value: floatPtr(1)},
+		{Command: "selfdestruct"},
+	}
+	for _, cmd := range invalid {
+		if err := cmd.validate(); err == nil {
+			t.Errorf("Expected %+v to be invalid", cmd)
+		}
+	}
+}
+
+func TestCommandChannel_Send(t *testing.T) {
+	emulator := newDeviceEmulator(Device{Name: "greenhouse"}, func(request map[string]any) string {
+		reply, _ := json.Marshal(map[string]any{"ack": request["id"], "ok": true, "version": "1.2.0"})
+		return string(reply)
+	})
+
+	reply, err := emulator.channel.send(context.Background(), DeviceCommand{Command: commandVersion}, time.Second)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if reply["version"] != "1.2.0" {
+		t.Errorf("Expected version in reply, got %v", reply)
+	}
+
+	_, err = emulator.channel.send(context.Background(), DeviceCommand{Command: commandInterval, Value: floatPtr(30)}, time.Second)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(emulator.written) != 2 || emulator.written[1] != `{"cmd":"interval","id":2,"value":30}`+"\n" {
+		t.Errorf("Unexpected commands written: %q", emulator.written)
+	}
+}
+
+func TestCommandChannel_SendFramed(t *testing.T) {
+	var buf strings.Builder
+	channel := newCommandChannel(Device{Name: "cellar", Framing: framingCRC8}, &buf)
+
+	channel.send(context.Background(), DeviceCommand{Command: commandRead}, 10*time.Millisecond)
+
+	payload, err := decodeFrame(buf.String())
+	if err != nil || payload != `{"cmd":"read","id":1}` {
+		t.Errorf("Expected a framed command, got %q (%v)", buf.String(), err)
+	}
+}
+
+func TestCommandChannel_Rejected(t *testing.T) {
+	emulator := newDeviceEmulator(Device{Name: "greenhouse"}, func(request map[string]any) string {
+		reply, _ := json.Marshal(map[string]any{"ack": request["id"], "ok": false, "error": "interval too short"})
+		return string(reply)
+	})
+
+	_, err := emulator.channel.send(context.Background(), DeviceCommand{Command: commandInterval, Value: floatPtr(0.1)}, time.Second)
+	if !errors.Is(err, errCommandFailed) || !strings.Contains(err.Error(), "interval too short") {
+		t.Errorf("Expected rejected command error, got %v", err)
+	}
+}
+
+func TestCommandChannel_Timeout(t *testing.T) {
+	emulator := newDeviceEmulator(Device{Name: "greenhouse"}, nil)
+
+	_, err := emulator.channel.send(context.Background(), DeviceCommand{Command: commandRead}, 20*time.Millisecond)
+	if err != errCommandTimeout {
+		t.Errorf("Expected timeout, got %v", err)
+	}
+	if len(emulator.channel.pending) != 0 {
+		t.Errorf("Expected pending command to be removed, got %d", len(emulator.channel.pending))
+	}
+}
+
+func TestCommandChannel_Detach(t *testing.T) {
+	registry := newCommandRegistry()
+	emulator := newDeviceEmulator(Device{Name: "greenhouse"}, nil)
+	registry.attach(emulator.channel)
+
+	if registry.get("greenhouse") != emulator.channel {
+		t.Fatal("Expected attached channel to be returned")
+	}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		registry.detach(emulator.channel)
+	}()
+	_, err := emulator.channel.send(context.Background(), DeviceCommand{Command: commandRead}, time.Second)
+	if err != errDeviceNotConnected {
+		t.Errorf("Expected not connected error when the link drops, got %v", err)
+	}
+	if registry.get("greenhouse") != nil {
+		t.Error("Expected channel to be removed")
+	}
+}
+
+func TestCommandChannel_Deliver(t *testing.T) {
+	origLogWarn := logWarn
+	logWarn = func(format string, v ...any) {}
+	defer func() { logWarn = origLogWarn }()
+
+	channel := newCommandChannel(Device{Name: "greenhouse"}, io.Discard)
+
+	if channel.deliver(`{"temperature_celcius":21.5}`) {
+		t.Error("Expected measurement not to be taken as a reply")
+	}
+	if channel.deliver(`{"ack":"x","temperature_celcius":21.5}`) {
+		t.Error("Expected non-numeric ack not to be taken as a reply")
+	}
+	if !channel.deliver(`{"ack":99,"ok":true}`) {
+		t.Error("Expected reply to unknown command to be consumed")
+	}
+}
+
+func TestSendDeviceCommand_NotConnected(t *testing.T) {
+	_, err := sendDeviceCommand(context.Background(), "nowhere", DeviceCommand{Command: commandVersion})
+	if err != errDeviceNotConnected {
+		t.Errorf("Expected not connected error, got %v", err)
+	}
+	if _, err := sendDeviceCommand(context.Background(), "nowhere", DeviceCommand{Command: "dance"}); err == nil {
+		t.Error("Expected error for invalid command")
+	}
+}
+
+func TestRunDeviceCommand(t *testing.T) {
+	var received DeviceCommand
+	var path, auth, contentType string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		auth = r.Header.Get("Authorization")
+		contentType = r.Header.Get("Content-Type")
+		json.NewDecoder(r.Body).Decode(&received)
+		json.NewEncoder(w).Encode(map[string]any{"reply": map[string]any{"ok": true}})
+	}))
+	defer server.Close()
+
+	stdout := os.Stdout
+	os.Stdout, _ = os.Open(os.DevNull)
+	err := runDeviceCommand([]string{"-server", server.URL, "-token", "secret", "back garden", "interval", "30"})
+	os.Stdout = stdout
+
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if path != "/api/devices/back%20garden/commands" && path != "/api/devices/back garden/commands" {
+		t.Errorf("Unexpected request path %q", path)
+	}
+	if received.Command != commandInterval || received.Value == nil || *received.Value != 30 {
+		t.Errorf("Unexpected command sent: %+v", received)
+	}
+	if auth != "Bearer secret" || contentType != "application/json" {
+		t.Errorf("Unexpected headers: Authorization %q, Content-Type %q", auth, contentType)
+	}
+}
+
+func TestRunDeviceCommand_Errors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Device not connected", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	stderr := os.Stderr
+	os.Stderr, _ = os.Open(os.DevNull)
+	defer func() { os.Stderr = stderr }()
+
+	t.Setenv("SKOGSNET_TOKEN", "")
+	cases := [][]string{
+		{"-server", server.URL, "-token", "secret", "cellar"},
+		{"-server", server.URL, "-token", "secret", "cellar", "interval", "soon"},
+		{"-server", server.URL, "-token", "secret", "cellar", "dance"},
+		{"-server", server.URL, "-token", "secret", "cellar", "read", "1", "2"},
+		{"-server", server.URL, "cellar", "read"},
+	}
+	for _, args := range cases {
+		if err := runDeviceCommand(args); err == nil {
+			t.Errorf("Expected error for %v", args)
+		}
+	}
+
+	err := runDeviceCommand([]string{"-server", server.URL, "-token", "secret", "cellar", "version"})
+	if err == nil || !strings.Contains(err.Error(), "Device not connected") {
+		t.Errorf("Expected server error to be reported, got %v", err)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+// subcommand is run as skogsnet_v2 [flags] <name> [args] instead of reading
+// the sensors.
+type subcommand struct {
+	name  string
+	usage string
+	run   func(args []string) error
+}
+
+var subcommands = []subcommand{
+	{"device", deviceCommandUsage, runDeviceCommand},
+	{"token", tokenUsage, runTokenCommand},
+	{"calibrate", calibrateUsage, runCalibrateCommand},
+	{"migrate", migrateUsage, runMigrateCommand},
+	{"backup", backupUsage, runBackupCommand},
+	{"restore", restoreUsage, runRestoreCommand},
+	{"import", importUsage, runImportCommand},
+}
+
+var runSubcommand = runSubcommandImpl
+
+func init() {
+	flag.Usage = func() {
+		out := flag.CommandLine.Output()
+		fmt.Fprintf(out, "Usage of %s:\n  %s [flags]\n  %s [flags] <command> [args]\n\nCommands:\n", os.Args[0], os.Args[0], os.Args[0])
+		for _, cmd := range subcommands {
+			fmt.Fprintf(out, "  %s\n", cmd.usage)
+		}
+		fmt.Fprintf(out, "\nFlags:\n")
+		flag.PrintDefaults()
+	}
+}
+
+func runSubcommandImpl(args []string) {
+	for _, cmd := range subcommands {
+		if cmd.name != args[0] {
+			continue
+		}
+		if err := cmd.run(args[1:]); err != nil {
+			logError("%s: %v", cmd.name, err)
+			osExit(1)
+		}
+		return
+	}
+
+	logError("Unknown command %q", args[0])
+	flag.Usage()
+	osExit(1)
+}
+
+// newSubcommandFlagSet returns the flag set of a subcommand. It also accepts
+// the global flags, so they may be given after the command name too.
+func newSubcommandFlagSet(name, usage string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	flag.VisitAll(func(f *flag.Flag) {
+		fs.Var(f.Value, f.Name, f.Usage)
+	})
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage of %s %s:\n", os.Args[0], usage)
+		fs.PrintDefaults()
+	}
+	return fs
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestRunSubcommand_Unknown(t *testing.T) {
+	origExit := osExit
+	origLogError := logError
+	exitCode := 0
+	osExit = func(code int) { exitCode = code }
+	logError = func(format string, v ...any) {}
+	stderr := os.Stderr
+	os.Stderr, _ = os.Open(os.DevNull)
+	defer func() {
+		osExit = origExit
+		logError = origLogError
+		os.Stderr = stderr
+	}()
+
+	runSubcommand([]string{"frobnicate"})
+	if exitCode != 1 {
+		t.Errorf("Expected exit code 1 for unknown command, got %d", exitCode)
+	}
+}
+
+func TestRunSubcommand_Dispatch(t *testing.T) {
+	origSubcommands := subcommands
+	var got []string
+	subcommands = []subcommand{{"echo", "echo ARGS", func(args []string) error {
+		got = args
+		return nil
+	}}}
+	defer func() { subcommands = origSubcommands }()
+
+	runSubcommand([]string{"echo", "a", "b"})
+	if len(got) != 2 || got[0] != "a" || got[1] != "b" {
+		t.Errorf("Expected args to be passed on, got %v", got)
+	}
+}
+
+func TestNewSubcommandFlagSet_GlobalFlags(t *testing.T) {
+	origDB := *dbFileName
+	defer func() { *dbFileName = origDB }()
+
+	fs := newSubcommandFlagSet("test", "test")
+	if err := fs.Parse([]string{"-db", "other.db", "rest"}); err != nil {
+		t.Fatalf("Expected global flag to be accepted, got %v", err)
+	}
+	if *dbFileName != "other.db" || fs.Arg(0) != "rest" {
+		t.Errorf("Expected -db to set the global flag, got %q", *dbFileName)
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
-	"os"
 	"strings"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -15,6 +14,7 @@ var enableWALMode = enableWALModeImpl
 var openDatabase = openDatabaseImpl
 var insertWeather = insertWeatherImpl
 var insertMeasurement = insertMeasurementImpl
+var insertMeasurementBatch = insertMeasurementBatchImpl
 var exportCSVAndExit = exportCSVAndExitImpl
 
 func mustInitDatabaseImpl(dbFileName *string) (*sql.DB, error) {
@@ -53,6 +53,13 @@ func enableWALModeImpl(db *sql.DB) {
 }
 
 func exportCSVAndExitImpl(dbFileName *string, exportCSV *string) {
+	options, err := exportOptionsFromFlags()
+	if err != nil {
+		logError("%v", err)
+		osExit(1)
+		return
+	}
+
 	db, err := openDatabase(*dbFileName)
 	if err != nil {
 		logError("Failed to open database: %v", err)
@@ -60,72 +67,108 @@ func exportCSVAndExitImpl(dbFileName *string, exportCSV *string) {
 		return
 	}
 	defer db.Close()
-	if err := exportToCSV(db, *exportCSV); err != nil {
-		logError("Export to CSV failed: %v", err)
+	storage, err := openStorage(db)
+	if err != nil {
+		logError("Failed to open storage: %v", err)
 		osExit(1)
 		return
-	} else {
+	}
+	defer storage.Close()
+	if err := exportMeasurements(storage, *exportCSV, options); err != nil {
+		logError("Export to %s failed: %v", strings.ToUpper(options.format), err)
+		osExit(1)
+		return
+	} else if *exportCSV != "-" {
 		logInfo("Exported measurements to %s", *exportCSV)
 	}
 }
 
+// openDatabaseImpl opens the database and applies pending schema
+// migrations, or with -no-migrate fails while any are pending.
 func openDatabaseImpl(dbPath string) (*sql.DB, error) {
-	if dbPath == "" {
-		return nil, fmt.Errorf("database path is empty")
-	}
-
-	db, err := sql.Open("sqlite3", dbPath)
+	db, err := connectDatabase(dbPath)
 	if err != nil {
 		return nil, err
 	}
 
-	createMeasurementTable := `
-	CREATE TABLE IF NOT EXISTS measurements (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		weather_id INTEGER,
-		timestamp INTEGER,
-		temperature REAL,
-		humidity REAL
-	);`
-
-	createWeatherTable := `
-	CREATE TABLE IF NOT EXISTS weather (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		timestamp INTEGER,
-		city TEXT,
-		temp REAL,
-		humidity INTEGER,
-		wind_speed REAL,
-		wind_deg INTEGER,
-		clouds INTEGER,
-		weather_code INTEGER,
-		description TEXT
-	);`
-
-	_, err = db.Exec(createMeasurementTable)
-	if err != nil {
-		db.Close()
-		return nil, err
+	if *noMigrate {
+		err = checkSchemaVersion(db)
+	} else {
+		var applied []migration
+		applied, err = migrateUp(db, 0)
+		for _, m := range applied {
+			logInfo("Applied schema migration %04d %s", m.version, m.name)
+		}
 	}
-	_, err = db.Exec(createWeatherTable)
 	if err != nil {
 		db.Close()
 		return nil, err
 	}
-
 	return db, nil
 }
 
+// connectDatabase opens the database without touching its schema.
+func connectDatabase(dbPath string) (*sql.DB, error) {
+	if dbPath == "" {
+		return nil, fmt.Errorf("database path is empty")
+	}
+
+	// Devices store their measurements concurrently over separate pooled
+	// connections. Wait for a held lock instead of failing, and take the
+	// write lock when a transaction begins, so two transactions can't
+	// deadlock upgrading their read locks.
+	separator := "?"
+	if strings.Contains(dbPath, "?") {
+		separator = "&"
+	}
+	return sql.Open("sqlite3", dbPath+separator+"_busy_timeout=5000&_txlock=immediate")
+}
+
 func insertMeasurementImpl(db *sql.DB, m Measurement, timestamp int64) error {
 	if db == nil {
 		return errors.New("db is nil")
 	}
 
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := insertMeasurementTx(tx, m, timestamp); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// insertMeasurementBatchImpl stores all measurements at their UnixTimestamp
+// in a single transaction, so either all or none of them are written.
+func insertMeasurementBatchImpl(db *sql.DB, measurements []Measurement) error {
+	if db == nil {
+		return errors.New("db is nil")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, m := range measurements {
+		if err := insertMeasurementTx(tx, m, m.UnixTimestamp); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// insertMeasurementTx stores the measurement row, linked to the nearest
+// weather record, together with its extra metrics. The raw readings of
+// calibrated fields are kept next to the calibrated values.
+func insertMeasurementTx(tx *sql.Tx, m Measurement, timestamp int64) error {
 	// Find nearest weather record within 10 minutes
 	const weatherMatchWindowMillis = 600_000
 	var weatherID sql.NullInt64
 
-	err := db.QueryRow(`
+	err := tx.QueryRow(`
 		SELECT id FROM weather
 		WHERE ABS(timestamp - ?) < ?
 		ORDER BY ABS(timestamp - ?) ASC
@@ -135,17 +178,49 @@ func insertMeasurementImpl(db *sql.DB, m Measurement, timestamp int64) error {
 		return err
 	}
 
-	_, err = db.Exec(
-		"INSERT INTO measurements (timestamp, temperature, humidity, weather_id) VALUES (?, ?, ?, ?)",
-		timestamp, m.TemperatureCelsius, m.HumidityPercentage, func() int64 {
+	deviceID := sql.NullInt64{Int64: m.DeviceID, Valid: m.DeviceID != 0}
+	receivedTS := m.ReceivedTimestamp
+	if receivedTS == 0 {
+		receivedTS = timestamp
+	}
+
+	result, err := tx.Exec(
+		"INSERT INTO measurements (timestamp, temperature, humidity, weather_id, device_id, device_ts, received_ts, seq, raw_temperature, raw_humidity) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		timestamp, m.columnValue(temperatureField), m.columnValue(humidityField), func() int64 {
 			if weatherID.Valid {
 				return weatherID.Int64
 			} else {
 				return 0
 			}
 		}(),
+		deviceID,
+		m.DeviceTimestamp,
+		receivedTS,
+		m.Sequence,
+		m.rawValue(temperatureField),
+		m.rawValue(humidityField),
 	)
-	return err
+	if err != nil {
+		return err
+	}
+	if len(m.Metrics) == 0 {
+		return nil
+	}
+
+	measurementID, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	for _, metric := range sortedMetricNames(m.Metrics) {
+		_, err := tx.Exec(
+			"INSERT INTO measurement_values (measurement_id, metric, value, raw_value) VALUES (?, ?, ?, ?)",
+			measurementID, metric, m.Metrics[metric], m.rawValue(metric),
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func insertWeatherImpl(db *sql.DB, w Weather, timestamp int64) error {
@@ -180,126 +255,127 @@ func insertWeatherImpl(db *sql.DB, w Weather, timestamp int64) error {
 	return err
 }
 
-func exportToCSV(db *sql.DB, filename string) error {
-	file, err := os.Create(filename)
+// exportMeasurementsSQLite passes the measurements selected by filter to
+// w, oldest first, with their weather and a value for every extra metric.
+func exportMeasurementsSQLite(db *sql.DB, filter exportFilter, w exportWriter) error {
+	metrics, err := listMetrics(db)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
-
-	fields := []string{
-		"timestamp",
-		"temperature",
-		"humidity",
-		"city",
-		"weather_temp",
-		"weather_humidity",
-		"wind_speed",
-		"wind_deg",
-		"clouds",
-		"weather_code",
-		"weather_description",
+	metricColumns := ""
+	args := make([]any, 0, len(metrics)+3)
+	for _, metric := range metrics {
+		metricColumns += ",\n\t\t\t(SELECT value FROM measurement_values WHERE measurement_id = m.id AND metric = ?)"
+		args = append(args, metric)
 	}
 
-	header := strings.Join(fields, ",") + "\n"
-	if _, err := file.WriteString(header); err != nil {
-		return err
+	where := "m.timestamp >= ?"
+	args = append(args, filter.from)
+	if filter.to != 0 {
+		where += " AND m.timestamp < ?"
+		args = append(args, filter.to)
+	}
+	if filter.device != "" {
+		where += " AND d.name = ?"
+		args = append(args, filter.device)
 	}
 
 	rows, err := db.Query(`
-		SELECT m.timestamp, m.temperature, m.humidity,
-			w.city, w.temp, w.humidity, w.wind_speed, w.wind_deg, w.clouds, w.weather_code, w.description
+		SELECT m.timestamp, d.name, m.temperature, m.humidity,
+			w.city, w.temp, w.humidity, w.wind_speed, w.wind_deg, w.clouds, w.weather_code, w.description, w.timestamp`+metricColumns+`
 		FROM measurements m
 		LEFT JOIN weather w ON m.weather_id = w.id
+		LEFT JOIN devices d ON m.device_id = d.id
+		WHERE `+where+`
 		ORDER BY m.timestamp ASC
-	`)
+	`, args...)
 	if err != nil {
 		return err
 	}
 	defer rows.Close()
+	return writeExportRows(w, metrics, rows)
+}
 
+// writeExportRows passes the rows of an export query, selecting the
+// columns of exportRow, to w.
+func writeExportRows(w exportWriter, metrics []string, rows *sql.Rows) error {
+	if err := w.begin(metrics); err != nil {
+		return err
+	}
+	row := exportRow{metrics: make([]sql.NullFloat64, len(metrics))}
 	for rows.Next() {
-		var ts int64
-		var temp, hum float64
-		var city sql.NullString
-		var wTemp sql.NullFloat64
-		var wHum sql.NullInt64
-		var windSpeed sql.NullFloat64
-		var windDeg sql.NullInt64
-		var clouds sql.NullInt64
-		var weatherCode sql.NullInt64
-		var description sql.NullString
-
-		if err := rows.Scan(&ts, &temp, &hum, &city, &wTemp, &wHum, &windSpeed, &windDeg, &clouds, &weatherCode, &description); err != nil {
+		if err := rows.Scan(row.dest()...); err != nil {
 			return err
 		}
-
-		// Format floats with one decimal, ints as is, empty string for NULLs
-		line := fmt.Sprintf("%d,%.1f,%.1f,%s,%.1f,%d,%.1f,%d,%d,%d,%s\n",
-			ts,
-			temp,
-			hum,
-			func() string {
-				if city.Valid {
-					return city.String
-				} else {
-					return ""
-				}
-			}(),
-			func() float64 {
-				if wTemp.Valid {
-					return float64(int(wTemp.Float64*10)) / 10
-				} else {
-					return 0
-				}
-			}(),
-			func() int64 {
-				if wHum.Valid {
-					return wHum.Int64
-				} else {
-					return 0
-				}
-			}(),
-			func() float64 {
-				if windSpeed.Valid {
-					return float64(int(windSpeed.Float64*10)) / 10
-				} else {
-					return 0
-				}
-			}(),
-			func() int64 {
-				if windDeg.Valid {
-					return windDeg.Int64
-				} else {
-					return 0
-				}
-			}(),
-			func() int64 {
-				if clouds.Valid {
-					return clouds.Int64
-				} else {
-					return 0
-				}
-			}(),
-			func() int64 {
-				if weatherCode.Valid {
-					return weatherCode.Int64
-				} else {
-					return 0
-				}
-			}(),
-			func() string {
-				if description.Valid {
-					return description.String
-				} else {
-					return ""
-				}
-			}(),
-		)
-		if _, err := file.WriteString(line); err != nil {
+		if err := w.write(&row); err != nil {
 			return err
 		}
 	}
+	return rows.Err()
+}
 
-	return nil
+// listMetrics returns the names of all extra metrics stored so far.
+func listMetrics(db *sql.DB) ([]string, error) {
+	rows, err := db.Query("SELECT DISTINCT metric FROM measurement_values ORDER BY metric")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var metrics []string
+	for rows.Next() {
+		var metric string
+		if err := rows.Scan(&metric); err != nil {
+			return nil, err
+		}
+		metrics = append(metrics, metric)
+	}
+	return metrics, rows.Err()
+}
+
+// latestMeasurements returns the newest measurements of deviceID, every
+// device when 0, newest first. The first carries its extra metrics.
+func latestMeasurements(db *sql.DB, deviceID int64, limit int) ([]Result, error) {
+	where := ""
+	args := []any{}
+	if deviceID != 0 {
+		where = "WHERE m.device_id = ?"
+		args = append(args, deviceID)
+	}
+	rows, err := db.Query(`
+		SELECT m.id, m.device_id, devices.name, m.timestamp,
+			m.temperature, m.temperature, m.temperature, m.humidity, m.humidity, m.humidity,
+			w.city, w.temp, w.humidity, w.wind_speed, w.wind_deg, w.clouds, w.weather_code, w.description
+		FROM measurements m
+		LEFT JOIN weather w ON m.weather_id = w.id
+		LEFT JOIN devices ON m.device_id = devices.id
+		`+where+`
+		ORDER BY m.timestamp DESC
+		LIMIT ?
+	`, append(args, limit)...)
+	if err != nil {
+		return nil, err
+	}
+	results, err := scanResults(rows)
+	if err != nil || len(results) == 0 {
+		return results, err
+	}
+
+	rows, err = db.Query("SELECT metric, value FROM measurement_values WHERE measurement_id = ?", results[0].MeasurementID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var metric string
+		var value float64
+		if err := rows.Scan(&metric, &value); err != nil {
+			return nil, err
+		}
+		if results[0].Metrics == nil {
+			results[0].Metrics = make(map[string]float64)
+		}
+		results[0].Metrics[metric] = value
+	}
+	return results, rows.Err()
 }
@@ -372,7 +372,7 @@ func TestExportCSVAndExit(t *testing.T) {
 		t.Fatalf("Failed to read CSV file: %v", err)
 	}
 
-	expectedHeader := "timestamp,temperature,humidity,city,weather_temp,weather_humidity,wind_speed,wind_deg,clouds,weather_code,weather_description\n"
+	expectedHeader := "timestamp,device,temperature,humidity,city,weather_temp,weather_humidity,wind_speed,wind_deg,clouds,weather_code,weather_description\n"
 	if string(data[:len(expectedHeader)]) != expectedHeader {
 		t.Errorf("CSV header mismatch:\nExpected: %q\nGot: %q", expectedHeader, string(data[:len(expectedHeader)]))
 	}
@@ -414,7 +414,7 @@ func TestExportCSVAndExit_ExportError(t *testing.T) {
 	openDatabase = mockOpenDatabase
 	defer func() { openDatabase = origOpenDatabase }()
 
-	// Simulate exportToCSV error by passing a nil DB pointer
+	// Simulate export error by passing a nil DB pointer
 	dbPath := "test_export_error.db"
 	csvPath := "/invalid/path/to/export.csv" // Invalid path to trigger error
 	defer os.Remove(dbPath)
@@ -438,10 +438,10 @@ func TestExportCSVAndExit_ExportError(t *testing.T) {
 	exportCSVAndExit(&dbPath, &csvPath)
 
 	if !exitCalled {
-		t.Error("Expected osExit to be called for exportToCSV error")
+		t.Error("Expected osExit to be called for export error")
 	}
 	if !strings.Contains(buf.String(), "Export to CSV failed") {
-		t.Error("Expected log error for exportToCSV error")
+		t.Error("Expected log error for export error")
 	}
 }
 
@@ -506,7 +506,7 @@ func TestExportToCSV(t *testing.T) {
 	}
 
 	csvFile := "test_export.csv"
-	if err := exportToCSV(db, csvFile); err != nil {
+	if err := exportMeasurements(sqliteStorage{db}, csvFile, exportOptions{}); err != nil {
 		t.Fatalf("Failed to export to CSV: %v", err)
 	}
 	defer os.Remove(csvFile)
@@ -516,7 +516,7 @@ func TestExportToCSV(t *testing.T) {
 		t.Fatalf("Failed to read CSV file: %v", err)
 	}
 
-	expectedHeader := "timestamp,temperature,humidity,city,weather_temp,weather_humidity,wind_speed,wind_deg,clouds,weather_code,weather_description\n"
+	expectedHeader := "timestamp,device,temperature,humidity,city,weather_temp,weather_humidity,wind_speed,wind_deg,clouds,weather_code,weather_description\n"
 	if string(data[:len(expectedHeader)]) != expectedHeader {
 		t.Errorf("CSV header mismatch:\nExpected: %q\nGot: %q", expectedHeader, string(data[:len(expectedHeader)]))
 	}
@@ -529,7 +529,7 @@ func TestExportToCSV(t *testing.T) {
 	}
 
 	// Check if the data matches the inserted measurement and weather
-	expectedLine := fmt.Sprintf("%d,%.1f,%.1f,%s,%.1f,%d,%.1f,%d,%d,%d,%s",
+	expectedLine := fmt.Sprintf("%d,,%g,%g,%s,%g,%d,%g,%d,%d,%d,%s",
 		timestamp,
 		m1.TemperatureCelsius,
 		m1.HumidityPercentage,
@@ -559,7 +559,7 @@ func TestExportToCSV_EmptyDB(t *testing.T) {
 	defer db.Close()
 
 	csvFile := "test_empty_export.csv"
-	if err := exportToCSV(db, csvFile); err != nil {
+	if err := exportMeasurements(sqliteStorage{db}, csvFile, exportOptions{}); err != nil {
 		t.Fatalf("Failed to export to CSV: %v", err)
 	}
 	defer os.Remove(csvFile)
@@ -569,7 +569,7 @@ func TestExportToCSV_EmptyDB(t *testing.T) {
 		t.Fatalf("Failed to read CSV file: %v", err)
 	}
 
-	expectedHeader := "timestamp,temperature,humidity,city,weather_temp,weather_humidity,wind_speed,wind_deg,clouds,weather_code,weather_description\n"
+	expectedHeader := "timestamp,device,temperature,humidity,city,weather_temp,weather_humidity,wind_speed,wind_deg,clouds,weather_code,weather_description\n"
 	if string(data) != expectedHeader {
 		t.Errorf("CSV file should only contain header, got: %q", string(data))
 	}
@@ -596,7 +596,7 @@ func TestExportToCSV_NoWeatherData(t *testing.T) {
 	}
 
 	csvFile := "test_no_weather_export.csv"
-	if err := exportToCSV(db, csvFile); err != nil {
+	if err := exportMeasurements(sqliteStorage{db}, csvFile, exportOptions{}); err != nil {
 		t.Fatalf("Failed to export to CSV: %v", err)
 	}
 	defer os.Remove(csvFile)
@@ -606,7 +606,7 @@ func TestExportToCSV_NoWeatherData(t *testing.T) {
 		t.Fatalf("Failed to read CSV file: %v", err)
 	}
 
-	expectedHeader := "timestamp,temperature,humidity,city,weather_temp,weather_humidity,wind_speed,wind_deg,clouds,weather_code,weather_description\n"
+	expectedHeader := "timestamp,device,temperature,humidity,city,weather_temp,weather_humidity,wind_speed,wind_deg,clouds,weather_code,weather_description\n"
 	if string(data[:len(expectedHeader)]) != expectedHeader {
 		t.Errorf("CSV header mismatch:\nExpected: %q\nGot: %q", expectedHeader, string(data[:len(expectedHeader)]))
 	}
@@ -618,8 +618,200 @@ func TestExportToCSV_NoWeatherData(t *testing.T) {
 		t.Error("CSV file should contain data after header, but it's empty")
 	}
 
-	expectedLine := fmt.Sprintf("%d,%.1f,%.1f,,0.0,0,0.0,0,0,0,", m.UnixTimestamp, m.TemperatureCelsius, m.HumidityPercentage)
+	expectedLine := fmt.Sprintf("%d,,%g,%g,,,,,,,,", m.UnixTimestamp, m.TemperatureCelsius, m.HumidityPercentage)
 	if lines != expectedLine {
 		t.Errorf("CSV data mismatch:\nExpected: %q\nGot: %q", expectedLine, lines)
 	}
 }
+
+func TestInsertMeasurement_Metrics(t *testing.T) {
+	tmpDB := "test_measurement_values.db"
+	defer os.Remove(tmpDB)
+
+	db, err := openDatabase(tmpDB)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	m := Measurement{
+		TemperatureCelsius: 20.0,
+		HumidityPercentage: 50.0,
+		Metrics:            map[string]float64{"lux": 120, "co2": 650},
+	}
+	if err := insertMeasurement(db, m, time.Now().UnixMilli()); err != nil {
+		t.Fatalf("Failed to insert measurement: %v", err)
+	}
+
+	rows, err := db.Query(`
+		SELECT mv.metric, mv.value FROM measurement_values mv
+		JOIN measurements m ON m.id = mv.measurement_id
+		ORDER BY mv.metric`)
+	if err != nil {
+		t.Fatalf("Failed to query measurement values: %v", err)
+	}
+	defer rows.Close()
+
+	var got []string
+	for rows.Next() {
+		var metric string
+		var value float64
+		if err := rows.Scan(&metric, &value); err != nil {
+			t.Fatalf("Failed to scan value: %v", err)
+		}
+		got = append(got, fmt.Sprintf("%s=%v", metric, value))
+	}
+	if strings.Join(got, ",") != "co2=650,lux=120" {
+		t.Errorf("Unexpected measurement values: %v", got)
+	}
+}
+
+func TestExportToCSV_Metrics(t *testing.T) {
+	tmpDB := "test_export_metrics.db"
+	defer os.Remove(tmpDB)
+
+	db, err := openDatabase(tmpDB)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	if err := insertMeasurement(db, Measurement{TemperatureCelsius: 20.0, HumidityPercentage: 50.0, Metrics: map[string]float64{"lux": 120.5}}, 1000); err != nil {
+		t.Fatalf("Failed to insert measurement: %v", err)
+	}
+	if err := insertMeasurement(db, Measurement{TemperatureCelsius: 21.0, HumidityPercentage: 51.0, Metrics: map[string]float64{"co2": 600}}, 2000); err != nil {
+		t.Fatalf("Failed to insert measurement: %v", err)
+	}
+
+	csvFile := "test_export_metrics.csv"
+	if err := exportMeasurements(sqliteStorage{db}, csvFile, exportOptions{}); err != nil {
+		t.Fatalf("Failed to export to CSV: %v", err)
+	}
+	defer os.Remove(csvFile)
+
+	data, err := os.ReadFile(csvFile)
+	if err != nil {
+		t.Fatalf("Failed to read CSV file: %v", err)
+	}
+
+	expected := "timestamp,device,temperature,humidity,city,weather_temp,weather_humidity,wind_speed,wind_deg,clouds,weather_code,weather_description,co2,lux\n" +
+		"1000,,20,50,,,,,,,,,,120.5\n" +
+		"2000,,21,51,,,,,,,,,600,\n"
+	if string(data) != expected {
+		t.Errorf("CSV mismatch:\nExpected: %q\nGot: %q", expected, string(data))
+	}
+}
+
+func TestInsertMeasurement_DeviceClockColumns(t *testing.T) {
+	tmpDB := "test_device_clock.db"
+	defer os.Remove(tmpDB)
+
+	db, err := openDatabase(tmpDB)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	deviceTS := int64(60_000)
+	seq := int64(7)
+	m := Measurement{DeviceTimestamp: &deviceTS, ReceivedTimestamp: 2_000, Sequence: &seq}
+	if err := insertMeasurement(db, m, 1_500); err != nil {
+		t.Fatalf("Failed to insert measurement: %v", err)
+	}
+	if err := insertMeasurement(db, Measurement{}, 3_000); err != nil {
+		t.Fatalf("Failed to insert measurement: %v", err)
+	}
+
+	rows, err := db.Query("SELECT timestamp, device_ts, received_ts, seq FROM measurements ORDER BY timestamp")
+	if err != nil {
+		t.Fatalf("Failed to query measurements: %v", err)
+	}
+	defer rows.Close()
+
+	var got []string
+	for rows.Next() {
+		var ts, receivedTS int64
+		var devTS, sq sql.NullInt64
+		if err := rows.Scan(&ts, &devTS, &receivedTS, &sq); err != nil {
+			t.Fatalf("Failed to scan row: %v", err)
+		}
+		got = append(got, fmt.Sprintf("%d/%v/%d/%v", ts, devTS, receivedTS, sq))
+	}
+	expected := "1500/{60000 true}/2000/{7 true},3000/{0 false}/3000/{0 false}"
+	if strings.Join(got, ",") != expected {
+		t.Errorf("Expected %s, got %s", expected, strings.Join(got, ","))
+	}
+}
+
+func TestOpenDatabase_UpgradesOldSchema(t *testing.T) {
+	tmpDB := "test_old_schema.db"
+	defer os.Remove(tmpDB)
+
+	old, err := sql.Open("sqlite3", tmpDB)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	_, err = old.Exec(`CREATE TABLE measurements (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		weather_id INTEGER,
+		timestamp INTEGER,
+		temperature REAL,
+		humidity REAL
+	)`)
+	old.Close()
+	if err != nil {
+		t.Fatalf("Failed to create old schema: %v", err)
+	}
+
+	db, err := openDatabase(tmpDB)
+	if err != nil {
+		t.Fatalf("Failed to open old database: %v", err)
+	}
+	defer db.Close()
+
+	if err := insertMeasurement(db, Measurement{DeviceID: 1}, 1_000); err != nil {
+		t.Errorf("Expected insert into upgraded schema to succeed, got %v", err)
+	}
+}
+
+func TestInsertMeasurementBatch(t *testing.T) {
+	tmpDB := "test_measurement_batch.db"
+	defer os.Remove(tmpDB)
+	db, err := openDatabase(tmpDB)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	batch := []Measurement{
+		{UnixTimestamp: 1000, TemperatureCelsius: 20.0, Metrics: map[string]float64{"lux": 5}},
+		{UnixTimestamp: 2000, TemperatureCelsius: 21.0},
+	}
+	if err := insertMeasurementBatch(db, batch); err != nil {
+		t.Fatalf("Failed to insert batch: %v", err)
+	}
+
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM measurements WHERE timestamp IN (1000, 2000)").Scan(&count)
+	if count != 2 {
+		t.Errorf("Expected 2 measurements, got %d", count)
+	}
+
+	// A failing measurement rolls back the whole batch
+	failing := []Measurement{
+		{UnixTimestamp: 3000},
+		{UnixTimestamp: 4000, Metrics: map[string]float64{"lux": 1}},
+	}
+	db.Exec("DROP TABLE measurement_values")
+	if err := insertMeasurementBatch(db, failing); err == nil {
+		t.Fatal("Expected batch insert to fail")
+	}
+	db.QueryRow("SELECT COUNT(*) FROM measurements WHERE timestamp = 3000").Scan(&count)
+	if count != 0 {
+		t.Errorf("Expected the batch to be rolled back, got %d rows", count)
+	}
+
+	if err := insertMeasurementBatch(nil, batch); err == nil {
+		t.Error("Expected error for nil DB")
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultDeviceName = "default"
+
+type Device struct {
+	ID           int64  `json:"id"`
+	Name         string `json:"name"`
+	Port         string `json:"port"`
+	Location     string `json:"location"`
+	CreatedAt    int64  `json:"created_at"`
+	Baud         int    `json:"-"`
+	VID          string `json:"-"`
+	PID          string `json:"-"`
+	SerialNumber string `json:"-"`
+	Framing      string `json:"-"`
+	Source       string `json:"-"`
+}
+
+// deviceFlags collects the repeatable -device flag, e.g.
+// -device name=greenhouse,port=/dev/ttyACM0,location=Back garden
+// -device name=cellar,vid=2341,pid=0043,serial=75833353035351A0E1B1
+type deviceFlags []Device
+
+var deviceSpecs deviceFlags
+
+var configuredDevices = configuredDevicesImpl
+var registerDevice = registerDeviceImpl
+var lookupDevice = lookupDeviceImpl
+
+func init() {
+	flag.Var(&deviceSpecs, "device", "Sensor device as name=NAME,port=PORT|auto[,vid=VID][,pid=PID][,serial=SERIAL][,location=LOCATION][,baud=BAUD][,framing=none|crc8][,source=serial|sim|replay:FILE|tcp|udp|mqtt|w1|hwmon] (repeatable)")
+}
+
+func (d *deviceFlags) String() string {
+	if d == nil {
+		return ""
+	}
+	names := make([]string, 0, len(*d))
+	for _, device := range *d {
+		names = append(names, device.Name)
+	}
+	return strings.Join(names, ",")
+}
+
+func (d *deviceFlags) Set(value string) error {
+	device, err := parseDeviceSpec(value)
+	if err != nil {
+		return err
+	}
+	for _, existing := range *d {
+		if existing.Name == device.Name {
+			return fmt.Errorf("duplicate device name %q", device.Name)
+		}
+	}
+	*d = append(*d, device)
+	return nil
+}
+
+func parseDeviceSpec(spec string) (Device, error) {
+	var device Device
+	for _, part := range strings.Split(spec, ",") {
+		key, value, ok := strings.Cut(part, "=")
+		if !ok {
+			return Device{}, fmt.Errorf("invalid device option %q, expected key=value", part)
+		}
+		key = strings.TrimSpace(key)
+		value = strings.TrimSpace(value)
+		switch key {
+		case "name":
+			device.Name = value
+		case "port":
+			device.Port = value
+		case "location":
+			device.Location = value
+		case "baud":
+			baud, err := strconv.Atoi(value)
+			if err != nil || baud <= 0 {
+				return Device{}, fmt.Errorf("invalid baud rate %q", value)
+			}
+			device.Baud = baud
+		case "vid":
+			device.VID = value
+		case "pid":
+			device.PID = value
+		case "serial":
+			device.SerialNumber = value
+		case "framing":
+			if err := validateFraming(value); err != nil {
+				return Device{}, err
+			}
+			device.Framing = value
+		case "source":
+			if err := validateSource(value); err != nil {
+				return Device{}, err
+			}
+			device.Source = value
+		default:
+			return Device{}, fmt.Errorf("unknown device option %q", key)
+		}
+	}
+	if device.Name == "" {
+		return Device{}, errors.New("device name is required")
+	}
+	if device.Port == "" && !device.hasUSBSelector() && !device.simulated() && !device.networked() {
+		return Device{}, fmt.Errorf("device %s: port or a USB selector is required", device.Name)
+	}
+
+	return device, nil
+}
+
+func (d Device) hasUSBSelector() bool {
+	return d.VID != "" || d.PID != "" || d.SerialNumber != ""
+}
+
+// simulated reports whether the device is read from a sim or replay source
+// rather than hardware.
+func (d Device) simulated() bool {
+	return d.Source == sourceSim || strings.HasPrefix(d.Source, replayPrefix)
+}
+
+// networked reports whether the device sends its lines over TCP, UDP or
+// MQTT.
+func (d Device) networked() bool {
+	return d.Source == sourceTCP || d.Source == sourceUDP || d.Source == sourceMQTT
+}
+
+// sysfs reports whether the device is a 1-Wire probe or hwmon chip, whose
+// port is its slave id or chip name.
+func (d Device) sysfs() bool {
+	return d.Source == sourceW1 || d.Source == sourceHwmon
+}
+
+func (d Device) autoDetect() bool {
+	return strings.EqualFold(d.Port, autoPortName)
+}
+
+// portSpec describes how the device's port is selected, e.g.
+// "/dev/ttyACM0" or "auto usb vid=2341 pid=0043", names its simulated
+// source, or gives the address it sends from, e.g. "tcp://192.168.1.20".
+func (d Device) portSpec() string {
+	if d.simulated() {
+		return d.Source
+	}
+	if d.Source == sourceModbus {
+		return d.Port
+	}
+	if d.sysfs() {
+		return d.Source + ":" + d.Port
+	}
+	if d.networked() {
+		if d.Port == "" {
+			return d.Source
+		}
+		return d.Source + "://" + d.Port
+	}
+	var parts []string
+	if d.Port != "" {
+		parts = append(parts, d.Port)
+	}
+	if d.hasUSBSelector() {
+		parts = append(parts, "usb")
+		if d.VID != "" {
+			parts = append(parts, "vid="+d.VID)
+		}
+		if d.PID != "" {
+			parts = append(parts, "pid="+d.PID)
+		}
+		if d.SerialNumber != "" {
+			parts = append(parts, "serial="+d.SerialNumber)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// configuredDevicesImpl returns the devices given with -device, or a single
+// default device built from -port, -baud, -framing, -source and the -usb-*
+// selectors when none were given.
+func configuredDevicesImpl() []Device {
+	if len(deviceSpecs) == 0 {
+		device := Device{
+			Name:         defaultDeviceName,
+			Port:         *portName,
+			Baud:         *baudRate,
+			VID:          *usbVID,
+			PID:          *usbPID,
+			SerialNumber: *usbSerial,
+			Framing:      *lineFraming,
+			Source:       *dataSource,
+		}
+		// The -port default would defeat USB selection unless given explicitly
+		if device.hasUSBSelector() && !flagWasSet("port") {
+			device.Port = ""
+		}
+		// Network sensors alone need no serial device
+		if (*listenTCP != "" || *listenUDP != "" || *mqttConfigFile != "" || *modbusConfigFile != "" || *pollW1 || *pollHwmon) && !slices.ContainsFunc([]string{"port", "usb-vid", "usb-pid", "usb-serial", "source"}, flagWasSet) {
+			return nil
+		}
+		return []Device{device}
+	}
+
+	devices := make([]Device, len(deviceSpecs))
+	copy(devices, deviceSpecs)
+	for i := range devices {
+		if devices[i].Baud == 0 {
+			devices[i].Baud = *baudRate
+		}
+		if devices[i].Framing == "" {
+			devices[i].Framing = *lineFraming
+		}
+		if devices[i].Source == "" {
+			devices[i].Source = *dataSource
+		}
+	}
+	return devices
+}
+
+// registerDeviceImpl inserts the device or updates its port and location if a
+// device with the same name already exists, and fills in ID and CreatedAt.
+func registerDeviceImpl(db *sql.DB, device *Device) error {
+	if db == nil {
+		return errors.New("db is nil")
+	}
+
+	_, err := db.Exec(`
+		INSERT INTO devices (name, port, location, created_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT(name) DO UPDATE SET port = excluded.port, location = excluded.location
+	`, device.Name, device.portSpec(), device.Location, time.Now().UnixMilli())
+	if err != nil {
+		return err
+	}
+
+	return db.QueryRow("SELECT id, created_at FROM devices WHERE name = ?", device.Name).
+		Scan(&device.ID, &device.CreatedAt)
+}
+
+// lookupDeviceImpl finds a device by name, or by id when the key is numeric.
+func lookupDeviceImpl(db *sql.DB, key string) (Device, error) {
+	if db == nil {
+		return Device{}, errors.New("db is nil")
+	}
+
+	var device Device
+	var port, location sql.NullString
+	var row *sql.Row
+	if id, err := strconv.ParseInt(key, 10, 64); err == nil {
+		row = db.QueryRow("SELECT id, name, port, location, created_at FROM devices WHERE id = ? OR name = ? ORDER BY id = ? DESC LIMIT 1", id, key, id)
+	} else {
+		row = db.QueryRow("SELECT id, name, port, location, created_at FROM devices WHERE name = ?", key)
+	}
+	if err := row.Scan(&device.ID, &device.Name, &port, &location, &device.CreatedAt); err != nil {
+		return Device{}, err
+	}
+	device.Port = port.String
+	device.Location = location.String
+
+	return device, nil
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"database/sql"
+	"os"
+	"testing"
+)
+
+func TestParseDeviceSpec(t *testing.T) {
+	device, err := parseDeviceSpec("name=greenhouse,port=/dev/ttyACM1,location=Back garden,baud=115200")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if device.Name != "greenhouse" || device.Port != "/dev/ttyACM1" || device.Location != "Back garden" || device.Baud != 115200 {
+		t.Errorf("Unexpected device: %+v", device)
+	}
+}
+
+func TestParseDeviceSpec_Errors(t *testing.T) {
+	specs := []string{
+		"port=/dev/ttyACM0",
+		"name=cellar",
+		"name=cellar,port=/dev/ttyACM0,baud=fast",
+		"name=cellar,port=/dev/ttyACM0,color=red",
+		"name=cellar,/dev/ttyACM0",
+	}
+	for _, spec := range specs {
+		if _, err := parseDeviceSpec(spec); err == nil {
+			t.Errorf("Expected error for spec %q", spec)
+		}
+	}
+}
+
+func TestDeviceFlags_Set(t *testing.T) {
+	var flags deviceFlags
+	if err := flags.Set("name=sauna,port=/dev/ttyACM2"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err := flags.Set("name=sauna,port=/dev/ttyACM3"); err == nil {
+		t.Error("Expected error for duplicate device name")
+	}
+	if flags.String() != "sauna" {
+		t.Errorf("Expected 'sauna', got %q", flags.String())
+	}
+}
+
+func TestConfiguredDevices_Default(t *testing.T) {
+	origSpecs := deviceSpecs
+	deviceSpecs = nil
+	defer func() { deviceSpecs = origSpecs }()
+
+	devices := configuredDevices()
+	if len(devices) != 1 {
+		t.Fatalf("Expected 1 device, got %d", len(devices))
+	}
+	if devices[0].Name != defaultDeviceName || devices[0].Port != *portName || devices[0].Baud != *baudRate {
+		t.Errorf("Unexpected default device: %+v", devices[0])
+	}
+}
+
+func TestConfiguredDevices_FromFlags(t *testing.T) {
+	origSpecs := deviceSpecs
+	deviceSpecs = deviceFlags{
+		{Name: "greenhouse", Port: "/dev/ttyACM0"},
+		{Name: "cellar", Port: "/dev/ttyACM1", Baud: 115200},
+	}
+	defer func() { deviceSpecs = origSpecs }()
+
+	devices := configuredDevices()
+	if len(devices) != 2 {
+		t.Fatalf("Expected 2 devices, got %d", len(devices))
+	}
+	if devices[0].Baud != *baudRate {
+		t.Errorf("Expected default baud rate for greenhouse, got %d", devices[0].Baud)
+	}
+	if devices[1].Baud != 115200 {
+		t.Errorf("Expected baud 115200 for cellar, got %d", devices[1].Baud)
+	}
+}
+
+func TestRegisterDevice(t *testing.T) {
+	tmpDB := "test_register_device.db"
+	defer os.Remove(tmpDB)
+
+	db, err := openDatabase(tmpDB)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	device := Device{Name: "greenhouse", Port: "/dev/ttyACM0", Location: "Garden"}
+	if err := registerDevice(db, &device); err != nil {
+		t.Fatalf("Failed to register device: %v", err)
+	}
+	if device.ID == 0 || device.CreatedAt == 0 {
+		t.Errorf("Expected ID and CreatedAt to be set, got %+v", device)
+	}
+
+	// Registering again with a new port keeps the id and updates the port
+	again := Device{Name: "greenhouse", Port: "/dev/ttyACM1", Location: "Garden"}
+	if err := registerDevice(db, &again); err != nil {
+		t.Fatalf("Failed to re-register device: %v", err)
+	}
+	if again.ID != device.ID {
+		t.Errorf("Expected same device id %d, got %d", device.ID, again.ID)
+	}
+
+	found, err := lookupDevice(db, "greenhouse")
+	if err != nil {
+		t.Fatalf("Failed to look up device: %v", err)
+	}
+	if found.Port != "/dev/ttyACM1" {
+		t.Errorf("Expected updated port, got %s", found.Port)
+	}
+}
+
+func TestRegisterDevice_InvalidDB(t *testing.T) {
+	if err := registerDevice(nil, &Device{Name: "x"}); err == nil {
+		t.Error("Expected error when registering with nil DB, got nil")
+	}
+}
+
+func TestLookupDevice(t *testing.T) {
+	tmpDB := "test_lookup_device.db"
+	defer os.Remove(tmpDB)
+
+	db, err := openDatabase(tmpDB)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	device := Device{Name: "cellar", Port: "/dev/ttyACM1"}
+	if err := registerDevice(db, &device); err != nil {
+		t.Fatalf("Failed to register device: %v", err)
+	}
+
+	byID, err := lookupDevice(db, "1")
+	if err != nil || byID.Name != "cellar" {
+		t.Errorf("Expected to find cellar by id, got %+v, %v", byID, err)
+	}
+
+	if _, err := lookupDevice(db, "sauna"); err != sql.ErrNoRows {
+		t.Errorf("Expected sql.ErrNoRows for unknown device, got %v", err)
+	}
+}
+
+func TestParseDeviceSpec_USBSelectors(t *testing.T) {
+	device, err := parseDeviceSpec("name=cellar,vid=2341,pid=0043,serial=75833353035351A0E1B1")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if device.Port != "" || device.VID != "2341" || device.PID != "0043" || device.SerialNumber != "75833353035351A0E1B1" {
+		t.Errorf("Unexpected device: %+v", device)
+	}
+	if device.portSpec() != "usb vid=2341 pid=0043 serial=75833353035351A0E1B1" {
+		t.Errorf("Unexpected port spec: %q", device.portSpec())
+	}
+
+	auto, err := parseDeviceSpec("name=sauna,port=auto,vid=1a86")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !auto.autoDetect() || auto.portSpec() != "auto usb vid=1a86" {
+		t.Errorf("Unexpected auto device: %+v (%s)", auto, auto.portSpec())
+	}
+}
+
+func TestConfiguredDevices_USBFlags(t *testing.T) {
+	origSpecs := deviceSpecs
+	origVID := *usbVID
+	deviceSpecs = nil
+	*usbVID = "2341"
+	defer func() {
+		deviceSpecs = origSpecs
+		*usbVID = origVID
+	}()
+
+	devices := configuredDevices()
+	if len(devices) != 1 || devices[0].Port != "" || devices[0].VID != "2341" {
+		t.Errorf("Expected default port to be dropped in favour of the USB selector, got %+v", devices)
+	}
+}
+
+func TestParseDeviceSpec_Framing(t *testing.T) {
+	device, err := parseDeviceSpec("name=cellar,port=/dev/ttyACM1,framing=crc8")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if device.Framing != framingCRC8 {
+		t.Errorf("Expected crc8 framing, got %q", device.Framing)
+	}
+	if _, err := parseDeviceSpec("name=cellar,port=/dev/ttyACM1,framing=nmea"); err == nil {
+		t.Error("Expected error for unknown framing")
+	}
+
+	origSpecs := deviceSpecs
+	deviceSpecs = deviceFlags{device, {Name: "sauna", Port: "/dev/ttyACM2"}}
+	defer func() { deviceSpecs = origSpecs }()
+
+	devices := configuredDevices()
+	if devices[0].Framing != framingCRC8 || devices[1].Framing != *lineFraming {
+		t.Errorf("Expected per-device framing with -framing as default, got %+v", devices)
+	}
+}
+
+func TestParseDeviceSpec_Source(t *testing.T) {
+	device, err := parseDeviceSpec("name=virtual,source=sim")
+	if err != nil {
+		t.Fatalf("Expected simulated device without port, got %v", err)
+	}
+	if !device.simulated() || device.portSpec() != "sim" {
+		t.Errorf("Unexpected simulated device: %+v (%s)", device, device.portSpec())
+	}
+	if _, err := parseDeviceSpec("name=virtual,source=carrier-pigeon"); err == nil {
+		t.Error("Expected error for unknown source")
+	}
+	if _, err := parseDeviceSpec("name=virtual,source=serial"); err == nil {
+		t.Error("Expected serial source to still require a port")
+	}
+}
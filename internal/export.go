@@ -0,0 +1,431 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+const (
+	exportFormatCSV     = "csv"
+	exportFormatJSON    = "json"
+	exportFormatNDJSON  = "ndjson"
+	exportFormatParquet = "parquet"
+	exportFormatInflux  = "influx"
+
+	exportTimeUnix  = "unix"
+	exportTimeISO   = "iso"
+	exportTimeLocal = "local"
+
+	exportTimeLayout = "2006-01-02T15:04:05.000Z07:00"
+)
+
+var (
+	exportFormat = flag.String("export-format", exportFormatCSV, "Format of the -export-csv file: csv, json, ndjson, parquet or influx for InfluxDB line protocol")
+	exportFrom   = flag.String("export-from", "", "Export measurements from this time on, as YYYY-MM-DD, YYYY-MM-DD HH:MM:SS or RFC 3339")
+	exportTo     = flag.String("export-to", "", "Export measurements from before this time, as YYYY-MM-DD, YYYY-MM-DD HH:MM:SS or RFC 3339")
+	exportDevice = flag.String("export-device", "", "Export only the measurements of the device with this name")
+	exportTime   = flag.String("export-time", exportTimeUnix, "Timestamps in csv and json exports: unix for Unix milliseconds, iso for ISO 8601 in UTC, or local for ISO 8601 in local time")
+)
+
+// exportColumns are the fixed columns of an export, followed by one column
+// per extra metric.
+var exportColumns = []string{
+	"timestamp",
+	"device",
+	"temperature",
+	"humidity",
+	"city",
+	"weather_temp",
+	"weather_humidity",
+	"wind_speed",
+	"wind_deg",
+	"clouds",
+	"weather_code",
+	"weather_description",
+}
+
+// exportMetricPrefix starts the column of an extra metric named like a fixed
+// column, e.g. a wind_speed sensor next to the weather's wind_speed. Metrics
+// whose name already starts with it get it too, so every column maps back to
+// its metric.
+const exportMetricPrefix = "metric_"
+
+// exportMetricColumn returns the column name of an extra metric.
+func exportMetricColumn(metric string) string {
+	if strings.HasPrefix(metric, exportMetricPrefix) || slices.Contains(exportColumns, metric) {
+		return exportMetricPrefix + metric
+	}
+	return metric
+}
+
+// exportColumnMetric returns the extra metric of a column written by
+// exportMetricColumn.
+func exportColumnMetric(column string) string {
+	return strings.TrimPrefix(column, exportMetricPrefix)
+}
+
+// exportFilter selects the measurements to export. Zero values select all.
+type exportFilter struct {
+	from, to int64 // Unix milliseconds, to excluded
+	device   string
+}
+
+// exportOptions are the settings of an export. The zero value writes CSV
+// with Unix millisecond timestamps.
+type exportOptions struct {
+	format     string
+	timeFormat string
+	filter     exportFilter
+}
+
+// exportOptionsFromFlags checks and collects the -export-* flags.
+func exportOptionsFromFlags() (exportOptions, error) {
+	options := exportOptions{format: *exportFormat, timeFormat: *exportTime, filter: exportFilter{device: *exportDevice}}
+	switch options.format {
+	case exportFormatCSV, exportFormatJSON, exportFormatNDJSON, exportFormatParquet, exportFormatInflux:
+	default:
+		return options, fmt.Errorf("invalid -export-format %q, expected csv, json, ndjson, parquet or influx", options.format)
+	}
+	switch options.timeFormat {
+	case exportTimeUnix, exportTimeISO, exportTimeLocal:
+	default:
+		return options, fmt.Errorf("invalid -export-time %q, expected unix, iso or local", options.timeFormat)
+	}
+
+	var err error
+	if *exportFrom != "" {
+		if options.filter.from, err = parseCalibrationTime(*exportFrom); err != nil {
+			return options, fmt.Errorf("invalid -export-from: %w", err)
+		}
+	}
+	if *exportTo != "" {
+		if options.filter.to, err = parseCalibrationTime(*exportTo); err != nil {
+			return options, fmt.Errorf("invalid -export-to: %w", err)
+		}
+		if options.filter.to <= options.filter.from {
+			return options, fmt.Errorf("-export-to %s is not after -export-from", *exportTo)
+		}
+	}
+	return options, nil
+}
+
+// exportRow is a measurement as selected for an export: the columns of
+// exportColumns, the time of its weather, then the value of each extra
+// metric.
+type exportRow struct {
+	ts          int64
+	device      sql.NullString
+	temp, hum   sql.NullFloat64
+	city        sql.NullString
+	wTemp       sql.NullFloat64
+	wHum        sql.NullInt64
+	windSpeed   sql.NullFloat64
+	windDeg     sql.NullInt64
+	clouds      sql.NullInt64
+	weatherCode sql.NullInt64
+	description sql.NullString
+	weatherTS   sql.NullInt64 // when the weather was fetched, not a column
+	metrics     []sql.NullFloat64
+}
+
+func (row *exportRow) dest() []any {
+	dest := []any{&row.ts, &row.device, &row.temp, &row.hum, &row.city, &row.wTemp, &row.wHum, &row.windSpeed, &row.windDeg, &row.clouds, &row.weatherCode, &row.description, &row.weatherTS}
+	for i := range row.metrics {
+		dest = append(dest, &row.metrics[i])
+	}
+	return dest
+}
+
+// values returns the fixed columns followed by the metrics, nil for NULLs
+// and float64, int64 or string otherwise.
+func (row *exportRow) values() []any {
+	values := []any{row.ts, nullString(row.device), nullFloat(row.temp), nullFloat(row.hum), nullString(row.city),
+		nullFloat(row.wTemp), nullInt(row.wHum), nullFloat(row.windSpeed), nullInt(row.windDeg), nullInt(row.clouds),
+		nullInt(row.weatherCode), nullString(row.description)}
+	for _, value := range row.metrics {
+		values = append(values, nullFloat(value))
+	}
+	return values
+}
+
+func nullString(s sql.NullString) any {
+	if !s.Valid {
+		return nil
+	}
+	return s.String
+}
+
+func nullFloat(f sql.NullFloat64) any {
+	if !f.Valid {
+		return nil
+	}
+	return f.Float64
+}
+
+func nullInt(i sql.NullInt64) any {
+	if !i.Valid {
+		return nil
+	}
+	return i.Int64
+}
+
+// exportWriter writes the rows a storage selects for an export. Storages
+// call begin once with the extra metrics, before the rows.
+type exportWriter interface {
+	begin(metrics []string) error
+	write(row *exportRow) error
+	end() error
+}
+
+func newExportWriter(w io.Writer, options exportOptions) exportWriter {
+	switch options.format {
+	case exportFormatJSON, exportFormatNDJSON:
+		return &jsonExportWriter{w: w, timeFormat: options.timeFormat, array: options.format == exportFormatJSON}
+	case exportFormatParquet:
+		return &parquetExportWriter{w: w}
+	case exportFormatInflux:
+		return &influxExportWriter{w: w}
+	default:
+		return &csvExportWriter{w: csv.NewWriter(w), timeFormat: options.timeFormat}
+	}
+}
+
+// formatExportTime formats Unix milliseconds as unix, iso or local.
+func formatExportTime(ms int64, timeFormat string) string {
+	switch timeFormat {
+	case exportTimeISO:
+		return time.UnixMilli(ms).UTC().Format(exportTimeLayout)
+	case exportTimeLocal:
+		return time.UnixMilli(ms).Local().Format(exportTimeLayout)
+	default:
+		return strconv.FormatInt(ms, 10)
+	}
+}
+
+// csvExportWriter writes a header line and a line per measurement, with
+// empty cells for NULLs and numbers at full precision.
+type csvExportWriter struct {
+	w          *csv.Writer
+	timeFormat string
+	record     []string
+}
+
+func (c *csvExportWriter) begin(metrics []string) error {
+	header := append([]string{}, exportColumns...)
+	for _, metric := range metrics {
+		header = append(header, exportMetricColumn(metric))
+	}
+	return c.w.Write(header)
+}
+
+func (c *csvExportWriter) write(row *exportRow) error {
+	c.record = c.record[:0]
+	for i, value := range row.values() {
+		cell := ""
+		switch value := value.(type) {
+		case float64:
+			cell = strconv.FormatFloat(value, 'f', -1, 64)
+		case int64:
+			if i == 0 {
+				cell = formatExportTime(value, c.timeFormat)
+			} else {
+				cell = strconv.FormatInt(value, 10)
+			}
+		case string:
+			cell = value
+		}
+		c.record = append(c.record, cell)
+	}
+	return c.w.Write(c.record)
+}
+
+func (c *csvExportWriter) end() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// jsonExportWriter writes an object per measurement, with the fixed
+// columns in order, null when missing, and the metrics it has under
+// "metrics". As json the objects form an array, as ndjson they are lines.
+type jsonExportWriter struct {
+	w          io.Writer
+	timeFormat string
+	array      bool
+	metrics    []string
+	rows       int // written so far
+}
+
+func (j *jsonExportWriter) begin(metrics []string) error {
+	j.metrics = metrics
+	if j.array {
+		_, err := io.WriteString(j.w, "[")
+		return err
+	}
+	return nil
+}
+
+func (j *jsonExportWriter) write(row *exportRow) error {
+	values := row.values()
+	object := []byte{'{'}
+	for i, column := range exportColumns {
+		value := values[i]
+		if i == 0 && (j.timeFormat == exportTimeISO || j.timeFormat == exportTimeLocal) {
+			value = formatExportTime(row.ts, j.timeFormat)
+		}
+		if i > 0 {
+			object = append(object, ',')
+		}
+		object = appendJSONField(object, column, value)
+	}
+	hasMetrics := false
+	for i, metric := range j.metrics {
+		value := values[len(exportColumns)+i]
+		if value == nil {
+			continue
+		}
+		if hasMetrics {
+			object = append(object, ',')
+		} else {
+			object = append(object, `,"metrics":{`...)
+			hasMetrics = true
+		}
+		object = appendJSONField(object, metric, value)
+	}
+	if hasMetrics {
+		object = append(object, '}')
+	}
+	object = append(object, '}')
+
+	line := string(object) + "\n"
+	if j.array {
+		line = "\n" + string(object)
+		if j.rows > 0 {
+			line = "," + line
+		}
+	}
+	j.rows++
+	_, err := io.WriteString(j.w, line)
+	return err
+}
+
+// appendJSONField appends "name":value to object.
+func appendJSONField(object []byte, name string, value any) []byte {
+	key, _ := json.Marshal(name)
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		encoded = []byte("null") // NaN and infinities
+	}
+	return append(append(append(object, key...), ':'), encoded...)
+}
+
+func (j *jsonExportWriter) end() error {
+	if j.array {
+		_, err := io.WriteString(j.w, "\n]\n")
+		return err
+	}
+	return nil
+}
+
+// parquetExportWriter writes a Parquet file with a UTC millisecond
+// timestamp column and an optional column for every other field.
+type parquetExportWriter struct {
+	w       io.Writer
+	writer  *parquet.Writer
+	columns []int // the parquet column of each exportRow value
+	row     parquet.Row
+}
+
+func (p *parquetExportWriter) begin(metrics []string) error {
+	fields := parquet.Group{"timestamp": parquet.Timestamp(parquet.Millisecond)}
+	for _, column := range []string{"device", "city", "weather_description"} {
+		fields[column] = parquet.Optional(parquet.String())
+	}
+	for _, column := range []string{"temperature", "humidity", "weather_temp", "wind_speed"} {
+		fields[column] = parquet.Optional(parquet.Leaf(parquet.DoubleType))
+	}
+	for _, column := range []string{"weather_humidity", "wind_deg", "clouds", "weather_code"} {
+		fields[column] = parquet.Optional(parquet.Int(64))
+	}
+	names := append([]string{}, exportColumns...)
+	for _, metric := range metrics {
+		column := exportMetricColumn(metric)
+		fields[column] = parquet.Optional(parquet.Leaf(parquet.DoubleType))
+		names = append(names, column)
+	}
+	schema := parquet.NewSchema("measurement", fields)
+
+	index := make(map[string]int)
+	for i, path := range schema.Columns() {
+		index[path[0]] = i
+	}
+	p.columns = p.columns[:0]
+	for _, name := range names {
+		p.columns = append(p.columns, index[name])
+	}
+	p.row = make(parquet.Row, len(index))
+	p.writer = parquet.NewWriter(p.w, schema, parquet.Compression(&parquet.Snappy), parquet.MaxRowsPerRowGroup(100_000))
+	return nil
+}
+
+func (p *parquetExportWriter) write(row *exportRow) error {
+	for i, value := range row.values() {
+		column := p.columns[i]
+		switch {
+		case i == 0:
+			p.row[column] = parquet.ValueOf(value).Level(0, 0, column)
+		case value == nil:
+			p.row[column] = parquet.NullValue().Level(0, 0, column)
+		default:
+			p.row[column] = parquet.ValueOf(value).Level(0, 1, column)
+		}
+	}
+	_, err := p.writer.WriteRows([]parquet.Row{p.row})
+	return err
+}
+
+func (p *parquetExportWriter) end() error {
+	return p.writer.Close()
+}
+
+// exportMeasurements writes the measurements of s selected by options to
+// filename, or to standard output for "-". Rows are written as they are
+// read, so exports of any size take little memory.
+func exportMeasurements(s Storage, filename string, options exportOptions) error {
+	out := os.Stdout
+	if filename != "-" {
+		file, err := os.Create(filename)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+
+	buffered := bufio.NewWriter(out)
+	w := newExportWriter(buffered, options)
+	if err := s.Export(options.filter, w); err != nil {
+		return err
+	}
+	if err := w.end(); err != nil {
+		return err
+	}
+	if err := buffered.Flush(); err != nil {
+		return err
+	}
+	if filename != "-" {
+		return out.Close()
+	}
+	return nil
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// openExportTestDB returns a database with measurements of two devices,
+// the first with weather and a lux reading.
+func openExportTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, greenhouse := openCalibrationTestDB(t, filepath.Join(t.TempDir(), "export.db"))
+	cellar := Device{Name: "cellar", Port: "/dev/ttyACM1"}
+	if err := registerDevice(db, &cellar); err != nil {
+		t.Fatalf("Failed to register device: %v", err)
+	}
+
+	weather := Weather{Name: "Umeå, Västerbotten"}
+	weather.Main.Temp = 4.5
+	weather.Main.Humidity = 90
+	weather.Weather = append(weather.Weather, struct {
+		ID          int    `json:"id"`
+		Main        string `json:"main"`
+		Description string `json:"description"`
+	}{ID: 500, Description: `light "rain"`})
+	insertWeather(db, weather, rollupTestBase)
+	insertMeasurement(db, Measurement{DeviceID: greenhouse.ID, TemperatureCelsius: 20.25, HumidityPercentage: 50, Metrics: map[string]float64{"lux": 120.5}}, rollupTestBase+1000)
+	insertMeasurement(db, Measurement{DeviceID: cellar.ID, TemperatureCelsius: 4, HumidityPercentage: 80}, rollupTestBase+2000)
+	insertMeasurement(db, Measurement{DeviceID: greenhouse.ID, TemperatureCelsius: 21, HumidityPercentage: 51}, rollupTestBase+3000)
+	return db
+}
+
+func exportToString(t *testing.T, db *sql.DB, options exportOptions) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "export")
+	if err := exportMeasurements(sqliteStorage{db}, file, options); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	data, _ := os.ReadFile(file)
+	return string(data)
+}
+
+func TestExportMeasurements_CSV(t *testing.T) {
+	db := openExportTestDB(t)
+
+	lines := strings.Split(exportToString(t, db, exportOptions{}), "\n")
+	if len(lines) != 5 || lines[0] != strings.Join(exportColumns, ",")+",lux" {
+		t.Fatalf("Unexpected export %q", lines)
+	}
+	// Cells with commas and quotes are quoted, NULLs are empty
+	expected := `1700006401000,greenhouse,20.25,50,"Umeå, Västerbotten",4.5,90,0,0,0,500,"light ""rain""",120.5`
+	if lines[1] != expected {
+		t.Errorf("Expected %q, got %q", expected, lines[1])
+	}
+	if !strings.HasSuffix(lines[2], `,500,"light ""rain""",`) {
+		t.Errorf("Expected an empty lux cell, got %q", lines[2])
+	}
+}
+
+func TestExportMeasurements_Filter(t *testing.T) {
+	db := openExportTestDB(t)
+	tests := []struct {
+		filter exportFilter
+		rows   int
+	}{
+		{exportFilter{}, 3},
+		{exportFilter{from: rollupTestBase + 2000}, 2},
+		{exportFilter{to: rollupTestBase + 3000}, 2},
+		{exportFilter{from: rollupTestBase + 2000, to: rollupTestBase + 3000}, 1},
+		{exportFilter{device: "greenhouse"}, 2},
+		{exportFilter{device: "cellar", from: rollupTestBase + 3000}, 0},
+		{exportFilter{device: "attic"}, 0},
+	}
+	for _, test := range tests {
+		data := exportToString(t, db, exportOptions{filter: test.filter})
+		if rows := strings.Count(data, "\n") - 1; rows != test.rows {
+			t.Errorf("Expected %d rows for %+v, got %q", test.rows, test.filter, data)
+		}
+	}
+}
+
+func TestExportMeasurements_TimeFormats(t *testing.T) {
+	db := openExportTestDB(t)
+	origLocal := time.Local
+	time.Local = time.FixedZone("EET", 2*3600)
+	defer func() { time.Local = origLocal }()
+
+	iso := exportToString(t, db, exportOptions{timeFormat: exportTimeISO})
+	if !strings.Contains(iso, "\n2023-11-15T00:00:01.000Z,greenhouse,") {
+		t.Errorf("Expected ISO timestamps in UTC, got %q", iso)
+	}
+	local := exportToString(t, db, exportOptions{timeFormat: exportTimeLocal, format: exportFormatNDJSON})
+	if !strings.HasPrefix(local, `{"timestamp":"2023-11-15T02:00:01.000+02:00","device":"greenhouse",`) {
+		t.Errorf("Expected local ISO timestamps, got %q", local)
+	}
+}
+
+func TestExportMeasurements_JSON(t *testing.T) {
+	db := openExportTestDB(t)
+
+	data := exportToString(t, db, exportOptions{format: exportFormatJSON})
+	var rows []map[string]any
+	if err := json.Unmarshal([]byte(data), &rows); err != nil {
+		t.Fatalf("Expected a JSON array, got %v: %q", err, data)
+	}
+	if len(rows) != 3 || rows[0]["timestamp"] != float64(rollupTestBase+1000) || rows[0]["city"] != "Umeå, Västerbotten" {
+		t.Fatalf("Unexpected rows %+v", rows)
+	}
+	if metrics, ok := rows[0]["metrics"].(map[string]any); !ok || metrics["lux"] != 120.5 {
+		t.Errorf("Expected the lux reading under metrics, got %+v", rows[0])
+	}
+	if _, ok := rows[1]["metrics"]; ok || rows[1]["device"] != "cellar" {
+		t.Errorf("Expected no metrics for the cellar, got %+v", rows[1])
+	}
+
+	empty := exportToString(t, openEmptyExportTestDB(t), exportOptions{format: exportFormatJSON})
+	if err := json.Unmarshal([]byte(empty), &rows); err != nil || len(rows) != 0 {
+		t.Errorf("Expected an empty array, got %q", empty)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(exportToString(t, db, exportOptions{format: exportFormatNDJSON}), "\n"), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("Expected a line per measurement, got %q", lines)
+	}
+	var row map[string]any
+	if err := json.Unmarshal([]byte(lines[2]), &row); err != nil || row["temperature"] != 21.0 || row["wind_speed"] != 0.0 {
+		t.Errorf("Unexpected line %q, %v", lines[2], err)
+	}
+}
+
+// openEmptyExportTestDB returns an empty database.
+func openEmptyExportTestDB(t *testing.T) *sql.DB {
+	db, _ := openCalibrationTestDB(t, filepath.Join(t.TempDir(), "empty.db"))
+	return db
+}
+
+func TestExportMeasurements_Parquet(t *testing.T) {
+	db := openExportTestDB(t)
+	data := exportToString(t, db, exportOptions{format: exportFormatParquet})
+
+	type parquetRow struct {
+		Timestamp   time.Time `parquet:"timestamp,timestamp(millisecond)"`
+		Device      *string   `parquet:"device,optional"`
+		Temperature *float64  `parquet:"temperature,optional"`
+		City        *string   `parquet:"city,optional"`
+		WeatherCode *int64    `parquet:"weather_code,optional"`
+		Lux         *float64  `parquet:"lux,optional"`
+	}
+	rows, err := parquet.Read[parquetRow](bytes.NewReader([]byte(data)), int64(len(data)))
+	if err != nil || len(rows) != 3 {
+		t.Fatalf("Expected 3 rows, got %+v, %v", rows, err)
+	}
+	first := rows[0]
+	if first.Timestamp.UnixMilli() != rollupTestBase+1000 || *first.Device != "greenhouse" || *first.Temperature != 20.25 ||
+		*first.City != "Umeå, Västerbotten" || *first.WeatherCode != 500 || *first.Lux != 120.5 {
+		t.Errorf("Unexpected first row %+v", first)
+	}
+	if rows[1].Lux != nil || *rows[1].Device != "cellar" {
+		t.Errorf("Expected no lux for the cellar, got %+v", rows[1])
+	}
+}
+
+func TestExportMeasurements_MetricNamedLikeColumn(t *testing.T) {
+	db := openExportTestDB(t)
+	cellar, _ := lookupDevice(db, "cellar")
+	insertMeasurement(db, Measurement{DeviceID: cellar.ID, TemperatureCelsius: 5, Metrics: map[string]float64{"wind_speed": 3.5, "metric_x": 1}}, rollupTestBase+4000)
+
+	lines := strings.Split(exportToString(t, db, exportOptions{}), "\n")
+	if lines[0] != strings.Join(exportColumns, ",")+",lux,metric_metric_x,metric_wind_speed" || !strings.HasSuffix(lines[4], ",,1,3.5") {
+		t.Errorf("Expected prefixed metric columns, got %q", lines)
+	}
+
+	data := exportToString(t, db, exportOptions{format: exportFormatParquet})
+	type parquetRow struct {
+		WindSpeed       *float64 `parquet:"wind_speed,optional"`
+		MetricWindSpeed *float64 `parquet:"metric_wind_speed,optional"`
+	}
+	rows, err := parquet.Read[parquetRow](bytes.NewReader([]byte(data)), int64(len(data)))
+	if err != nil || len(rows) != 4 || rows[3].MetricWindSpeed == nil || *rows[3].MetricWindSpeed != 3.5 || *rows[3].WindSpeed != 0 {
+		t.Errorf("Expected the metric apart from the weather column, got %+v, %v", rows, err)
+	}
+
+	influx := exportToString(t, db, exportOptions{format: exportFormatInflux})
+	if !strings.Contains(influx, "metric_wind_speed=3.5") {
+		t.Errorf("Expected the prefixed field in line protocol, got %q", influx)
+	}
+
+	for column, metric := range map[string]string{"metric_wind_speed": "wind_speed", "metric_metric_x": "metric_x", "lux": "lux"} {
+		if field := (importMapping{}).field(column); field != metric {
+			t.Errorf("Expected column %s to import as %s, got %q", column, metric, field)
+		}
+	}
+}
+
+func TestExportOptionsFromFlags(t *testing.T) {
+	orig := []string{*exportFormat, *exportFrom, *exportTo, *exportDevice, *exportTime}
+	defer func() {
+		*exportFormat, *exportFrom, *exportTo, *exportDevice, *exportTime = orig[0], orig[1], orig[2], orig[3], orig[4]
+	}()
+
+	*exportFormat, *exportFrom, *exportTo, *exportDevice, *exportTime = "ndjson", "2026-01-01", "2026-02-01T00:00:00Z", "greenhouse", "iso"
+	options, err := exportOptionsFromFlags()
+	from, _ := parseCalibrationTime("2026-01-01")
+	if err != nil || options.format != exportFormatNDJSON || options.timeFormat != exportTimeISO ||
+		options.filter != (exportFilter{from: from, to: 1769904000000, device: "greenhouse"}) {
+		t.Errorf("Unexpected options %+v, %v", options, err)
+	}
+
+	invalid := []struct{ format, from, to, timeFormat, message string }{
+		{"xml", "", "", "unix", "invalid -export-format"},
+		{"csv", "", "", "epoch", "invalid -export-time"},
+		{"csv", "yesterday", "", "unix", "invalid -export-from"},
+		{"csv", "", "tomorrow", "unix", "invalid -export-to"},
+		{"csv", "2026-02-01", "2026-01-01", "unix", "is not after -export-from"},
+	}
+	for _, test := range invalid {
+		*exportFormat, *exportFrom, *exportTo, *exportTime = test.format, test.from, test.to, test.timeFormat
+		if _, err := exportOptionsFromFlags(); err == nil || !strings.Contains(err.Error(), test.message) {
+			t.Errorf("Expected %q for %+v, got %v", test.message, test, err)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	framingNone = "none"
+	framingCRC8 = "crc8"
+)
+
+var errFrameCorrupt = errors.New("corrupt frame")
+
+var decodeFrame = decodeFrameImpl
+
+func validateFraming(framing string) error {
+	switch framing {
+	case framingNone, framingCRC8:
+		return nil
+	}
+	return fmt.Errorf("unknown framing %q, expected %s or %s", framing, framingNone, framingCRC8)
+}
+
+// crc8 computes CRC-8/SMBUS (polynomial 0x07, initial value 0) of data.
+func crc8(data []byte) byte {
+	var crc byte
+	for _, b := range data {
+		crc ^= b
+		for range 8 {
+			if crc&0x80 != 0 {
+				crc = crc<<1 ^ 0x07
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// encodeFrame wraps a payload as $<payload>*<crc8 as two hex digits>.
+func encodeFrame(payload string) string {
+	return fmt.Sprintf("$%s*%02X", payload, crc8([]byte(payload)))
+}
+
+// decodeFrameImpl checks a $<payload>*<crc8> frame, similar to NMEA
+// sentences, and returns the payload. Anything that is not a complete frame
+// with a matching checksum, such as a line garbled while the USB link comes
+// up, wraps errFrameCorrupt.
+func decodeFrameImpl(line string) (string, error) {
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, "$") {
+		return "", fmt.Errorf("%w: missing start marker", errFrameCorrupt)
+	}
+	star := strings.LastIndexByte(line, '*')
+	if star < 0 || len(line)-star-1 != 2 {
+		return "", fmt.Errorf("%w: missing checksum", errFrameCorrupt)
+	}
+
+	payload := line[1:star]
+	checksum, err := strconv.ParseUint(line[star+1:], 16, 8)
+	if err != nil {
+		return "", fmt.Errorf("%w: invalid checksum %q", errFrameCorrupt, line[star+1:])
+	}
+	if expected := crc8([]byte(payload)); byte(checksum) != expected {
+		return "", fmt.Errorf("%w: checksum %02X, expected %02X", errFrameCorrupt, checksum, expected)
+	}
+
+	return payload, nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestCRC8(t *testing.T) {
+	// Standard check value for CRC-8/SMBUS
+	if crc := crc8([]byte("123456789")); crc != 0xF4 {
+		t.Errorf("Expected 0xF4, got 0x%02X", crc)
+	}
+}
+
+func TestEncodeDecodeFrame(t *testing.T) {
+	payload := `{"temperature_celcius":21.5,"humidity":40.1}`
+	frame := encodeFrame(payload)
+	if frame[0] != '$' || frame[len(frame)-3] != '*' {
+		t.Fatalf("Unexpected frame %q", frame)
+	}
+
+	decoded, err := decodeFrame(frame + "\r")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if decoded != payload {
+		t.Errorf("Expected %q, got %q", payload, decoded)
+	}
+}
+
+func TestDecodeFrame_LowercaseChecksum(t *testing.T) {
+	payload := `{"lux":12}`
+	frame := fmt.Sprintf("$%s*%02x", payload, crc8([]byte(payload)))
+	if _, err := decodeFrame(frame); err != nil {
+		t.Errorf("Expected lowercase checksum to be accepted, got %v", err)
+	}
+}
+
+func TestDecodeFrame_Corrupt(t *testing.T) {
+	good := encodeFrame(`{"temperature_celcius":21.5}`)
+	frames := []string{
+		`{"temperature_celcius":21.5}`,
+		"\x00\xfe" + good,
+		good[:len(good)-3],
+		good[:len(good)-1],
+		good[:len(good)-2] + "ZZ",
+		`$` + `{"temperature_celcius":29.5}` + good[len(good)-3:],
+	}
+	for _, frame := range frames {
+		if _, err := decodeFrame(frame); !errors.Is(err, errFrameCorrupt) {
+			t.Errorf("Expected corrupt frame error for %q, got %v", frame, err)
+		}
+	}
+}
+
+func TestValidateFraming(t *testing.T) {
+	for _, framing := range []string{framingNone, framingCRC8} {
+		if err := validateFraming(framing); err != nil {
+			t.Errorf("Expected %s to be valid, got %v", framing, err)
+		}
+	}
+	if err := validateFraming("nmea"); err == nil {
+		t.Error("Expected error for unknown framing")
+	}
+}
@@ -0,0 +1,550 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	importUsage = "import [-format csv|ndjson] [-default-device NAME] [-map COLUMN=FIELD,...] [-batch-size N] [-dry-run] <file|->"
+
+	importFormatCSV    = "csv"
+	importFormatNDJSON = "ndjson"
+
+	importMaxLoggedErrors = 10
+)
+
+// importColumnAliases are the column names understood without -map, in
+// lower case, by the field they are stored as.
+var importColumnAliases = map[string]string{
+	"timestamp":           "timestamp",
+	"time":                "timestamp",
+	"datetime":            "timestamp",
+	"date":                "timestamp",
+	"device":              "device",
+	"device_name":         "device",
+	"temperature":         temperatureField,
+	"temperature_celcius": temperatureField,
+	"temperature_celsius": temperatureField,
+	"temp":                temperatureField,
+	"humidity":            humidityField,
+	"humidity_percentage": humidityField,
+	"rh":                  humidityField,
+}
+
+// importTimeLayouts are the timestamp formats accepted besides Unix time.
+// Times without a zone are local.
+var importTimeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04",
+	"2006/01/02 15:04:05",
+}
+
+// importMapping maps column names of the file to fields, given with -map
+// as COLUMN=FIELD pairs. A field of - ignores the column.
+type importMapping map[string]string
+
+func (m importMapping) String() string {
+	pairs := make([]string, 0, len(m))
+	for column, field := range m {
+		pairs = append(pairs, column+"="+field)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (m importMapping) Set(value string) error {
+	for _, pair := range strings.Split(value, ",") {
+		column, field, ok := strings.Cut(pair, "=")
+		column, field = strings.TrimSpace(column), strings.TrimSpace(field)
+		if !ok || column == "" || field == "" {
+			return fmt.Errorf("invalid mapping %q, expected COLUMN=FIELD", pair)
+		}
+		if target, ok := importColumnAliases[strings.ToLower(field)]; ok {
+			field = target
+		} else if field != "-" && !validMetricName(field) {
+			return fmt.Errorf("invalid field %q for column %s", field, column)
+		}
+		m[column] = field
+	}
+	return nil
+}
+
+// field returns what a column is stored as: timestamp, device, a metric
+// name, or "" when it is ignored.
+func (m importMapping) field(column string) string {
+	if field, ok := m[column]; ok {
+		if field == "-" {
+			return ""
+		}
+		return field
+	}
+	if strings.HasPrefix(column, exportMetricPrefix) {
+		if metric := exportColumnMetric(column); validMetricName(metric) {
+			return metric
+		}
+	}
+	if field, ok := importColumnAliases[strings.ToLower(column)]; ok {
+		return field
+	}
+	if replaySkippedColumns[column] || !validMetricName(column) {
+		return ""
+	}
+	return column
+}
+
+// importStats counts the rows of an import by outcome.
+type importStats struct {
+	imported, duplicates, invalid int
+}
+
+// importer stores parsed rows in batches, one transaction each.
+type importer struct {
+	db            *sql.DB
+	defaultDevice string
+	batchSize     int
+	dryRun        bool
+	devices       map[string]int64 // device IDs by name
+	batch         []Measurement
+	stats         importStats
+	progress      func(importStats)
+}
+
+// add queues a measurement of the named device, writing the batch once full.
+func (imp *importer) add(m Measurement, device string) error {
+	if device == "" {
+		device = imp.defaultDevice
+	}
+	id, ok := imp.devices[device]
+	if !ok {
+		d, err := lookupDevice(imp.db, device)
+		if errors.Is(err, sql.ErrNoRows) {
+			d = Device{Name: device}
+			if imp.dryRun {
+				d.ID, err = -int64(len(imp.devices)+1), nil // stands in for the rolled back rows
+			} else {
+				err = registerDevice(imp.db, &d)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("device %s: %w", device, err)
+		}
+		id = d.ID
+		imp.devices[device] = id
+	}
+	m.DeviceID = id
+	imp.batch = append(imp.batch, m)
+	if len(imp.batch) >= imp.batchSize {
+		return imp.flush()
+	}
+	return nil
+}
+
+// flush writes the queued measurements in one transaction, skipping those
+// of a device that already has a measurement at the same time. Each is
+// linked to the nearest weather record like a live reading.
+func (imp *importer) flush() error {
+	if len(imp.batch) == 0 {
+		return nil
+	}
+	tx, err := imp.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	imported, duplicates := 0, 0
+	for _, m := range imp.batch {
+		var exists bool
+		err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM measurements WHERE device_id = ? AND timestamp = ?)", m.DeviceID, m.UnixTimestamp).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if exists {
+			duplicates++
+			continue
+		}
+		if err := insertMeasurementTx(tx, m, m.UnixTimestamp); err != nil {
+			return err
+		}
+		imported++
+	}
+	// A dry run rolls back, so duplicates within the file are only found
+	// within a batch
+	if !imp.dryRun {
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+
+	imp.batch = imp.batch[:0]
+	imp.stats.imported += imported
+	imp.stats.duplicates += duplicates
+	if imp.progress != nil {
+		imp.progress(imp.stats)
+	}
+	return nil
+}
+
+// parseImportRow turns the cells of a row, by column name, into a
+// measurement and the name of its device. Empty cells are missing values.
+func parseImportRow(cells map[string]string, mapping importMapping) (Measurement, string, error) {
+	var m Measurement
+	var device string
+	seen := make(map[string]bool)
+	for column, cell := range cells {
+		field := mapping.field(column)
+		if field == "" {
+			continue
+		}
+		cell = strings.TrimSpace(cell)
+		if seen[field] {
+			return m, "", fmt.Errorf("columns mapped to %s twice", field)
+		}
+		if cell == "" {
+			continue
+		}
+		seen[field] = true
+
+		switch field {
+		case "timestamp":
+			timestamp, err := parseImportTimestamp(cell)
+			if err != nil {
+				return m, "", err
+			}
+			m.UnixTimestamp = timestamp
+		case "device":
+			device = cell
+		default:
+			value, err := strconv.ParseFloat(cell, 64)
+			if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+				if field == temperatureField || field == humidityField || mapping[column] != "" {
+					return m, "", fmt.Errorf("%s is not a number: %q", column, cell)
+				}
+				seen[field] = false
+				continue // e.g. a notes column
+			}
+			switch field {
+			case temperatureField:
+				m.TemperatureCelsius = value
+			case humidityField:
+				m.HumidityPercentage = value
+			default:
+				if m.Metrics == nil {
+					m.Metrics = make(map[string]float64)
+				}
+				m.Metrics[field] = value
+			}
+		}
+	}
+
+	if !seen["timestamp"] {
+		return m, "", errors.New("missing timestamp")
+	}
+	if !seen[temperatureField] && !seen[humidityField] && len(m.Metrics) == 0 {
+		return m, "", errors.New("missing a value")
+	}
+	for _, field := range []string{temperatureField, humidityField} {
+		if !seen[field] {
+			m.setMissing(field)
+		}
+	}
+	if m.UnixTimestamp > time.Now().Add(24*time.Hour).UnixMilli() {
+		return m, "", fmt.Errorf("timestamp %s is in the future", time.UnixMilli(m.UnixTimestamp).Format(time.RFC3339))
+	}
+	if seen[humidityField] && (m.HumidityPercentage < 0 || m.HumidityPercentage > 100) {
+		return m, "", fmt.Errorf("humidity %g is not between 0 and 100", m.HumidityPercentage)
+	}
+	if config := validationSettings; config != nil {
+		if r := checkImportRanges(config, device, m); r != nil {
+			return m, "", errors.New(r.Reason)
+		}
+	}
+	m.ReceivedTimestamp = m.UnixTimestamp
+	return m, device, nil
+}
+
+// checkImportRanges applies the range rules of -validation-config. Rate
+// and spike rules need readings in the order they were taken and are left
+// out.
+func checkImportRanges(config *validationConfig, device string, m Measurement) *rejection {
+	fields := m.readings()
+	for _, metric := range sortedMetricNames(fields) {
+		if rule, ok := config.rule(device, metric); ok {
+			if r := checkRange(rule, metric, fields[metric]); r != nil {
+				return r
+			}
+		}
+	}
+	return nil
+}
+
+// parseImportTimestamp parses Unix time, in milliseconds or, below 1e11,
+// in seconds, or a time in one of importTimeLayouts.
+func parseImportTimestamp(s string) (int64, error) {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		if n <= 0 {
+			return 0, fmt.Errorf("invalid timestamp %q", s)
+		}
+		if n < 100_000_000_000 {
+			return n * 1000, nil
+		}
+		return n, nil
+	}
+	for _, layout := range importTimeLayouts {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t.UnixMilli(), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid timestamp %q", s)
+}
+
+// readImportCSV passes each row of a CSV file with a header line to row,
+// by column name, with its line number.
+func readImportCSV(r io.Reader, mapping importMapping, row func(line int, cells map[string]string) error) error {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return fmt.Errorf("failed to read header: %w", err)
+	}
+	header = append([]string{}, header...)
+	header[0] = strings.TrimPrefix(header[0], "\ufeff") // spreadsheets write a byte order mark
+	hasTimestamp, hasValue := false, false
+	for _, column := range header {
+		switch mapping.field(column) {
+		case "", "device":
+		case "timestamp":
+			hasTimestamp = true
+		default:
+			hasValue = true
+		}
+	}
+	if !hasTimestamp {
+		return fmt.Errorf("no timestamp column in %s, map one with -map COLUMN=timestamp", strings.Join(header, ","))
+	}
+	if !hasValue {
+		return fmt.Errorf("no value column in %s, map one with -map COLUMN=temperature", strings.Join(header, ","))
+	}
+
+	cells := make(map[string]string, len(header))
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			var parseErr *csv.ParseError
+			if !errors.As(err, &parseErr) {
+				return err
+			}
+			if err := row(parseErr.Line, nil); err != nil {
+				return err
+			}
+			continue
+		}
+		line, _ := reader.FieldPos(0)
+		clear(cells)
+		for i, column := range header {
+			if i < len(record) {
+				cells[column] = record[i]
+			}
+		}
+		if err := row(line, cells); err != nil {
+			return err
+		}
+	}
+}
+
+// readImportNDJSON passes each line of a JSON object per line to row, by
+// field name. An object under "metrics", as written by -export-format
+// ndjson, is read as fields of its own. Invalid lines are passed as nil.
+func readImportNDJSON(r io.Reader, row func(line int, cells map[string]string) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		var object map[string]any
+		decoder := json.NewDecoder(strings.NewReader(text))
+		decoder.UseNumber()
+		if err := decoder.Decode(&object); err != nil {
+			if err := row(line, nil); err != nil {
+				return err
+			}
+			continue
+		}
+		cells := make(map[string]string, len(object))
+		for name, value := range object {
+			if metrics, ok := value.(map[string]any); ok && name == "metrics" {
+				for metric, value := range metrics {
+					cells[metric] = jsonCell(value)
+				}
+				continue
+			}
+			cells[name] = jsonCell(value)
+		}
+		if err := row(line, cells); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// jsonCell returns a decoded JSON value as a cell, "" for null.
+func jsonCell(value any) string {
+	switch value := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return value
+	case json.Number:
+		return value.String()
+	default:
+		return fmt.Sprint(value)
+	}
+}
+
+// countingReader counts the bytes read through it, for progress reports.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// runImportCommand implements the import subcommand.
+func runImportCommand(args []string) error {
+	fs := newSubcommandFlagSet("import", importUsage)
+	format := fs.String("format", importFormatCSV, "Format of the file: csv with a header line, or ndjson")
+	device := fs.String("default-device", defaultDeviceName, "Device of the rows without a device, created if missing")
+	batchSize := fs.Int("batch-size", 10_000, "Rows written per transaction")
+	dryRun := fs.Bool("dry-run", false, "Check the file and count the rows without storing them")
+	mapping := importMapping{}
+	fs.Var(mapping, "map", "Store column as field, e.g. \"Temp (°C)=temperature,RH%=humidity\"; a field of - ignores the column")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("file is required")
+	}
+	if *format != importFormatCSV && *format != importFormatNDJSON {
+		return fmt.Errorf("invalid -format %q, expected csv or ndjson", *format)
+	}
+	if *batchSize < 1 {
+		return errors.New("-batch-size must be at least 1")
+	}
+	if *dbDriver != driverSQLite {
+		return fmt.Errorf("import writes to -db, not supported with -db-driver %s", *dbDriver)
+	}
+	if *validationConfigFile != "" {
+		config, err := loadValidationConfig(*validationConfigFile)
+		if err != nil {
+			return err
+		}
+		validationSettings = config
+	}
+
+	in := os.Stdin
+	var size int64
+	if fs.Arg(0) != "-" {
+		file, err := os.Open(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		if info, err := file.Stat(); err == nil {
+			size = info.Size()
+		}
+		in = file
+	}
+
+	var db *sql.DB
+	var err error
+	if *dryRun {
+		// A dry run must not change the database, migrations included
+		db, err = connectDatabase(*dbFileName)
+		if err == nil {
+			if err = checkSchemaVersion(db); err != nil {
+				db.Close()
+			}
+		}
+	} else {
+		db, err = openDatabase(*dbFileName)
+	}
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	verb := "Imported"
+	if *dryRun {
+		verb = "Would import"
+	}
+	counter := &countingReader{r: in}
+	imp := &importer{db: db, defaultDevice: *device, batchSize: *batchSize, dryRun: *dryRun, devices: make(map[string]int64)}
+	imp.progress = func(stats importStats) {
+		done := ""
+		if size > 0 {
+			done = fmt.Sprintf(" (%d%%)", counter.n*100/size)
+		}
+		fmt.Printf("%s %d row(s), %d duplicate(s), %d invalid%s\n", verb, stats.imported, stats.duplicates, stats.invalid, done)
+	}
+
+	row := func(line int, cells map[string]string) error {
+		err := errors.New("malformed line")
+		var m Measurement
+		var device string
+		if cells != nil {
+			m, device, err = parseImportRow(cells, mapping)
+		}
+		if err != nil {
+			imp.stats.invalid++
+			if imp.stats.invalid <= importMaxLoggedErrors {
+				logWarn("import: line %d: %v", line, err)
+			}
+			return nil
+		}
+		return imp.add(m, device)
+	}
+	if *format == importFormatNDJSON {
+		err = readImportNDJSON(counter, row)
+	} else {
+		err = readImportCSV(counter, mapping, row)
+	}
+	if err == nil {
+		err = imp.flush()
+	}
+	if err != nil {
+		return err
+	}
+
+	if imp.stats.invalid > importMaxLoggedErrors {
+		logWarn("import: %d more invalid line(s) not shown", imp.stats.invalid-importMaxLoggedErrors)
+	}
+	fmt.Printf("%s %d row(s) from %s, skipped %d duplicate(s) and %d invalid row(s)\n",
+		verb, imp.stats.imported, fs.Arg(0), imp.stats.duplicates, imp.stats.invalid)
+	return nil
+}
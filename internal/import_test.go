@@ -0,0 +1,302 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// runImport runs the import command on the database at path and returns
+// what it printed and the warnings it logged.
+func runImport(t *testing.T, path string, args ...string) (string, []string, error) {
+	t.Helper()
+	origDB, origWarn := *dbFileName, logWarn
+	*dbFileName = path
+	var warnings []string
+	logWarn = func(format string, v ...any) { warnings = append(warnings, fmt.Sprintf(format, v...)) }
+	defer func() { *dbFileName, logWarn = origDB, origWarn }()
+
+	stdout := os.Stdout
+	r, w, _ := os.Pipe()
+	os.Stdout = w
+	err := runImportCommand(args)
+	w.Close()
+	os.Stdout = stdout
+	output, _ := io.ReadAll(r)
+	return string(output), warnings, err
+}
+
+func writeImportFile(t *testing.T, name, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatalf("Failed to write %s: %v", name, err)
+	}
+	return path
+}
+
+func TestRunImportCommand_ExportRoundTrip(t *testing.T) {
+	source := openExportTestDB(t)
+	exported := filepath.Join(t.TempDir(), "export.csv")
+	if err := exportMeasurements(sqliteStorage{source}, exported, exportOptions{}); err != nil {
+		t.Fatalf("Failed to export: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "import.db")
+	db, _ := openCalibrationTestDB(t, path)
+	insertWeather(db, Weather{Name: "Umeå"}, rollupTestBase+60_000)
+
+	output, warnings, err := runImport(t, path, exported)
+	if err != nil || len(warnings) != 0 {
+		t.Fatalf("Expected no error, got %v, %q", err, warnings)
+	}
+	if !strings.Contains(output, "Imported 3 row(s) from "+exported+", skipped 0 duplicate(s) and 0 invalid row(s)") {
+		t.Errorf("Unexpected output %q", output)
+	}
+
+	rows, err := db.Query(`
+		SELECT m.timestamp, d.name, m.temperature, m.humidity, w.city, v.value
+		FROM measurements m
+		JOIN devices d ON d.id = m.device_id
+		LEFT JOIN weather w ON w.id = m.weather_id
+		LEFT JOIN measurement_values v ON v.measurement_id = m.id AND v.metric = 'lux'
+		ORDER BY m.timestamp`)
+	if err != nil {
+		t.Fatalf("Failed to query: %v", err)
+	}
+	defer rows.Close()
+	var imported []string
+	for rows.Next() {
+		var timestamp int64
+		var device, city string
+		var temperature, humidity float64
+		var lux sql.NullFloat64
+		rows.Scan(&timestamp, &device, &temperature, &humidity, &city, &lux)
+		imported = append(imported, fmt.Sprintf("%d %s %g %g %s %v", timestamp-rollupTestBase, device, temperature, humidity, city, lux.Float64))
+	}
+	expected := []string{"1000 greenhouse 20.25 50 Umeå 120.5", "2000 cellar 4 80 Umeå 0", "3000 greenhouse 21 51 Umeå 0"}
+	if strings.Join(imported, "|") != strings.Join(expected, "|") {
+		t.Errorf("Expected %q linked to the local weather, got %q", expected, imported)
+	}
+
+	// Importing the same file again only finds duplicates
+	output, _, err = runImport(t, path, exported)
+	if err != nil || !strings.Contains(output, "Imported 0 row(s)") || !strings.Contains(output, "skipped 3 duplicate(s)") {
+		t.Errorf("Expected only duplicates, got %q, %v", output, err)
+	}
+	if count := countMeasurements(t, path); count != 3 {
+		t.Errorf("Expected 3 measurements, got %d", count)
+	}
+}
+
+func TestRunImportCommand_LoggerCSV(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "import.db")
+	db, _ := openCalibrationTestDB(t, path)
+
+	file := writeImportFile(t, "logger.csv", "\ufeffNo.,Time,Temp (°C),RH%,Notes\n"+
+		"1,2024-05-01 12:00:00,18.5,61,\n"+
+		"2,2024-05-01 12:10:00,18.7,62,door open\n"+
+		"3,2024-05-01 12:20:00,n/a,62,\n"+
+		"4,2024-05-01 12:30:00,19.0,150,\n"+
+		"5,yesterday,19.1,60,\n"+
+		"6,2024-05-01 12:50:00,19.2,,\n"+
+		"7,2024-05-01 13:00:00,19.3,60,\n"+
+		"8,2024-05-01 13:10:00,,,no reading\n")
+	output, warnings, err := runImport(t, path, "-map", "Temp (°C)=temperature,RH%=humidity", "-map", "No.=-", "-default-device", "logger", "-batch-size", "2", file)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !strings.Contains(output, "Imported 4 row(s) from "+file+", skipped 0 duplicate(s) and 4 invalid row(s)") {
+		t.Errorf("Unexpected output %q", output)
+	}
+	if !strings.Contains(output, "Imported 2 row(s), 0 duplicate(s), 0 invalid (100%)\nImported 4 row(s), 0 duplicate(s), 3 invalid (100%)\n") {
+		t.Errorf("Expected progress after each batch, got %q", output)
+	}
+	expectedWarnings := []string{
+		`import: line 4: Temp (°C) is not a number: "n/a"`,
+		"import: line 5: humidity 150 is not between 0 and 100",
+		`import: line 6: invalid timestamp "yesterday"`,
+		"import: line 9: missing a value",
+	}
+	if strings.Join(warnings, "|") != strings.Join(expectedWarnings, "|") {
+		t.Errorf("Expected warnings %q, got %q", expectedWarnings, warnings)
+	}
+
+	device, err := lookupDevice(db, "logger")
+	if err != nil {
+		t.Fatalf("Expected the logger device to be created, got %v", err)
+	}
+	var timestamp int64
+	var temperature float64
+	db.QueryRow("SELECT timestamp, temperature FROM measurements WHERE device_id = ? ORDER BY timestamp LIMIT 1", device.ID).Scan(&timestamp, &temperature)
+	noon := time.Date(2024, 5, 1, 12, 0, 0, 0, time.Local).UnixMilli()
+	if timestamp != noon || temperature != 18.5 {
+		t.Errorf("Expected 18.5 at local noon, got %g at %d", temperature, timestamp)
+	}
+	var metrics int
+	db.QueryRow("SELECT COUNT(*) FROM measurement_values").Scan(&metrics)
+	if metrics != 0 {
+		t.Errorf("Expected the row number and notes to be ignored, got %d metric values", metrics)
+	}
+}
+
+func TestRunImportCommand_NDJSON(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "import.db")
+	db, _ := openCalibrationTestDB(t, path)
+
+	file := writeImportFile(t, "v1.ndjson", `{"timestamp":"2024-05-01T10:00:00Z","device":"greenhouse","temperature":20,"humidity":50,"metrics":{"lux":300}}`+"\n"+
+		`{"time":1714557660,"temperature_celcius":20.5,"humidity":51,"co2":415,"city":null}`+"\n"+
+		"\n"+
+		`{"timestamp":1714557720000,"temperature":21`+"\n"+
+		`{"timestamp":1714557780000,"temperature":"warm","humidity":52}`+"\n")
+	output, warnings, err := runImport(t, path, "-format", "ndjson", file)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !strings.Contains(output, "Imported 2 row(s)") || !strings.Contains(output, "2 invalid row(s)") {
+		t.Errorf("Unexpected output %q", output)
+	}
+	if len(warnings) != 2 || warnings[0] != "import: line 4: malformed line" || !strings.HasPrefix(warnings[1], "import: line 5: temperature is not a number") {
+		t.Errorf("Unexpected warnings %q", warnings)
+	}
+
+	rows, _ := db.Query(`
+		SELECT d.name, m.timestamp, v.metric, v.value
+		FROM measurements m
+		JOIN devices d ON d.id = m.device_id
+		JOIN measurement_values v ON v.measurement_id = m.id
+		ORDER BY m.timestamp`)
+	defer rows.Close()
+	var imported []string
+	for rows.Next() {
+		var device, metric string
+		var timestamp int64
+		var value float64
+		rows.Scan(&device, &timestamp, &metric, &value)
+		imported = append(imported, fmt.Sprintf("%s %d %s %g", device, timestamp, metric, value))
+	}
+	expected := []string{"greenhouse 1714557600000 lux 300", "default 1714557660000 co2 415"}
+	if strings.Join(imported, "|") != strings.Join(expected, "|") {
+		t.Errorf("Expected %q, got %q", expected, imported)
+	}
+}
+
+func TestRunImportCommand_DryRun(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "import.db")
+	db, _ := openCalibrationTestDB(t, path)
+
+	file := writeImportFile(t, "dry.csv", "timestamp,device,temperature,humidity\n1000,attic,20,50\n1000,attic,20,50\n2000,attic,21,51\n")
+	output, _, err := runImport(t, path, "-dry-run", file)
+	if err != nil || !strings.Contains(output, "Would import 2 row(s) from "+file+", skipped 1 duplicate(s)") {
+		t.Errorf("Unexpected dry run %q, %v", output, err)
+	}
+	if count := countMeasurements(t, path); count != 0 {
+		t.Errorf("Expected nothing stored, got %d measurements", count)
+	}
+	if _, err := lookupDevice(db, "attic"); err != sql.ErrNoRows {
+		t.Errorf("Expected no device created, got %v", err)
+	}
+
+	// A database that needs migrating is left alone
+	fresh := filepath.Join(t.TempDir(), "fresh.db")
+	if _, _, err := runImport(t, fresh, "-dry-run", file); err == nil || !strings.Contains(err.Error(), "migrate up") {
+		t.Errorf("Expected the dry run to refuse a pending schema, got %v", err)
+	}
+	assertNoMigrationsTable(t, fresh)
+}
+
+func TestRunImportCommand_Errors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "import.db")
+	openCalibrationTestDB(t, path)
+	origDriver := *dbDriver
+	defer func() { *dbDriver = origDriver }()
+
+	noHumidity := writeImportFile(t, "no-humidity.csv", "time,temp\n1000,20\n")
+	noValue := writeImportFile(t, "no-value.csv", "time,device\n1000,attic\n")
+	tests := []struct {
+		args    []string
+		message string
+	}{
+		{nil, "file is required"},
+		{[]string{"-format", "xml", noHumidity}, "invalid -format"},
+		{[]string{"-batch-size", "0", noHumidity}, "-batch-size must be at least 1"},
+		{[]string{"-map", "temp", noHumidity}, "invalid mapping"},
+		{[]string{"-map", "temp=not a metric", noHumidity}, "invalid field"},
+		{[]string{noValue}, "no value column in time,device, map one with -map COLUMN=temperature"},
+		{[]string{"-map", "time=-", noHumidity}, "no timestamp column in time,temp"},
+		{[]string{filepath.Join(t.TempDir(), "missing.csv")}, "no such file"},
+	}
+	for _, test := range tests {
+		if _, _, err := runImport(t, path, test.args...); err == nil || !strings.Contains(err.Error(), test.message) {
+			t.Errorf("Expected %q for %q, got %v", test.message, test.args, err)
+		}
+	}
+
+	*dbDriver = driverPostgres
+	if _, _, err := runImport(t, path, noHumidity); err == nil || !strings.Contains(err.Error(), "not supported with -db-driver postgres") {
+		t.Errorf("Expected the import to refuse PostgreSQL, got %v", err)
+	}
+}
+
+func TestParseImportTimestamp(t *testing.T) {
+	local := time.Date(2024, 5, 1, 12, 30, 0, 0, time.Local).UnixMilli()
+	tests := []struct {
+		value    string
+		expected int64
+	}{
+		{"1714566600000", 1714566600000},
+		{"1714566600", 1714566600000},
+		{"2024-05-01T12:30:00.250Z", 1714566600250},
+		{"2024-05-01T14:30:00+02:00", 1714566600000},
+		{"2024-05-01 12:30:00", local},
+		{"2024-05-01T12:30:00", local},
+		{"2024-05-01 12:30", local},
+		{"2024/05/01 12:30:00", local},
+	}
+	for _, test := range tests {
+		if timestamp, err := parseImportTimestamp(test.value); err != nil || timestamp != test.expected {
+			t.Errorf("Expected %d for %q, got %d, %v", test.expected, test.value, timestamp, err)
+		}
+	}
+	for _, value := range []string{"", "0", "-5", "May 1st", "2024-13-01 00:00:00"} {
+		if _, err := parseImportTimestamp(value); err == nil {
+			t.Errorf("Expected an error for %q", value)
+		}
+	}
+}
+
+func TestParseImportRow_ValidationConfig(t *testing.T) {
+	origSettings := validationSettings
+	defer func() { validationSettings = origSettings }()
+	maxTemp := 30.0
+	validationSettings = &validationConfig{Rules: map[string]validationRule{temperatureField: {Max: &maxTemp, MaxRate: 0.1}}}
+
+	cells := map[string]string{"timestamp": "1000", "temperature": "25", "humidity": "50"}
+	if _, _, err := parseImportRow(cells, importMapping{}); err != nil {
+		t.Errorf("Expected the rate rule to be left out, got %v", err)
+	}
+	cells["temperature"] = "35"
+	if _, _, err := parseImportRow(cells, importMapping{}); err == nil || !strings.Contains(err.Error(), "above") {
+		t.Errorf("Expected the range rule to apply, got %v", err)
+	}
+
+	minHumidity := 1.0
+	validationSettings = &validationConfig{Rules: map[string]validationRule{humidityField: {Min: &minHumidity}}}
+	m := Measurement{TemperatureCelsius: 20, Missing: map[string]bool{humidityField: true}}
+	if r := checkImportRanges(validationSettings, "", m); r != nil {
+		t.Errorf("Expected the humidity rule to skip a row without humidity, got %+v", r)
+	}
+
+	future := fmt.Sprint(time.Now().Add(48 * time.Hour).UnixMilli())
+	if _, _, err := parseImportRow(map[string]string{"timestamp": future, "temperature": "20", "humidity": "50"}, importMapping{}); err == nil {
+		t.Error("Expected a timestamp in the future to be rejected")
+	}
+	if _, _, err := parseImportRow(map[string]string{"timestamp": "1000", "temperature": "20", "temp": "21", "humidity": "50"}, importMapping{}); err == nil {
+		t.Error("Expected two temperature columns to be rejected")
+	}
+}
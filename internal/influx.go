@@ -0,0 +1,554 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	influxMeasurements = "measurements"
+	influxWeather      = "weather"
+
+	influxRequestTimeout = 30 * time.Second
+	influxMinRetryDelay  = 1 * time.Second
+	influxMaxRetryDelay  = 5 * time.Minute
+	influxFlushTimeout   = 5 * time.Second // for the last push on shutdown
+)
+
+var (
+	influxURL       = flag.String("influx-url", "", "Push measurements and weather to the InfluxDB v2 server at this URL, e.g. http://localhost:8086")
+	influxOrg       = flag.String("influx-org", "", "InfluxDB organization to write to")
+	influxBucket    = flag.String("influx-bucket", "", "InfluxDB bucket to write to")
+	influxToken     = flag.String("influx-token", "", "InfluxDB API token (default from the INFLUX_TOKEN environment variable)")
+	influxBatch     = flag.Int("influx-batch", 5000, "Lines pushed to InfluxDB per request")
+	influxInterval  = flag.Duration("influx-interval", 10*time.Second, "Longest time a line waits before it is pushed to InfluxDB")
+	influxQueueSize = flag.Int("influx-queue", 100_000, "Lines kept while InfluxDB is unreachable; the oldest are dropped beyond this")
+	influxQueueFile = flag.String("influx-queue-file", "", "File the lines not pushed yet are kept in, to be pushed after a restart or crash (default <db>.influx)")
+)
+
+var startInfluxPusher = startInfluxPusherImpl
+var pushMeasurementToInflux = pushMeasurementToInfluxImpl
+var pushWeatherToInflux = pushWeatherToInfluxImpl
+
+// activeInfluxPusher is set while -influx-url is in use.
+var activeInfluxPusher atomic.Pointer[influxPusher]
+
+// influxField is a field of a line, with a float64, int64 or string value.
+type influxField struct {
+	key   string
+	value any
+}
+
+var (
+	influxMeasurementEscaper = strings.NewReplacer(`,`, `\,`, ` `, `\ `)
+	influxKeyEscaper         = strings.NewReplacer(`,`, `\,`, `=`, `\=`, ` `, `\ `)
+	influxStringEscaper      = strings.NewReplacer(`"`, `\"`, `\`, `\\`)
+)
+
+// influxLine formats a line of InfluxDB line protocol with a nanosecond
+// timestamp from Unix milliseconds. Empty tags and fields that are not
+// finite numbers are left out; without any field there is no line.
+func influxLine(measurement string, tags [][2]string, fields []influxField, timestamp int64) string {
+	var b strings.Builder
+	b.WriteString(influxMeasurementEscaper.Replace(measurement))
+	for _, tag := range tags {
+		if tag[1] == "" {
+			continue
+		}
+		b.WriteByte(',')
+		b.WriteString(influxKeyEscaper.Replace(tag[0]))
+		b.WriteByte('=')
+		b.WriteString(influxKeyEscaper.Replace(tag[1]))
+	}
+
+	separator := byte(' ')
+	for _, field := range fields {
+		var value string
+		switch v := field.value.(type) {
+		case float64:
+			if math.IsNaN(v) || math.IsInf(v, 0) {
+				continue
+			}
+			value = strconv.FormatFloat(v, 'f', -1, 64)
+		case int64:
+			value = strconv.FormatInt(v, 10) + "i"
+		case string:
+			value = `"` + influxStringEscaper.Replace(v) + `"`
+		default:
+			continue // NULL
+		}
+		b.WriteByte(separator)
+		b.WriteString(influxKeyEscaper.Replace(field.key))
+		b.WriteByte('=')
+		b.WriteString(value)
+		separator = ','
+	}
+	if separator == ' ' {
+		return ""
+	}
+
+	b.WriteByte(' ')
+	b.WriteString(strconv.FormatInt(timestamp*int64(time.Millisecond), 10))
+	return b.String()
+}
+
+// measurementLine is the line of a measurement of the named device, with a
+// field per extra metric.
+func measurementLine(device string, m Measurement) string {
+	fields := []influxField{{"temperature", m.columnValue(temperatureField)}, {"humidity", m.columnValue(humidityField)}}
+	for _, metric := range sortedMetricNames(m.Metrics) {
+		fields = append(fields, influxField{metric, m.Metrics[metric]})
+	}
+	return influxLine(influxMeasurements, [][2]string{{"device", device}}, fields, m.UnixTimestamp)
+}
+
+// weatherLine is the line of a weather sample, with the fields stored in
+// the weather table.
+func weatherLine(w Weather, timestamp int64) string {
+	var code int64
+	var description string
+	if len(w.Weather) > 0 {
+		code = int64(w.Weather[0].ID)
+		description = w.Weather[0].Description
+	}
+	return influxLine(influxWeather, [][2]string{{"city", w.Name}}, []influxField{
+		{"temperature", w.Main.Temp},
+		{"humidity", int64(w.Main.Humidity)},
+		{"wind_speed", w.Wind.Speed},
+		{"wind_deg", int64(w.Wind.Deg)},
+		{"clouds", int64(w.Clouds.All)},
+		{"weather_code", code},
+		{"description", description},
+	}, timestamp)
+}
+
+// influxExportWriter writes a measurements line per row, and a weather line
+// for the weather of each row unless the row before had the same.
+type influxExportWriter struct {
+	w           io.Writer
+	metrics     []string
+	lastWeather int64
+}
+
+func (e *influxExportWriter) begin(metrics []string) error {
+	e.metrics = metrics
+	return nil
+}
+
+func (e *influxExportWriter) write(row *exportRow) error {
+	values := row.values()
+	fields := []influxField{{"temperature", values[2]}, {"humidity", values[3]}}
+	for i, metric := range e.metrics {
+		fields = append(fields, influxField{exportMetricColumn(metric), values[len(exportColumns)+i]})
+	}
+	lines := []string{influxLine(influxMeasurements, [][2]string{{"device", row.device.String}}, fields, row.ts)}
+
+	if row.weatherTS.Valid && row.weatherTS.Int64 != e.lastWeather {
+		e.lastWeather = row.weatherTS.Int64
+		lines = append(lines, influxLine(influxWeather, [][2]string{{"city", row.city.String}}, []influxField{
+			{"temperature", values[5]},
+			{"humidity", values[6]},
+			{"wind_speed", values[7]},
+			{"wind_deg", values[8]},
+			{"clouds", values[9]},
+			{"weather_code", values[10]},
+			{"description", values[11]},
+		}, row.weatherTS.Int64))
+	}
+	for _, line := range lines {
+		if line == "" {
+			continue
+		}
+		if _, err := io.WriteString(e.w, line+"\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *influxExportWriter) end() error {
+	return nil
+}
+
+// influxPusher queues lines and pushes them in batches to the write
+// endpoint of an InfluxDB v2 server. While the server is unreachable the
+// lines stay queued and pushing is retried with a growing delay. Once open
+// has been called the queue is also kept in a file, so it survives a crash.
+type influxPusher struct {
+	client    *http.Client
+	writeURL  string
+	token     string
+	batchSize int
+	maxQueue  int
+
+	mu      sync.Mutex
+	queue   []string // oldest first
+	dropped int      // lines dropped from the front of queue so far
+	full    chan struct{}
+	path    string // file the queue is kept in, if any
+	stored  int    // lines in the file, the queue plus lines sent or dropped since
+}
+
+func newInfluxPusher(serverURL, org, bucket, token string, batchSize, maxQueue int) *influxPusher {
+	query := url.Values{"org": {org}, "bucket": {bucket}, "precision": {"ns"}}
+	return &influxPusher{
+		client:    &http.Client{Timeout: influxRequestTimeout},
+		writeURL:  strings.TrimSuffix(serverURL, "/") + "/api/v2/write?" + query.Encode(),
+		token:     token,
+		batchSize: batchSize,
+		maxQueue:  maxQueue,
+		full:      make(chan struct{}, 1),
+	}
+}
+
+// enqueue adds lines to the queue, dropping the oldest lines beyond
+// maxQueue, and appends them to the queue file. The file is rewritten with
+// just the queue rather than grow beyond twice maxQueue lines.
+func (p *influxPusher) enqueue(lines ...string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var added []string
+	for _, line := range lines {
+		if line != "" {
+			added = append(added, line)
+		}
+	}
+	p.queue = append(p.queue, added...)
+	if excess := len(p.queue) - p.maxQueue; excess > 0 {
+		p.queue = p.queue[excess:]
+		p.dropped += excess
+		throttledLogWarn(&lastInfluxWarn, "InfluxDB queue is full, dropped the %d oldest line(s)", excess)
+	}
+	if p.path != "" && len(added) > 0 {
+		var err error
+		if p.stored+len(added) > 2*p.maxQueue {
+			err = p.rewrite()
+		} else if err = appendLines(p.path, added); err == nil {
+			p.stored += len(added)
+		}
+		if err != nil {
+			throttledLogError(&lastInfluxWarn, "Failed to keep %d line(s) for InfluxDB in %s: %v", len(added), p.path, err)
+		}
+	}
+	if len(p.queue) >= p.batchSize {
+		select {
+		case p.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (p *influxPusher) queued() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.queue)
+}
+
+// influxError is a response of the server other than 204 No Content.
+type influxError struct {
+	status     int
+	message    string
+	retryAfter time.Duration
+}
+
+func (e *influxError) Error() string {
+	return fmt.Sprintf("InfluxDB answered %d: %s", e.status, e.message)
+}
+
+// retryable reports whether the same request may succeed later, i.e. the
+// server did not refuse the lines themselves. A wrong token or bucket can
+// be fixed while the lines wait.
+func (e *influxError) retryable() bool {
+	switch e.status {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusUnprocessableEntity:
+		return false
+	}
+	return true
+}
+
+// send posts lines to the write endpoint.
+func (p *influxPusher) send(ctx context.Context, lines []string) error {
+	body := strings.Join(lines, "\n") + "\n"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.writeURL, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if p.token != "" {
+		req.Header.Set("Authorization", "Token "+p.token)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+
+	message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	e := &influxError{status: resp.StatusCode, message: strings.TrimSpace(string(message))}
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+		e.retryAfter = time.Duration(seconds) * time.Second
+	}
+	return e
+}
+
+// push sends the queued lines a batch at a time until the queue is empty
+// or a push fails. It returns the delay the server asked for, if any, with
+// the error of a push to retry. Batches the server refuses are dropped.
+func (p *influxPusher) push(ctx context.Context) (time.Duration, error) {
+	for {
+		p.mu.Lock()
+		n := min(len(p.queue), p.batchSize)
+		batch := append([]string(nil), p.queue[:n]...)
+		droppedBefore := p.dropped
+		p.mu.Unlock()
+		if n == 0 {
+			return 0, nil
+		}
+
+		err := p.send(ctx, batch)
+		var refused *influxError
+		if errors.As(err, &refused) && !refused.retryable() {
+			throttledLogError(&lastInfluxWarn, "Dropped %d line(s) refused by InfluxDB: %v", n, err)
+			err = nil
+		}
+		if err != nil {
+			if refused != nil {
+				return refused.retryAfter, err
+			}
+			return 0, err
+		}
+
+		// Lines dropped meanwhile were taken from the front, i.e. the batch
+		p.mu.Lock()
+		sent := max(n-(p.dropped-droppedBefore), 0)
+		p.queue = p.queue[min(sent, len(p.queue)):]
+		if p.path != "" {
+			if err := p.rewrite(); err != nil {
+				throttledLogError(&lastInfluxWarn, "Failed to remove pushed lines from %s: %v", p.path, err)
+			}
+		}
+		p.mu.Unlock()
+	}
+}
+
+// run pushes the queue every interval, or as soon as a batch is full, until
+// ctx is cancelled. After a failed push it waits before trying again, twice
+// as long after every further failure.
+func (p *influxPusher) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var retryAt time.Time
+	delay := influxMinRetryDelay
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-p.full:
+		}
+		if time.Now().Before(retryAt) {
+			continue
+		}
+
+		wait, err := p.push(ctx)
+		if err == nil {
+			delay = influxMinRetryDelay
+			retryAt = time.Time{}
+			continue
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if wait < delay {
+			wait = delay
+		}
+		retryAt = time.Now().Add(wait)
+		delay = min(delay*2, influxMaxRetryDelay)
+		throttledLogWarn(&lastInfluxWarn, "Failed to push %d line(s) to InfluxDB, retrying in %v: %v", p.queued(), wait, err)
+	}
+}
+
+// open queues the lines an earlier run left in the file at path and keeps
+// the queue in that file from now on.
+func (p *influxPusher) open(path string) (int, error) {
+	lines, err := readLines(path)
+	if err != nil {
+		return 0, err
+	}
+	p.enqueue(lines...)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.path = path
+	return len(lines), p.rewrite()
+}
+
+// rewrite replaces the queue file with the lines still queued, or removes
+// it when there are none. p.mu must be held.
+func (p *influxPusher) rewrite() error {
+	if len(p.queue) == 0 {
+		if err := os.Remove(p.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		p.stored = 0
+		return nil
+	}
+
+	tmp := p.path + ".tmp"
+	os.Remove(tmp)
+	if err := appendLines(tmp, p.queue); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, p.path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	p.stored = len(p.queue)
+	return nil
+}
+
+// appendLines appends lines to the file at path and syncs it to disk.
+func appendLines(path string, lines []string) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	for _, line := range lines {
+		writer.WriteString(line)
+		writer.WriteByte('\n')
+	}
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// readLines returns the non-empty lines of the file at path, or none if it
+// does not exist.
+func readLines(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if line := scanner.Text(); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, scanner.Err()
+}
+
+// validateInfluxFlags checks the -influx-* flags when -influx-url is set.
+func validateInfluxFlags() error {
+	if *influxURL == "" {
+		return nil
+	}
+	u, err := url.Parse(*influxURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid -influx-url %q, expected e.g. http://localhost:8086", *influxURL)
+	}
+	if *influxOrg == "" || *influxBucket == "" {
+		return errors.New("-influx-url needs -influx-org and -influx-bucket")
+	}
+	if *influxBatch < 1 {
+		return fmt.Errorf("invalid -influx-batch %d, expected at least 1", *influxBatch)
+	}
+	if *influxInterval <= 0 {
+		return fmt.Errorf("invalid -influx-interval %v, expected a positive duration", *influxInterval)
+	}
+	if *influxQueueSize < *influxBatch {
+		return fmt.Errorf("invalid -influx-queue %d, expected at least -influx-batch", *influxQueueSize)
+	}
+	return nil
+}
+
+// startInfluxPusherImpl queues the lines an earlier run left in the queue
+// file and pushes lines to InfluxDB until ctx is cancelled. On shutdown it
+// makes a last push; what is left stays in the queue file for the next start.
+func startInfluxPusherImpl(ctx context.Context, wg *sync.WaitGroup) error {
+	token := *influxToken
+	if token == "" {
+		token = os.Getenv("INFLUX_TOKEN")
+	}
+	path := *influxQueueFile
+	if path == "" {
+		path = *dbFileName + ".influx"
+	}
+
+	p := newInfluxPusher(*influxURL, *influxOrg, *influxBucket, token, *influxBatch, *influxQueueSize)
+	n, err := p.open(path)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		logInfo("Queued %d line(s) for InfluxDB left by an earlier run in %s", n, path)
+	}
+	activeInfluxPusher.Store(p)
+	logInfo("Pushing to InfluxDB at %s, bucket %s", *influxURL, *influxBucket)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		p.run(ctx, *influxInterval)
+		activeInfluxPusher.Store(nil)
+
+		flushCtx, cancel := context.WithTimeout(context.Background(), influxFlushTimeout)
+		defer cancel()
+		if _, err := p.push(flushCtx); err != nil {
+			logWarn("Failed to push to InfluxDB before stopping: %v", err)
+		}
+		if n := p.queued(); n > 0 {
+			logWarn("%d line(s) for InfluxDB kept in %s and will be pushed on the next start", n, path)
+		}
+		logInfo("InfluxDB pusher stopped")
+	}()
+	return nil
+}
+
+// pushMeasurementToInfluxImpl queues a stored measurement for InfluxDB.
+func pushMeasurementToInfluxImpl(device Device, m Measurement) {
+	if p := activeInfluxPusher.Load(); p != nil {
+		p.enqueue(measurementLine(device.Name, m))
+	}
+}
+
+// pushWeatherToInfluxImpl queues a stored weather sample for InfluxDB.
+func pushWeatherToInfluxImpl(w Weather, timestamp int64) {
+	if p := activeInfluxPusher.Load(); p != nil {
+		p.enqueue(weatherLine(w, timestamp))
+	}
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// influxStandIn is an httptest server taking writes like InfluxDB v2, and
+// answering with the queued statuses first.
+type influxStandIn struct {
+	*httptest.Server
+	mu       sync.Mutex
+	statuses []int
+	requests []*http.Request
+	bodies   []string
+}
+
+func newInfluxStandIn(t *testing.T, statuses ...int) *influxStandIn {
+	s := &influxStandIn{statuses: statuses}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.requests = append(s.requests, r)
+		if len(s.statuses) > 0 {
+			status := s.statuses[0]
+			s.statuses = s.statuses[1:]
+			if status == http.StatusServiceUnavailable {
+				w.Header().Set("Retry-After", "30")
+			}
+			http.Error(w, `{"code":"unavailable"}`, status)
+			return
+		}
+		s.bodies = append(s.bodies, string(body))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *influxStandIn) written() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var lines []string
+	for _, body := range s.bodies {
+		lines = append(lines, strings.Split(strings.TrimSuffix(body, "\n"), "\n")...)
+	}
+	return lines
+}
+
+func TestInfluxLine(t *testing.T) {
+	tests := []struct {
+		name     string
+		line     string
+		expected string
+	}{
+		{
+			"escaping",
+			influxLine("my measurements", [][2]string{{"device", "green house,1"}, {"city", "Umeå=home"}}, []influxField{
+				{"air temp", 20.5}, {"count", int64(3)}, {"note", `say "hi" \o/`},
+			}, 1000),
+			`my\ measurements,device=green\ house\,1,city=Umeå\=home air\ temp=20.5,count=3i,note="say \"hi\" \\o/" 1000000000`,
+		},
+		{
+			"missing values",
+			influxLine("weather", [][2]string{{"city", ""}}, []influxField{{"temperature", math.NaN()}, {"humidity", nil}, {"wind_speed", 0.0}}, 1),
+			"weather wind_speed=0 1000000",
+		},
+		{
+			"no fields",
+			influxLine("weather", nil, []influxField{{"temperature", math.Inf(1)}}, 1),
+			"",
+		},
+	}
+	for _, test := range tests {
+		if test.line != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.name, test.expected, test.line)
+		}
+	}
+
+	m := Measurement{UnixTimestamp: 1000, TemperatureCelsius: 21.5, HumidityPercentage: 40, Metrics: map[string]float64{"lux": 120, "co2": 415}}
+	if line := measurementLine("cellar", m); line != "measurements,device=cellar temperature=21.5,humidity=40,co2=415,lux=120 1000000000" {
+		t.Errorf("Unexpected measurement line %q", line)
+	}
+	m.setMissing(humidityField)
+	if line := measurementLine("cellar", m); line != "measurements,device=cellar temperature=21.5,co2=415,lux=120 1000000000" {
+		t.Errorf("Expected no humidity field for a reading without one, got %q", line)
+	}
+	w := Weather{Name: "Helsinki"}
+	w.Main.Temp, w.Main.Humidity, w.Wind.Speed, w.Wind.Deg, w.Clouds.All = 4.5, 90, 3.2, 180, 75
+	if line := weatherLine(w, 1000); line != `weather,city=Helsinki temperature=4.5,humidity=90i,wind_speed=3.2,wind_deg=180i,clouds=75i,weather_code=0i,description="" 1000000000` {
+		t.Errorf("Unexpected weather line %q", line)
+	}
+}
+
+func TestExportMeasurements_Influx(t *testing.T) {
+	db := openExportTestDB(t)
+	lines := strings.Split(strings.TrimSuffix(exportToString(t, db, exportOptions{format: exportFormatInflux}), "\n"), "\n")
+
+	expected := []string{
+		"measurements,device=greenhouse temperature=20.25,humidity=50,lux=120.5 1700006401000000000",
+		`weather,city=Umeå\,\ Västerbotten temperature=4.5,humidity=90i,wind_speed=0,wind_deg=0i,clouds=0i,weather_code=500i,description="light \"rain\"" 1700006400000000000`,
+		"measurements,device=cellar temperature=4,humidity=80 1700006402000000000",
+		"measurements,device=greenhouse temperature=21,humidity=51 1700006403000000000",
+	}
+	if strings.Join(lines, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected\n%s\ngot\n%s", strings.Join(expected, "\n"), strings.Join(lines, "\n"))
+	}
+}
+
+func TestInfluxPusher_Push(t *testing.T) {
+	server := newInfluxStandIn(t)
+	p := newInfluxPusher(server.URL+"/", "home", "skogsnet", "secret", 2, 10)
+	p.enqueue("a v=1 1", "b v=2 2", "", "c v=3 3")
+
+	if _, err := p.push(context.Background()); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(server.requests) != 2 || p.queued() != 0 {
+		t.Fatalf("Expected 2 requests for 3 lines in batches of 2, got %d with %d queued", len(server.requests), p.queued())
+	}
+	r := server.requests[0]
+	if r.Method != http.MethodPost || r.URL.Path != "/api/v2/write" || r.URL.Query().Get("org") != "home" ||
+		r.URL.Query().Get("bucket") != "skogsnet" || r.URL.Query().Get("precision") != "ns" {
+		t.Errorf("Unexpected request %s %s", r.Method, r.URL)
+	}
+	if r.Header.Get("Authorization") != "Token secret" || !strings.HasPrefix(r.Header.Get("Content-Type"), "text/plain") {
+		t.Errorf("Unexpected headers %v", r.Header)
+	}
+	if server.bodies[0] != "a v=1 1\nb v=2 2\n" || server.bodies[1] != "c v=3 3\n" {
+		t.Errorf("Unexpected bodies %q", server.bodies)
+	}
+}
+
+func TestInfluxPusher_Retry(t *testing.T) {
+	quietWriterLogs(t)
+	server := newInfluxStandIn(t, http.StatusServiceUnavailable, http.StatusUnauthorized)
+	p := newInfluxPusher(server.URL, "home", "skogsnet", "", 10, 10)
+	p.enqueue("a v=1 1")
+
+	// Lines stay queued while the server is unavailable or the token wrong
+	wait, err := p.push(context.Background())
+	if err == nil || wait != 30*time.Second || p.queued() != 1 {
+		t.Errorf("Expected a retry after 30s with the line queued, got %v, %v, %d", wait, err, p.queued())
+	}
+	if _, err := p.push(context.Background()); err == nil || !strings.Contains(err.Error(), "401") || p.queued() != 1 {
+		t.Errorf("Expected an unauthorized error with the line queued, got %v, %d", err, p.queued())
+	}
+	if _, err := p.push(context.Background()); err != nil || p.queued() != 0 || len(server.written()) != 1 {
+		t.Errorf("Expected the line pushed once the server recovers, got %v, %q", err, server.written())
+	}
+	if server.requests[0].Header.Get("Authorization") != "" {
+		t.Errorf("Expected no token, got %q", server.requests[0].Header.Get("Authorization"))
+	}
+
+	// Refused lines are dropped rather than retried forever
+	refusing := newInfluxStandIn(t, http.StatusBadRequest)
+	p = newInfluxPusher(refusing.URL, "home", "skogsnet", "", 10, 10)
+	p.enqueue("not line protocol")
+	if _, err := p.push(context.Background()); err != nil || p.queued() != 0 {
+		t.Errorf("Expected the refused line to be dropped, got %v, %d", err, p.queued())
+	}
+
+	// An unreachable server keeps the lines too
+	refusing.Close()
+	p.enqueue("a v=1 1")
+	if _, err := p.push(context.Background()); err == nil || p.queued() != 1 {
+		t.Errorf("Expected a connection error with the line queued, got %v, %d", err, p.queued())
+	}
+}
+
+func TestInfluxPusher_QueueLimit(t *testing.T) {
+	quietWriterLogs(t)
+	p := newInfluxPusher("http://127.0.0.1:1", "home", "skogsnet", "", 2, 3)
+	p.enqueue("a v=1 1", "b v=2 2")
+	select {
+	case <-p.full:
+	default:
+		t.Error("Expected a full batch to wake the pusher")
+	}
+	p.enqueue("c v=3 3", "d v=4 4", "e v=5 5")
+	if strings.Join(p.queue, "|") != "c v=3 3|d v=4 4|e v=5 5" || p.dropped != 2 {
+		t.Errorf("Expected the oldest lines dropped, got %q, %d", p.queue, p.dropped)
+	}
+}
+
+func TestStartInfluxPusher(t *testing.T) {
+	quietWriterLogs(t)
+	server := newInfluxStandIn(t)
+	queueFile := filepath.Join(t.TempDir(), "measurements.db.influx")
+	os.WriteFile(queueFile, []byte("saved v=1 1\n"), 0o600)
+
+	orig := []string{*influxURL, *influxOrg, *influxBucket, *influxToken, *influxQueueFile}
+	origInterval := *influxInterval
+	defer func() {
+		*influxURL, *influxOrg, *influxBucket, *influxToken, *influxQueueFile = orig[0], orig[1], orig[2], orig[3], orig[4]
+		*influxInterval = origInterval
+	}()
+	*influxURL, *influxOrg, *influxBucket, *influxToken, *influxQueueFile = server.URL, "home", "skogsnet", "", queueFile
+	*influxInterval = 20 * time.Millisecond
+	t.Setenv("INFLUX_TOKEN", "from-env")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	if err := startInfluxPusher(ctx, &wg); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	pushMeasurementToInflux(Device{Name: "cellar"}, Measurement{UnixTimestamp: 2000, TemperatureCelsius: 4, HumidityPercentage: 80})
+	pushWeatherToInflux(Weather{Name: "Helsinki"}, 3000)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(server.written()) < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	wg.Wait()
+
+	lines := server.written()
+	if len(lines) != 3 || lines[0] != "saved v=1 1" || !strings.HasPrefix(lines[1], "measurements,device=cellar ") || !strings.HasPrefix(lines[2], "weather,city=Helsinki ") {
+		t.Errorf("Unexpected lines %q", lines)
+	}
+	if token := server.requests[0].Header.Get("Authorization"); token != "Token from-env" {
+		t.Errorf("Expected the token from INFLUX_TOKEN, got %q", token)
+	}
+	if activeInfluxPusher.Load() != nil {
+		t.Error("Expected the pusher to be gone after shutdown")
+	}
+	if _, err := os.Stat(queueFile); !os.IsNotExist(err) {
+		t.Errorf("Expected the queue file removed once everything was pushed, got %v", err)
+	}
+}
+
+func TestStartInfluxPusher_KeepsQueueOnShutdown(t *testing.T) {
+	quietWriterLogs(t)
+	server := newInfluxStandIn(t)
+	server.Close()
+	queueFile := filepath.Join(t.TempDir(), "measurements.db.influx")
+
+	orig := []string{*influxURL, *influxOrg, *influxBucket, *influxQueueFile}
+	defer func() {
+		*influxURL, *influxOrg, *influxBucket, *influxQueueFile = orig[0], orig[1], orig[2], orig[3]
+	}()
+	*influxURL, *influxOrg, *influxBucket, *influxQueueFile = server.URL, "home", "skogsnet", queueFile
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	if err := startInfluxPusher(ctx, &wg); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	pushMeasurementToInflux(Device{Name: "cellar"}, Measurement{UnixTimestamp: 2000, TemperatureCelsius: 4})
+	cancel()
+	wg.Wait()
+
+	data, err := os.ReadFile(queueFile)
+	if err != nil || string(data) != "measurements,device=cellar temperature=4,humidity=0 2000000000\n" {
+		t.Errorf("Expected the unsent line to be kept, got %q, %v", data, err)
+	}
+}
+
+func TestInfluxPusher_QueueFile(t *testing.T) {
+	quietWriterLogs(t)
+	server := newInfluxStandIn(t, http.StatusServiceUnavailable)
+	path := filepath.Join(t.TempDir(), "measurements.db.influx")
+	os.WriteFile(path, []byte("a v=1 1\nb v=2 2\n"), 0o600)
+
+	p := newInfluxPusher(server.URL, "home", "skogsnet", "", 2, 3)
+	if n, err := p.open(path); err != nil || n != 2 || p.queued() != 2 {
+		t.Fatalf("Expected the 2 lines in the file queued, got %d, %v, %d", n, err, p.queued())
+	}
+	readQueueFile := func() string {
+		data, _ := os.ReadFile(path)
+		return string(data)
+	}
+
+	// Queued lines are on disk straight away, so a crash loses none
+	p.enqueue("c v=3 3")
+	if got := readQueueFile(); got != "a v=1 1\nb v=2 2\nc v=3 3\n" {
+		t.Errorf("Expected the new line appended, got %q", got)
+	}
+	if _, err := p.push(context.Background()); err == nil {
+		t.Fatal("Expected the unavailable server to fail the push")
+	}
+	if got := readQueueFile(); got != "a v=1 1\nb v=2 2\nc v=3 3\n" {
+		t.Errorf("Expected the file untouched by a failed push, got %q", got)
+	}
+
+	// The file is rewritten rather than grow beyond twice the queue limit
+	p.enqueue("d v=4 4", "e v=5 5", "f v=6 6", "g v=7 7")
+	if got := readQueueFile(); got != "e v=5 5\nf v=6 6\ng v=7 7\n" {
+		t.Errorf("Expected the dropped lines gone from the file, got %q", got)
+	}
+
+	// Pushed lines are taken off the file
+	if _, err := p.push(context.Background()); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Expected the queue file removed once empty, got %v", err)
+	}
+}
+
+func TestValidateInfluxFlags(t *testing.T) {
+	orig := []string{*influxURL, *influxOrg, *influxBucket}
+	origBatch, origQueue, origInterval := *influxBatch, *influxQueueSize, *influxInterval
+	defer func() {
+		*influxURL, *influxOrg, *influxBucket = orig[0], orig[1], orig[2]
+		*influxBatch, *influxQueueSize, *influxInterval = origBatch, origQueue, origInterval
+	}()
+
+	*influxURL = ""
+	if err := validateInfluxFlags(); err != nil {
+		t.Errorf("Expected no error without -influx-url, got %v", err)
+	}
+	*influxURL, *influxOrg, *influxBucket = "http://localhost:8086", "home", "skogsnet"
+	if err := validateInfluxFlags(); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+
+	tests := []struct {
+		apply   func()
+		message string
+	}{
+		{func() { *influxURL = "localhost:8086" }, "invalid -influx-url"},
+		{func() { *influxBucket = "" }, "needs -influx-org and -influx-bucket"},
+		{func() { *influxBatch = 0 }, "invalid -influx-batch"},
+		{func() { *influxInterval = 0 }, "invalid -influx-interval"},
+		{func() { *influxQueueSize = 10 }, "invalid -influx-queue"},
+	}
+	for _, test := range tests {
+		*influxURL, *influxOrg, *influxBucket = "http://localhost:8086", "home", "skogsnet"
+		*influxBatch, *influxQueueSize, *influxInterval = 5000, 100_000, 10*time.Second
+		test.apply()
+		if err := validateInfluxFlags(); err == nil || !strings.Contains(err.Error(), test.message) {
+			t.Errorf("Expected %q, got %v", test.message, err)
+		}
+	}
+}
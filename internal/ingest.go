@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	maxIngestBodyBytes = 1 << 20
+	// maxIngestClockSkew tolerates pushing clients whose clock runs slightly
+	// ahead; later timestamps are rejected.
+	maxIngestClockSkew = time.Minute
+)
+
+// parseIngestBody reads a single JSON object or a batch of newline-delimited
+// objects pushed by a device. Each object is validated by deserializeData; an
+// optional ts is taken as Unix time in milliseconds, otherwise the
+// measurement is stored at receivedAt.
+func parseIngestBody(body []byte, device Device, receivedAt int64) ([]Measurement, error) {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	var measurements []Measurement
+	for i := 1; ; i++ {
+		var raw json.RawMessage
+		err := decoder.Decode(&raw)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("measurement %d: %w", i, err)
+		}
+
+		m, err := deserializeData(string(raw))
+		if err != nil {
+			return nil, fmt.Errorf("measurement %d: %w", i, err)
+		}
+		m.DeviceID = device.ID
+		m.DeviceName = device.Name
+		m.ReceivedTimestamp = receivedAt
+		m.UnixTimestamp = receivedAt
+		if m.DeviceTimestamp != nil {
+			if *m.DeviceTimestamp > receivedAt+maxIngestClockSkew.Milliseconds() {
+				return nil, fmt.Errorf("measurement %d: ts %d is in the future", i, *m.DeviceTimestamp)
+			}
+			m.UnixTimestamp = *m.DeviceTimestamp
+		}
+		measurements = append(measurements, m)
+	}
+
+	if len(measurements) == 0 {
+		return nil, errors.New("no measurements in request body")
+	}
+	return measurements, nil
+}
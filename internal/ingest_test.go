@@ -0,0 +1,59 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseIngestBody_SingleObject(t *testing.T) {
+	device := Device{ID: 4, Name: "pi-zero"}
+	body := "{\n  \"temperature_celcius\": 21.5,\n  \"humidity\": 40.0,\n  \"co2\": 640\n}\n"
+
+	measurements, err := parseIngestBody([]byte(body), device, 5_000)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(measurements) != 1 {
+		t.Fatalf("Expected 1 measurement, got %d", len(measurements))
+	}
+	m := measurements[0]
+	if m.DeviceID != 4 || m.TemperatureCelsius != 21.5 || m.Metrics["co2"] != 640 || m.UnixTimestamp != 5_000 || m.ReceivedTimestamp != 5_000 {
+		t.Errorf("Unexpected measurement: %+v", m)
+	}
+}
+
+func TestParseIngestBody_Batch(t *testing.T) {
+	body := `{"temperature_celcius":20.0,"ts":1000}
+{"temperature_celcius":20.5,"ts":2000,"seq":2}
+
+{"temperature_celcius":21.0}
+`
+	measurements, err := parseIngestBody([]byte(body), Device{ID: 1, Name: "pi"}, 100_000)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(measurements) != 3 {
+		t.Fatalf("Expected 3 measurements, got %d", len(measurements))
+	}
+	if measurements[0].UnixTimestamp != 1000 || measurements[1].UnixTimestamp != 2000 || measurements[2].UnixTimestamp != 100_000 {
+		t.Errorf("Expected ts to be used as the timestamp, got %d, %d, %d",
+			measurements[0].UnixTimestamp, measurements[1].UnixTimestamp, measurements[2].UnixTimestamp)
+	}
+}
+
+func TestParseIngestBody_Errors(t *testing.T) {
+	cases := map[string]string{
+		"":      "no measurements",
+		"   \n": "no measurements",
+		`{"temperature_celcius":20.0}` + "\n" + `{"temperature_celcius":"hot"}`: "measurement 2",
+		`{"temperature_celcius":20.0`:                                           "measurement 1",
+		`[{"temperature_celcius":20.0}]`:                                        "measurement 1",
+		`{"temperature_celcius":20.0,"ts":999999}`:                              "in the future",
+	}
+	for body, expected := range cases {
+		_, err := parseIngestBody([]byte(body), Device{}, 1_000)
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("Body %q: expected error containing %q, got %v", body, expected, err)
+		}
+	}
+}
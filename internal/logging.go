@@ -15,6 +15,13 @@ var (
 	lastDeserializeErr time.Time
 	lastInsertErr      time.Time
 	lastWeatherErr     time.Time
+	lastDuplicateWarn  time.Time
+	lastFrameWarn      time.Time
+	lastMQTTWarn       time.Time
+	lastSysfsErr       time.Time
+	lastRejectWarn     time.Time
+	lastRollupErr      time.Time
+	lastInfluxWarn     time.Time
 	throttleInterval   = 5 * time.Second
 )
 
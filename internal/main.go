@@ -19,37 +19,108 @@ const (
 	weatherFetchInterval   = 1 * time.Minute
 	weatherFetchRetryDelay = 500 * time.Millisecond
 	serialRetryDelay       = 500 * time.Millisecond
+	serialMaxRetryDelay    = 30 * time.Second
+	serialProbeReadTimeout = 500 * time.Millisecond
 )
 
 var (
-	portName       = flag.String("port", "/dev/ttyACM0", "Serial port name")
-	baudRate       = flag.Int("baud", 9600, "Serial baud rate")
-	dbFileName     = flag.String("db", "measurements.db", "SQLite database filename")
-	exportCSV      = flag.String("export-csv", "", "Export measurements to CSV file and exit")
-	serveDashboard = flag.Bool("dashboard", false, "Serve web dashboard at http://localhost:8080")
-	enableWeather  = flag.Bool("weather", false, "Enable periodic weather data fetching")
-	weatherCity    = flag.String("city", "", "City name for weather data")
+	portName             = flag.String("port", "/dev/ttyACM0", "Serial port name, or \"auto\" to use the first port sending measurements")
+	usbVID               = flag.String("usb-vid", "", "Select the serial port by USB vendor ID (hex)")
+	usbPID               = flag.String("usb-pid", "", "Select the serial port by USB product ID (hex)")
+	usbSerial            = flag.String("usb-serial", "", "Select the serial port by USB serial number")
+	baudRate             = flag.Int("baud", 9600, "Serial baud rate")
+	lineFraming          = flag.String("framing", framingNone, "Serial line framing: none, or crc8 for $<json>*<crc8> frames")
+	dataSource           = flag.String("source", sourceSerial, "Measurement source: serial, sim for simulated readings, or replay:FILE.csv to replay an export")
+	replaySpeed          = flag.Float64("replay-speed", 1, "Speed factor for -source replay, 0 replays as fast as possible")
+	listenTCP            = flag.String("listen-tcp", "", "Accept newline-delimited JSON measurements over TCP on this address, e.g. :7070")
+	listenUDP            = flag.String("listen-udp", "", "Accept JSON measurement datagrams over UDP on this address, e.g. :7070")
+	mqttConfigFile       = flag.String("mqtt-config", "", "Subscribe to sensor topics on an MQTT broker as described in this JSON file")
+	modbusConfigFile     = flag.String("modbus-config", "", "Poll the Modbus RTU/TCP devices described in this JSON file")
+	validationConfigFile = flag.String("validation-config", "", "Reject implausible readings by the range, rate and spike rules in this JSON file")
+	dbFileName           = flag.String("db", "measurements.db", "SQLite database filename")
+	exportCSV            = flag.String("export-csv", "", "Export measurements to this file, or - for standard output, in -export-format and exit")
+	serveDashboard       = flag.Bool("dashboard", false, "Serve web dashboard at http://localhost:8080")
+	enableWeather        = flag.Bool("weather", false, "Enable periodic weather data fetching")
+	weatherCity          = flag.String("city", "", "City name for weather data")
 )
 
 var mainLoop = mainLoopImpl
+var readDeviceLoop = readDeviceLoopImpl
 
 func main() {
 	flag.Parse()
 	setupLogging()
 
+	if flag.NArg() > 0 {
+		runSubcommand(flag.Args())
+		return
+	}
+
 	if *exportCSV != "" {
 		exportCSVAndExit(dbFileName, exportCSV)
 		return
 	}
 
+	if err := validateFraming(*lineFraming); err != nil {
+		logFatal("%v", err)
+		osExit(1)
+		return
+	}
+	if err := validateSource(*dataSource); err != nil {
+		logFatal("%v", err)
+		osExit(1)
+		return
+	}
+	if *mqttConfigFile != "" {
+		config, err := loadMQTTConfig(*mqttConfigFile)
+		if err != nil {
+			logFatal("%v", err)
+			osExit(1)
+			return
+		}
+		mqttSettings = config
+	}
+	if *modbusConfigFile != "" {
+		config, err := loadModbusConfig(*modbusConfigFile)
+		if err != nil {
+			logFatal("%v", err)
+			osExit(1)
+			return
+		}
+		modbusSettings = config
+	}
+	if *validationConfigFile != "" {
+		config, err := loadValidationConfig(*validationConfigFile)
+		if err != nil {
+			logFatal("%v", err)
+			osExit(1)
+			return
+		}
+		validationSettings = config
+	}
+	if *mqttPublishBroker != "" {
+		err := validateTopicPrefix(*mqttTopicPrefix)
+		if err == nil {
+			err = checkPublishLoop(mqttSettings, *mqttTopicPrefix)
+		}
+		if err != nil {
+			logFatal("%v", err)
+			osExit(1)
+			return
+		}
+	}
+
+	if err := validateInfluxFlags(); err != nil {
+		logFatal("%v", err)
+		osExit(1)
+		return
+	}
+
 	logInfo("Skogsnet v2 started")
 
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
 
-	serialPort := initSerialPort()
-	defer serialPort.Close()
-
 	db, err := mustInitDatabase(dbFileName)
 	if err != nil {
 		logFatal("Could not initialize database: %v", err)
@@ -60,10 +131,49 @@ func main() {
 
 	enableWALMode(db)
 
+	storage, err := openStorage(db)
+	if err != nil {
+		logFatal("Could not open storage: %v", err)
+		osExit(1)
+		return
+	}
+	defer storage.Close()
+	if *dbDriver != driverSQLite {
+		setActiveStorage(storage)
+		defer setActiveStorage(nil)
+	}
+
+	devices := configuredDevices()
+	for i := range devices {
+		if err := registerDevice(db, &devices[i]); err != nil {
+			logFatal("Could not register device %s: %v", devices[i].Name, err)
+			osExit(1)
+			return
+		}
+	}
+
 	var latestWeather Weather
 	var latestWeatherTimestamp int64
 	var wg sync.WaitGroup
 
+	if err := startMeasurementWriter(ctx, db, &wg); err != nil {
+		logFatal("Could not start the database writer: %v", err)
+		osExit(1)
+		return
+	}
+
+	if *dbDriver == driverSQLite {
+		startRollupWorker(ctx, db, &wg)
+	}
+
+	if *backupDir != "" {
+		if err := startBackupScheduler(ctx, db, &wg); err != nil {
+			logFatal("Could not start backups: %v", err)
+			osExit(1)
+			return
+		}
+	}
+
 	if *enableWeather {
 		startWeatherFetcher(ctx, db, &latestWeather, &latestWeatherTimestamp, &wg)
 	}
@@ -72,44 +182,121 @@ func main() {
 		startDashboardServer(ctx, db, &wg)
 	}
 
-	mainLoop(ctx, serialPort, db, &latestWeather, &wg)
+	if *mqttPublishBroker != "" {
+		startMQTTPublisher(ctx, &wg)
+	}
+
+	if *influxURL != "" {
+		if err := startInfluxPusher(ctx, &wg); err != nil {
+			logFatal("Could not start the InfluxDB pusher: %v", err)
+			osExit(1)
+			return
+		}
+	}
+
+	mainLoop(ctx, devices, db, &latestWeather, &wg)
+}
+
+// mainLoopImpl runs every measurement source concurrently until shutdown is
+// requested, then waits for all workers to finish.
+func mainLoopImpl(ctx context.Context, devices []Device, db *sql.DB, latestWeather *Weather, wg *sync.WaitGroup) {
+	var sources sync.WaitGroup
+	for _, source := range configuredSources(devices) {
+		sources.Add(1)
+		go func(source Source) {
+			defer sources.Done()
+			source.Run(ctx, db, latestWeather)
+		}(source)
+	}
+
+	<-ctx.Done()
+	fmt.Println("Graceful shutdown requested. Exiting...")
+	sources.Wait()
+	wg.Wait()
 }
 
-func mainLoopImpl(ctx context.Context, serialPort serial.Port, db *sql.DB, latestWeather *Weather, wg *sync.WaitGroup) {
+// readDeviceLoopImpl processes lines from an open serial port until ctx is
+// cancelled or the port stops delivering data, in which case the error
+// describing the lost link is returned. While it runs, commands can be sent
+// to the device and their replies are routed back to the sender.
+func readDeviceLoopImpl(ctx context.Context, device Device, serialPort serial.Port, db *sql.DB, latestWeather *Weather) error {
+	commands := newCommandChannel(device, serialPort)
+	deviceCommandChannels.attach(commands)
+	defer deviceCommandChannels.detach(commands)
+
 	scanner := bufio.NewScanner(serialPort)
 	for {
 		select {
 		case <-ctx.Done():
-			fmt.Println("Graceful shutdown requested. Exiting...")
-			wg.Wait()
-			return
+			return nil
 		default:
 			line, err := readFromSerial(scanner)
 			if err != nil {
 				if err.Error() == "timeout" {
-					throttledLogWarn(&lastTimeoutWarn, "Serial read timeout. Retrying...")
+					throttledLogWarn(&lastTimeoutWarn, "Serial read timeout on %s. Retrying...", device.Name)
 					continue
 				}
+				return err
 			}
 			if line == "" {
-				throttledLogWarn(&lastWarn, "No data read from serial port. Retrying...")
-				time.Sleep(serialRetryDelay)
 				continue
 			}
 
-			measurement, err := deserializeData(line)
-			if err != nil {
-				throttledLogError(&lastDeserializeErr, "Failed to deserialize data: %v", err)
-				continue
-			}
-
-			currentTimestamp := time.Now().UnixMilli()
-			if err := insertMeasurement(db, measurement, currentTimestamp); err != nil {
-				throttledLogError(&lastInsertErr, "Failed to insert measurement into database: %v", err)
-				continue
-			}
+			handleDeviceLine(device, line, db, latestWeather, commands)
+		}
+	}
+}
 
-			printToConsole(measurement, latestWeather)
+// handleDeviceLine decodes one line received from a device and stores the
+// measurement it carries. Replies to commands are handed to commands when the
+// source supports them.
+func handleDeviceLine(device Device, line string, db *sql.DB, latestWeather *Weather, commands *commandChannel) {
+	payload := line
+	if device.Framing == framingCRC8 {
+		var err error
+		payload, err = decodeFrame(line)
+		if err != nil {
+			deviceStatuses.countFrame(device, frameCorrupt)
+			throttledLogWarn(&lastFrameWarn, "Dropping corrupt frame from %s: %v", device.Name, err)
+			return
 		}
 	}
+
+	if commands != nil && commands.deliver(payload) {
+		deviceStatuses.countFrame(device, frameGood)
+		return
+	}
+
+	measurement, err := deserializeData(payload)
+	if err != nil {
+		deviceStatuses.countFrame(device, frameBad)
+		throttledLogError(&lastDeserializeErr, "Failed to deserialize data from %s: %v", device.Name, err)
+		return
+	}
+	deviceStatuses.countFrame(device, frameGood)
+	measurement.DeviceID = device.ID
+	measurement.DeviceName = device.Name
+
+	if !applyDeviceClock(device, &measurement, time.Now().UnixMilli()) {
+		return
+	}
+	if err := calibrateMeasurement(db, &measurement); err != nil {
+		daemonMetrics.countInsertFailures(1)
+		throttledLogError(&lastInsertErr, "Failed to load calibrations of %s: %v", device.Name, err)
+		return
+	}
+	if r := validateMeasurement(device, measurement); r != nil {
+		rejectMeasurement(db, device, measurement, payload, r)
+		return
+	}
+	if err := storeMeasurement(db, measurement); err != nil {
+		daemonMetrics.countInsertFailures(1)
+		throttledLogError(&lastInsertErr, "Failed to insert measurement into database: %v", err)
+		return
+	}
+	publishMeasurement(device, measurement)
+	pushMeasurementToInflux(device, measurement)
+	daemonMetrics.recordMeasurement(device, measurement)
+
+	printToConsole(measurement, latestWeather)
 }
@@ -4,6 +4,7 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"io"
 	"os"
 	"sync"
 	"testing"
@@ -105,11 +106,17 @@ func TestMainLoop_GracefulShutdown(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	cancel() // Immediately cancel
 
-	mainLoop(ctx, serialPort, db, &latestWeather, &wg)
+	origSuperviseDevice := superviseDevice
+	superviseDevice = func(ctx context.Context, device Device, db *sql.DB, latestWeather *Weather) {
+		readDeviceLoop(ctx, device, serialPort, db, latestWeather)
+	}
+	defer func() { superviseDevice = origSuperviseDevice }()
+
+	mainLoop(ctx, []Device{{Name: "test"}}, db, &latestWeather, &wg)
 	// Should exit gracefully, no panic
 }
 
-func TestMainLoop_TimeoutError(t *testing.T) {
+func TestReadDeviceLoop_TimeoutError(t *testing.T) {
 	origReadFromSerial := readFromSerial
 	readFromSerial = func(scanner Scanner) (string, error) {
 		return "", errors.New("timeout")
@@ -119,18 +126,19 @@ func TestMainLoop_TimeoutError(t *testing.T) {
 	serialPort := &mockSerialPort{data: []string{}}
 	db, _ := sql.Open("sqlite3", ":memory:")
 	var latestWeather Weather
-	var wg sync.WaitGroup
 
 	ctx, cancel := context.WithCancel(context.Background())
 	go func() {
 		time.Sleep(100 * time.Millisecond)
 		cancel()
 	}()
-	mainLoop(ctx, serialPort, db, &latestWeather, &wg)
+	if err := readDeviceLoop(ctx, Device{Name: "test"}, serialPort, db, &latestWeather); err != nil {
+		t.Errorf("Expected nil error on shutdown, got %v", err)
+	}
 	// Should handle timeout error and continue
 }
 
-func TestMainLoop_EmptyLine(t *testing.T) {
+func TestReadDeviceLoop_EmptyLine(t *testing.T) {
 	origReadFromSerial := readFromSerial
 	readFromSerial = func(scanner Scanner) (string, error) {
 		return "", nil
@@ -140,18 +148,19 @@ func TestMainLoop_EmptyLine(t *testing.T) {
 	serialPort := &mockSerialPort{data: []string{}}
 	db, _ := sql.Open("sqlite3", ":memory:")
 	var latestWeather Weather
-	var wg sync.WaitGroup
 
 	ctx, cancel := context.WithCancel(context.Background())
 	go func() {
 		time.Sleep(100 * time.Millisecond)
 		cancel()
 	}()
-	mainLoop(ctx, serialPort, db, &latestWeather, &wg)
+	if err := readDeviceLoop(ctx, Device{Name: "test"}, serialPort, db, &latestWeather); err != nil {
+		t.Errorf("Expected nil error on shutdown, got %v", err)
+	}
 	// Should handle empty line and continue
 }
 
-func TestMainLoop_DeserializeError(t *testing.T) {
+func TestReadDeviceLoop_DeserializeError(t *testing.T) {
 	origReadFromSerial := readFromSerial
 	origDeserializeData := deserializeData
 	readFromSerial = func(scanner Scanner) (string, error) {
@@ -168,18 +177,19 @@ func TestMainLoop_DeserializeError(t *testing.T) {
 	serialPort := &mockSerialPort{data: []string{"bad json"}}
 	db, _ := sql.Open("sqlite3", ":memory:")
 	var latestWeather Weather
-	var wg sync.WaitGroup
 
 	ctx, cancel := context.WithCancel(context.Background())
 	go func() {
 		time.Sleep(100 * time.Millisecond)
 		cancel()
 	}()
-	mainLoop(ctx, serialPort, db, &latestWeather, &wg)
+	if err := readDeviceLoop(ctx, Device{Name: "test"}, serialPort, db, &latestWeather); err != nil {
+		t.Errorf("Expected nil error on shutdown, got %v", err)
+	}
 	// Should handle deserialize error and continue
 }
 
-func TestMainLoop_InsertError(t *testing.T) {
+func TestReadDeviceLoop_InsertError(t *testing.T) {
 	origReadFromSerial := readFromSerial
 	origDeserializeData := deserializeData
 	origInsertMeasurement := insertMeasurement
@@ -201,18 +211,19 @@ func TestMainLoop_InsertError(t *testing.T) {
 	serialPort := &mockSerialPort{data: []string{"{\"temperature_celcius\":21.1,\"humidity\":44.2}"}}
 	db, _ := sql.Open("sqlite3", ":memory:")
 	var latestWeather Weather
-	var wg sync.WaitGroup
 
 	ctx, cancel := context.WithCancel(context.Background())
 	go func() {
 		time.Sleep(100 * time.Millisecond)
 		cancel()
 	}()
-	mainLoop(ctx, serialPort, db, &latestWeather, &wg)
+	if err := readDeviceLoop(ctx, Device{Name: "test"}, serialPort, db, &latestWeather); err != nil {
+		t.Errorf("Expected nil error on shutdown, got %v", err)
+	}
 	// Should handle insert error and continue
 }
 
-func TestMainLoop_Success(t *testing.T) {
+func TestReadDeviceLoop_Success(t *testing.T) {
 	origReadFromSerial := readFromSerial
 	origDeserializeData := deserializeData
 	origInsertMeasurement := insertMeasurement
@@ -237,14 +248,15 @@ func TestMainLoop_Success(t *testing.T) {
 	serialPort := &mockSerialPort{data: []string{"{\"temperature_celcius\":21.1,\"humidity\":44.2}"}}
 	db, _ := sql.Open("sqlite3", ":memory:")
 	var latestWeather Weather
-	var wg sync.WaitGroup
 
 	ctx, cancel := context.WithCancel(context.Background())
 	go func() {
 		time.Sleep(100 * time.Millisecond)
 		cancel()
 	}()
-	mainLoop(ctx, serialPort, db, &latestWeather, &wg)
+	if err := readDeviceLoop(ctx, Device{Name: "test"}, serialPort, db, &latestWeather); err != nil {
+		t.Errorf("Expected nil error on shutdown, got %v", err)
+	}
 	// Should process successfully
 }
 
@@ -276,7 +288,7 @@ func TestMain_DBInitError(t *testing.T) {
 	origSetupLogging := setupLogging
 	origLogFatal := logFatal
 	origOsExit := osExit
-	origInitSerialPort := initSerialPort
+	origRegisterDevice := registerDevice
 
 	mustInitDatabase = func(dbFileName *string) (*sql.DB, error) {
 		return nil, errors.New("db error")
@@ -286,14 +298,14 @@ func TestMain_DBInitError(t *testing.T) {
 	logFatal = func(format string, args ...interface{}) { logFatalCalled = true }
 	osExitCalled := false
 	osExit = func(code int) { osExitCalled = true }
-	initSerialPort = func() serial.Port { return &mockSerialPort{} }
+	registerDevice = func(db *sql.DB, device *Device) error { return nil }
 
 	defer func() {
 		mustInitDatabase = origMustInitDatabase
 		setupLogging = origSetupLogging
 		logFatal = origLogFatal
 		osExit = origOsExit
-		initSerialPort = origInitSerialPort
+		registerDevice = origRegisterDevice
 	}()
 
 	*exportCSV = ""
@@ -307,7 +319,7 @@ func TestMain_WeatherFetcherEnabled(t *testing.T) {
 	origStartWeatherFetcher := startWeatherFetcher
 	origSetupLogging := setupLogging
 	origMustInitDatabase := mustInitDatabase
-	origInitSerialPort := initSerialPort
+	origRegisterDevice := registerDevice
 	origEnableWALMode := enableWALMode
 	origMainLoop := mainLoop
 	origExportCSV := *exportCSV
@@ -321,9 +333,9 @@ func TestMain_WeatherFetcherEnabled(t *testing.T) {
 	mustInitDatabase = func(dbFileName *string) (*sql.DB, error) {
 		return sql.Open("sqlite3", ":memory:")
 	}
-	initSerialPort = func() serial.Port { return &mockSerialPort{} }
+	registerDevice = func(db *sql.DB, device *Device) error { return nil }
 	enableWALMode = func(db *sql.DB) {}
-	mainLoop = func(ctx context.Context, serialPort serial.Port, db *sql.DB, latestWeather *Weather, wg *sync.WaitGroup) {
+	mainLoop = func(ctx context.Context, devices []Device, db *sql.DB, latestWeather *Weather, wg *sync.WaitGroup) {
 	}
 	*exportCSV = ""
 	*enableWeather = true
@@ -331,7 +343,7 @@ func TestMain_WeatherFetcherEnabled(t *testing.T) {
 		startWeatherFetcher = origStartWeatherFetcher
 		setupLogging = origSetupLogging
 		mustInitDatabase = origMustInitDatabase
-		initSerialPort = origInitSerialPort
+		registerDevice = origRegisterDevice
 		enableWALMode = origEnableWALMode
 		mainLoop = origMainLoop
 		*exportCSV = origExportCSV
@@ -348,7 +360,7 @@ func TestMain_DashboardEnabled(t *testing.T) {
 	origStartDashboardServer := startDashboardServer
 	origSetupLogging := setupLogging
 	origMustInitDatabase := mustInitDatabase
-	origInitSerialPort := initSerialPort
+	origRegisterDevice := registerDevice
 	origEnableWALMode := enableWALMode
 	origMainLoop := mainLoop
 	origExportCSV := *exportCSV
@@ -362,9 +374,9 @@ func TestMain_DashboardEnabled(t *testing.T) {
 	mustInitDatabase = func(dbFileName *string) (*sql.DB, error) {
 		return sql.Open("sqlite3", ":memory:")
 	}
-	initSerialPort = func() serial.Port { return &mockSerialPort{} }
+	registerDevice = func(db *sql.DB, device *Device) error { return nil }
 	enableWALMode = func(db *sql.DB) {}
-	mainLoop = func(ctx context.Context, serialPort serial.Port, db *sql.DB, latestWeather *Weather, wg *sync.WaitGroup) {
+	mainLoop = func(ctx context.Context, devices []Device, db *sql.DB, latestWeather *Weather, wg *sync.WaitGroup) {
 	}
 	*exportCSV = ""
 	*serveDashboard = true
@@ -372,7 +384,7 @@ func TestMain_DashboardEnabled(t *testing.T) {
 		startDashboardServer = origStartDashboardServer
 		setupLogging = origSetupLogging
 		mustInitDatabase = origMustInitDatabase
-		initSerialPort = origInitSerialPort
+		registerDevice = origRegisterDevice
 		enableWALMode = origEnableWALMode
 		*exportCSV = origExportCSV
 		*serveDashboard = origServeDashboard
@@ -388,26 +400,26 @@ func TestMain_MainLoopRuns(t *testing.T) {
 	origMainLoop := mainLoop
 	origSetupLogging := setupLogging
 	origMustInitDatabase := mustInitDatabase
-	origInitSerialPort := initSerialPort
+	origRegisterDevice := registerDevice
 	origEnableWALMode := enableWALMode
 	origExportCSV := *exportCSV
 
 	mainLoopCalled := false
-	mainLoop = func(ctx context.Context, serialPort serial.Port, db *sql.DB, latestWeather *Weather, wg *sync.WaitGroup) {
+	mainLoop = func(ctx context.Context, devices []Device, db *sql.DB, latestWeather *Weather, wg *sync.WaitGroup) {
 		mainLoopCalled = true
 	}
 	setupLogging = func() {}
 	mustInitDatabase = func(dbFileName *string) (*sql.DB, error) {
 		return sql.Open("sqlite3", ":memory:")
 	}
-	initSerialPort = func() serial.Port { return &mockSerialPort{} }
+	registerDevice = func(db *sql.DB, device *Device) error { return nil }
 	enableWALMode = func(db *sql.DB) {}
 	*exportCSV = ""
 	defer func() {
 		mainLoop = origMainLoop
 		setupLogging = origSetupLogging
 		mustInitDatabase = origMustInitDatabase
-		initSerialPort = origInitSerialPort
+		registerDevice = origRegisterDevice
 		enableWALMode = origEnableWALMode
 		*exportCSV = origExportCSV
 	}()
@@ -417,3 +429,252 @@ func TestMain_MainLoopRuns(t *testing.T) {
 		t.Error("Expected mainLoop to be called")
 	}
 }
+
+func TestMainLoop_MultipleDevices(t *testing.T) {
+	origPrintToConsole := printToConsole
+	printToConsole = func(m Measurement, w *Weather) {}
+	defer func() { printToConsole = origPrintToConsole }()
+
+	tmpDB := "test_multi_device.db"
+	defer os.Remove(tmpDB)
+	db, err := openDatabase(tmpDB)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	greenhouse := Device{Name: "greenhouse", Port: "/dev/ttyACM0"}
+	cellar := Device{Name: "cellar", Port: "/dev/ttyACM1"}
+	for _, d := range []*Device{&greenhouse, &cellar} {
+		if err := registerDevice(db, d); err != nil {
+			t.Fatalf("Failed to register device: %v", err)
+		}
+	}
+
+	origOpenSerialPort := openSerialPort
+	openSerialPort = func(device Device) (serial.Port, string, error) {
+		switch device.Name {
+		case "greenhouse":
+			return &mockSerialPort{data: []string{`{"temperature_celcius":30.0,"humidity":70.0}`}}, device.Port, nil
+		case "cellar":
+			return &mockSerialPort{data: []string{`{"temperature_celcius":5.0,"humidity":90.0}`}}, device.Port, nil
+		}
+		return nil, "", errors.New("unknown device")
+	}
+	defer func() { openSerialPort = origOpenSerialPort }()
+
+	var latestWeather Weather
+	var wg sync.WaitGroup
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		cancel()
+	}()
+	mainLoop(ctx, []Device{greenhouse, cellar}, db, &latestWeather, &wg)
+
+	for _, tc := range []struct {
+		device Device
+		temp   float64
+	}{{greenhouse, 30.0}, {cellar, 5.0}} {
+		var temp float64
+		row := db.QueryRow("SELECT temperature FROM measurements WHERE device_id = ?", tc.device.ID)
+		if err := row.Scan(&temp); err != nil {
+			t.Fatalf("Failed to query measurement for %s: %v", tc.device.Name, err)
+		}
+		if temp != tc.temp {
+			t.Errorf("Expected %v for %s, got %v", tc.temp, tc.device.Name, temp)
+		}
+	}
+}
+
+func TestReadDeviceLoop_LinkLost(t *testing.T) {
+	origReadFromSerial := readFromSerial
+	readFromSerial = func(scanner Scanner) (string, error) {
+		return "", io.EOF
+	}
+	defer func() { readFromSerial = origReadFromSerial }()
+
+	db, _ := sql.Open("sqlite3", ":memory:")
+	var latestWeather Weather
+
+	err := readDeviceLoop(context.Background(), Device{Name: "test"}, &mockSerialPort{}, db, &latestWeather)
+	if err != io.EOF {
+		t.Errorf("Expected io.EOF when the port goes away, got %v", err)
+	}
+}
+
+func TestReadDeviceLoop_DeviceClock(t *testing.T) {
+	origReadFromSerial := readFromSerial
+	origInsertMeasurement := insertMeasurement
+	origPrintToConsole := printToConsole
+	origClocks := deviceClocks
+	origThrottledLogWarn := throttledLogWarn
+	lines := []string{
+		`{"temperature_celcius":20.0,"ts":1000,"seq":1}`,
+		`{"temperature_celcius":20.0,"ts":1000,"seq":1}`,
+		`{"temperature_celcius":20.5,"ts":6000,"seq":2}`,
+	}
+	readFromSerial = func(scanner Scanner) (string, error) {
+		if len(lines) == 0 {
+			return "", io.EOF
+		}
+		line := lines[0]
+		lines = lines[1:]
+		return line, nil
+	}
+	var stored []Measurement
+	var timestamps []int64
+	insertMeasurement = func(db *sql.DB, m Measurement, ts int64) error {
+		stored = append(stored, m)
+		timestamps = append(timestamps, ts)
+		return nil
+	}
+	printToConsole = func(m Measurement, w *Weather) {}
+	deviceClocks = newClockRegistry()
+	throttledLogWarn = func(last *time.Time, format string, v ...any) {}
+	defer func() {
+		readFromSerial = origReadFromSerial
+		insertMeasurement = origInsertMeasurement
+		printToConsole = origPrintToConsole
+		deviceClocks = origClocks
+		throttledLogWarn = origThrottledLogWarn
+	}()
+
+	var latestWeather Weather
+	readDeviceLoop(context.Background(), Device{Name: "clocked"}, &mockSerialPort{}, nil, &latestWeather)
+
+	if len(stored) != 2 {
+		t.Fatalf("Expected the duplicate to be dropped, got %d measurements", len(stored))
+	}
+	if *stored[1].Sequence != 2 || stored[1].ReceivedTimestamp == 0 {
+		t.Errorf("Unexpected measurement: %+v", stored[1])
+	}
+	// The second ts is 5s ahead of its receive time, so it is clamped to it
+	if timestamps[1]-timestamps[0] > 5000 || timestamps[1] != stored[1].UnixTimestamp {
+		t.Errorf("Expected timestamps from the device clock, got %v", timestamps)
+	}
+}
+
+func TestReadDeviceLoop_Framing(t *testing.T) {
+	origReadFromSerial := readFromSerial
+	origInsertMeasurement := insertMeasurement
+	origPrintToConsole := printToConsole
+	origStatuses := deviceStatuses
+	origThrottledLogWarn := throttledLogWarn
+	origThrottledLogError := throttledLogError
+	lines := []string{
+		"\x00\x13" + encodeFrame(`{"temperature_celcius":20.0}`),
+		encodeFrame(`{"temperature_celcius":20.5}`),
+		encodeFrame(`{"temperature_celcius":"warm"}`),
+		`{"temperature_celcius":21.0}`,
+		encodeFrame(`{"temperature_celcius":21.5}`),
+	}
+	readFromSerial = func(scanner Scanner) (string, error) {
+		if len(lines) == 0 {
+			return "", io.EOF
+		}
+		line := lines[0]
+		lines = lines[1:]
+		return line, nil
+	}
+	var stored []float64
+	insertMeasurement = func(db *sql.DB, m Measurement, ts int64) error {
+		stored = append(stored, m.TemperatureCelsius)
+		return nil
+	}
+	printToConsole = func(m Measurement, w *Weather) {}
+	deviceStatuses = newStatusRegistry()
+	throttledLogWarn = func(last *time.Time, format string, v ...any) {}
+	throttledLogError = func(last *time.Time, format string, v ...any) {}
+	defer func() {
+		readFromSerial = origReadFromSerial
+		insertMeasurement = origInsertMeasurement
+		printToConsole = origPrintToConsole
+		deviceStatuses = origStatuses
+		throttledLogWarn = origThrottledLogWarn
+		throttledLogError = origThrottledLogError
+	}()
+
+	var latestWeather Weather
+	device := Device{Name: "framed", Framing: framingCRC8}
+	readDeviceLoop(context.Background(), device, &mockSerialPort{}, nil, &latestWeather)
+
+	if len(stored) != 2 || stored[0] != 20.5 || stored[1] != 21.5 {
+		t.Errorf("Expected only intact frames to be stored, got %v", stored)
+	}
+	frames := deviceStatuses.snapshot()[0].Frames
+	if frames != (FrameCounts{Good: 2, Bad: 1, Corrupt: 2}) {
+		t.Errorf("Unexpected frame counts: %+v", frames)
+	}
+}
+
+func TestReadDeviceLoop_CommandReply(t *testing.T) {
+	origReadFromSerial := readFromSerial
+	origInsertMeasurement := insertMeasurement
+	origPrintToConsole := printToConsole
+	origLogInfo := logInfo
+
+	written := make(chan struct{})
+	port := &commandPort{written: written}
+	lines := make(chan string, 2)
+	readFromSerial = func(scanner Scanner) (string, error) {
+		line, ok := <-lines
+		if !ok {
+			return "", io.EOF
+		}
+		return line, nil
+	}
+	inserted := 0
+	insertMeasurement = func(db *sql.DB, m Measurement, ts int64) error {
+		inserted++
+		return nil
+	}
+	printToConsole = func(m Measurement, w *Weather) {}
+	logInfo = func(format string, v ...any) {}
+	defer func() {
+		readFromSerial = origReadFromSerial
+		insertMeasurement = origInsertMeasurement
+		printToConsole = origPrintToConsole
+		logInfo = origLogInfo
+	}()
+
+	device := Device{Name: "commanded"}
+	var latestWeather Weather
+	done := make(chan error)
+	go func() { done <- readDeviceLoop(context.Background(), device, port, nil, &latestWeather) }()
+
+	// Wait for the loop to attach its command channel
+	for deviceCommandChannels.get(device.Name) == nil {
+		time.Sleep(time.Millisecond)
+	}
+	go func() {
+		<-written
+		lines <- `{"ack":1,"ok":true,"version":"1.2.0"}`
+		lines <- `{"temperature_celcius":21.5}`
+		close(lines)
+	}()
+
+	reply, err := sendDeviceCommand(context.Background(), device.Name, DeviceCommand{Command: commandVersion})
+	if err != nil || reply["version"] != "1.2.0" {
+		t.Errorf("Expected version reply, got %v, %v", reply, err)
+	}
+	<-done
+	if inserted != 1 {
+		t.Errorf("Expected only the measurement to be stored, got %d", inserted)
+	}
+	if deviceCommandChannels.get(device.Name) != nil {
+		t.Error("Expected command channel to be detached when the loop ends")
+	}
+}
+
+// commandPort signals when a command is written to it.
+type commandPort struct {
+	mockSerialPort
+	written chan struct{}
+}
+
+func (p *commandPort) Write(b []byte) (int, error) {
+	close(p.written)
+	return len(b), nil
+}
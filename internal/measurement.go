@@ -1,8 +1,11 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"sort"
+	"sync"
 	"time"
 )
 
@@ -10,29 +13,177 @@ type Measurement struct {
 	UnixTimestamp      int64
 	TemperatureCelsius float64
 	HumidityPercentage float64
+	DeviceID           int64
+	DeviceName         string
+	Metrics            map[string]float64 `gorm:"-"` // extra numeric fields, e.g. lux or co2
+	DeviceTimestamp    *int64             `gorm:"-"` // ts sent by the device, in its own clock
+	ReceivedTimestamp  int64              `gorm:"-"`
+	Sequence           *int64             `gorm:"-"` // seq sent by the device
+	Raw                map[string]float64 `gorm:"-"` // readings before calibration, by field
+	Missing            map[string]bool    `gorm:"-"` // temperature or humidity fields the reading left out
 }
 
+const (
+	temperatureField = "temperature_celcius"
+	humidityField    = "humidity"
+	timestampField   = "ts"
+	sequenceField    = "seq"
+	deviceField      = "device" // sender name on shared network sources
+)
+
 var deserializeData = deserializeDataImpl
 var printToConsole = printToConsoleImpl
 
+// consoleMu keeps measurements from several devices from interleaving.
+var consoleMu sync.Mutex
+
+// deserializeDataImpl parses a JSON object from the device. Temperature and
+// humidity go to their own fields, and the optional ts (device clock in
+// milliseconds) and seq (increasing counter) are kept for clock correction.
+// Every other numeric field with a valid metric name is kept in Metrics.
+// Non-numeric fields are ignored.
 func deserializeDataImpl(data string) (Measurement, error) {
 	var measurement Measurement
-	type raw struct {
-		TemperatureCelsius float64 `json:"temperature_celcius"`
-		HumidityPercentage float64 `json:"humidity"`
-	}
-	var r raw
-	if err := json.Unmarshal([]byte(data), &r); err != nil {
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(data), &fields); err != nil {
 		return Measurement{}, fmt.Errorf("failed to deserialize data: %w", err)
 	}
-	measurement.TemperatureCelsius = r.TemperatureCelsius
-	measurement.HumidityPercentage = r.HumidityPercentage
+
+	present := make(map[string]bool)
+	for key, raw := range fields {
+		var value float64
+		isNumber := json.Unmarshal(raw, &value) == nil && !bytes.Equal(raw, []byte("null"))
+
+		switch key {
+		case deviceField:
+			continue
+		case timestampField, sequenceField:
+			if bytes.Equal(raw, []byte("null")) {
+				continue
+			}
+			var n int64
+			if err := json.Unmarshal(raw, &n); err != nil || n < 0 {
+				return Measurement{}, fmt.Errorf("failed to deserialize data: %s is not a non-negative integer: %s", key, raw)
+			}
+			if key == timestampField {
+				measurement.DeviceTimestamp = &n
+			} else {
+				measurement.Sequence = &n
+			}
+		case temperatureField, humidityField:
+			if bytes.Equal(raw, []byte("null")) {
+				continue
+			}
+			if !isNumber {
+				return Measurement{}, fmt.Errorf("failed to deserialize data: %s is not a number: %s", key, raw)
+			}
+			if key == temperatureField {
+				measurement.TemperatureCelsius = value
+			} else {
+				measurement.HumidityPercentage = value
+			}
+			present[key] = true
+		default:
+			if !isNumber || !validMetricName(key) {
+				continue
+			}
+			if measurement.Metrics == nil {
+				measurement.Metrics = make(map[string]float64)
+			}
+			measurement.Metrics[key] = value
+		}
+	}
+	for _, field := range []string{temperatureField, humidityField} {
+		if !present[field] {
+			measurement.setMissing(field)
+		}
+	}
 	measurement.UnixTimestamp = time.Now().UnixMilli()
 
 	return measurement, nil
 }
 
+func (m *Measurement) setMissing(field string) {
+	if m.Missing == nil {
+		m.Missing = make(map[string]bool)
+	}
+	m.Missing[field] = true
+}
+
+// readings returns the values the measurement carries by field name,
+// leaving out a temperature or humidity that was not sent.
+func (m Measurement) readings() map[string]float64 {
+	fields := make(map[string]float64, len(m.Metrics)+2)
+	if !m.Missing[temperatureField] {
+		fields[temperatureField] = m.TemperatureCelsius
+	}
+	if !m.Missing[humidityField] {
+		fields[humidityField] = m.HumidityPercentage
+	}
+	for metric, value := range m.Metrics {
+		fields[metric] = value
+	}
+	return fields
+}
+
+// columnValue returns the temperature or humidity to store, or nil when the
+// field was not sent.
+func (m Measurement) columnValue(field string) any {
+	value, ok := m.readings()[field]
+	if !ok {
+		return nil
+	}
+	return value
+}
+
+// metricField returns the field name a metric is stored under, for metrics
+// named on the command line or in config files. "temperature" is accepted
+// for temperature_celcius.
+func metricField(name string) (string, error) {
+	switch name {
+	case "temperature", temperatureField:
+		return temperatureField, nil
+	case timestampField, sequenceField, deviceField:
+		return "", fmt.Errorf("%s cannot be calibrated", name)
+	}
+	if !validMetricName(name) {
+		return "", fmt.Errorf("invalid metric name %q", name)
+	}
+	return name, nil
+}
+
+// validMetricName allows names that are safe as column headers and labels:
+// letters, digits and underscores, not starting with a digit.
+func validMetricName(name string) bool {
+	if name == "" || len(name) > 64 {
+		return false
+	}
+	for i, r := range name {
+		switch {
+		case r == '_', r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z':
+		case r >= '0' && r <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// sortedMetricNames returns the metric names in alphabetical order.
+func sortedMetricNames(metrics map[string]float64) []string {
+	names := make([]string, 0, len(metrics))
+	for name := range metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 func printToConsoleImpl(measurement Measurement, weather *Weather) {
+	consoleMu.Lock()
+	defer consoleMu.Unlock()
+
 	t := time.UnixMilli(measurement.UnixTimestamp)
 
 	const (
@@ -42,9 +193,16 @@ func printToConsoleImpl(measurement Measurement, weather *Weather) {
 		reset  = "\033[0m"
 	)
 
-	fmt.Printf("%sMeasurement at %s%s\n", cyan, t.Format("2006-01-02 15:04:05"), reset)
+	if measurement.DeviceName != "" {
+		fmt.Printf("%sMeasurement from %s at %s%s\n", cyan, measurement.DeviceName, t.Format("2006-01-02 15:04:05"), reset)
+	} else {
+		fmt.Printf("%sMeasurement at %s%s\n", cyan, t.Format("2006-01-02 15:04:05"), reset)
+	}
 	fmt.Printf("    %sTemperature:        %s %s%.2f °C%s\n", green, reset, reset, measurement.TemperatureCelsius, reset)
 	fmt.Printf("    %sHumidity:           %s %s%.2f %%%s\n", green, reset, reset, measurement.HumidityPercentage, reset)
+	for _, name := range sortedMetricNames(measurement.Metrics) {
+		fmt.Printf("    %s%-20s%s %.2f\n", green, name+":", reset, measurement.Metrics[name])
+	}
 
 	if weather != nil && len(weather.Weather) > 0 {
 		fmt.Printf("\n")
@@ -186,3 +186,147 @@ func TestPrintToConsole_NoWeather(t *testing.T) {
 		t.Error("Did not expect output to contain 'Weather:' when weather is nil")
 	}
 }
+
+func TestDeserializeData_ExtraMetrics(t *testing.T) {
+	jsonStr := `{"temperature_celcius":21.0,"humidity":40.0,"lux":312,"pressure":1013.2,"battery_v":3.71,"firmware":"1.2.0","ok":true,"bad-name":1,"nested":{"co2":400}}`
+	m, err := deserializeData(jsonStr)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	expected := map[string]float64{"lux": 312, "pressure": 1013.2, "battery_v": 3.71}
+	if len(m.Metrics) != len(expected) {
+		t.Fatalf("Expected metrics %v, got %v", expected, m.Metrics)
+	}
+	for name, value := range expected {
+		if m.Metrics[name] != value {
+			t.Errorf("Expected %s=%v, got %v", name, value, m.Metrics[name])
+		}
+	}
+}
+
+func TestDeserializeData_OnlyExtraMetrics(t *testing.T) {
+	m, err := deserializeData(`{"co2":612,"soil_moisture":0.43}`)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if m.Metrics["co2"] != 612 || m.Metrics["soil_moisture"] != 0.43 {
+		t.Errorf("Unexpected metrics: %v", m.Metrics)
+	}
+}
+
+func TestDeserializeData_NullTemperature(t *testing.T) {
+	m, err := deserializeData(`{"temperature_celcius":null,"humidity":40.0}`)
+	if err != nil {
+		t.Fatalf("Expected no error for null temperature, got %v", err)
+	}
+	if m.TemperatureCelsius != 0 || m.HumidityPercentage != 40.0 {
+		t.Errorf("Unexpected values: %+v", m)
+	}
+	if fields := m.readings(); len(fields) != 1 || fields[humidityField] != 40 {
+		t.Errorf("Expected only humidity to be read, got %v", fields)
+	}
+}
+
+func TestDeserializeData_NotAnObject(t *testing.T) {
+	for _, data := range []string{`[1,2,3]`, `42`, `not json`} {
+		if _, err := deserializeData(data); err == nil {
+			t.Errorf("Expected error for %q", data)
+		}
+	}
+}
+
+func TestValidMetricName(t *testing.T) {
+	for _, name := range []string{"lux", "co2", "soil_moisture", "Battery_V", "_x"} {
+		if !validMetricName(name) {
+			t.Errorf("Expected %q to be valid", name)
+		}
+	}
+	for _, name := range []string{"", "2nd", "bad-name", "with space", "é", strings.Repeat("a", 65)} {
+		if validMetricName(name) {
+			t.Errorf("Expected %q to be invalid", name)
+		}
+	}
+}
+
+func TestPrintToConsole_Metrics(t *testing.T) {
+	measurement := Measurement{
+		UnixTimestamp:      1752595488000,
+		TemperatureCelsius: 21.1,
+		HumidityPercentage: 44.2,
+		Metrics:            map[string]float64{"lux": 312, "co2": 415.5},
+	}
+
+	var buf bytes.Buffer
+	stdout := os.Stdout
+	r, w, _ := os.Pipe()
+	os.Stdout = w
+	done := make(chan struct{})
+	go func() {
+		io.Copy(&buf, r)
+		close(done)
+	}()
+
+	printToConsole(measurement, nil)
+	w.Close()
+	<-done
+	os.Stdout = stdout
+
+	output := stripANSI(buf.String())
+	if !strings.Contains(output, "co2:                 415.50") || !strings.Contains(output, "lux:                 312.00") {
+		t.Errorf("Expected metrics in output, got:\n%s", output)
+	}
+	if strings.Index(output, "co2:") > strings.Index(output, "lux:") {
+		t.Error("Expected metrics in alphabetical order")
+	}
+}
+
+func TestDeserializeData_TimestampAndSequence(t *testing.T) {
+	m, err := deserializeData(`{"temperature_celcius":21.0,"humidity":40.0,"ts":1752595488000,"seq":42}`)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if m.DeviceTimestamp == nil || *m.DeviceTimestamp != 1752595488000 {
+		t.Errorf("Expected device timestamp, got %v", m.DeviceTimestamp)
+	}
+	if m.Sequence == nil || *m.Sequence != 42 {
+		t.Errorf("Expected seq 42, got %v", m.Sequence)
+	}
+	if len(m.Metrics) != 0 {
+		t.Errorf("Expected ts and seq not to be stored as metrics, got %v", m.Metrics)
+	}
+
+	plain, err := deserializeData(`{"temperature_celcius":21.0}`)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if plain.DeviceTimestamp != nil || plain.Sequence != nil {
+		t.Errorf("Expected no ts or seq, got %+v", plain)
+	}
+}
+
+func TestDeserializeData_InvalidSequence(t *testing.T) {
+	for _, data := range []string{`{"seq":"one"}`, `{"seq":-1}`, `{"seq":1.5}`, `{"ts":"now"}`} {
+		if _, err := deserializeData(data); err == nil {
+			t.Errorf("Expected error for %s", data)
+		}
+	}
+}
+
+func TestMetricField(t *testing.T) {
+	for input, expected := range map[string]string{
+		"temperature":       temperatureField,
+		temperatureField:    temperatureField,
+		humidityField:       humidityField,
+		"lux":               "lux",
+		"soil_moisture_pct": "soil_moisture_pct",
+	} {
+		if metric, err := metricField(input); err != nil || metric != expected {
+			t.Errorf("metricField(%q) = %q, %v, expected %q", input, metric, err, expected)
+		}
+	}
+	for _, input := range []string{"", sequenceField, timestampField, deviceField, "bad name"} {
+		if _, err := metricField(input); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// sensorSample is the last measurement stored for a device.
+type sensorSample struct {
+	temperature float64
+	humidity    float64
+	timestamp   int64
+}
+
+// metricsRegistry keeps what /metrics reports beyond the device statuses:
+// the last sensor and weather values and the failure counters.
+type metricsRegistry struct {
+	mu               sync.Mutex
+	samples          map[string]sensorSample
+	weather          *Weather
+	weatherTimestamp int64
+
+	insertFailures       atomic.Int64
+	spilled              atomic.Int64
+	weatherFetchFailures atomic.Int64
+}
+
+var daemonMetrics = newMetricsRegistry()
+
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{samples: make(map[string]sensorSample)}
+}
+
+// recordMeasurement keeps a stored measurement as the device's current
+// values, unless a newer one was stored already.
+func (r *metricsRegistry) recordMeasurement(device Device, m Measurement) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if last, ok := r.samples[device.Name]; ok && last.timestamp > m.UnixTimestamp {
+		return
+	}
+	r.samples[device.Name] = sensorSample{m.TemperatureCelsius, m.HumidityPercentage, m.UnixTimestamp}
+}
+
+// recordWeather keeps a stored weather sample as the current outside weather.
+func (r *metricsRegistry) recordWeather(w Weather, timestamp int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.weather = &w
+	r.weatherTimestamp = timestamp
+}
+
+// countInsertFailures counts valid measurements or weather samples lost
+// because the database failed, whether storing them, looking up their
+// calibration or registering their device. Rejected readings don't count.
+func (r *metricsRegistry) countInsertFailures(n int) {
+	r.insertFailures.Add(int64(n))
+}
+
+// countSpilled counts measurements the database did not take that were kept
+// in the spill journal, to be written once it recovers.
+func (r *metricsRegistry) countSpilled(n int) {
+	r.spilled.Add(int64(n))
+}
+
+func (r *metricsRegistry) countWeatherFetchFailure() {
+	r.weatherFetchFailures.Add(1)
+}
+
+// metricFamily is a metric with its samples in the Prometheus text format.
+type metricFamily struct {
+	name    string
+	help    string
+	kind    string // gauge or counter
+	samples []metricSample
+}
+
+type metricSample struct {
+	labels [][2]string
+	value  float64
+}
+
+var metricLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func (f *metricFamily) add(value float64, labels ...string) {
+	sample := metricSample{value: value}
+	for i := 0; i+1 < len(labels); i += 2 {
+		sample.labels = append(sample.labels, [2]string{labels[i], labels[i+1]})
+	}
+	f.samples = append(f.samples, sample)
+}
+
+func (f *metricFamily) writeTo(w io.Writer) error {
+	if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind); err != nil {
+		return err
+	}
+	for _, sample := range f.samples {
+		var b strings.Builder
+		b.WriteString(f.name)
+		if len(sample.labels) > 0 {
+			b.WriteByte('{')
+			for i, label := range sample.labels {
+				if i > 0 {
+					b.WriteByte(',')
+				}
+				fmt.Fprintf(&b, `%s="%s"`, label[0], metricLabelEscaper.Replace(label[1]))
+			}
+			b.WriteByte('}')
+		}
+		b.WriteByte(' ')
+		b.WriteString(formatMetricValue(sample.value))
+		b.WriteByte('\n')
+		if _, err := io.WriteString(w, b.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func formatMetricValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// families returns the metrics for the given device statuses, with ages
+// relative to now.
+func (r *metricsRegistry) families(statuses []DeviceStatus, now time.Time) []*metricFamily {
+	temperature := &metricFamily{name: "skogsnet_temperature_celsius", help: "Temperature of the last stored measurement.", kind: "gauge"}
+	humidity := &metricFamily{name: "skogsnet_humidity_percent", help: "Relative humidity of the last stored measurement.", kind: "gauge"}
+	age := &metricFamily{name: "skogsnet_last_sample_age_seconds", help: "Seconds since the last stored measurement was taken.", kind: "gauge"}
+	weatherTemperature := &metricFamily{name: "skogsnet_weather_temperature_celsius", help: "Outside temperature of the last weather sample.", kind: "gauge"}
+	weatherHumidity := &metricFamily{name: "skogsnet_weather_humidity_percent", help: "Outside relative humidity of the last weather sample.", kind: "gauge"}
+	windSpeed := &metricFamily{name: "skogsnet_weather_wind_speed_meters_per_second", help: "Wind speed of the last weather sample.", kind: "gauge"}
+	windDirection := &metricFamily{name: "skogsnet_weather_wind_direction_degrees", help: "Wind direction of the last weather sample.", kind: "gauge"}
+	clouds := &metricFamily{name: "skogsnet_weather_clouds_percent", help: "Cloud cover of the last weather sample.", kind: "gauge"}
+	weatherAge := &metricFamily{name: "skogsnet_weather_age_seconds", help: "Seconds since the last weather sample was fetched.", kind: "gauge"}
+	linesRead := &metricFamily{name: "skogsnet_lines_read_total", help: "Lines received from the device.", kind: "counter"}
+	deserializeFailures := &metricFamily{name: "skogsnet_deserialize_failures_total", help: "Lines from the device that were not a valid measurement.", kind: "counter"}
+	linkUp := &metricFamily{name: "skogsnet_link_up", help: "1 while the device is connected, 0 while its link is lost or reconnecting.", kind: "gauge"}
+	insertFailures := &metricFamily{name: "skogsnet_insert_failures_total", help: "Measurements and weather samples that could not be written to the database and were lost.", kind: "counter"}
+	spilled := &metricFamily{name: "skogsnet_measurements_spilled_total", help: "Measurements written to the spill journal because the database failed.", kind: "counter"}
+	weatherFetchFailures := &metricFamily{name: "skogsnet_weather_fetch_failures_total", help: "Failed attempts to fetch the weather.", kind: "counter"}
+
+	r.mu.Lock()
+	names := make([]string, 0, len(r.samples))
+	for name := range r.samples {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		sample := r.samples[name]
+		temperature.add(sample.temperature, "device", name)
+		humidity.add(sample.humidity, "device", name)
+		age.add(now.Sub(time.UnixMilli(sample.timestamp)).Seconds(), "device", name)
+	}
+	if w := r.weather; w != nil {
+		weatherTemperature.add(w.Main.Temp, "city", w.Name)
+		weatherHumidity.add(float64(w.Main.Humidity), "city", w.Name)
+		windSpeed.add(w.Wind.Speed, "city", w.Name)
+		windDirection.add(float64(w.Wind.Deg), "city", w.Name)
+		clouds.add(float64(w.Clouds.All), "city", w.Name)
+		weatherAge.add(now.Sub(time.UnixMilli(r.weatherTimestamp)).Seconds(), "city", w.Name)
+	}
+	r.mu.Unlock()
+
+	for _, status := range statuses {
+		frames := status.Frames
+		linesRead.add(float64(frames.Good+frames.Bad+frames.Corrupt), "device", status.Device)
+		deserializeFailures.add(float64(frames.Bad), "device", status.Device)
+		if status.Link == "" {
+			continue // posts over HTTP, there is no link
+		}
+		up := 0.0
+		if status.Link == LinkConnected {
+			up = 1
+		}
+		linkUp.add(up, "device", status.Device)
+	}
+	insertFailures.add(float64(r.insertFailures.Load()))
+	spilled.add(float64(r.spilled.Load()))
+	weatherFetchFailures.add(float64(r.weatherFetchFailures.Load()))
+
+	return []*metricFamily{
+		temperature, humidity, age,
+		weatherTemperature, weatherHumidity, windSpeed, windDirection, clouds, weatherAge,
+		linesRead, deserializeFailures, linkUp,
+		insertFailures, spilled, weatherFetchFailures,
+	}
+}
+
+// serveMetrics answers /metrics in the Prometheus text format.
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", metricsContentType)
+	for _, family := range daemonMetrics.families(deviceStatuses.snapshot(), time.Now()) {
+		if err := family.writeTo(w); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsRegistry_Families(t *testing.T) {
+	registry := newMetricsRegistry()
+	now := time.UnixMilli(1_700_000_060_000)
+
+	greenhouse := Device{Name: "greenhouse"}
+	registry.recordMeasurement(greenhouse, Measurement{TemperatureCelsius: 21.5, HumidityPercentage: 40, UnixTimestamp: 1_700_000_000_000})
+	registry.recordMeasurement(greenhouse, Measurement{TemperatureCelsius: 5, HumidityPercentage: 90, UnixTimestamp: 1_699_000_000_000})
+	registry.recordMeasurement(Device{Name: `cellar "north"`}, Measurement{TemperatureCelsius: 8, HumidityPercentage: 70, UnixTimestamp: 1_700_000_050_000})
+
+	var w Weather
+	w.Name = "Stockholm"
+	w.Main.Temp = -3.5
+	w.Main.Humidity = 80
+	w.Wind.Speed = 4.2
+	w.Wind.Deg = 270
+	w.Clouds.All = 75
+	registry.recordWeather(w, 1_700_000_000_000)
+	registry.countInsertFailures(3)
+	registry.countSpilled(5)
+	registry.countWeatherFetchFailure()
+
+	statuses := []DeviceStatus{
+		{Device: "greenhouse", Link: LinkConnected, Frames: FrameCounts{Good: 10, Bad: 2, Corrupt: 1}},
+		{Device: "cellar", Link: LinkLost},
+		{Device: "pusher", Frames: FrameCounts{Good: 4}},
+	}
+
+	var b strings.Builder
+	for _, family := range registry.families(statuses, now) {
+		if err := family.writeTo(&b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	out := b.String()
+
+	for _, want := range []string{
+		"# HELP skogsnet_temperature_celsius Temperature of the last stored measurement.\n# TYPE skogsnet_temperature_celsius gauge\n",
+		`skogsnet_temperature_celsius{device="cellar \"north\""} 8` + "\n",
+		`skogsnet_temperature_celsius{device="greenhouse"} 21.5` + "\n",
+		`skogsnet_humidity_percent{device="greenhouse"} 40` + "\n",
+		`skogsnet_last_sample_age_seconds{device="greenhouse"} 60` + "\n",
+		`skogsnet_last_sample_age_seconds{device="cellar \"north\""} 10` + "\n",
+		`skogsnet_weather_temperature_celsius{city="Stockholm"} -3.5` + "\n",
+		`skogsnet_weather_humidity_percent{city="Stockholm"} 80` + "\n",
+		`skogsnet_weather_wind_speed_meters_per_second{city="Stockholm"} 4.2` + "\n",
+		`skogsnet_weather_wind_direction_degrees{city="Stockholm"} 270` + "\n",
+		`skogsnet_weather_clouds_percent{city="Stockholm"} 75` + "\n",
+		`skogsnet_weather_age_seconds{city="Stockholm"} 60` + "\n",
+		"# TYPE skogsnet_lines_read_total counter\n",
+		`skogsnet_lines_read_total{device="greenhouse"} 13` + "\n",
+		`skogsnet_lines_read_total{device="pusher"} 4` + "\n",
+		`skogsnet_deserialize_failures_total{device="greenhouse"} 2` + "\n",
+		`skogsnet_link_up{device="greenhouse"} 1` + "\n",
+		`skogsnet_link_up{device="cellar"} 0` + "\n",
+		"skogsnet_insert_failures_total 3\n",
+		"skogsnet_measurements_spilled_total 5\n",
+		"skogsnet_weather_fetch_failures_total 1\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Expected metrics to contain %q, got:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, `skogsnet_link_up{device="pusher"}`) {
+		t.Errorf("Expected no link metric for a device without a link, got:\n%s", out)
+	}
+	if strings.Index(out, `device="cellar \"north\""} 8`) > strings.Index(out, `device="greenhouse"} 21.5`) {
+		t.Errorf("Expected devices ordered by name, got:\n%s", out)
+	}
+}
+
+func TestFormatMetricValue(t *testing.T) {
+	cases := map[float64]string{
+		0:                "0",
+		21.5:             "21.5",
+		1e21:             "1e+21",
+		math.Inf(1):      "+Inf",
+		math.Inf(-1):     "-Inf",
+		float64(1 << 40): "1.099511627776e+12",
+	}
+	for value, want := range cases {
+		if got := formatMetricValue(value); got != want {
+			t.Errorf("formatMetricValue(%v) = %q, want %q", value, got, want)
+		}
+	}
+	if got := formatMetricValue(math.NaN()); got != "NaN" {
+		t.Errorf("formatMetricValue(NaN) = %q, want NaN", got)
+	}
+}
+
+func TestServeMetrics(t *testing.T) {
+	origMetrics := daemonMetrics
+	origStatuses := deviceStatuses
+	daemonMetrics = newMetricsRegistry()
+	deviceStatuses = newStatusRegistry()
+	defer func() {
+		daemonMetrics = origMetrics
+		deviceStatuses = origStatuses
+	}()
+
+	device := Device{Name: "greenhouse"}
+	deviceStatuses.countFrame(device, frameGood)
+	deviceStatuses.countFrame(device, frameBad)
+	daemonMetrics.recordMeasurement(device, Measurement{TemperatureCelsius: 20, HumidityPercentage: 50, UnixTimestamp: time.Now().UnixMilli()})
+
+	w := httptest.NewRecorder()
+	serveMetrics(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	if got := w.Header().Get("Content-Type"); got != metricsContentType {
+		t.Errorf("Expected content type %q, got %q", metricsContentType, got)
+	}
+	body := w.Body.String()
+	for _, want := range []string{
+		`skogsnet_temperature_celsius{device="greenhouse"} 20`,
+		`skogsnet_lines_read_total{device="greenhouse"} 2`,
+		`skogsnet_deserialize_failures_total{device="greenhouse"} 1`,
+		"skogsnet_insert_failures_total 0",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected /metrics to contain %q, got:\n%s", want, body)
+		}
+	}
+}
+
+func TestHandleDeviceLine_Metrics(t *testing.T) {
+	origInsertMeasurement := insertMeasurement
+	origPrintToConsole := printToConsole
+	origLogError := throttledLogError
+	origCalibrate := calibrateMeasurement
+	origMetrics := daemonMetrics
+	defer func() {
+		insertMeasurement = origInsertMeasurement
+		printToConsole = origPrintToConsole
+		throttledLogError = origLogError
+		calibrateMeasurement = origCalibrate
+		daemonMetrics = origMetrics
+	}()
+
+	daemonMetrics = newMetricsRegistry()
+	var insertErr error
+	insertMeasurement = func(db *sql.DB, m Measurement, ts int64) error { return insertErr }
+	printToConsole = func(m Measurement, w *Weather) {}
+	throttledLogError = func(last *time.Time, format string, v ...any) {}
+
+	device := Device{ID: 1, Name: t.Name()}
+	handleDeviceLine(device, `{"temperature_celcius":20.0,"humidity":50.0}`, nil, &Weather{}, nil)
+	if sample, ok := daemonMetrics.samples[device.Name]; !ok || sample.temperature != 20 || sample.humidity != 50 {
+		t.Errorf("Expected stored measurement to be recorded, got %+v", daemonMetrics.samples)
+	}
+
+	insertErr = errors.New("disk full")
+	handleDeviceLine(device, `{"temperature_celcius":30.0,"humidity":50.0}`, nil, &Weather{}, nil)
+	if got := daemonMetrics.insertFailures.Load(); got != 1 {
+		t.Errorf("Expected 1 insert failure, got %d", got)
+	}
+	if sample := daemonMetrics.samples[device.Name]; sample.temperature != 20 {
+		t.Errorf("Expected a measurement that was not stored not to be recorded, got %+v", sample)
+	}
+
+	// A measurement lost to a failed calibration lookup counts too
+	calibrateMeasurement = func(db *sql.DB, m *Measurement) error { return errors.New("database is locked") }
+	handleDeviceLine(device, `{"temperature_celcius":30.0,"humidity":50.0}`, nil, &Weather{}, nil)
+	if got := daemonMetrics.insertFailures.Load(); got != 2 {
+		t.Errorf("Expected 2 insert failures, got %d", got)
+	}
+}
+
+func TestRejectMeasurement_NotAnInsertFailure(t *testing.T) {
+	origInsertRejected := insertRejectedMeasurement
+	origLogWarn, origLogError := throttledLogWarn, throttledLogError
+	origMetrics := daemonMetrics
+	defer func() {
+		insertRejectedMeasurement = origInsertRejected
+		throttledLogWarn, throttledLogError = origLogWarn, origLogError
+		daemonMetrics = origMetrics
+	}()
+	daemonMetrics = newMetricsRegistry()
+	insertRejectedMeasurement = func(db *sql.DB, m Measurement, payload string, r *rejection) error {
+		return errors.New("disk full")
+	}
+	throttledLogWarn = func(last *time.Time, format string, v ...any) {}
+	throttledLogError = func(last *time.Time, format string, v ...any) {}
+
+	// The reading was discarded on purpose, only its audit record is lost
+	rejectMeasurement(nil, Device{Name: t.Name()}, Measurement{}, "{}", &rejection{Rule: "max"})
+	if got := daemonMetrics.insertFailures.Load(); got != 0 {
+		t.Errorf("Expected no insert failure for a rejected reading, got %d", got)
+	}
+}
+
+func TestNetworkDevicesStore_Metrics(t *testing.T) {
+	origLogWarn, origLogError := throttledLogWarn, throttledLogError
+	origMetrics := daemonMetrics
+	defer func() {
+		throttledLogWarn, throttledLogError = origLogWarn, origLogError
+		daemonMetrics = origMetrics
+	}()
+	daemonMetrics = newMetricsRegistry()
+	throttledLogWarn = func(last *time.Time, format string, v ...any) {}
+	throttledLogError = func(last *time.Time, format string, v ...any) {}
+
+	db, err := openDatabase(filepath.Join(t.TempDir(), "metrics.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	db.Close()
+
+	// Registering fails with the database closed: only a measurement counts
+	devices := newNetworkDevices(sourceTCP, nil)
+	devices.store(db, "shed", "10.0.0.5", `{"temperature_celcius":20.0,"humidity":50.0}`, &Weather{})
+	devices.store(db, "shed", "10.0.0.5", "not a measurement", &Weather{})
+	if got := daemonMetrics.insertFailures.Load(); got != 1 {
+		t.Errorf("Expected 1 insert failure for the lost measurement, got %d", got)
+	}
+
+	// Senders beyond the limit are ignored, not failed
+	for i := range maxNetworkDevices {
+		devices.devices[fmt.Sprintf("sender-%d", i)] = Device{ID: int64(i + 1)}
+	}
+	devices.store(db, "shed", "10.0.0.5", `{"temperature_celcius":20.0,"humidity":50.0}`, &Weather{})
+	if got := daemonMetrics.insertFailures.Load(); got != 1 {
+		t.Errorf("Expected a sender beyond the limit not to count, got %d", got)
+	}
+}
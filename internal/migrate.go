@@ -0,0 +1,397 @@
+package main
+
+import (
+	"database/sql"
+	"embed"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const migrateUsage = "migrate status | up [VERSION] | down [STEPS]"
+
+var noMigrate = flag.Bool("no-migrate", false, "Do not apply pending schema migrations on startup, and refuse to start while any are pending")
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+var migrationFilePattern = regexp.MustCompile(`^(\d{4})_([a-z0-9_]+)\.(up|down)\.sql$`)
+
+// migrations are the schema changes in the order they are applied. Each has
+// an up script and, unless it can't be undone, a down script.
+var migrations = mustLoadMigrations(migrationFiles)
+
+type migration struct {
+	version int
+	name    string
+	up      string
+	down    string
+}
+
+// migrationState is a migration and when it was applied, 0 if pending.
+type migrationState struct {
+	version   int
+	name      string
+	appliedAt int64
+}
+
+// legacyColumns were added by versions from before migrations to databases
+// created without them. Databases from those versions are brought up to
+// the baseline before it is recorded.
+var legacyColumns = []struct{ table, name, definition string }{
+	{"measurements", "device_id", "INTEGER"},
+	{"measurements", "device_ts", "INTEGER"},
+	{"measurements", "received_ts", "INTEGER"},
+	{"measurements", "seq", "INTEGER"},
+	{"measurements", "raw_temperature", "REAL"},
+	{"measurements", "raw_humidity", "REAL"},
+	{"devices", "token_hash", "TEXT"},
+	{"measurement_values", "raw_value", "REAL"},
+}
+
+func mustLoadMigrations(files fs.FS) []migration {
+	loaded, err := loadMigrations(files)
+	if err != nil {
+		panic(err)
+	}
+	return loaded
+}
+
+// loadMigrations reads NNNN_name.up.sql and NNNN_name.down.sql files. The
+// versions must count up from 1 without gaps.
+func loadMigrations(files fs.FS) ([]migration, error) {
+	paths, err := fs.Glob(files, "migrations/*.sql")
+	if err != nil {
+		return nil, err
+	}
+	byVersion := make(map[int]*migration)
+	for _, p := range paths {
+		match := migrationFilePattern.FindStringSubmatch(path.Base(p))
+		if match == nil {
+			return nil, fmt.Errorf("invalid migration file name %s, expected NNNN_name.up.sql or NNNN_name.down.sql", p)
+		}
+		version, _ := strconv.Atoi(match[1])
+		script, err := fs.ReadFile(files, p)
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &migration{version: version, name: match[2]}
+			byVersion[version] = m
+		}
+		if m.name != match[2] {
+			return nil, fmt.Errorf("migration %04d is named both %s and %s", version, m.name, match[2])
+		}
+		if match[3] == "up" {
+			m.up = string(script)
+		} else {
+			m.down = string(script)
+		}
+	}
+
+	loaded := make([]migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		loaded = append(loaded, *m)
+	}
+	sort.Slice(loaded, func(i, j int) bool { return loaded[i].version < loaded[j].version })
+	for i, m := range loaded {
+		if m.version != i+1 {
+			return nil, fmt.Errorf("migration %04d is missing", i+1)
+		}
+		if m.up == "" {
+			return nil, fmt.Errorf("migration %04d %s has no up script", m.version, m.name)
+		}
+	}
+	return loaded, nil
+}
+
+func ensureMigrationsTable(db *sql.DB) error {
+	_, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at INTEGER NOT NULL
+	);`)
+	return err
+}
+
+// migrationsTableExists reports whether schema_migrations was created, so
+// the version can be read without writing to the database.
+func migrationsTableExists(db *sql.DB) (bool, error) {
+	var exists bool
+	err := db.QueryRow("SELECT COUNT(*) > 0 FROM sqlite_master WHERE type = 'table' AND name = 'schema_migrations'").Scan(&exists)
+	return exists, err
+}
+
+// schemaVersion returns the version of the last applied migration, 0 for a
+// new database or one from before migrations. It doesn't change the
+// database.
+func schemaVersion(db *sql.DB) (int, error) {
+	exists, err := migrationsTableExists(db)
+	if err != nil || !exists {
+		return 0, err
+	}
+	var version int
+	err = db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version)
+	return version, err
+}
+
+// migrationStates lists every known migration with the time it was applied.
+func migrationStates(db *sql.DB) ([]migrationState, error) {
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+
+	states := make([]migrationState, 0, len(migrations))
+	for _, m := range migrations {
+		states = append(states, migrationState{version: m.version, name: m.name, appliedAt: applied[m.version]})
+	}
+	return states, nil
+}
+
+// appliedMigrations returns the time each applied migration was applied at
+// by version, none when schema_migrations doesn't exist yet.
+func appliedMigrations(db *sql.DB) (map[int]int64, error) {
+	applied := make(map[int]int64)
+	exists, err := migrationsTableExists(db)
+	if err != nil || !exists {
+		return applied, err
+	}
+	rows, err := db.Query("SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var version int
+		var appliedAt int64
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+	return applied, rows.Err()
+}
+
+// migrateUp applies the pending migrations up to target, or all of them
+// when target is 0, each in its own transaction. It returns the applied
+// migrations.
+func migrateUp(db *sql.DB, target int) ([]migration, error) {
+	if target < 0 || target > len(migrations) {
+		return nil, fmt.Errorf("unknown schema version %d, the latest is %d", target, len(migrations))
+	}
+	if target == 0 {
+		target = len(migrations)
+	}
+	version, err := schemaVersion(db)
+	if err != nil {
+		return nil, err
+	}
+	if version > len(migrations) {
+		return nil, fmt.Errorf("schema version %d is newer than this program knows", version)
+	}
+	if version >= target {
+		return nil, nil
+	}
+	if err := ensureMigrationsTable(db); err != nil {
+		return nil, err
+	}
+	if version == 0 {
+		if err := adoptLegacySchema(db); err != nil {
+			return nil, err
+		}
+	}
+
+	var applied []migration
+	for _, m := range migrations[version:target] {
+		if err := runMigration(db, m.up, "INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)", m.version, m.name, time.Now().UnixMilli()); err != nil {
+			return applied, fmt.Errorf("migration %04d %s failed: %w", m.version, m.name, err)
+		}
+		applied = append(applied, m)
+	}
+	return applied, nil
+}
+
+// migrateDown reverts the last steps applied migrations, newest first. It
+// returns the reverted migrations.
+func migrateDown(db *sql.DB, steps int) ([]migration, error) {
+	if steps < 1 {
+		return nil, fmt.Errorf("invalid number of steps %d", steps)
+	}
+	version, err := schemaVersion(db)
+	if err != nil {
+		return nil, err
+	}
+	if steps > version {
+		return nil, fmt.Errorf("only %d migration(s) are applied", version)
+	}
+	if version > len(migrations) {
+		return nil, fmt.Errorf("schema version %d is newer than this program knows", version)
+	}
+	for _, m := range migrations[version-steps : version] {
+		if m.down == "" {
+			return nil, fmt.Errorf("migration %04d %s can't be reverted", m.version, m.name)
+		}
+	}
+
+	var reverted []migration
+	for i := version - 1; i >= version-steps; i-- {
+		m := migrations[i]
+		if err := runMigration(db, m.down, "DELETE FROM schema_migrations WHERE version = ?", m.version); err != nil {
+			return reverted, fmt.Errorf("reverting migration %04d %s failed: %w", m.version, m.name, err)
+		}
+		reverted = append(reverted, m)
+	}
+	return reverted, nil
+}
+
+// runMigration runs a script and records it in schema_migrations in one
+// transaction.
+func runMigration(db *sql.DB, script, record string, args ...any) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(script); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(record, args...); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// adoptLegacySchema adds the columns that versions from before migrations
+// added on the fly, so the baseline applies to their databases too.
+func adoptLegacySchema(db *sql.DB) error {
+	for _, column := range legacyColumns {
+		var exists bool
+		err := db.QueryRow("SELECT COUNT(*) > 0 FROM sqlite_master WHERE type = 'table' AND name = ?", column.table).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			continue // created by the baseline
+		}
+		if err := addColumnIfMissing(db, column.table, column.name, column.definition); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addColumnIfMissing adds a column to an existing table unless it is
+// already there.
+func addColumnIfMissing(db *sql.DB, table, column, definition string) error {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, columnType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &columnType, &notNull, &defaultValue, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
+// checkSchemaVersion fails while migrations are pending, for -no-migrate.
+func checkSchemaVersion(db *sql.DB) error {
+	version, err := schemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if version < len(migrations) {
+		return fmt.Errorf("database schema is at version %d of %d; run \"migrate up\" or start without -no-migrate", version, len(migrations))
+	}
+	return nil
+}
+
+// runMigrateCommand implements the migrate subcommand.
+func runMigrateCommand(args []string) error {
+	fs := newSubcommandFlagSet("migrate", migrateUsage)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		fs.Usage()
+		return errors.New("expected status, up or down")
+	}
+	var number int
+	if fs.NArg() == 2 {
+		var err error
+		if number, err = strconv.Atoi(fs.Arg(1)); err != nil {
+			return fmt.Errorf("invalid number %q", fs.Arg(1))
+		}
+	}
+
+	db, err := connectDatabase(*dbFileName)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	switch fs.Arg(0) {
+	case "status":
+		if fs.NArg() != 1 {
+			return errors.New("status takes no arguments")
+		}
+		states, err := migrationStates(db)
+		if err != nil {
+			return err
+		}
+		for _, state := range states {
+			applied := "pending"
+			if state.appliedAt != 0 {
+				applied = "applied " + time.UnixMilli(state.appliedAt).Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%04d %-30s %s\n", state.version, state.name, applied)
+		}
+		return nil
+	case "up":
+		applied, err := migrateUp(db, number)
+		for _, m := range applied {
+			fmt.Printf("Applied %04d %s\n", m.version, m.name)
+		}
+		if err == nil && len(applied) == 0 {
+			fmt.Println("Schema is up to date")
+		}
+		return err
+	case "down":
+		if fs.NArg() == 1 {
+			number = 1
+		}
+		reverted, err := migrateDown(db, number)
+		for _, m := range reverted {
+			fmt.Printf("Reverted %04d %s\n", m.version, m.name)
+		}
+		return err
+	}
+	return fmt.Errorf("unknown migrate action %q, expected status, up or down", fs.Arg(0))
+}
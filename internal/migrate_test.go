@@ -0,0 +1,252 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func indexExists(t *testing.T, db *sql.DB, name string) bool {
+	t.Helper()
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'index' AND name = ?", name).Scan(&count); err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	return count > 0
+}
+
+func TestLoadMigrations(t *testing.T) {
+	if len(migrations) < 2 || migrations[0].name != "baseline" || migrations[0].down != "" {
+		t.Errorf("Unexpected embedded migrations %+v", migrations)
+	}
+
+	loaded, err := loadMigrations(fstest.MapFS{
+		"migrations/0002_second.up.sql":   {Data: []byte("CREATE TABLE b (id INTEGER);")},
+		"migrations/0002_second.down.sql": {Data: []byte("DROP TABLE b;")},
+		"migrations/0001_first.up.sql":    {Data: []byte("CREATE TABLE a (id INTEGER);")},
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(loaded) != 2 || loaded[0].name != "first" || loaded[1].down != "DROP TABLE b;" {
+		t.Errorf("Unexpected migrations %+v", loaded)
+	}
+
+	for name, files := range map[string]fstest.MapFS{
+		"gap":          {"migrations/0001_a.up.sql": {}, "migrations/0003_c.up.sql": {}},
+		"bad name":     {"migrations/1_a.up.sql": {}},
+		"no up":        {"migrations/0001_a.down.sql": {}},
+		"name clash":   {"migrations/0001_a.up.sql": {}, "migrations/0001_b.down.sql": {}},
+		"not sql kind": {"migrations/0001_a.sideways.sql": {}},
+	} {
+		if _, err := loadMigrations(files); err == nil {
+			t.Errorf("Expected error for %s", name)
+		}
+	}
+}
+
+func TestMigrateUp_NewDatabase(t *testing.T) {
+	db, err := connectDatabase(filepath.Join(t.TempDir(), "new.db"))
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer db.Close()
+
+	applied, err := migrateUp(db, 1)
+	if err != nil || len(applied) != 1 {
+		t.Fatalf("Expected the baseline to be applied, got %v, %v", applied, err)
+	}
+	if indexExists(t, db, "idx_measurements_timestamp") {
+		t.Error("Expected the index migration to wait for its version")
+	}
+
+	applied, err = migrateUp(db, 0)
+	if err != nil || len(applied) != len(migrations)-1 {
+		t.Fatalf("Expected the remaining migrations to be applied, got %v, %v", applied, err)
+	}
+	for _, index := range []string{"idx_measurements_timestamp", "idx_weather_timestamp"} {
+		if !indexExists(t, db, index) {
+			t.Errorf("Expected index %s", index)
+		}
+	}
+	if version, _ := schemaVersion(db); version != len(migrations) {
+		t.Errorf("Expected schema version %d, got %d", len(migrations), version)
+	}
+	if applied, err := migrateUp(db, 0); err != nil || len(applied) != 0 {
+		t.Errorf("Expected nothing left to apply, got %v, %v", applied, err)
+	}
+	if _, err := migrateUp(db, len(migrations)+1); err == nil {
+		t.Error("Expected error for an unknown version")
+	}
+
+	db.Exec("INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, 'future', 1)", len(migrations)+1)
+	if _, err := migrateUp(db, 0); err == nil || !strings.Contains(err.Error(), "newer") {
+		t.Errorf("Expected error for a newer schema, got %v", err)
+	}
+}
+
+func TestMigrateUp_LegacyDatabase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "legacy.db")
+	db, err := connectDatabase(path)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer db.Close()
+
+	// As created by the first release, and by one that had added devices
+	_, err = db.Exec(`
+		CREATE TABLE measurements (id INTEGER PRIMARY KEY AUTOINCREMENT, weather_id INTEGER, timestamp INTEGER, temperature REAL, humidity REAL, device_id INTEGER);
+		CREATE TABLE weather (id INTEGER PRIMARY KEY AUTOINCREMENT, timestamp INTEGER, city TEXT, temp REAL, humidity INTEGER, wind_speed REAL, wind_deg INTEGER, clouds INTEGER, weather_code INTEGER, description TEXT);
+		CREATE TABLE devices (id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT NOT NULL UNIQUE, port TEXT, location TEXT, created_at INTEGER);
+		INSERT INTO measurements (timestamp, temperature, humidity, device_id) VALUES (1000, 21.5, 40, 1);
+	`)
+	if err != nil {
+		t.Fatalf("Failed to create legacy schema: %v", err)
+	}
+
+	if _, err := migrateUp(db, 0); err != nil {
+		t.Fatalf("Expected the legacy database to be adopted, got %v", err)
+	}
+	if err := insertMeasurement(db, Measurement{UnixTimestamp: 2000, DeviceID: 1, TemperatureCelsius: 22, Metrics: map[string]float64{"lux": 5}, Raw: map[string]float64{"lux": 4}}, 2000); err != nil {
+		t.Errorf("Expected inserts to work after adoption, got %v", err)
+	}
+	var count int
+	var temperature float64
+	db.QueryRow("SELECT COUNT(*), MIN(temperature) FROM measurements").Scan(&count, &temperature)
+	if count != 2 || temperature != 21.5 {
+		t.Errorf("Expected the existing measurement to be kept, got %d rows, min %v", count, temperature)
+	}
+	if _, err := db.Exec("UPDATE devices SET token_hash = 'x'"); err != nil {
+		t.Errorf("Expected token_hash to be added, got %v", err)
+	}
+}
+
+func TestMigrateDown(t *testing.T) {
+	db, err := connectDatabase(filepath.Join(t.TempDir(), "down.db"))
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer db.Close()
+	migrateUp(db, 2)
+
+	reverted, err := migrateDown(db, 1)
+	if err != nil || len(reverted) != 1 || reverted[0].version != 2 {
+		t.Fatalf("Expected migration 2 to be reverted, got %v, %v", reverted, err)
+	}
+	if indexExists(t, db, "idx_measurements_timestamp") {
+		t.Error("Expected the index to be dropped")
+	}
+	if version, _ := schemaVersion(db); version != 1 {
+		t.Errorf("Expected schema version 1, got %d", version)
+	}
+	if _, err := migrateDown(db, 1); err == nil || !strings.Contains(err.Error(), "can't be reverted") {
+		t.Errorf("Expected the baseline to be irreversible, got %v", err)
+	}
+	if _, err := migrateDown(db, 5); err == nil {
+		t.Error("Expected error for more steps than applied migrations")
+	}
+	if _, err := migrateDown(db, 0); err == nil {
+		t.Error("Expected error for 0 steps")
+	}
+}
+
+// assertNoMigrationsTable fails the test if schema_migrations was created
+// in the database at path.
+func assertNoMigrationsTable(t *testing.T, path string) {
+	t.Helper()
+	db, err := connectDatabase(path)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+	if exists, err := migrationsTableExists(db); err != nil || exists {
+		t.Errorf("Expected schema_migrations not to be created, got %v, %v", exists, err)
+	}
+}
+
+func TestOpenDatabase_NoMigrate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nomigrate.db")
+	defer func() { *noMigrate = false }()
+
+	*noMigrate = true
+	if db, err := openDatabase(path); err == nil || !strings.Contains(err.Error(), "migrate up") {
+		t.Errorf("Expected -no-migrate to refuse a pending schema, got %v", err)
+		if db != nil {
+			db.Close()
+		}
+	}
+	assertNoMigrationsTable(t, path)
+
+	*noMigrate = false
+	db, err := openDatabase(path)
+	if err != nil {
+		t.Fatalf("Expected migrations to be applied, got %v", err)
+	}
+	db.Close()
+
+	*noMigrate = true
+	db, err = openDatabase(path)
+	if err != nil {
+		t.Fatalf("Expected an up to date schema to open with -no-migrate, got %v", err)
+	}
+	db.Close()
+}
+
+func TestRunMigrateCommand(t *testing.T) {
+	tmpDB := filepath.Join(t.TempDir(), "migrate_command.db")
+	origDB := *dbFileName
+	*dbFileName = tmpDB
+	defer func() { *dbFileName = origDB }()
+
+	run := func(args ...string) (string, error) {
+		stdout := os.Stdout
+		r, w, _ := os.Pipe()
+		os.Stdout = w
+		err := runMigrateCommand(args)
+		w.Close()
+		os.Stdout = stdout
+		output, _ := io.ReadAll(r)
+		return string(output), err
+	}
+
+	output, err := run("status")
+	if err != nil || strings.Count(output, "pending") != len(migrations) {
+		t.Errorf("Expected every migration pending, got %q, %v", output, err)
+	}
+	assertNoMigrationsTable(t, tmpDB)
+	output, err = run("up", "1")
+	if err != nil || !strings.Contains(output, "Applied 0001 baseline") || strings.Contains(output, "0002") {
+		t.Errorf("Unexpected up output %q, %v", output, err)
+	}
+	output, _ = run("up")
+	if !strings.Contains(output, "Applied 0002 timestamp_indexes") || strings.Count(output, "Applied") != len(migrations)-1 {
+		t.Errorf("Unexpected up output %q", output)
+	}
+	output, _ = run("up")
+	if !strings.Contains(output, "Schema is up to date") {
+		t.Errorf("Unexpected up output %q", output)
+	}
+	output, _ = run("status")
+	if strings.Contains(output, "pending") || !strings.Contains(output, "0001 baseline") {
+		t.Errorf("Expected every migration applied, got %q", output)
+	}
+	output, err = run("down")
+	latest := migrations[len(migrations)-1]
+	if err != nil || output != fmt.Sprintf("Reverted %04d %s\n", latest.version, latest.name) {
+		t.Errorf("Unexpected down output %q, %v", output, err)
+	}
+
+	stderr := os.Stderr
+	os.Stderr, _ = os.Open(os.DevNull)
+	defer func() { os.Stderr = stderr }()
+	for _, args := range [][]string{nil, {"sideways"}, {"up", "two"}, {"status", "1"}, {"down", "1", "2"}, {"down", "5"}} {
+		if _, err := run(args...); err == nil {
+			t.Errorf("Expected error for %v", args)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+-- Schema as created before versioned migrations. Every statement tolerates
+-- existing tables, so databases from those versions can be adopted.
+
+CREATE TABLE IF NOT EXISTS measurements (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	weather_id INTEGER,
+	device_id INTEGER,
+	timestamp INTEGER,
+	temperature REAL,
+	humidity REAL,
+	device_ts INTEGER,
+	received_ts INTEGER,
+	seq INTEGER,
+	raw_temperature REAL,
+	raw_humidity REAL
+);
+
+CREATE TABLE IF NOT EXISTS weather (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	timestamp INTEGER,
+	city TEXT,
+	temp REAL,
+	humidity INTEGER,
+	wind_speed REAL,
+	wind_deg INTEGER,
+	clouds INTEGER,
+	weather_code INTEGER,
+	description TEXT
+);
+
+CREATE TABLE IF NOT EXISTS devices (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	name TEXT NOT NULL UNIQUE,
+	port TEXT,
+	location TEXT,
+	created_at INTEGER,
+	token_hash TEXT
+);
+
+CREATE TABLE IF NOT EXISTS measurement_values (
+	measurement_id INTEGER NOT NULL,
+	metric TEXT NOT NULL,
+	value REAL,
+	raw_value REAL,
+	PRIMARY KEY (measurement_id, metric)
+);
+
+CREATE TABLE IF NOT EXISTS calibrations (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	device_id INTEGER NOT NULL,
+	metric TEXT NOT NULL,
+	gain REAL NOT NULL DEFAULT 1,
+	offset REAL NOT NULL DEFAULT 0,
+	valid_from INTEGER NOT NULL,
+	created_at INTEGER,
+	note TEXT
+);
+
+CREATE TABLE IF NOT EXISTS rejected_measurements (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	timestamp INTEGER,
+	device_id INTEGER,
+	metric TEXT,
+	value REAL,
+	rule TEXT,
+	reason TEXT,
+	payload TEXT
+);
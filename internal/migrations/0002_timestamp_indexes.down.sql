@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_measurements_timestamp;
+DROP INDEX IF EXISTS idx_measurements_device_timestamp;
+DROP INDEX IF EXISTS idx_weather_timestamp;
@@ -0,0 +1,5 @@
+-- Range queries of the dashboard and the nearest-weather lookup of every
+-- insert scanned the whole table.
+CREATE INDEX IF NOT EXISTS idx_measurements_timestamp ON measurements (timestamp);
+CREATE INDEX IF NOT EXISTS idx_measurements_device_timestamp ON measurements (device_id, timestamp);
+CREATE INDEX IF NOT EXISTS idx_weather_timestamp ON weather (timestamp);
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS rollup_progress;
+DROP TABLE IF EXISTS rollup_values;
+DROP TABLE IF EXISTS rollups;
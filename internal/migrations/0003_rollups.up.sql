@@ -0,0 +1,46 @@
+-- Aggregates of the measurements per device over 1 minute, 1 hour and 1 day,
+-- so long dashboard ranges don't scan every raw row. Averages are sum / count
+-- to let buckets be merged; weather sums cover the measurements linked to a
+-- weather record, weather_id is the latest of them.
+CREATE TABLE rollups (
+	resolution INTEGER NOT NULL,
+	device_id INTEGER NOT NULL,
+	bucket INTEGER NOT NULL,
+	count INTEGER NOT NULL,
+	temperature_sum REAL NOT NULL,
+	temperature_min REAL,
+	temperature_max REAL,
+	humidity_sum REAL NOT NULL,
+	humidity_min REAL,
+	humidity_max REAL,
+	weather_count INTEGER NOT NULL,
+	weather_temp_sum REAL NOT NULL,
+	weather_humidity_sum REAL NOT NULL,
+	wind_speed_sum REAL NOT NULL,
+	wind_deg_sum REAL NOT NULL,
+	clouds_sum REAL NOT NULL,
+	weather_code_sum REAL NOT NULL,
+	weather_id INTEGER,
+	PRIMARY KEY (resolution, device_id, bucket)
+) WITHOUT ROWID;
+
+CREATE TABLE rollup_values (
+	resolution INTEGER NOT NULL,
+	device_id INTEGER NOT NULL,
+	bucket INTEGER NOT NULL,
+	metric TEXT NOT NULL,
+	count INTEGER NOT NULL,
+	sum REAL NOT NULL,
+	min REAL,
+	max REAL,
+	PRIMARY KEY (resolution, device_id, bucket, metric)
+) WITHOUT ROWID;
+
+-- Measurements up to last_measurement_id are in the rollups. Raw
+-- measurements from before raw_since may have been deleted by retention.
+CREATE TABLE rollup_progress (
+	id INTEGER PRIMARY KEY CHECK (id = 1),
+	last_measurement_id INTEGER NOT NULL,
+	raw_since INTEGER NOT NULL
+);
+INSERT INTO rollup_progress (id, last_measurement_id, raw_since) VALUES (1, 0, 0);
@@ -0,0 +1,2 @@
+ALTER TABLE rollups DROP COLUMN humidity_count;
+ALTER TABLE rollups DROP COLUMN temperature_count;
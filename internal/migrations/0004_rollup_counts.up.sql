@@ -0,0 +1,8 @@
+-- Temperature and humidity are NULL when a device does not send them, so
+-- their averages are divided by the measurements that have a value rather
+-- than by count.
+ALTER TABLE rollups ADD COLUMN temperature_count INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE rollups ADD COLUMN humidity_count INTEGER NOT NULL DEFAULT 0;
+UPDATE rollups SET
+	temperature_count = CASE WHEN temperature_min IS NULL THEN 0 ELSE count END,
+	humidity_count = CASE WHEN humidity_min IS NULL THEN 0 ELSE count END;
@@ -0,0 +1,660 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.bug.st/serial"
+)
+
+const (
+	sourceModbus = "modbus"
+
+	modbusReadHolding = 0x03
+	modbusReadInput   = 0x04
+
+	modbusDefaultPort     = "502"
+	modbusDefaultInterval = 30 // seconds
+	modbusTimeout         = 2 * time.Second
+)
+
+var (
+	errModbusTimeout  = errors.New("modbus device did not answer in time")
+	errModbusResponse = errors.New("invalid modbus response")
+)
+
+// modbusSettings holds the -modbus-config file loaded at startup, nil when
+// Modbus is not used.
+var modbusSettings *modbusConfig
+
+var dialModbus = dialModbusImpl
+
+// modbusRetryDelay is the first delay before reconnecting to a device that
+// did not answer.
+var modbusRetryDelay = serialRetryDelay
+
+// modbusConfig is the file given with -modbus-config, e.g.
+//
+//	{
+//	  "devices": [
+//	    {"name": "barn-1", "location": "Barn", "address": "tcp://192.168.1.50:502", "unit": 1, "interval": 30,
+//	     "registers": [
+//	       {"metric": "temperature_celcius", "address": 0, "type": "int16", "scale": 0.1},
+//	       {"metric": "humidity", "address": 1, "type": "uint16", "scale": 0.1}
+//	     ]},
+//	    {"name": "barn-2", "address": "rtu:///dev/ttyUSB0", "baud": 9600, "parity": "even", "unit": 3,
+//	     "registers": [{"metric": "co2", "address": 0, "function": "input", "type": "float32"}]}
+//	  ]
+//	}
+type modbusConfig struct {
+	Devices []modbusDevice `json:"devices"`
+}
+
+// modbusDevice is one transmitter, reached over Modbus TCP (tcp://host:port)
+// or Modbus RTU on a serial port (rtu:///dev/ttyUSB0).
+type modbusDevice struct {
+	Name      string           `json:"name"`
+	Location  string           `json:"location"`
+	Address   string           `json:"address"`
+	Unit      *byte            `json:"unit"`     // 1 when not given
+	Interval  float64          `json:"interval"` // seconds between polls
+	Baud      int              `json:"baud"`
+	Parity    string           `json:"parity"`
+	Registers []modbusRegister `json:"registers"`
+}
+
+// modbusRegister maps one value to a measurement field. The value is read
+// from a holding (default) or input register; 32-bit types span two registers
+// with the high word first. Addresses are the zero-based protocol addresses,
+// so input register 30001 is address 0. The stored value is
+// raw * scale + offset.
+type modbusRegister struct {
+	Metric   string   `json:"metric"`
+	Address  uint16   `json:"address"`
+	Function string   `json:"function"` // holding or input
+	Type     string   `json:"type"`     // int16, uint16, int32, uint32 or float32
+	Scale    *float64 `json:"scale"`
+	Offset   float64  `json:"offset"`
+}
+
+// modbusException is an error answer of the device.
+type modbusException struct {
+	function byte
+	code     byte
+}
+
+func (e modbusException) Error() string {
+	names := map[byte]string{
+		1: "illegal function",
+		2: "illegal data address",
+		3: "illegal data value",
+		4: "server device failure",
+		6: "server device busy",
+	}
+	if name, ok := names[e.code]; ok {
+		return fmt.Sprintf("modbus exception %d (%s) for function %d", e.code, name, e.function)
+	}
+	return fmt.Sprintf("modbus exception %d for function %d", e.code, e.function)
+}
+
+// modbusTransport sends a request PDU to a unit and returns the response PDU.
+type modbusTransport interface {
+	exchange(unit byte, pdu []byte) ([]byte, error)
+	Close() error
+}
+
+// modbusSource polls the registers of one Modbus device.
+type modbusSource struct{ device modbusDevice }
+
+func loadModbusConfig(path string) (*modbusConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config modbusConfig
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&config); err != nil {
+		return nil, fmt.Errorf("invalid Modbus config %s: %w", path, err)
+	}
+	if err := config.validate(); err != nil {
+		return nil, fmt.Errorf("invalid Modbus config %s: %w", path, err)
+	}
+	return &config, nil
+}
+
+func (c modbusConfig) validate() error {
+	if len(c.Devices) == 0 {
+		return errors.New("at least one device is required")
+	}
+	names := make(map[string]bool)
+	for _, device := range c.Devices {
+		if device.Name == "" {
+			return errors.New("device name is required")
+		}
+		if names[device.Name] {
+			return fmt.Errorf("duplicate device name %q", device.Name)
+		}
+		names[device.Name] = true
+		if err := device.validate(); err != nil {
+			return fmt.Errorf("device %s: %w", device.Name, err)
+		}
+	}
+	return nil
+}
+
+func (d modbusDevice) validate() error {
+	transport, target, ok := strings.Cut(d.Address, "://")
+	if !ok || target == "" || (transport != "tcp" && transport != "rtu") {
+		return fmt.Errorf("invalid address %q, expected tcp://HOST[:PORT] or rtu://PORT", d.Address)
+	}
+	if _, err := d.parity(); err != nil {
+		return err
+	}
+	if d.Interval < 0 {
+		return errors.New("interval must be positive")
+	}
+	if len(d.Registers) == 0 {
+		return errors.New("at least one register is required")
+	}
+
+	metrics := make(map[string]bool)
+	for _, reg := range d.Registers {
+		switch reg.Metric {
+		case "":
+			return errors.New("register metric is required")
+		case deviceField, timestampField, sequenceField:
+			return fmt.Errorf("metric %q is reserved", reg.Metric)
+		}
+		if metrics[reg.Metric] {
+			return fmt.Errorf("duplicate metric %q", reg.Metric)
+		}
+		metrics[reg.Metric] = true
+		if _, err := reg.functionCode(); err != nil {
+			return fmt.Errorf("metric %s: %w", reg.Metric, err)
+		}
+		if reg.words() == 0 {
+			return fmt.Errorf("metric %s: unknown type %q, expected int16, uint16, int32, uint32 or float32", reg.Metric, reg.Type)
+		}
+	}
+	return nil
+}
+
+// parity returns the serial parity of an RTU device, none by default.
+func (d modbusDevice) parity() (serial.Parity, error) {
+	switch strings.ToLower(d.Parity) {
+	case "", "none":
+		return serial.NoParity, nil
+	case "even":
+		return serial.EvenParity, nil
+	case "odd":
+		return serial.OddParity, nil
+	}
+	return serial.NoParity, fmt.Errorf("unknown parity %q, expected none, even or odd", d.Parity)
+}
+
+func (d modbusDevice) unit() byte {
+	if d.Unit == nil {
+		return 1
+	}
+	return *d.Unit
+}
+
+func (d modbusDevice) interval() time.Duration {
+	if d.Interval == 0 {
+		return modbusDefaultInterval * time.Second
+	}
+	return time.Duration(d.Interval * float64(time.Second))
+}
+
+func (d modbusDevice) asDevice() Device {
+	return Device{Name: d.Name, Location: d.Location, Port: d.Address, Source: sourceModbus, Framing: framingNone}
+}
+
+func (r modbusRegister) functionCode() (byte, error) {
+	switch r.Function {
+	case "", "holding":
+		return modbusReadHolding, nil
+	case "input":
+		return modbusReadInput, nil
+	}
+	return 0, fmt.Errorf("unknown function %q, expected holding or input", r.Function)
+}
+
+// words returns the number of registers the type spans, 0 for unknown types.
+func (r modbusRegister) words() uint16 {
+	switch r.Type {
+	case "", "int16", "uint16":
+		return 1
+	case "int32", "uint32", "float32":
+		return 2
+	}
+	return 0
+}
+
+// decode converts the raw register words into the scaled value.
+func (r modbusRegister) decode(words []uint16) float64 {
+	var raw float64
+	switch r.Type {
+	case "", "int16":
+		raw = float64(int16(words[0]))
+	case "uint16":
+		raw = float64(words[0])
+	case "int32":
+		raw = float64(int32(uint32(words[0])<<16 | uint32(words[1])))
+	case "uint32":
+		raw = float64(uint32(words[0])<<16 | uint32(words[1]))
+	case "float32":
+		raw = float64(math.Float32frombits(uint32(words[0])<<16 | uint32(words[1])))
+	}
+
+	scale := 1.0
+	if r.Scale != nil {
+		scale = *r.Scale
+	}
+	return raw*scale + r.Offset
+}
+
+// readRegisters reads count registers starting at address with the given
+// read function.
+func readRegisters(t modbusTransport, unit, function byte, address, count uint16) ([]uint16, error) {
+	request := []byte{function, 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(request[1:], address)
+	binary.BigEndian.PutUint16(request[3:], count)
+
+	response, err := t.exchange(unit, request)
+	if err != nil {
+		return nil, err
+	}
+	if len(response) >= 2 && response[0] == function|0x80 {
+		return nil, modbusException{function: function, code: response[1]}
+	}
+	if len(response) < 2 || response[0] != function || int(response[1]) != 2*int(count) || len(response) != 2+2*int(count) {
+		return nil, fmt.Errorf("%w: % X", errModbusResponse, response)
+	}
+
+	words := make([]uint16, count)
+	for i := range words {
+		words[i] = binary.BigEndian.Uint16(response[2+2*i:])
+	}
+	return words, nil
+}
+
+// pollModbus reads every register of the device and returns them as a
+// measurement line.
+func pollModbus(t modbusTransport, device modbusDevice) (string, error) {
+	fields := make(map[string]float64, len(device.Registers))
+	for _, reg := range device.Registers {
+		function, _ := reg.functionCode()
+		words, err := readRegisters(t, device.unit(), function, reg.Address, reg.words())
+		if err != nil {
+			return "", fmt.Errorf("%s at %d: %w", reg.Metric, reg.Address, err)
+		}
+		value := reg.decode(words)
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			return "", fmt.Errorf("%s at %d: invalid value", reg.Metric, reg.Address)
+		}
+		fields[reg.Metric] = value
+	}
+
+	line, err := json.Marshal(fields)
+	return string(line), err
+}
+
+// modbusTCP frames requests with the MBAP header of Modbus TCP.
+type modbusTCP struct {
+	conn          net.Conn
+	transactionID uint16
+}
+
+func (t *modbusTCP) exchange(unit byte, pdu []byte) ([]byte, error) {
+	t.transactionID++
+	request := make([]byte, 7, 7+len(pdu))
+	binary.BigEndian.PutUint16(request[0:], t.transactionID)
+	binary.BigEndian.PutUint16(request[4:], uint16(len(pdu)+1))
+	request[6] = unit
+	request = append(request, pdu...)
+
+	t.conn.SetDeadline(time.Now().Add(modbusTimeout))
+	if _, err := t.conn.Write(request); err != nil {
+		return nil, err
+	}
+
+	for {
+		header := make([]byte, 7)
+		if _, err := io.ReadFull(t.conn, header); err != nil {
+			return nil, modbusReadError(err)
+		}
+		length := binary.BigEndian.Uint16(header[4:])
+		if length < 2 || length > 254 {
+			return nil, fmt.Errorf("%w: length %d", errModbusResponse, length)
+		}
+		response := make([]byte, length-1)
+		if _, err := io.ReadFull(t.conn, response); err != nil {
+			return nil, modbusReadError(err)
+		}
+		// Skip late answers to requests that timed out earlier
+		if binary.BigEndian.Uint16(header[0:]) == t.transactionID {
+			return response, nil
+		}
+	}
+}
+
+func (t *modbusTCP) Close() error {
+	return t.conn.Close()
+}
+
+func modbusReadError(err error) error {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return errModbusTimeout
+	}
+	return err
+}
+
+// modbusRTU frames requests with the unit address and CRC-16 of Modbus RTU.
+// port must return 0 bytes from Read when its read timeout expires, as
+// serial.Port does.
+type modbusRTU struct {
+	port io.ReadWriteCloser
+}
+
+// crc16 computes the CRC-16/MODBUS of data.
+func crc16(data []byte) uint16 {
+	crc := uint16(0xFFFF)
+	for _, b := range data {
+		crc ^= uint16(b)
+		for range 8 {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0xA001
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return crc
+}
+
+func (t *modbusRTU) exchange(unit byte, pdu []byte) ([]byte, error) {
+	frame := append([]byte{unit}, pdu...)
+	frame = binary.LittleEndian.AppendUint16(frame, crc16(frame))
+	if _, err := t.port.Write(frame); err != nil {
+		return nil, err
+	}
+
+	// unit, function and the exception code or byte count
+	response := make([]byte, 3)
+	if err := t.readFull(response); err != nil {
+		return nil, err
+	}
+	remaining := 2 // CRC
+	if response[1]&0x80 == 0 {
+		remaining += int(response[2])
+	}
+	rest := make([]byte, remaining)
+	if err := t.readFull(rest); err != nil {
+		return nil, err
+	}
+	response = append(response, rest...)
+
+	body := response[:len(response)-2]
+	if binary.LittleEndian.Uint16(response[len(response)-2:]) != crc16(body) {
+		return nil, fmt.Errorf("%w: CRC mismatch", errModbusResponse)
+	}
+	if body[0] != unit {
+		return nil, fmt.Errorf("%w: answer from unit %d", errModbusResponse, body[0])
+	}
+	return body[1:], nil
+}
+
+// readFull fills buf, treating an empty read as the read timeout expiring.
+func (t *modbusRTU) readFull(buf []byte) error {
+	for read := 0; read < len(buf); {
+		n, err := t.port.Read(buf[read:])
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return errModbusTimeout
+		}
+		read += n
+	}
+	return nil
+}
+
+func (t *modbusRTU) Close() error {
+	return t.port.Close()
+}
+
+// dialModbusImpl opens the connection to a Modbus device.
+func dialModbusImpl(device modbusDevice) (modbusTransport, error) {
+	transport, target, _ := strings.Cut(device.Address, "://")
+	if transport == "tcp" {
+		if _, _, err := net.SplitHostPort(target); err != nil {
+			target = net.JoinHostPort(target, modbusDefaultPort)
+		}
+		conn, err := net.DialTimeout("tcp", target, modbusTimeout)
+		if err != nil {
+			return nil, err
+		}
+		return &modbusTCP{conn: conn}, nil
+	}
+
+	parity, err := device.parity()
+	if err != nil {
+		return nil, err
+	}
+	baud := device.Baud
+	if baud == 0 {
+		baud = 9600
+	}
+	bus, err := modbusBuses.open(target, serial.Mode{BaudRate: baud, Parity: parity, DataBits: 8, StopBits: serial.OneStopBit}, device.Name)
+	if err != nil {
+		return nil, err
+	}
+	return &modbusUnit{bus: bus}, nil
+}
+
+// modbusBus is one RTU serial port shared by the units wired to it. Only one
+// request can be on the wire at a time, so mu is held for a whole exchange.
+type modbusBus struct {
+	target string
+	mode   serial.Mode
+	owner  string // device the port is claimed for
+
+	mu     sync.Mutex
+	rtu    *modbusRTU
+	closed bool
+
+	refs int // guarded by modbusBusRegistry.mu
+}
+
+type modbusBusRegistry struct {
+	mu    sync.Mutex
+	buses map[string]*modbusBus
+}
+
+var modbusBuses = &modbusBusRegistry{buses: make(map[string]*modbusBus)}
+
+// open returns the bus on target, opening the port for the first unit on it.
+// Every unit on a port must use the same serial settings.
+func (r *modbusBusRegistry) open(target string, mode serial.Mode, device string) (*modbusBus, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if bus, ok := r.buses[target]; ok {
+		if bus.mode != mode {
+			return nil, fmt.Errorf("port %s is opened by device %s with other serial settings", target, bus.owner)
+		}
+		bus.refs++
+		return bus, nil
+	}
+
+	if owner, ok := serialPortClaims.claim(target, device); !ok {
+		return nil, fmt.Errorf("port %s is used by device %s", target, owner)
+	}
+	port, err := serialOpen(target, &mode)
+	if err != nil {
+		serialPortClaims.release(target, device)
+		return nil, err
+	}
+	if err := port.SetReadTimeout(modbusTimeout); err != nil {
+		port.Close()
+		serialPortClaims.release(target, device)
+		return nil, err
+	}
+	bus := &modbusBus{
+		target: target,
+		mode:   mode,
+		owner:  device,
+		rtu:    &modbusRTU{port: &claimedPort{Port: port, name: target, device: device}},
+		refs:   1,
+	}
+	r.buses[target] = bus
+	return bus, nil
+}
+
+// release drops one unit from the bus and closes the port after the last.
+func (r *modbusBusRegistry) release(bus *modbusBus) {
+	r.mu.Lock()
+	bus.refs--
+	last := bus.refs == 0
+	if last && r.buses[bus.target] == bus {
+		delete(r.buses, bus.target)
+	}
+	r.mu.Unlock()
+
+	if last {
+		bus.close()
+	}
+}
+
+// fail closes a bus whose port broke, so the units on it redial and open the
+// port afresh instead of sharing the broken one.
+func (r *modbusBusRegistry) fail(bus *modbusBus) {
+	r.mu.Lock()
+	if r.buses[bus.target] == bus {
+		delete(r.buses, bus.target)
+	}
+	r.mu.Unlock()
+
+	bus.close()
+}
+
+func (b *modbusBus) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.closed {
+		b.closed = true
+		b.rtu.Close()
+	}
+}
+
+// modbusUnit is the transport of one device on a shared RTU bus.
+type modbusUnit struct {
+	bus  *modbusBus
+	once sync.Once
+}
+
+func (u *modbusUnit) exchange(unit byte, pdu []byte) ([]byte, error) {
+	u.bus.mu.Lock()
+	if u.bus.closed {
+		u.bus.mu.Unlock()
+		return nil, fmt.Errorf("port %s was closed", u.bus.target)
+	}
+	response, err := u.bus.rtu.exchange(unit, pdu)
+	u.bus.mu.Unlock()
+
+	// A unit that does not answer or garbles its answer leaves the port
+	// usable for the others on it
+	if err != nil && !errors.Is(err, errModbusTimeout) && !errors.Is(err, errModbusResponse) {
+		modbusBuses.fail(u.bus)
+	}
+	return response, err
+}
+
+func (u *modbusUnit) Close() error {
+	u.once.Do(func() { modbusBuses.release(u.bus) })
+	return nil
+}
+
+// claimedPort releases its claim on the serial port when closed.
+type claimedPort struct {
+	serial.Port
+	name, device string
+	once         sync.Once
+}
+
+func (p *claimedPort) Close() error {
+	err := p.Port.Close()
+	p.once.Do(func() { serialPortClaims.release(p.name, p.device) })
+	return err
+}
+
+// Run polls the device every interval, reconnecting with exponential backoff
+// when the device cannot be reached.
+func (s modbusSource) Run(ctx context.Context, db *sql.DB, latestWeather *Weather) {
+	device := s.device.asDevice()
+	if err := registerDevice(db, &device); err != nil {
+		logError("Could not register Modbus device %s: %v", device.Name, err)
+		return
+	}
+
+	backoff := modbusRetryDelay
+	var transport modbusTransport
+	defer func() {
+		if transport != nil {
+			transport.Close()
+		}
+	}()
+
+	for ctx.Err() == nil {
+		if transport == nil {
+			var err error
+			transport, err = dialModbus(s.device)
+			if err != nil {
+				deviceStatuses.setLink(device, LinkReconnecting, err)
+				if !sleepContext(ctx, backoff) {
+					return
+				}
+				backoff = min(backoff*2, serialMaxRetryDelay)
+				continue
+			}
+		}
+
+		line, err := pollModbus(transport, s.device)
+		if err != nil {
+			// An exception is an answer; the connection itself is fine
+			var exception modbusException
+			if !errors.As(err, &exception) {
+				transport.Close()
+				transport = nil
+			}
+			deviceStatuses.setLink(device, LinkLost, err)
+			if !sleepContext(ctx, backoff) {
+				return
+			}
+			backoff = min(backoff*2, serialMaxRetryDelay)
+			continue
+		}
+
+		backoff = modbusRetryDelay
+		deviceStatuses.setLink(device, LinkConnected, nil)
+		handleDeviceLine(device, line, db, latestWeather, nil)
+		if !sleepContext(ctx, s.device.interval()) {
+			return
+		}
+	}
+}
@@ -0,0 +1,466 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.bug.st/serial"
+)
+
+// modbusSimulator answers read requests from its register tables.
+type modbusSimulator struct {
+	mu      sync.Mutex
+	holding map[uint16]uint16
+	input   map[uint16]uint16
+}
+
+func (s *modbusSimulator) handle(pdu []byte) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	function := pdu[0]
+	registers := map[byte]map[uint16]uint16{modbusReadHolding: s.holding, modbusReadInput: s.input}[function]
+	if registers == nil || len(pdu) != 5 {
+		return []byte{function | 0x80, 1}
+	}
+	address := binary.BigEndian.Uint16(pdu[1:])
+	count := binary.BigEndian.Uint16(pdu[3:])
+
+	response := []byte{function, byte(2 * count)}
+	for i := range count {
+		value, ok := registers[address+i]
+		if !ok {
+			return []byte{function | 0x80, 2}
+		}
+		response = binary.BigEndian.AppendUint16(response, value)
+	}
+	return response
+}
+
+// serveTCP runs a Modbus TCP server for the simulator and returns its address.
+func (s *modbusSimulator) serveTCP(t *testing.T) (string, func()) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+
+	var conns sync.WaitGroup
+	var mu sync.Mutex
+	var open []net.Conn
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			open = append(open, conn)
+			mu.Unlock()
+			conns.Add(1)
+			go func() {
+				defer conns.Done()
+				defer conn.Close()
+				for {
+					header := make([]byte, 7)
+					if _, err := io.ReadFull(conn, header); err != nil {
+						return
+					}
+					pdu := make([]byte, binary.BigEndian.Uint16(header[4:])-1)
+					if _, err := io.ReadFull(conn, pdu); err != nil {
+						return
+					}
+					response := s.handle(pdu)
+					binary.BigEndian.PutUint16(header[4:], uint16(len(response)+1))
+					conn.Write(append(header, response...))
+				}
+			}()
+		}
+	}()
+
+	stop := func() {
+		listener.Close()
+		mu.Lock()
+		for _, conn := range open {
+			conn.Close()
+		}
+		mu.Unlock()
+		conns.Wait()
+	}
+	t.Cleanup(stop)
+	return listener.Addr().String(), stop
+}
+
+// fakeRTUPort answers RTU frames for one unit like a serial port with a read
+// timeout: reads return 0 bytes when no answer is pending.
+type fakeRTUPort struct {
+	sim     *modbusSimulator
+	unit    byte
+	corrupt bool
+	pending bytes.Buffer
+}
+
+func (p *fakeRTUPort) Write(frame []byte) (int, error) {
+	body := frame[:len(frame)-2]
+	if binary.LittleEndian.Uint16(frame[len(frame)-2:]) != crc16(body) || body[0] != p.unit {
+		return len(frame), nil // ignored, as on a shared bus
+	}
+	response := append([]byte{p.unit}, p.sim.handle(body[1:])...)
+	crc := crc16(response)
+	if p.corrupt {
+		crc++
+	}
+	p.pending.Write(binary.LittleEndian.AppendUint16(response, crc))
+	return len(frame), nil
+}
+
+func (p *fakeRTUPort) Read(buf []byte) (int, error) {
+	if p.pending.Len() == 0 {
+		return 0, nil
+	}
+	return p.pending.Read(buf)
+}
+
+func (p *fakeRTUPort) Close() error { return nil }
+
+func floatWords(v float32) (uint16, uint16) {
+	bits := math.Float32bits(v)
+	return uint16(bits >> 16), uint16(bits)
+}
+
+func TestCRC16(t *testing.T) {
+	if crc := crc16([]byte{0x01, 0x03, 0x00, 0x00, 0x00, 0x0A}); crc != 0xCDC5 {
+		t.Errorf("Expected CRC 0xCDC5, got %#04X", crc)
+	}
+}
+
+func TestModbusRegister_Decode(t *testing.T) {
+	scale := 0.1
+	high, low := floatWords(1013.25)
+	cases := []struct {
+		reg      modbusRegister
+		words    []uint16
+		expected float64
+	}{
+		{modbusRegister{Scale: &scale}, []uint16{0xFF9C}, -10},
+		{modbusRegister{Type: "uint16", Scale: &scale}, []uint16{0xFF9C}, 6543.6},
+		{modbusRegister{Type: "int32"}, []uint16{0xFFFF, 0xFFFE}, -2},
+		{modbusRegister{Type: "uint32"}, []uint16{0x0001, 0x0000}, 65536},
+		{modbusRegister{Type: "float32"}, []uint16{high, low}, 1013.25},
+		{modbusRegister{Type: "int16", Offset: -40}, []uint16{65}, 25},
+	}
+	for _, c := range cases {
+		if value := c.reg.decode(c.words); math.Abs(value-c.expected) > 1e-9 {
+			t.Errorf("decode(%+v, %v) = %v, expected %v", c.reg, c.words, value, c.expected)
+		}
+	}
+}
+
+func TestLoadModbusConfig(t *testing.T) {
+	path := "test_modbus_config.json"
+	defer os.Remove(path)
+
+	write := func(content string) {
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatalf("Failed to write config: %v", err)
+		}
+	}
+
+	write(`{"devices":[{"name":"barn-1","address":"tcp://192.168.1.50","registers":[{"metric":"temperature_celcius","address":0,"scale":0.1}]},
+		{"name":"barn-2","address":"rtu:///dev/ttyUSB0","unit":0,"parity":"even","interval":5,"registers":[{"metric":"co2","address":3,"function":"input","type":"float32"}]}]}`)
+	config, err := loadModbusConfig(path)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(config.Devices) != 2 || config.Devices[0].unit() != 1 || config.Devices[1].unit() != 0 {
+		t.Errorf("Unexpected config: %+v", config)
+	}
+	if config.Devices[0].interval() != modbusDefaultInterval*time.Second || config.Devices[1].interval() != 5*time.Second {
+		t.Errorf("Unexpected intervals %v, %v", config.Devices[0].interval(), config.Devices[1].interval())
+	}
+
+	register := `"registers":[{"metric":"humidity","address":1}]`
+	invalid := map[string]string{
+		`{"devices":[]}`: "at least one device",
+		`{"devices":[{"address":"tcp://a",` + register + `}]}`:                                                              "name is required",
+		`{"devices":[{"name":"a","address":"udp://a",` + register + `}]}`:                                                   "invalid address",
+		`{"devices":[{"name":"a","address":"tcp://a","parity":"mark",` + register + `}]}`:                                   "unknown parity",
+		`{"devices":[{"name":"a","address":"tcp://a","registers":[]}]}`:                                                     "at least one register",
+		`{"devices":[{"name":"a","address":"tcp://a","registers":[{"metric":"seq"}]}]}`:                                     "reserved",
+		`{"devices":[{"name":"a","address":"tcp://a","registers":[{"metric":"x","type":"int64"}]}]}`:                        "unknown type",
+		`{"devices":[{"name":"a","address":"tcp://a","registers":[{"metric":"x","function":"coil"}]}]}`:                     "unknown function",
+		`{"devices":[{"name":"a","address":"tcp://a","registers":[{"metric":"x"},{"metric":"x"}]}]}`:                        "duplicate metric",
+		`{"devices":[{"name":"a","address":"tcp://a",` + register + `},{"name":"a","address":"tcp://b",` + register + `}]}`: "duplicate device",
+	}
+	for content, expected := range invalid {
+		write(content)
+		if _, err := loadModbusConfig(path); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("Config %s: expected error containing %q, got %v", content, expected, err)
+		}
+	}
+}
+
+func TestPollModbus_TCP(t *testing.T) {
+	high, low := floatWords(612.5)
+	sim := &modbusSimulator{
+		holding: map[uint16]uint16{0: 0xFF38, 1: 455},
+		input:   map[uint16]uint16{10: high, 11: low},
+	}
+	addr, _ := sim.serveTCP(t)
+
+	scale := 0.1
+	device := modbusDevice{
+		Name:    "barn-1",
+		Address: "tcp://" + addr,
+		Registers: []modbusRegister{
+			{Metric: temperatureField, Address: 0, Scale: &scale},
+			{Metric: humidityField, Address: 1, Type: "uint16", Scale: &scale},
+			{Metric: "co2", Address: 10, Function: "input", Type: "float32"},
+		},
+	}
+	transport, err := dialModbus(device)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer transport.Close()
+
+	line, err := pollModbus(transport, device)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	m, err := deserializeData(line)
+	if err != nil {
+		t.Fatalf("Expected a valid line, got %q: %v", line, err)
+	}
+	if math.Abs(m.TemperatureCelsius+20) > 1e-9 || math.Abs(m.HumidityPercentage-45.5) > 1e-9 || m.Metrics["co2"] != 612.5 {
+		t.Errorf("Unexpected measurement from %s: %+v", line, m)
+	}
+
+	device.Registers = append(device.Registers, modbusRegister{Metric: "lux", Address: 99})
+	_, err = pollModbus(transport, device)
+	var exception modbusException
+	if !errors.As(err, &exception) || exception.code != 2 || !strings.Contains(err.Error(), "illegal data address") {
+		t.Errorf("Expected illegal data address exception, got %v", err)
+	}
+}
+
+func TestModbusRTU_Exchange(t *testing.T) {
+	sim := &modbusSimulator{holding: map[uint16]uint16{4: 215}}
+	port := &fakeRTUPort{sim: sim, unit: 3}
+	transport := &modbusRTU{port: port}
+
+	words, err := readRegisters(transport, 3, modbusReadHolding, 4, 1)
+	if err != nil || len(words) != 1 || words[0] != 215 {
+		t.Fatalf("Expected [215], got %v, %v", words, err)
+	}
+
+	_, err = readRegisters(transport, 3, modbusReadHolding, 5, 1)
+	var exception modbusException
+	if !errors.As(err, &exception) || exception.code != 2 {
+		t.Errorf("Expected exception, got %v", err)
+	}
+
+	if _, err := readRegisters(transport, 7, modbusReadHolding, 4, 1); err != errModbusTimeout {
+		t.Errorf("Expected timeout for a unit that does not answer, got %v", err)
+	}
+
+	port.corrupt = true
+	if _, err := readRegisters(transport, 3, modbusReadHolding, 4, 1); !errors.Is(err, errModbusResponse) {
+		t.Errorf("Expected CRC error, got %v", err)
+	}
+}
+
+// fakeRTUBus is a serial port with several units wired to it. It fails the
+// test when a request is written before the previous answer was read.
+type fakeRTUBus struct {
+	mockPort
+	t      *testing.T
+	units  map[byte]*fakeRTUPort
+	mu     sync.Mutex
+	closed bool
+}
+
+func (b *fakeRTUBus) SetReadTimeout(time.Duration) error { return nil }
+
+func (b *fakeRTUBus) Write(frame []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, unit := range b.units {
+		if unit.pending.Len() > 0 {
+			b.t.Error("Request written while an answer was pending")
+		}
+	}
+	for _, unit := range b.units {
+		unit.Write(frame)
+	}
+	return len(frame), nil
+}
+
+func (b *fakeRTUBus) Read(buf []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, unit := range b.units {
+		if unit.pending.Len() > 0 {
+			return unit.Read(buf)
+		}
+	}
+	return 0, nil
+}
+
+func (b *fakeRTUBus) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	return nil
+}
+
+func TestDialModbus_SharedRTUBus(t *testing.T) {
+	origSerialOpen := serialOpen
+	defer func() { serialOpen = origSerialOpen }()
+
+	bus := &fakeRTUBus{t: t, units: map[byte]*fakeRTUPort{
+		1: {sim: &modbusSimulator{holding: map[uint16]uint16{0: 211}}, unit: 1},
+		2: {sim: &modbusSimulator{holding: map[uint16]uint16{0: 185}}, unit: 2},
+	}}
+	opened := 0
+	serialOpen = func(name string, mode *serial.Mode) (serial.Port, error) {
+		opened++
+		return bus, nil
+	}
+
+	unit1, unit2 := byte(1), byte(2)
+	first, err := dialModbus(modbusDevice{Name: "barn-1", Address: "rtu:///dev/ttyUSB0", Unit: &unit1})
+	if err != nil {
+		t.Fatalf("Failed to dial first unit: %v", err)
+	}
+	second, err := dialModbus(modbusDevice{Name: "barn-2", Address: "rtu:///dev/ttyUSB0", Unit: &unit2})
+	if err != nil {
+		t.Fatalf("Expected second unit to share the port, got %v", err)
+	}
+	if opened != 1 {
+		t.Errorf("Expected port to be opened once, got %d", opened)
+	}
+	if _, err := dialModbus(modbusDevice{Name: "barn-3", Address: "rtu:///dev/ttyUSB0", Baud: 19200}); err == nil {
+		t.Error("Expected other serial settings on the same port to fail")
+	}
+	if owner, ok := serialPortClaims.claim("/dev/ttyUSB0", "greenhouse"); ok || owner != "barn-1" {
+		t.Errorf("Expected the port to stay claimed by barn-1, got %s", owner)
+	}
+
+	var wg sync.WaitGroup
+	for _, c := range []struct {
+		transport modbusTransport
+		unit      byte
+		expected  uint16
+	}{{first, 1, 211}, {second, 2, 185}} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 20 {
+				words, err := readRegisters(c.transport, c.unit, modbusReadHolding, 0, 1)
+				if err != nil || len(words) != 1 || words[0] != c.expected {
+					t.Errorf("Expected [%d] from unit %d, got %v, %v", c.expected, c.unit, words, err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	first.Close()
+	first.Close()
+	if bus.closed {
+		t.Error("Expected port to stay open while a unit uses it")
+	}
+	if _, err := readRegisters(second, 2, modbusReadHolding, 0, 1); err != nil {
+		t.Errorf("Expected remaining unit to keep polling, got %v", err)
+	}
+	second.Close()
+	if !bus.closed {
+		t.Error("Expected port to be closed with its last unit")
+	}
+	if owner, ok := serialPortClaims.claim("/dev/ttyUSB0", "greenhouse"); !ok {
+		t.Errorf("Expected port claim to be released, held by %s", owner)
+	}
+	serialPortClaims.release("/dev/ttyUSB0", "greenhouse")
+}
+
+func TestModbusSource(t *testing.T) {
+	db, stored := networkTestSetup(t)
+	sim := &modbusSimulator{holding: map[uint16]uint16{0: 211, 1: 604}}
+	addr, stopServer := sim.serveTCP(t)
+
+	origRetryDelay := modbusRetryDelay
+	defer func() { modbusRetryDelay = origRetryDelay }()
+	modbusRetryDelay = 10 * time.Millisecond
+
+	scale := 0.1
+	source := modbusSource{modbusDevice{
+		Name:     "barn-1",
+		Location: "Barn",
+		Address:  "tcp://" + addr,
+		Interval: 0.02,
+		Registers: []modbusRegister{
+			{Metric: temperatureField, Address: 0, Scale: &scale},
+			{Metric: humidityField, Address: 1, Scale: &scale},
+		},
+	}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		source.Run(ctx, db, &Weather{})
+		close(done)
+	}()
+
+	waitFor(t, "Modbus measurements", func() bool { return len(stored()) >= 2 })
+	m := stored()[0]
+	if math.Abs(m.TemperatureCelsius-21.1) > 1e-9 || math.Abs(m.HumidityPercentage-60.4) > 1e-9 {
+		t.Errorf("Unexpected measurement: %+v", m)
+	}
+	device, err := lookupDevice(db, "barn-1")
+	if err != nil || device.Location != "Barn" || device.Port != "tcp://"+addr || m.DeviceID != device.ID {
+		t.Errorf("Expected device registered with its address, got %+v, %v", device, err)
+	}
+
+	stopServer()
+	waitFor(t, "link lost", func() bool {
+		for _, status := range deviceStatuses.snapshot() {
+			if status.Device == "barn-1" && status.Link != LinkConnected {
+				return true
+			}
+		}
+		return false
+	})
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Modbus source did not stop")
+	}
+}
+
+func TestConfiguredSources_Modbus(t *testing.T) {
+	origSettings := modbusSettings
+	defer func() { modbusSettings = origSettings }()
+
+	modbusSettings = &modbusConfig{Devices: []modbusDevice{{Name: "barn-1"}, {Name: "barn-2"}}}
+	sources := configuredSources(nil)
+	if len(sources) != 2 {
+		t.Fatalf("Expected a source per Modbus device, got %d", len(sources))
+	}
+	if source, ok := sources[1].(modbusSource); !ok || source.device.Name != "barn-2" {
+		t.Errorf("Expected Modbus source for barn-2, got %#v", sources[1])
+	}
+}
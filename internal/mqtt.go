@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	mqttReconnectDelay  = 5 * time.Second
+	mqttDisconnectQuiet = 250 // milliseconds
+)
+
+// mqttSettings holds the -mqtt-config file loaded at startup, nil when MQTT
+// is not used.
+var mqttSettings *mqttConfig
+
+// mqttConfig is the file given with -mqtt-config, e.g.
+//
+//	{
+//	  "broker": "tcp://localhost:1883",
+//	  "subscriptions": [
+//	    {"topic": "zigbee2mqtt/+", "device": "{1}",
+//	     "fields": {"temperature_celcius": "temperature", "humidity": "humidity", "battery": "battery"}},
+//	    {"topic": "tele/+/SENSOR", "device": "{1}",
+//	     "fields": {"temperature_celcius": "AM2301.Temperature", "humidity": "AM2301.Humidity"}}
+//	  ]
+//	}
+type mqttConfig struct {
+	Broker        string             `json:"broker"`
+	ClientID      string             `json:"client_id"`
+	Username      string             `json:"username"`
+	Password      string             `json:"password"`
+	Subscriptions []mqttSubscription `json:"subscriptions"`
+}
+
+// mqttSubscription maps the messages on a topic pattern to measurements.
+// Device names the device a message belongs to, where {1}, {2}, ... are
+// replaced by the topic levels matched by the wildcards of Topic. Fields maps
+// measurement fields to paths into the JSON payload such as "AM2301.Humidity"
+// or "sensors.0.value"; without fields the payload must already be a
+// measurement line.
+type mqttSubscription struct {
+	Topic  string            `json:"topic"`
+	Device string            `json:"device"`
+	Fields map[string]string `json:"fields"`
+}
+
+// mqttSource subscribes to sensor topics on an MQTT broker.
+type mqttSource struct {
+	config     mqttConfig
+	devices    *networkDevices
+	subscribed chan struct{} // receives after every (re)subscription, for tests
+}
+
+func loadMQTTConfig(path string) (*mqttConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config mqttConfig
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&config); err != nil {
+		return nil, fmt.Errorf("invalid MQTT config %s: %w", path, err)
+	}
+	if err := config.validate(); err != nil {
+		return nil, fmt.Errorf("invalid MQTT config %s: %w", path, err)
+	}
+	return &config, nil
+}
+
+func (c mqttConfig) validate() error {
+	if c.Broker == "" {
+		return errors.New("broker is required")
+	}
+	if len(c.Subscriptions) == 0 {
+		return errors.New("at least one subscription is required")
+	}
+	for i, sub := range c.Subscriptions {
+		if err := validateTopicPattern(sub.Topic); err != nil {
+			return fmt.Errorf("subscription %d: %w", i+1, err)
+		}
+		for field, path := range sub.Fields {
+			if field == deviceField {
+				return fmt.Errorf("subscription %d: field %q is reserved", i+1, field)
+			}
+			if strings.TrimPrefix(path, "$.") == "" {
+				return fmt.Errorf("subscription %d: empty path for %s", i+1, field)
+			}
+		}
+	}
+	return nil
+}
+
+// validateTopicPattern checks the wildcards of an MQTT topic filter: + stands
+// for one whole level and # for all remaining levels.
+func validateTopicPattern(pattern string) error {
+	if pattern == "" {
+		return errors.New("topic is required")
+	}
+	levels := strings.Split(pattern, "/")
+	for i, level := range levels {
+		switch {
+		case level == "#" && i != len(levels)-1:
+			return fmt.Errorf("topic %q: # must be the last level", pattern)
+		case level != "+" && level != "#" && strings.ContainsAny(level, "+#"):
+			return fmt.Errorf("topic %q: wildcards must fill a whole level", pattern)
+		}
+	}
+	return nil
+}
+
+// matchTopic reports whether topic matches pattern and returns the levels
+// matched by its wildcards, # matching the rest of the topic as one. As in
+// MQTT, "a/#" also matches "a".
+func matchTopic(pattern, topic string) ([]string, bool) {
+	patternLevels := strings.Split(pattern, "/")
+	topicLevels := strings.Split(topic, "/")
+
+	var wildcards []string
+	for i, level := range patternLevels {
+		if level == "#" {
+			return append(wildcards, strings.Join(topicLevels[i:], "/")), true
+		}
+		if i >= len(topicLevels) {
+			return nil, false
+		}
+		switch level {
+		case "+":
+			wildcards = append(wildcards, topicLevels[i])
+		case topicLevels[i]:
+		default:
+			return nil, false
+		}
+	}
+	if len(patternLevels) != len(topicLevels) {
+		return nil, false
+	}
+	return wildcards, true
+}
+
+// deviceName returns the name of the device that published on topic.
+// Without a Device template the topic itself names the device.
+func (s mqttSubscription) deviceName(topic string, wildcards []string) string {
+	if s.Device == "" {
+		return strings.ReplaceAll(topic, "/", "-")
+	}
+	name := s.Device
+	for i, value := range wildcards {
+		name = strings.ReplaceAll(name, "{"+strconv.Itoa(i+1)+"}", value)
+	}
+	return name
+}
+
+// line converts a message payload into a measurement line.
+func (s mqttSubscription) line(payload []byte) (string, error) {
+	if len(s.Fields) == 0 {
+		return strings.TrimSpace(string(payload)), nil
+	}
+
+	var document any
+	if err := json.Unmarshal(payload, &document); err != nil {
+		return "", fmt.Errorf("payload is not JSON: %w", err)
+	}
+	fields := make(map[string]any, len(s.Fields))
+	for field, path := range s.Fields {
+		value, ok := lookupPath(document, path)
+		if !ok {
+			continue
+		}
+		// Some firmwares publish numbers as strings
+		if text, isString := value.(string); isString {
+			if number, err := strconv.ParseFloat(strings.TrimSpace(text), 64); err == nil {
+				value = number
+			}
+		}
+		fields[field] = value
+	}
+	if len(fields) == 0 {
+		return "", errors.New("none of the mapped fields are in the payload")
+	}
+
+	line, err := json.Marshal(fields)
+	return string(line), err
+}
+
+// lookupPath follows a dot separated path of object keys and array indexes,
+// optionally starting with "$.", through a decoded JSON document.
+func lookupPath(document any, path string) (any, bool) {
+	value := document
+	for _, key := range strings.Split(strings.TrimPrefix(path, "$."), ".") {
+		switch node := value.(type) {
+		case map[string]any:
+			next, ok := node[key]
+			if !ok {
+				return nil, false
+			}
+			value = next
+		case []any:
+			index, err := strconv.Atoi(key)
+			if err != nil || index < 0 || index >= len(node) {
+				return nil, false
+			}
+			value = node[index]
+		default:
+			return nil, false
+		}
+	}
+	return value, value != nil
+}
+
+func (s *mqttSource) Run(ctx context.Context, db *sql.DB, latestWeather *Weather) {
+	clientID := s.config.ClientID
+	if clientID == "" {
+		host, _ := os.Hostname()
+		clientID = "skogsnet_v2-" + host
+	}
+
+	var mu sync.Mutex
+	seen := make(map[string]Device)
+
+	handler := func(sub mqttSubscription) mqtt.MessageHandler {
+		return func(_ mqtt.Client, msg mqtt.Message) {
+			// A retained message is the broker's copy of an older reading
+			if msg.Retained() {
+				return
+			}
+			wildcards, ok := matchTopic(sub.Topic, msg.Topic())
+			if !ok {
+				return
+			}
+			line, err := sub.line(msg.Payload())
+			if err != nil {
+				throttledLogWarn(&lastMQTTWarn, "Ignoring MQTT message on %s: %v", msg.Topic(), err)
+				return
+			}
+			if device, ok := s.devices.store(db, sub.deviceName(msg.Topic(), wildcards), msg.Topic(), line, latestWeather); ok {
+				mu.Lock()
+				seen[device.Name] = device
+				mu.Unlock()
+			}
+		}
+	}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(s.config.Broker).
+		SetClientID(clientID).
+		SetUsername(s.config.Username).
+		SetPassword(s.config.Password).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(mqttReconnectDelay).
+		SetMaxReconnectInterval(serialMaxRetryDelay)
+	opts.SetOnConnectHandler(func(client mqtt.Client) {
+		logInfo("Connected to MQTT broker %s", s.config.Broker)
+		for _, sub := range s.config.Subscriptions {
+			token := client.Subscribe(sub.Topic, 0, handler(sub))
+			if token.Wait() && token.Error() != nil {
+				logError("Failed to subscribe to %s: %v", sub.Topic, token.Error())
+			}
+		}
+		if s.subscribed != nil {
+			s.subscribed <- struct{}{}
+		}
+	})
+	opts.SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+		logWarn("Lost connection to MQTT broker %s: %v", s.config.Broker, err)
+		mu.Lock()
+		defer mu.Unlock()
+		for _, device := range seen {
+			deviceStatuses.setLink(device, LinkLost, err)
+		}
+	})
+
+	client := mqtt.NewClient(opts)
+	logInfo("Connecting to MQTT broker %s", s.config.Broker)
+	client.Connect()
+	<-ctx.Done()
+	client.Disconnect(mqttDisconnectQuiet)
+}
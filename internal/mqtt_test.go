@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+)
+
+// startTestBroker runs an embedded MQTT broker on a free local port.
+func startTestBroker(t *testing.T) (*mochi.Server, string) {
+	t.Helper()
+	probe, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to find a free port: %v", err)
+	}
+	addr := probe.Addr().String()
+	probe.Close()
+
+	server := mochi.New(&mochi.Options{InlineClient: true, Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+	server.AddHook(new(auth.AllowHook), nil)
+	if err := server.AddListener(listeners.NewTCP(listeners.Config{ID: "test", Address: addr})); err != nil {
+		t.Fatalf("Failed to add listener: %v", err)
+	}
+	go server.Serve()
+	t.Cleanup(func() { server.Close() })
+	return server, "tcp://" + addr
+}
+
+func TestMatchTopic(t *testing.T) {
+	cases := []struct {
+		pattern, topic string
+		wildcards      []string
+		ok             bool
+	}{
+		{"zigbee2mqtt/+", "zigbee2mqtt/balcony", []string{"balcony"}, true},
+		{"zigbee2mqtt/+", "zigbee2mqtt/balcony/availability", nil, false},
+		{"tele/+/SENSOR", "tele/tasmota_1/SENSOR", []string{"tasmota_1"}, true},
+		{"tele/+/SENSOR", "tele/tasmota_1/STATE", nil, false},
+		{"sensors/#", "sensors/garden/soil", []string{"garden/soil"}, true},
+		{"sensors/+/#", "sensors/garden", []string{"garden", ""}, true},
+		{"sensors/+/#", "sensors", nil, false},
+		{"home/cellar", "home/cellar", nil, true},
+	}
+	for _, c := range cases {
+		wildcards, ok := matchTopic(c.pattern, c.topic)
+		if ok != c.ok || strings.Join(wildcards, ",") != strings.Join(c.wildcards, ",") {
+			t.Errorf("matchTopic(%q, %q) = %v, %v", c.pattern, c.topic, wildcards, ok)
+		}
+	}
+}
+
+func TestMQTTSubscription_Line(t *testing.T) {
+	sub := mqttSubscription{Fields: map[string]string{
+		temperatureField: "AM2301.Temperature",
+		humidityField:    "$.AM2301.Humidity",
+		"pressure":       "sensors.1.value",
+		"battery":        "battery",
+	}}
+	line, err := sub.line([]byte(`{"Time":"2025-07-14T16:50:08","AM2301":{"Temperature":21.4,"Humidity":"55.1"},"sensors":[{"value":1},{"value":1013}]}`))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	m, err := deserializeData(line)
+	if err != nil {
+		t.Fatalf("Expected a valid measurement line, got %q: %v", line, err)
+	}
+	if m.TemperatureCelsius != 21.4 || m.HumidityPercentage != 55.1 || m.Metrics["pressure"] != 1013 {
+		t.Errorf("Unexpected measurement from %q: %+v", line, m)
+	}
+	if _, ok := m.Metrics["battery"]; ok {
+		t.Error("Expected missing fields to be left out")
+	}
+
+	if _, err := sub.line([]byte("online")); err == nil {
+		t.Error("Expected error for non-JSON payload")
+	}
+	if _, err := sub.line([]byte(`{"linkquality":120}`)); err == nil {
+		t.Error("Expected error when no mapped field is present")
+	}
+
+	raw := mqttSubscription{}
+	if line, _ := raw.line([]byte(" {\"temperature_celcius\":20}\n")); line != `{"temperature_celcius":20}` {
+		t.Errorf("Expected payload to pass through unmapped, got %q", line)
+	}
+}
+
+func TestMQTTSubscription_DeviceName(t *testing.T) {
+	sub := mqttSubscription{Device: "{2}-{1}"}
+	if name := sub.deviceName("sensors/garden/soil", []string{"garden", "soil"}); name != "soil-garden" {
+		t.Errorf("Unexpected name %q", name)
+	}
+	if name := (mqttSubscription{}).deviceName("home/cellar", nil); name != "home-cellar" {
+		t.Errorf("Expected name from the topic, got %q", name)
+	}
+}
+
+func TestLoadMQTTConfig(t *testing.T) {
+	path := "test_mqtt_config.json"
+	defer os.Remove(path)
+
+	write := func(content string) {
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatalf("Failed to write config: %v", err)
+		}
+	}
+
+	write(`{"broker":"tcp://localhost:1883","subscriptions":[{"topic":"zigbee2mqtt/+","device":"{1}","fields":{"temperature_celcius":"temperature"}}]}`)
+	config, err := loadMQTTConfig(path)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if config.Broker != "tcp://localhost:1883" || config.Subscriptions[0].Fields[temperatureField] != "temperature" {
+		t.Errorf("Unexpected config: %+v", config)
+	}
+
+	invalid := map[string]string{
+		`{"subscriptions":[{"topic":"a/+"}]}`:                                                  "broker",
+		`{"broker":"tcp://b:1883"}`:                                                            "subscription",
+		`{"broker":"tcp://b:1883","subscriptions":[{"topic":"a/#/b"}]}`:                        "last level",
+		`{"broker":"tcp://b:1883","subscriptions":[{"topic":"a/b+"}]}`:                         "whole level",
+		`{"broker":"tcp://b:1883","subscriptions":[{"topic":"a","fields":{"device":"name"}}]}`: "reserved",
+		`{"broker":"tcp://b:1883","subscriptions":[{"topic":"a","fields":{"lux":""}}]}`:        "empty path",
+		`{"broker":"tcp://b:1883","topic":"a"}`:                                                "unknown field",
+	}
+	for content, expected := range invalid {
+		write(content)
+		if _, err := loadMQTTConfig(path); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("Config %s: expected error containing %q, got %v", content, expected, err)
+		}
+	}
+
+	if _, err := loadMQTTConfig("missing_mqtt_config.json"); err == nil {
+		t.Error("Expected error for missing file")
+	}
+}
+
+func TestMQTTSource(t *testing.T) {
+	db, stored := networkTestSetup(t)
+	broker, url := startTestBroker(t)
+
+	source := &mqttSource{
+		config: mqttConfig{
+			Broker:   url,
+			ClientID: "skogsnet-test",
+			Subscriptions: []mqttSubscription{
+				{Topic: "zigbee2mqtt/+", Device: "{1}", Fields: map[string]string{
+					temperatureField: "temperature",
+					humidityField:    "humidity",
+					"battery":        "battery",
+				}},
+				{Topic: "skogsnet/#"},
+			},
+		},
+		devices: newNetworkDevices(sourceMQTT, []Device{
+			{Name: "balcony", Source: sourceMQTT, Location: "Balcony"},
+			{Name: "greenhouse", Source: sourceSerial, Port: "/dev/ttyACM0"},
+		}),
+		subscribed: make(chan struct{}, 1),
+	}
+
+	// Sent to the source when it subscribes
+	broker.Publish("zigbee2mqtt/retained", []byte(`{"temperature":30}`), true, 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		source.Run(ctx, db, &Weather{})
+		close(done)
+	}()
+	select {
+	case <-source.subscribed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("MQTT source did not subscribe")
+	}
+
+	// A topic must not write into the history of the serial device
+	broker.Publish("zigbee2mqtt/greenhouse", []byte(`{"temperature":45,"humidity":10}`), false, 0)
+	broker.Publish("zigbee2mqtt/balcony", []byte(`{"temperature":19.5,"humidity":61,"battery":97,"linkquality":120}`), false, 0)
+	broker.Publish("zigbee2mqtt/bridge/state", []byte("online"), false, 0)
+	broker.Publish("skogsnet/cellar", []byte(`{"temperature_celcius":12.0,"humidity":80.0}`), false, 0)
+
+	waitFor(t, "MQTT measurements", func() bool { return len(stored()) >= 2 })
+	time.Sleep(100 * time.Millisecond)
+
+	measurements := stored()
+	if len(measurements) != 2 {
+		t.Fatalf("Expected 2 measurements, got %d: %+v", len(measurements), measurements)
+	}
+	byTemperature := map[float64]Measurement{}
+	for _, m := range measurements {
+		byTemperature[m.TemperatureCelsius] = m
+	}
+	balcony, ok := byTemperature[19.5]
+	if !ok || balcony.HumidityPercentage != 61 || balcony.Metrics["battery"] != 97 {
+		t.Errorf("Unexpected balcony measurement: %+v", measurements)
+	}
+	if _, ok := balcony.Metrics["linkquality"]; ok {
+		t.Error("Expected unmapped fields to be ignored")
+	}
+
+	device, err := lookupDevice(db, "balcony")
+	if err != nil || device.Location != "Balcony" || device.Port != "mqtt://zigbee2mqtt/balcony" || balcony.DeviceID != device.ID {
+		t.Errorf("Expected configured balcony device registered with its topic, got %+v, %v", device, err)
+	}
+	if _, err := lookupDevice(db, "skogsnet-cellar"); err != nil {
+		t.Errorf("Expected device named after the topic, got %v", err)
+	}
+	if _, ok := byTemperature[45]; ok {
+		t.Error("Expected a topic named like a serial device to be refused")
+	}
+	if _, err := lookupDevice(db, "retained"); err == nil {
+		t.Error("Expected retained message to be ignored")
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("MQTT source did not stop")
+	}
+}
+
+func TestConfiguredSources_MQTT(t *testing.T) {
+	origSettings := mqttSettings
+	origLogWarn := logWarn
+	var warned int
+	logWarn = func(format string, v ...any) { warned++ }
+	defer func() {
+		mqttSettings = origSettings
+		logWarn = origLogWarn
+	}()
+
+	devices := []Device{{Name: "balcony", Source: sourceMQTT}}
+
+	mqttSettings = nil
+	if sources := configuredSources(devices); len(sources) != 0 || warned != 1 {
+		t.Errorf("Expected only a warning without -mqtt-config, got %d sources, %d warnings", len(sources), warned)
+	}
+
+	mqttSettings = &mqttConfig{Broker: "tcp://localhost:1883"}
+	sources := configuredSources(devices)
+	if len(sources) != 1 {
+		t.Fatalf("Expected 1 source, got %d", len(sources))
+	}
+	if source, ok := sources[0].(*mqttSource); !ok || len(source.devices.devices) != 1 {
+		t.Errorf("Expected MQTT subscriber seeded with balcony, got %#v", sources[0])
+	}
+}
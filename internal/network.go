@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+const (
+	// maxDatagramSize fits any UDP payload.
+	maxDatagramSize = 65535
+	// maxNetworkDevices limits the devices a source registers, so a
+	// misbehaving sender can't fill the devices table with made up names.
+	maxNetworkDevices = 256
+)
+
+var (
+	errConnectionClosed = errors.New("connection closed")
+	errDeviceNameTaken  = errors.New("device name is taken")
+	errTooManyDevices   = errors.New("too many devices")
+)
+
+// networkDevices resolves the senders on a network source to devices,
+// registering new ones on first contact.
+type networkDevices struct {
+	mu       sync.Mutex
+	source   string
+	devices  map[string]Device
+	reserved map[string]bool // names of configured devices of other sources
+}
+
+// tcpSource accepts connections from sensors that write newline-delimited
+// JSON, the same lines the Arduino sends over serial.
+type tcpSource struct {
+	addr    string
+	devices *networkDevices
+	bound   chan net.Addr // receives the listening address, for tests
+}
+
+// udpSource reads datagrams holding one or more JSON lines.
+type udpSource struct {
+	addr    string
+	devices *networkDevices
+	bound   chan net.Addr
+}
+
+// newNetworkDevices seeds the resolver with the configured devices of the
+// given network source, so their location and settings apply.
+func newNetworkDevices(source string, configured []Device) *networkDevices {
+	n := &networkDevices{source: source, devices: make(map[string]Device), reserved: make(map[string]bool)}
+	for _, device := range configured {
+		if device.Source == source {
+			n.devices[device.Name] = device
+		} else {
+			n.reserved[device.Name] = true
+		}
+	}
+	return n
+}
+
+// senderName returns the device named in the line, or one derived from the
+// remote host when the line does not name it.
+func senderName(payload string, remote net.Addr) string {
+	var fields struct {
+		Device string `json:"device"`
+	}
+	if json.Unmarshal([]byte(payload), &fields) == nil {
+		if name := strings.TrimSpace(fields.Device); name != "" && len(name) <= 64 {
+			return name
+		}
+	}
+
+	return remote.Network() + "-" + remoteHost(remote)
+}
+
+// remoteHost returns the address of remote without the port, which changes
+// with every connection.
+func remoteHost(remote net.Addr) string {
+	host := remote.String()
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return host
+}
+
+// resolve returns the device for a sender at address, the remote host or
+// MQTT topic it sends from, registering it when it is seen for the first time
+// or was only configured so far. Senders name themselves, so names of devices
+// read from other sources are refused.
+func (n *networkDevices) resolve(db *sql.DB, name, address string) (Device, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	device, ok := n.devices[name]
+	if ok && device.ID != 0 {
+		// Only the first address is stored; hosts on DHCP move around
+		device.Port = address
+		n.devices[name] = device
+		return device, nil
+	}
+	if n.reserved[name] {
+		return Device{}, fmt.Errorf("%w: %s is a configured device of another source", errDeviceNameTaken, name)
+	}
+	if !ok && len(n.devices) >= maxNetworkDevices {
+		return Device{}, fmt.Errorf("%w: more than %d %s devices, ignoring %s", errTooManyDevices, maxNetworkDevices, n.source, name)
+	}
+	var stored sql.NullString
+	err := db.QueryRow("SELECT port FROM devices WHERE name = ?", name).Scan(&stored)
+	if err != nil && err != sql.ErrNoRows {
+		return Device{}, err
+	}
+	if err == nil && !n.owns(stored.String) {
+		return Device{}, fmt.Errorf("%w: %s is read from %s", errDeviceNameTaken, name, stored.String)
+	}
+
+	device.Name = name
+	device.Source = n.source
+	device.Port = address
+	device.Framing = framingNone
+	if err := registerDevice(db, &device); err != nil {
+		return Device{}, err
+	}
+	if !ok {
+		logInfo("New %s device %s from %s", n.source, name, address)
+	}
+	n.devices[name] = device
+	return device, nil
+}
+
+// owns reports whether a device stored with port belongs to this source.
+// Devices without a port, e.g. created by an import, may be taken over.
+func (n *networkDevices) owns(port string) bool {
+	return port == "" || port == n.source || strings.HasPrefix(port, n.source+":")
+}
+
+// handleLine stores one line received from remote.
+func (n *networkDevices) handleLine(db *sql.DB, line string, remote net.Addr, latestWeather *Weather) (Device, bool) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return Device{}, false
+	}
+	return n.store(db, senderName(line, remote), remoteHost(remote), line, latestWeather)
+}
+
+// store passes a line from the named sender at address through
+// handleDeviceLine. A measurement lost because the device could not be
+// registered counts as an insert failure.
+func (n *networkDevices) store(db *sql.DB, name, address, line string, latestWeather *Weather) (Device, bool) {
+	device, err := n.resolve(db, name, address)
+	if errors.Is(err, errDeviceNameTaken) || errors.Is(err, errTooManyDevices) {
+		throttledLogWarn(&lastInsertErr, "Ignoring %s device from %s: %v", n.source, address, err)
+		return Device{}, false
+	}
+	if err != nil {
+		if _, parseErr := deserializeData(line); parseErr == nil {
+			daemonMetrics.countInsertFailures(1)
+		}
+		throttledLogError(&lastInsertErr, "Failed to register %s device from %s: %v", n.source, address, err)
+		return Device{}, false
+	}
+	deviceStatuses.setLink(device, LinkConnected, nil)
+	handleDeviceLine(device, line, db, latestWeather, nil)
+	return device, true
+}
+
+func (s *tcpSource) Run(ctx context.Context, db *sql.DB, latestWeather *Weather) {
+	listener, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		logError("Failed to listen for TCP sensors on %s: %v", s.addr, err)
+		return
+	}
+	logInfo("Listening for TCP sensors on %s", listener.Addr())
+	if s.bound != nil {
+		s.bound <- listener.Addr()
+	}
+
+	var conns sync.WaitGroup
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				logError("TCP accept on %s failed: %v", s.addr, err)
+			}
+			break
+		}
+		conns.Add(1)
+		go func() {
+			defer conns.Done()
+			s.serve(ctx, conn, db, latestWeather)
+		}()
+	}
+	conns.Wait()
+}
+
+// serve reads lines from one connection until it is closed. Every device
+// that sent over it is reported lost when the connection ends.
+func (s *tcpSource) serve(ctx context.Context, conn net.Conn, db *sql.DB, latestWeather *Weather) {
+	connectionDone := make(chan struct{})
+	defer close(connectionDone)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-connectionDone:
+		}
+	}()
+
+	seen := make(map[string]Device)
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		if device, ok := s.devices.handleLine(db, scanner.Text(), conn.RemoteAddr(), latestWeather); ok {
+			seen[device.Name] = device
+		}
+	}
+	conn.Close()
+
+	if ctx.Err() != nil {
+		return
+	}
+	err := scanner.Err()
+	if err == nil {
+		err = errConnectionClosed
+	}
+	for _, device := range seen {
+		deviceStatuses.setLink(device, LinkLost, err)
+	}
+}
+
+func (s *udpSource) Run(ctx context.Context, db *sql.DB, latestWeather *Weather) {
+	conn, err := net.ListenPacket("udp", s.addr)
+	if err != nil {
+		logError("Failed to listen for UDP sensors on %s: %v", s.addr, err)
+		return
+	}
+	logInfo("Listening for UDP sensors on %s", conn.LocalAddr())
+	if s.bound != nil {
+		s.bound <- conn.LocalAddr()
+	}
+
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, remote, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() == nil {
+				logError("UDP read on %s failed: %v", s.addr, err)
+			}
+			return
+		}
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			s.devices.handleLine(db, line, remote, latestWeather)
+		}
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// networkTestSetup replaces the storage and logging hooks and returns the
+// measurements stored through them.
+func networkTestSetup(t *testing.T) (*sql.DB, func() []Measurement) {
+	t.Helper()
+	origInsertMeasurement := insertMeasurement
+	origPrintToConsole := printToConsole
+	origStatuses := deviceStatuses
+	origLogInfo := logInfo
+	origLogWarn := logWarn
+
+	tmpDB := "test_network_" + t.Name() + ".db"
+	db, err := openDatabase(tmpDB)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+
+	var mu sync.Mutex
+	var stored []Measurement
+	insertMeasurement = func(db *sql.DB, m Measurement, ts int64) error {
+		mu.Lock()
+		stored = append(stored, m)
+		mu.Unlock()
+		return nil
+	}
+	printToConsole = func(m Measurement, w *Weather) {}
+	deviceStatuses = newStatusRegistry()
+	logInfo = func(format string, v ...any) {}
+	logWarn = func(format string, v ...any) {}
+
+	t.Cleanup(func() {
+		insertMeasurement = origInsertMeasurement
+		printToConsole = origPrintToConsole
+		deviceStatuses = origStatuses
+		logInfo = origLogInfo
+		logWarn = origLogWarn
+		db.Close()
+		os.Remove(tmpDB)
+	})
+
+	return db, func() []Measurement {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]Measurement(nil), stored...)
+	}
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestSenderName(t *testing.T) {
+	remote := &net.TCPAddr{IP: net.ParseIP("192.168.1.20"), Port: 51234}
+
+	if name := senderName(`{"device":"esp32-garden","temperature_celcius":20.0}`, remote); name != "esp32-garden" {
+		t.Errorf("Expected name from the line, got %q", name)
+	}
+	if name := senderName(`{"temperature_celcius":20.0}`, remote); name != "tcp-192.168.1.20" {
+		t.Errorf("Expected name from the remote host, got %q", name)
+	}
+	if name := senderName(`not json`, &net.UDPAddr{IP: net.ParseIP("10.0.0.5"), Port: 9}); name != "udp-10.0.0.5" {
+		t.Errorf("Expected name from the remote host, got %q", name)
+	}
+}
+
+func TestNetworkDevices_Resolve(t *testing.T) {
+	db, _ := networkTestSetup(t)
+
+	devices := newNetworkDevices(sourceTCP, []Device{
+		{Name: "esp32-garden", Source: sourceTCP, Location: "Garden"},
+		{Name: "cellar", Source: sourceSerial, Port: "/dev/ttyACM0"},
+	})
+	remote := &net.TCPAddr{IP: net.ParseIP("192.168.1.20"), Port: 5000}
+
+	device, err := devices.resolve(db, "esp32-garden", remoteHost(remote))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if device.ID == 0 || device.Location != "Garden" || device.Port != "192.168.1.20" {
+		t.Errorf("Unexpected device: %+v", device)
+	}
+
+	// A new connection from the same host reuses the registered device
+	again, _ := devices.resolve(db, "esp32-garden", remoteHost(&net.TCPAddr{IP: net.ParseIP("192.168.1.20"), Port: 5001}))
+	if again.ID != device.ID {
+		t.Errorf("Expected same device, got %+v", again)
+	}
+
+	stored, err := lookupDevice(db, "esp32-garden")
+	if err != nil || stored.Port != "tcp://192.168.1.20" {
+		t.Errorf("Expected device registered with its address, got %+v, %v", stored, err)
+	}
+	if _, ok := devices.devices["cellar"]; ok {
+		t.Error("Expected serial devices not to be seeded into the TCP resolver")
+	}
+}
+
+func TestNetworkDevices_Resolve_NameTaken(t *testing.T) {
+	db, _ := networkTestSetup(t)
+
+	if err := registerDevice(db, &Device{Name: "attic", Port: "/dev/ttyUSB0"}); err != nil {
+		t.Fatalf("Failed to register device: %v", err)
+	}
+	devices := newNetworkDevices(sourceTCP, []Device{
+		{Name: "cellar", Source: sourceSerial, Port: "/dev/ttyACM0"},
+	})
+
+	for _, name := range []string{"cellar", "attic"} {
+		if _, err := devices.resolve(db, name, "192.168.1.66"); !errors.Is(err, errDeviceNameTaken) {
+			t.Errorf("Expected %s to be refused, got %v", name, err)
+		}
+	}
+	stored, err := lookupDevice(db, "attic")
+	if err != nil || stored.Port != "/dev/ttyUSB0" {
+		t.Errorf("Expected the serial device to keep its port, got %+v, %v", stored, err)
+	}
+
+	// UDP devices are another source too
+	udp := newNetworkDevices(sourceUDP, nil)
+	if _, err := udp.resolve(db, "tcp-sender", "192.168.1.30"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if _, err := devices.resolve(db, "tcp-sender", "192.168.1.30"); !errors.Is(err, errDeviceNameTaken) {
+		t.Errorf("Expected a UDP device name to be refused on TCP, got %v", err)
+	}
+}
+
+func TestNetworkDevices_Resolve_AddressChange(t *testing.T) {
+	db, _ := networkTestSetup(t)
+
+	devices := newNetworkDevices(sourceTCP, nil)
+	device, err := devices.resolve(db, "esp32-garden", "192.168.1.20")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	origRegister := registerDevice
+	registerDevice = func(db *sql.DB, device *Device) error {
+		t.Errorf("Expected no registration on an address change, got %+v", device)
+		return nil
+	}
+	defer func() { registerDevice = origRegister }()
+
+	moved, err := devices.resolve(db, "esp32-garden", "192.168.1.21")
+	if err != nil || moved.ID != device.ID || moved.Port != "192.168.1.21" {
+		t.Errorf("Expected the same device at its new address, got %+v, %v", moved, err)
+	}
+}
+
+func TestNetworkDevices_Resolve_Limit(t *testing.T) {
+	db, _ := networkTestSetup(t)
+
+	devices := newNetworkDevices(sourceUDP, nil)
+	for i := range maxNetworkDevices {
+		if _, err := devices.resolve(db, fmt.Sprintf("sensor-%d", i), "192.168.1.20"); err != nil {
+			t.Fatalf("Expected device %d to be registered, got %v", i, err)
+		}
+	}
+	if _, err := devices.resolve(db, "one-too-many", "192.168.1.20"); err == nil {
+		t.Error("Expected devices beyond the limit to be refused")
+	}
+	if _, err := devices.resolve(db, "sensor-0", "192.168.1.20"); err != nil {
+		t.Errorf("Expected known devices to be kept, got %v", err)
+	}
+}
+
+func TestTCPSource(t *testing.T) {
+	db, stored := networkTestSetup(t)
+
+	source := &tcpSource{addr: "127.0.0.1:0", devices: newNetworkDevices(sourceTCP, nil), bound: make(chan net.Addr, 1)}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		source.Run(ctx, db, nil)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	conn, err := net.Dial("tcp", (<-source.bound).String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	conn.Write([]byte("{\"device\":\"esp32-garden\",\"temperature_celcius\":20.5,\"humidity\":41.0}\n\n{\"temperature_celcius\":19.0}\n"))
+	conn.Close()
+
+	waitFor(t, "measurements", func() bool { return len(stored()) == 2 })
+	measurements := stored()
+	if measurements[0].DeviceName != "esp32-garden" || measurements[0].DeviceID == 0 {
+		t.Errorf("Expected measurement from esp32-garden, got %+v", measurements[0])
+	}
+	if measurements[1].DeviceName != "tcp-127.0.0.1" || measurements[1].DeviceID == measurements[0].DeviceID {
+		t.Errorf("Expected unnamed sender to become its own device, got %+v", measurements[1])
+	}
+
+	waitFor(t, "lost links", func() bool {
+		statuses := deviceStatuses.snapshot()
+		return len(statuses) == 2 && statuses[0].Link == LinkLost && statuses[1].Link == LinkLost
+	})
+}
+
+func TestUDPSource(t *testing.T) {
+	db, stored := networkTestSetup(t)
+
+	source := &udpSource{addr: "127.0.0.1:0", devices: newNetworkDevices(sourceUDP, nil), bound: make(chan net.Addr, 1)}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		source.Run(ctx, db, nil)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	conn, err := net.Dial("udp", (<-source.bound).String())
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("{\"device\":\"esp32-attic\",\"temperature_celcius\":30.0,\"lux\":5}\n{\"device\":\"esp32-attic\",\"temperature_celcius\":30.5}"))
+
+	waitFor(t, "measurements", func() bool { return len(stored()) == 2 })
+	measurements := stored()
+	if measurements[0].DeviceName != "esp32-attic" || measurements[0].Metrics["lux"] != 5 || measurements[1].TemperatureCelsius != 30.5 {
+		t.Errorf("Unexpected measurements: %+v", measurements)
+	}
+	if _, ok := measurements[0].Metrics["device"]; ok {
+		t.Error("Expected device key not to be stored as a metric")
+	}
+}
+
+func TestConfiguredSources(t *testing.T) {
+	origTCP := *listenTCP
+	origUDP := *listenUDP
+	origLogWarn := logWarn
+	*listenTCP = ":7070"
+	*listenUDP = ""
+	var warned int
+	logWarn = func(format string, v ...any) { warned++ }
+	defer func() {
+		*listenTCP = origTCP
+		*listenUDP = origUDP
+		logWarn = origLogWarn
+	}()
+
+	sources := configuredSources([]Device{
+		{Name: "greenhouse", Source: sourceSerial, Port: "/dev/ttyACM0"},
+		{Name: "virtual", Source: sourceSim},
+		{Name: "old", Source: "replay:old.csv"},
+		{Name: "esp32", Source: sourceTCP},
+		{Name: "esp8266", Source: sourceUDP},
+	})
+
+	if len(sources) != 4 {
+		t.Fatalf("Expected 4 sources, got %d", len(sources))
+	}
+	if _, ok := sources[0].(serialSource); !ok {
+		t.Errorf("Expected serial source first, got %T", sources[0])
+	}
+	if _, ok := sources[1].(simSource); !ok {
+		t.Errorf("Expected sim source, got %T", sources[1])
+	}
+	if _, ok := sources[2].(replaySource); !ok {
+		t.Errorf("Expected replay source, got %T", sources[2])
+	}
+	tcp, ok := sources[3].(*tcpSource)
+	if !ok || tcp.addr != ":7070" || len(tcp.devices.devices) != 1 {
+		t.Errorf("Expected TCP listener seeded with esp32, got %#v", sources[3])
+	}
+	if warned != 1 {
+		t.Errorf("Expected a warning for the UDP device without listener, got %d", warned)
+	}
+}
+
+func TestConfiguredDevices_NetworkOnly(t *testing.T) {
+	origSpecs := deviceSpecs
+	origTCP := *listenTCP
+	deviceSpecs = nil
+	*listenTCP = ":7070"
+	defer func() {
+		deviceSpecs = origSpecs
+		*listenTCP = origTCP
+	}()
+
+	if devices := configuredDevices(); len(devices) != 0 {
+		t.Errorf("Expected no default serial device with only a listener, got %+v", devices)
+	}
+}
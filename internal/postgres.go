@@ -0,0 +1,405 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	_ "github.com/jackc/pgx/v5/stdlib"
+)
+
+// postgresSchema creates the tables of the PostgreSQL storage. They have no
+// primary keys, so TimescaleDB can partition them by time.
+var postgresSchema = []string{
+	`CREATE TABLE IF NOT EXISTS weather (
+		id BIGINT GENERATED BY DEFAULT AS IDENTITY,
+		time TIMESTAMPTZ NOT NULL,
+		city TEXT,
+		temp DOUBLE PRECISION,
+		humidity INTEGER,
+		wind_speed DOUBLE PRECISION,
+		wind_deg INTEGER,
+		clouds INTEGER,
+		weather_code INTEGER,
+		description TEXT
+	)`,
+	"ALTER TABLE weather ADD COLUMN IF NOT EXISTS site TEXT NOT NULL DEFAULT ''",
+	`CREATE TABLE IF NOT EXISTS measurements (
+		id BIGINT GENERATED BY DEFAULT AS IDENTITY,
+		time TIMESTAMPTZ NOT NULL,
+		device TEXT NOT NULL DEFAULT '',
+		temperature DOUBLE PRECISION,
+		humidity DOUBLE PRECISION,
+		raw_temperature DOUBLE PRECISION,
+		raw_humidity DOUBLE PRECISION,
+		metrics JSONB,
+		raw_metrics JSONB,
+		device_ts BIGINT,
+		received_ts BIGINT,
+		seq BIGINT,
+		weather_id BIGINT
+	)`,
+	"ALTER TABLE measurements ADD COLUMN IF NOT EXISTS site TEXT NOT NULL DEFAULT ''",
+	"ALTER TABLE measurements ADD COLUMN IF NOT EXISTS device_id BIGINT",
+	"DROP INDEX IF EXISTS weather_by_time",
+	"DROP INDEX IF EXISTS measurements_by_device_time",
+	"CREATE INDEX IF NOT EXISTS weather_by_site_time ON weather (site, time)",
+	"CREATE INDEX IF NOT EXISTS weather_by_id ON weather (id)",
+	"CREATE INDEX IF NOT EXISTS measurements_by_site_device_time ON measurements (site, device, time)",
+	"CREATE INDEX IF NOT EXISTS measurements_by_time ON measurements (time)",
+}
+
+// postgresMillis converts a TIMESTAMPTZ column to Unix milliseconds.
+const postgresMillis = "(extract(epoch FROM %s) * 1000)::bigint"
+
+// postgresStorage stores the measurements of several sites in one
+// PostgreSQL database, as hypertables when TimescaleDB is available. Every
+// row carries the site it came from, and an installation only reads and
+// links the rows of its own site. Devices are identified by name and keep
+// the ID of the local devices table alongside.
+type postgresStorage struct {
+	db   *sql.DB
+	site string
+}
+
+// openPostgresStorage connects to the database at url and creates the
+// tables it lacks. Rows are stored and read for site.
+func openPostgresStorage(url, site string) (*postgresStorage, error) {
+	db, err := sql.Open("pgx", url)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("could not connect to PostgreSQL: %w", err)
+	}
+	for _, statement := range postgresSchema {
+		if _, err := db.Exec(statement); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("could not create the PostgreSQL schema: %w", err)
+		}
+	}
+	if err := createHypertables(db); err != nil {
+		logWarn("TimescaleDB is available but not in use, storing plain tables: %v", err)
+	}
+	return &postgresStorage{db: db, site: site}, nil
+}
+
+// createHypertables turns the tables into TimescaleDB hypertables when the
+// server has the extension. Existing rows are moved into chunks.
+func createHypertables(db *sql.DB) error {
+	var available bool
+	err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM pg_available_extensions WHERE name = 'timescaledb')").Scan(&available)
+	if err != nil || !available {
+		return err
+	}
+	if _, err := db.Exec("CREATE EXTENSION IF NOT EXISTS timescaledb"); err != nil {
+		return err
+	}
+	for _, table := range []string{"measurements", "weather"} {
+		_, err := db.Exec("SELECT create_hypertable('" + table + "', 'time', if_not_exists => TRUE, migrate_data => TRUE)")
+		if err != nil {
+			return err
+		}
+	}
+	logInfo("Storing measurements in TimescaleDB hypertables")
+	return nil
+}
+
+func (s *postgresStorage) Close() error {
+	return s.db.Close()
+}
+
+func (s *postgresStorage) InsertMeasurement(m Measurement, timestamp int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := s.insertMeasurementTx(tx, m, timestamp); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *postgresStorage) InsertMeasurementBatch(measurements []Measurement) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, m := range measurements {
+		if err := s.insertMeasurementTx(tx, m, m.UnixTimestamp); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// insertMeasurementTx stores the measurement linked to the nearest weather
+// record of the site within 10 minutes, like the SQLite storage. Extra
+// metrics and their raw readings are kept as JSON objects.
+func (s *postgresStorage) insertMeasurementTx(tx *sql.Tx, m Measurement, timestamp int64) error {
+	at := time.UnixMilli(timestamp)
+	var weatherID sql.NullInt64
+	err := tx.QueryRow(`
+		SELECT id FROM weather
+		WHERE site = $2 AND time > $1::timestamptz - interval '10 minutes' AND time < $1::timestamptz + interval '10 minutes'
+		ORDER BY abs(extract(epoch FROM time - $1::timestamptz)) ASC
+		LIMIT 1
+	`, at, s.site).Scan(&weatherID)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	rawMetrics := make(map[string]float64)
+	for metric := range m.Metrics {
+		if raw, ok := m.Raw[metric]; ok {
+			rawMetrics[metric] = raw
+		}
+	}
+	metrics, err := jsonObject(m.Metrics)
+	if err != nil {
+		return err
+	}
+	raw, err := jsonObject(rawMetrics)
+	if err != nil {
+		return err
+	}
+	receivedTS := m.ReceivedTimestamp
+	if receivedTS == 0 {
+		receivedTS = timestamp
+	}
+	deviceID := sql.NullInt64{Int64: m.DeviceID, Valid: m.DeviceID != 0}
+
+	_, err = tx.Exec(`
+		INSERT INTO measurements (time, site, device, device_id, temperature, humidity, raw_temperature, raw_humidity, metrics, raw_metrics, device_ts, received_ts, seq, weather_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)`,
+		at,
+		s.site,
+		m.DeviceName,
+		deviceID,
+		m.columnValue(temperatureField),
+		m.columnValue(humidityField),
+		m.rawValue(temperatureField),
+		m.rawValue(humidityField),
+		metrics,
+		raw,
+		m.DeviceTimestamp,
+		receivedTS,
+		m.Sequence,
+		weatherID,
+	)
+	return err
+}
+
+// jsonObject encodes values for a JSONB column, NULL when there are none.
+func jsonObject(values map[string]float64) (any, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+	data, err := json.Marshal(values)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+func (s *postgresStorage) InsertWeather(w Weather, timestamp int64) error {
+	var weatherID int
+	var weatherDesc string
+	if len(w.Weather) > 0 {
+		weatherID = w.Weather[0].ID
+		weatherDesc = w.Weather[0].Description
+	}
+
+	_, err := s.db.Exec(
+		`INSERT INTO weather (time, site, city, temp, humidity, wind_speed, wind_deg, clouds, weather_code, description)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`,
+		time.UnixMilli(timestamp),
+		s.site,
+		w.Name,
+		w.Main.Temp,
+		w.Main.Humidity,
+		w.Wind.Speed,
+		w.Wind.Deg,
+		w.Clouds.All,
+		weatherID,
+		weatherDesc,
+	)
+	return err
+}
+
+func (s *postgresStorage) Export(filter exportFilter, w exportWriter) error {
+	rows, err := s.db.Query("SELECT DISTINCT jsonb_object_keys(metrics) FROM measurements WHERE site = $1 ORDER BY 1", s.site)
+	if err != nil {
+		return err
+	}
+	var metrics []string
+	for rows.Next() {
+		var metric string
+		if err := rows.Scan(&metric); err != nil {
+			rows.Close()
+			return err
+		}
+		metrics = append(metrics, metric)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	metricColumns := ""
+	args := make([]any, 0, len(metrics)+3)
+	for _, metric := range metrics {
+		args = append(args, metric)
+		metricColumns += fmt.Sprintf(", (m.metrics ->> $%d)::float8", len(args))
+	}
+	args = append(args, s.site, time.UnixMilli(filter.from))
+	where := fmt.Sprintf("m.site = $%d AND m.time >= $%d", len(args)-1, len(args))
+	if filter.to != 0 {
+		args = append(args, time.UnixMilli(filter.to))
+		where += fmt.Sprintf(" AND m.time < $%d", len(args))
+	}
+	if filter.device != "" {
+		args = append(args, filter.device)
+		where += fmt.Sprintf(" AND m.device = $%d", len(args))
+	}
+
+	rows, err = s.db.Query(`
+		SELECT `+fmt.Sprintf(postgresMillis, "m.time")+`, m.device, m.temperature, m.humidity,
+			w.city, w.temp, w.humidity, w.wind_speed, w.wind_deg, w.clouds, w.weather_code, w.description,
+			`+fmt.Sprintf(postgresMillis, "w.time")+metricColumns+`
+		FROM measurements m
+		LEFT JOIN weather w ON w.id = m.weather_id
+		WHERE `+where+`
+		ORDER BY m.time ASC
+	`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	return writeExportRows(w, metrics, rows)
+}
+
+// QueryBuckets averages the raw measurements, as the PostgreSQL storage has
+// no rollups.
+func (s *postgresStorage) QueryBuckets(device *Device, since, end, intervalSeconds int64) ([]Result, error) {
+	width := intervalSeconds * 1000
+	bucket := fmt.Sprintf("(floor(extract(epoch FROM m.time) / %d) * %d)::bigint", intervalSeconds, width)
+	where := "m.site = $1 AND m.time >= $2 AND m.time <= $3"
+	args := []any{s.site, time.UnixMilli(since / width * width), time.UnixMilli(end)}
+	if device != nil {
+		where += " AND m.device = $4"
+		args = append(args, device.Name)
+	}
+
+	rows, err := s.db.Query(`
+		SELECT NULL::bigint, b.device_id, b.device, b.bucket,
+			b.avg_temperature, b.min_temperature, b.max_temperature,
+			b.avg_humidity, b.min_humidity, b.max_humidity,
+			w.city, b.avg_weather_temp, b.avg_weather_humidity, b.avg_wind_speed,
+			b.avg_wind_deg, b.avg_clouds, b.avg_weather_code, w.description
+		FROM (
+			SELECT m.device, `+bucket+` AS bucket, MAX(m.device_id) AS device_id,
+				AVG(m.temperature)::float8 AS avg_temperature, MIN(m.temperature) AS min_temperature, MAX(m.temperature) AS max_temperature,
+				AVG(m.humidity)::float8 AS avg_humidity, MIN(m.humidity) AS min_humidity, MAX(m.humidity) AS max_humidity,
+				AVG(w.temp)::float8 AS avg_weather_temp, AVG(w.humidity)::float8 AS avg_weather_humidity,
+				AVG(w.wind_speed)::float8 AS avg_wind_speed, AVG(w.wind_deg)::float8 AS avg_wind_deg,
+				AVG(w.clouds)::float8 AS avg_clouds, AVG(w.weather_code)::float8 AS avg_weather_code,
+				MAX(m.weather_id) AS weather_id
+			FROM measurements m
+			LEFT JOIN weather w ON w.id = m.weather_id
+			WHERE `+where+`
+			GROUP BY 1, 2
+		) b
+		LEFT JOIN weather w ON w.id = b.weather_id
+		ORDER BY b.device, b.bucket
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	results, err := scanResults(rows)
+	if err != nil || len(results) == 0 {
+		return results, err
+	}
+
+	type bucketKey struct {
+		device    string
+		timestamp int64
+	}
+	index := make(map[bucketKey]*Result, len(results))
+	for i := range results {
+		index[bucketKey{results[i].Device, results[i].AggregatedTimestamp}] = &results[i]
+	}
+
+	rows, err = s.db.Query(`
+		SELECT m.device, `+bucket+`, e.key, AVG(e.value::float8)
+		FROM measurements m, jsonb_each_text(m.metrics) e
+		WHERE `+where+`
+		GROUP BY 1, 2, 3
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key bucketKey
+		var metric string
+		var value float64
+		if err := rows.Scan(&key.device, &key.timestamp, &metric, &value); err != nil {
+			return nil, err
+		}
+		result, ok := index[key]
+		if !ok {
+			continue
+		}
+		if result.Metrics == nil {
+			result.Metrics = make(map[string]float64)
+		}
+		result.Metrics[metric] = value
+	}
+	return results, rows.Err()
+}
+
+func (s *postgresStorage) LatestMeasurements(device *Device, limit int) ([]Result, error) {
+	where := "WHERE m.site = $2"
+	args := []any{limit, s.site}
+	if device != nil {
+		where += " AND m.device = $3"
+		args = append(args, device.Name)
+	}
+	rows, err := s.db.Query(`
+		SELECT m.id, m.device_id, m.device, `+fmt.Sprintf(postgresMillis, "m.time")+`,
+			m.temperature, m.temperature, m.temperature, m.humidity, m.humidity, m.humidity,
+			w.city, w.temp, w.humidity, w.wind_speed, w.wind_deg, w.clouds, w.weather_code, w.description,
+			m.metrics
+		FROM measurements m
+		LEFT JOIN weather w ON w.id = m.weather_id
+		`+where+`
+		ORDER BY m.time DESC
+		LIMIT $1
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []Result
+	for rows.Next() {
+		var row resultRow
+		var metrics []byte
+		if err := rows.Scan(append(row.dest(), &metrics)...); err != nil {
+			return nil, err
+		}
+		result := row.result()
+		if len(results) == 0 && metrics != nil {
+			if err := json.Unmarshal(metrics, &result.Metrics); err != nil {
+				return nil, err
+			}
+		}
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
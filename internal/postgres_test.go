@@ -0,0 +1,153 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// openPostgresTestStorage opens the storage in a schema of its own on the
+// server at SKOGSNET_TEST_POSTGRES_URL, and skips the test without one. The
+// returned function opens the same schema for another site.
+func openPostgresTestStorage(t *testing.T) (*postgresStorage, func(site string) *postgresStorage) {
+	t.Helper()
+	url := os.Getenv("SKOGSNET_TEST_POSTGRES_URL")
+	if url == "" {
+		t.Skip("SKOGSNET_TEST_POSTGRES_URL not set")
+	}
+	quietWriterLogs(t)
+
+	admin, err := sql.Open("pgx", url)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	t.Cleanup(func() { admin.Close() })
+	schema := fmt.Sprintf("skogsnet_test_%d", time.Now().UnixNano())
+	if _, err := admin.Exec("CREATE SCHEMA " + schema); err != nil {
+		t.Fatalf("Failed to create schema: %v", err)
+	}
+	t.Cleanup(func() { admin.Exec("DROP SCHEMA " + schema + " CASCADE") })
+
+	separator := "?"
+	if strings.Contains(url, "?") {
+		separator = "&"
+	}
+	open := func(site string) *postgresStorage {
+		s, err := openPostgresStorage(url+separator+"search_path="+schema+",public", site)
+		if err != nil {
+			t.Fatalf("Failed to open storage: %v", err)
+		}
+		t.Cleanup(func() { s.Close() })
+		return s
+	}
+	return open("umea"), open
+}
+
+func TestPostgresStorage(t *testing.T) {
+	s, openSite := openPostgresTestStorage(t)
+	greenhouse := Device{ID: 3, Name: "greenhouse"}
+
+	weather := Weather{Name: "Umeå"}
+	weather.Main.Temp = 4
+	weather.Main.Humidity = 90
+	if err := s.InsertWeather(weather, rollupTestBase); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	batch := []Measurement{
+		{UnixTimestamp: rollupTestBase + 10_000, DeviceID: 3, DeviceName: "greenhouse", TemperatureCelsius: 20, HumidityPercentage: 50, Metrics: map[string]float64{"lux": 100}},
+		{UnixTimestamp: rollupTestBase + 50_000, DeviceID: 3, DeviceName: "greenhouse", TemperatureCelsius: 22, HumidityPercentage: 54, Metrics: map[string]float64{"lux": 300}, Raw: map[string]float64{"lux": 290}},
+		{UnixTimestamp: rollupTestBase + 30_000, DeviceID: 4, DeviceName: "cellar", TemperatureCelsius: 4, HumidityPercentage: 90},
+	}
+	if err := s.InsertMeasurementBatch(batch); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err := s.InsertMeasurement(Measurement{DeviceID: 3, DeviceName: "greenhouse", TemperatureCelsius: 10}, rollupTestBase+7_200_000); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// Another site with a device of the same name and weather of its own
+	other := openSite("lulea")
+	otherWeather := Weather{Name: "Luleå"}
+	otherWeather.Main.Temp = -10
+	other.InsertWeather(otherWeather, rollupTestBase+5_000)
+	if err := other.InsertMeasurement(Measurement{DeviceID: 1, DeviceName: "greenhouse", TemperatureCelsius: 15}, rollupTestBase+6_000); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if latest, err := other.LatestMeasurements(nil, 10); err != nil || len(latest) != 1 || latest[0].City != "Luleå" || latest[0].DeviceID != 1 {
+		t.Errorf("Expected only the other site's measurement with its weather, got %+v, %v", latest, err)
+	}
+
+	var raw string
+	s.db.QueryRow("SELECT raw_metrics::text FROM measurements WHERE raw_metrics IS NOT NULL").Scan(&raw)
+	if raw != `{"lux": 290}` {
+		t.Errorf("Expected the raw lux reading, got %q", raw)
+	}
+
+	results, err := s.QueryBuckets(&greenhouse, rollupTestBase, rollupTestBase+86_400_000, 60)
+	if err != nil || len(results) != 2 {
+		t.Fatalf("Expected 2 minute buckets, got %+v, %v", results, err)
+	}
+	first := results[0]
+	if first.AggregatedTimestamp != rollupTestBase || first.Device != "greenhouse" || first.DeviceID != 3 || first.AvgTemperature != 21 ||
+		first.MinTemperature != 20 || first.MaxTemperature != 22 || first.Metrics["lux"] != 200 {
+		t.Errorf("Unexpected first bucket %+v", first)
+	}
+	if first.City != "Umeå" || first.AvgWeatherTemp != 4 || first.AvgWeatherHumidity != 90 {
+		t.Errorf("Expected the weather of the first bucket, got %+v", first)
+	}
+	if results[1].AggregatedTimestamp != rollupTestBase+7_200_000 || results[1].City != "" {
+		t.Errorf("Unexpected second bucket %+v", results[1])
+	}
+
+	results, err = s.QueryBuckets(nil, rollupTestBase+1000, rollupTestBase+86_400_000, 86400)
+	if err != nil || len(results) != 2 || results[0].Device != "cellar" || results[0].DeviceID != 4 || results[1].AggregatedTimestamp != rollupTestBase {
+		t.Errorf("Expected a daily bucket per device, got %+v, %v", results, err)
+	}
+
+	latest, err := s.LatestMeasurements(&greenhouse, 2)
+	if err != nil || len(latest) != 2 || latest[0].AvgTemperature != 10 || latest[0].DeviceID != 3 || latest[1].Metrics != nil ||
+		latest[1].AggregatedTimestamp != rollupTestBase+50_000 {
+		t.Errorf("Unexpected latest measurements %+v, %v", latest, err)
+	}
+	latest, err = s.LatestMeasurements(nil, 10)
+	if err != nil || len(latest) != 4 {
+		t.Errorf("Expected the measurements of every device, got %+v, %v", latest, err)
+	}
+
+	csvFile := filepath.Join(t.TempDir(), "export.csv")
+	if err := exportMeasurements(s, csvFile, exportOptions{}); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	data, _ := os.ReadFile(csvFile)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	expected := fmt.Sprintf("%d,greenhouse,20,50,Umeå,4,90,0,0,0,0,,100", rollupTestBase+10_000)
+	if len(lines) != 5 || lines[0] != strings.Join(exportColumns, ",")+",lux" || lines[1] != expected {
+		t.Errorf("Unexpected export %q", data)
+	}
+}
+
+func TestOpenPostgresStorage_Reopen(t *testing.T) {
+	s, _ := openPostgresTestStorage(t)
+	if err := s.InsertMeasurement(Measurement{DeviceName: "greenhouse", TemperatureCelsius: 20}, rollupTestBase); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// Opening again keeps the tables and their rows
+	for _, statement := range postgresSchema {
+		if _, err := s.db.Exec(statement); err != nil {
+			t.Fatalf("Expected the schema to apply again, got %v", err)
+		}
+	}
+	if err := createHypertables(s.db); err != nil {
+		t.Logf("TimescaleDB not in use: %v", err)
+	}
+	var count int
+	s.db.QueryRow("SELECT COUNT(*) FROM measurements").Scan(&count)
+	if count != 1 {
+		t.Errorf("Expected the measurement to be kept, got %d", count)
+	}
+}
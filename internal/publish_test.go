@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+func TestTopicID(t *testing.T) {
+	cases := map[string]string{
+		"greenhouse":      "greenhouse",
+		"esp32-garden":    "esp32-garden",
+		"living room/1":   "living_room_1",
+		"tcp-192.168.1.2": "tcp-192_168_1_2",
+	}
+	for name, expected := range cases {
+		if id := topicID(name); id != expected {
+			t.Errorf("topicID(%q) = %q, expected %q", name, id, expected)
+		}
+	}
+}
+
+func TestValidateTopicPrefix(t *testing.T) {
+	for _, prefix := range []string{"skogsnet", "home/skogsnet"} {
+		if err := validateTopicPrefix(prefix); err != nil {
+			t.Errorf("Expected %q to be valid, got %v", prefix, err)
+		}
+	}
+	for _, prefix := range []string{"", "skogsnet/#", "a/+/b", "/skogsnet", "skogsnet/"} {
+		if err := validateTopicPrefix(prefix); err == nil {
+			t.Errorf("Expected %q to be invalid", prefix)
+		}
+	}
+}
+
+func TestCheckPublishLoop(t *testing.T) {
+	if err := checkPublishLoop(nil, "skogsnet"); err != nil {
+		t.Errorf("Expected no error without subscriptions, got %v", err)
+	}
+	config := &mqttConfig{Subscriptions: []mqttSubscription{{Topic: "zigbee2mqtt/+"}}}
+	if err := checkPublishLoop(config, "skogsnet"); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+	for _, topic := range []string{"skogsnet/#", "#", "skogsnet/+/state", "skogsnet/devices/+/state", "+/+/+", "+/+/+/+"} {
+		config := &mqttConfig{Subscriptions: []mqttSubscription{{Topic: topic}}}
+		if err := checkPublishLoop(config, "skogsnet"); err == nil {
+			t.Errorf("Expected %q to be reported as a loop", topic)
+		}
+	}
+}
+
+// collectMessages records the last message of every topic on the broker.
+func collectMessages(t *testing.T, broker *mochi.Server) func(topic string) (string, bool) {
+	t.Helper()
+	var mu sync.Mutex
+	messages := make(map[string]string)
+	err := broker.Subscribe("#", 1, func(cl *mochi.Client, sub packets.Subscription, pk packets.Packet) {
+		mu.Lock()
+		messages[pk.TopicName] = string(pk.Payload)
+		mu.Unlock()
+	})
+	if err != nil {
+		t.Fatalf("Failed to subscribe: %v", err)
+	}
+	return func(topic string) (string, bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		payload, ok := messages[topic]
+		return payload, ok
+	}
+}
+
+func TestMQTTPublisher(t *testing.T) {
+	origStatuses := deviceStatuses
+	origLogInfo := logInfo
+	origLogWarn := logWarn
+	origBroker := *mqttPublishBroker
+	deviceStatuses = newStatusRegistry()
+	logInfo = func(format string, v ...any) {}
+	logWarn = func(format string, v ...any) {}
+	defer func() {
+		deviceStatuses = origStatuses
+		logInfo = origLogInfo
+		logWarn = origLogWarn
+		*mqttPublishBroker = origBroker
+	}()
+
+	broker, url := startTestBroker(t)
+	message := collectMessages(t, broker)
+	waitForMessage := func(topic, expected string) string {
+		t.Helper()
+		var payload string
+		waitFor(t, topic, func() bool {
+			var ok bool
+			payload, ok = message(topic)
+			return ok && strings.Contains(payload, expected)
+		})
+		return payload
+	}
+
+	*mqttPublishBroker = url
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	startMQTTPublisher(ctx, &wg)
+	waitForMessage("skogsnet/status", availabilityOnline)
+
+	greenhouse := Device{ID: 1, Name: "greenhouse", Location: "Greenhouse"}
+	deviceStatuses.setLink(greenhouse, LinkConnected, nil)
+	waitForMessage("skogsnet/devices/greenhouse/availability", availabilityOnline)
+
+	publishMeasurement(greenhouse, Measurement{UnixTimestamp: 1000, TemperatureCelsius: 21.5, HumidityPercentage: 40, Metrics: map[string]float64{"lux": 300}})
+	state := waitForMessage("skogsnet/devices/greenhouse/state", "21.5")
+	var fields map[string]float64
+	json.Unmarshal([]byte(state), &fields)
+	if fields["temperature"] != 21.5 || fields["humidity"] != 40 || fields["lux"] != 300 || fields["timestamp"] != 1000 {
+		t.Errorf("Unexpected state %s", state)
+	}
+
+	var config struct {
+		Name         string              `json:"name"`
+		UniqueID     string              `json:"unique_id"`
+		StateTopic   string              `json:"state_topic"`
+		Unit         string              `json:"unit_of_measurement"`
+		DeviceClass  string              `json:"device_class"`
+		Availability []map[string]string `json:"availability"`
+		Device       map[string]any      `json:"device"`
+	}
+	json.Unmarshal([]byte(waitForMessage("homeassistant/sensor/skogsnet_device_greenhouse/temperature/config", "unique_id")), &config)
+	if config.UniqueID != "skogsnet_device_greenhouse_temperature" || config.StateTopic != "skogsnet/devices/greenhouse/state" || config.Unit != "°C" || config.DeviceClass != "temperature" {
+		t.Errorf("Unexpected temperature config: %+v", config)
+	}
+	if len(config.Availability) != 2 || config.Availability[1]["topic"] != "skogsnet/devices/greenhouse/availability" {
+		t.Errorf("Expected bridge and device availability, got %+v", config.Availability)
+	}
+	if config.Device["suggested_area"] != "Greenhouse" {
+		t.Errorf("Expected location as suggested area, got %+v", config.Device)
+	}
+	waitForMessage("homeassistant/sensor/skogsnet_device_greenhouse/lux/config", "illuminance")
+
+	// A device posting over HTTP has no link state to follow
+	publishMeasurement(Device{ID: 2, Name: "pi zero"}, Measurement{TemperatureCelsius: 18})
+	json.Unmarshal([]byte(waitForMessage("homeassistant/sensor/skogsnet_device_pi_zero/temperature/config", "unique_id")), &config)
+	if len(config.Availability) != 1 {
+		t.Errorf("Expected only bridge availability, got %+v", config.Availability)
+	}
+
+	weather := Weather{Name: "Umeå"}
+	weather.Main.Temp = 12.5
+	weather.Weather = append(weather.Weather, struct {
+		ID          int    `json:"id"`
+		Main        string `json:"main"`
+		Description string `json:"description"`
+	}{ID: 3, Description: "Overcast"})
+	publishWeather(weather, 2000)
+	waitForMessage("skogsnet/weather/state", "Overcast")
+	waitForMessage("homeassistant/sensor/skogsnet_weather/wind_speed/config", "wind_speed")
+
+	// A device named weather stays apart from the weather
+	publishMeasurement(Device{ID: 3, Name: "weather"}, Measurement{TemperatureCelsius: 4})
+	waitForMessage("skogsnet/devices/weather/state", `"temperature":4`)
+	waitForMessage("homeassistant/sensor/skogsnet_device_weather/temperature/config", "skogsnet_device_weather_temperature")
+	if state, _ := message("skogsnet/weather/state"); !strings.Contains(state, "Overcast") {
+		t.Errorf("Expected the weather state to be kept, got %s", state)
+	}
+
+	deviceStatuses.setLink(greenhouse, LinkLost, errConnectionClosed)
+	waitForMessage("skogsnet/devices/greenhouse/availability", availabilityOffline)
+
+	cancel()
+	wg.Wait()
+	waitForMessage("skogsnet/status", availabilityOffline)
+	if activePublisher.Load() != nil {
+		t.Error("Expected publisher to be cleared on shutdown")
+	}
+}
+
+func TestHandleDeviceLine_Publish(t *testing.T) {
+	origInsertMeasurement := insertMeasurement
+	origPrintToConsole := printToConsole
+	origPublish := publishMeasurement
+	defer func() {
+		insertMeasurement = origInsertMeasurement
+		printToConsole = origPrintToConsole
+		publishMeasurement = origPublish
+	}()
+
+	var insertErr error
+	insertMeasurement = func(db *sql.DB, m Measurement, ts int64) error { return insertErr }
+	printToConsole = func(m Measurement, w *Weather) {}
+	var published []Measurement
+	publishMeasurement = func(device Device, m Measurement) { published = append(published, m) }
+
+	device := Device{ID: 1, Name: t.Name()}
+	handleDeviceLine(device, `{"temperature_celcius":20.0,"humidity":50.0}`, nil, &Weather{}, nil)
+	if len(published) != 1 || published[0].DeviceName != device.Name {
+		t.Fatalf("Expected stored measurement to be published, got %+v", published)
+	}
+
+	insertErr = errors.New("disk full")
+	origLogError := throttledLogError
+	throttledLogError = func(last *time.Time, format string, v ...any) {}
+	defer func() { throttledLogError = origLogError }()
+	handleDeviceLine(device, `{"temperature_celcius":20.0,"humidity":50.0}`, nil, &Weather{}, nil)
+	if len(published) != 1 {
+		t.Error("Expected a measurement that was not stored not to be published")
+	}
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	rollupInterval = 1 * time.Minute
+	rollupChunk    = 10_000 // measurements per transaction, so catching up doesn't block writers
+)
+
+// rollupResolutions are the bucket widths in seconds, coarsest first.
+var rollupResolutions = []int64{86400, 3600, 60}
+
+var (
+	retainRaw     retentionPeriod
+	retainMinutes retentionPeriod
+)
+
+var startRollupWorker = startRollupWorkerImpl
+var rollUpMeasurements = rollUpMeasurementsImpl
+var pruneRawMeasurements = pruneRawMeasurementsImpl
+
+func init() {
+	flag.Var(&retainRaw, "retain-raw", "Delete raw measurements older than `period` once they are in the rollups, e.g. 90d (default keep forever)")
+	flag.Var(&retainMinutes, "retain-1m", "Delete 1-minute rollups older than `period`, e.g. 365d (default keep forever)")
+}
+
+// retentionPeriod is how long data is kept, as a duration like 720h or a
+// number of days like 90d. 0 keeps data forever.
+type retentionPeriod time.Duration
+
+func (p *retentionPeriod) String() string {
+	if p == nil || *p == 0 {
+		return "0"
+	}
+	d := time.Duration(*p)
+	if d%(24*time.Hour) == 0 {
+		return strconv.FormatInt(int64(d/(24*time.Hour)), 10) + "d"
+	}
+	return d.String()
+}
+
+func (p *retentionPeriod) Set(value string) error {
+	var d time.Duration
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return fmt.Errorf("invalid retention %q, expected e.g. 90d or 36h", value)
+		}
+		d = time.Duration(n) * 24 * time.Hour
+	} else {
+		var err error
+		if d, err = time.ParseDuration(value); err != nil {
+			return fmt.Errorf("invalid retention %q, expected e.g. 90d or 36h", value)
+		}
+	}
+	if d < 0 {
+		return fmt.Errorf("invalid retention %q, expected a positive period", value)
+	}
+	*p = retentionPeriod(d)
+	return nil
+}
+
+// rollupSelectSQL aggregates the measurements matching a condition into
+// buckets of the given width in milliseconds, in the columns of rollups
+// after resolution.
+func rollupSelectSQL(bucketMillis int64, where string) string {
+	return fmt.Sprintf(`
+		SELECT COALESCE(m.device_id, 0) AS device_id, m.timestamp / %[1]d * %[1]d AS bucket,
+			COUNT(*) AS count, COUNT(m.temperature) AS temperature_count, COUNT(m.humidity) AS humidity_count,
+			TOTAL(m.temperature) AS temperature_sum, MIN(m.temperature) AS temperature_min, MAX(m.temperature) AS temperature_max,
+			TOTAL(m.humidity) AS humidity_sum, MIN(m.humidity) AS humidity_min, MAX(m.humidity) AS humidity_max,
+			COUNT(w.id) AS weather_count, TOTAL(w.temp) AS weather_temp_sum, TOTAL(w.humidity) AS weather_humidity_sum,
+			TOTAL(w.wind_speed) AS wind_speed_sum, TOTAL(w.wind_deg) AS wind_deg_sum, TOTAL(w.clouds) AS clouds_sum,
+			TOTAL(w.weather_code) AS weather_code_sum, MAX(w.id) AS weather_id
+		FROM measurements m
+		LEFT JOIN weather w ON w.id = m.weather_id
+		WHERE %[2]s
+		GROUP BY 1, 2`, bucketMillis, where)
+}
+
+// rollupValuesSelectSQL is rollupSelectSQL for the extra metrics.
+func rollupValuesSelectSQL(bucketMillis int64, where string) string {
+	return fmt.Sprintf(`
+		SELECT COALESCE(m.device_id, 0) AS device_id, m.timestamp / %[1]d * %[1]d AS bucket, v.metric AS metric,
+			COUNT(*) AS count, TOTAL(v.value) AS sum, MIN(v.value) AS min, MAX(v.value) AS max
+		FROM measurement_values v
+		JOIN measurements m ON m.id = v.measurement_id
+		WHERE %[2]s
+		GROUP BY 1, 2, 3`, bucketMillis, where)
+}
+
+// aggregateRollup adds the measurements matching a condition to the rollups
+// of one resolution, merging them into existing buckets.
+func aggregateRollup(tx *sql.Tx, resolution int64, where string, args ...any) error {
+	_, err := tx.Exec(`
+		INSERT INTO rollups (resolution, device_id, bucket, count, temperature_count, humidity_count,
+			temperature_sum, temperature_min, temperature_max, humidity_sum, humidity_min, humidity_max,
+			weather_count, weather_temp_sum, weather_humidity_sum, wind_speed_sum, wind_deg_sum, clouds_sum, weather_code_sum, weather_id)
+		SELECT ?, * FROM (`+rollupSelectSQL(resolution*1000, where)+`) WHERE true
+		ON CONFLICT (resolution, device_id, bucket) DO UPDATE SET
+			count = count + excluded.count,
+			temperature_count = temperature_count + excluded.temperature_count,
+			humidity_count = humidity_count + excluded.humidity_count,
+			temperature_sum = temperature_sum + excluded.temperature_sum,
+			temperature_min = MIN(COALESCE(temperature_min, excluded.temperature_min), COALESCE(excluded.temperature_min, temperature_min)),
+			temperature_max = MAX(COALESCE(temperature_max, excluded.temperature_max), COALESCE(excluded.temperature_max, temperature_max)),
+			humidity_sum = humidity_sum + excluded.humidity_sum,
+			humidity_min = MIN(COALESCE(humidity_min, excluded.humidity_min), COALESCE(excluded.humidity_min, humidity_min)),
+			humidity_max = MAX(COALESCE(humidity_max, excluded.humidity_max), COALESCE(excluded.humidity_max, humidity_max)),
+			weather_count = weather_count + excluded.weather_count,
+			weather_temp_sum = weather_temp_sum + excluded.weather_temp_sum,
+			weather_humidity_sum = weather_humidity_sum + excluded.weather_humidity_sum,
+			wind_speed_sum = wind_speed_sum + excluded.wind_speed_sum,
+			wind_deg_sum = wind_deg_sum + excluded.wind_deg_sum,
+			clouds_sum = clouds_sum + excluded.clouds_sum,
+			weather_code_sum = weather_code_sum + excluded.weather_code_sum,
+			weather_id = MAX(COALESCE(weather_id, 0), COALESCE(excluded.weather_id, 0))
+	`, append([]any{resolution}, args...)...)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO rollup_values (resolution, device_id, bucket, metric, count, sum, min, max)
+		SELECT ?, * FROM (`+rollupValuesSelectSQL(resolution*1000, where)+`) WHERE true
+		ON CONFLICT (resolution, device_id, bucket, metric) DO UPDATE SET
+			count = count + excluded.count,
+			sum = sum + excluded.sum,
+			min = MIN(COALESCE(min, excluded.min), COALESCE(excluded.min, min)),
+			max = MAX(COALESCE(max, excluded.max), COALESCE(excluded.max, max))
+	`, append([]any{resolution}, args...)...)
+	return err
+}
+
+// rollUpMeasurementsImpl adds the measurements stored since the last run to
+// the rollups. Measurements are taken by ID rather than timestamp, so late
+// arrivals, e.g. replayed from the spill journal, are counted too.
+func rollUpMeasurementsImpl(db *sql.DB) error {
+	for {
+		done, err := rollUpChunk(db)
+		if err != nil || done {
+			return err
+		}
+	}
+}
+
+// rollUpChunk rolls up the next rollupChunk measurements in one transaction.
+// It returns true once no measurements are left.
+func rollUpChunk(db *sql.DB) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var last int64
+	if err := tx.QueryRow("SELECT last_measurement_id FROM rollup_progress").Scan(&last); err != nil {
+		return false, err
+	}
+	var upTo sql.NullInt64
+	err = tx.QueryRow("SELECT MAX(id) FROM (SELECT id FROM measurements WHERE id > ? ORDER BY id LIMIT ?)", last, rollupChunk).Scan(&upTo)
+	if err != nil {
+		return false, err
+	}
+	if !upTo.Valid {
+		return true, nil
+	}
+
+	for _, resolution := range rollupResolutions {
+		if err := aggregateRollup(tx, resolution, "m.id > ? AND m.id <= ?", last, upTo.Int64); err != nil {
+			return false, err
+		}
+	}
+	if _, err := tx.Exec("UPDATE rollup_progress SET last_measurement_id = ?", upTo.Int64); err != nil {
+		return false, err
+	}
+	return false, tx.Commit()
+}
+
+// rebuildRollups recomputes the rollups of a device from its raw
+// measurements, after their values were changed in place. Buckets that
+// retention has already thinned out are left as they are.
+func rebuildRollups(tx *sql.Tx, deviceID int64) error {
+	var last, rawSince int64
+	if err := tx.QueryRow("SELECT last_measurement_id, raw_since FROM rollup_progress").Scan(&last, &rawSince); err != nil {
+		return err
+	}
+	for _, resolution := range rollupResolutions {
+		width := resolution * 1000
+		start := (rawSince + width - 1) / width * width // first bucket still complete
+		for _, table := range []string{"rollups", "rollup_values"} {
+			_, err := tx.Exec("DELETE FROM "+table+" WHERE resolution = ? AND device_id = ? AND bucket >= ?", resolution, deviceID, start)
+			if err != nil {
+				return err
+			}
+		}
+		if err := aggregateRollup(tx, resolution, "m.device_id = ? AND m.timestamp >= ? AND m.id <= ?", deviceID, start, last); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pruneRawMeasurementsImpl deletes raw measurements from before cutoff that
+// are already in the rollups, a chunk per transaction. It returns the number
+// of deleted measurements.
+func pruneRawMeasurementsImpl(db *sql.DB, cutoff int64) (int64, error) {
+	var deleted int64
+	for {
+		n, err := pruneRawChunk(db, cutoff)
+		deleted += n
+		if err != nil || n < rollupChunk {
+			return deleted, err
+		}
+	}
+}
+
+func pruneRawChunk(db *sql.DB, cutoff int64) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	const expired = "SELECT id FROM measurements WHERE timestamp < ? AND id <= (SELECT last_measurement_id FROM rollup_progress) ORDER BY id LIMIT ?"
+	if _, err := tx.Exec("DELETE FROM measurement_values WHERE measurement_id IN ("+expired+")", cutoff, rollupChunk); err != nil {
+		return 0, err
+	}
+	result, err := tx.Exec("DELETE FROM measurements WHERE id IN ("+expired+")", cutoff, rollupChunk)
+	if err != nil {
+		return 0, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec("UPDATE rollup_progress SET raw_since = MAX(raw_since, ?)", cutoff); err != nil {
+		return 0, err
+	}
+	return n, tx.Commit()
+}
+
+// pruneMinuteRollups deletes 1-minute rollups from before cutoff.
+func pruneMinuteRollups(db *sql.DB, cutoff int64) error {
+	for _, table := range []string{"rollups", "rollup_values"} {
+		if _, err := db.Exec("DELETE FROM "+table+" WHERE resolution = 60 AND bucket < ?", cutoff); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// maintainRollups brings the rollups up to date and applies retention.
+func maintainRollups(db *sql.DB, now time.Time) {
+	if err := rollUpMeasurements(db); err != nil {
+		throttledLogError(&lastRollupErr, "Failed to update rollups: %v", err)
+		return
+	}
+	if retainRaw > 0 {
+		n, err := pruneRawMeasurements(db, now.Add(-time.Duration(retainRaw)).UnixMilli())
+		if err != nil {
+			throttledLogError(&lastRollupErr, "Failed to delete old raw measurements: %v", err)
+		} else if n > 0 {
+			logInfo("Deleted %d raw measurement(s) older than %s", n, retainRaw.String())
+		}
+	}
+	if retainMinutes > 0 {
+		if err := pruneMinuteRollups(db, now.Add(-time.Duration(retainMinutes)).UnixMilli()); err != nil {
+			throttledLogError(&lastRollupErr, "Failed to delete old 1-minute rollups: %v", err)
+		}
+	}
+}
+
+// startRollupWorkerImpl keeps the rollups up to date and applies retention
+// every rollupInterval until ctx is cancelled.
+func startRollupWorkerImpl(ctx context.Context, db *sql.DB, wg *sync.WaitGroup) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(rollupInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				maintainRollups(db, time.Now())
+			}
+		}
+	}()
+}
+
+// bestRollup returns the coarsest rollup resolution that buckets of
+// intervalSeconds can be built from, 0 if none fits.
+func bestRollup(intervalSeconds int64) int64 {
+	for _, resolution := range rollupResolutions {
+		if intervalSeconds%resolution == 0 {
+			return resolution
+		}
+	}
+	return 0
+}
+
+// bucketSources returns the rows to aggregate into buckets of intervalSeconds
+// from since to end: the best rollup, and the raw measurements not rolled up
+// yet. deviceID 0 selects every device.
+func bucketSources(table, columns string, raw func(int64, string) string, deviceID, since, end, intervalSeconds int64) (string, []any) {
+	width := intervalSeconds * 1000
+	from := since / width * width
+	deviceWhere := ""
+	if deviceID != 0 {
+		deviceWhere = " AND m.device_id = ?"
+	}
+
+	resolution := bestRollup(intervalSeconds)
+	if resolution == 0 {
+		args := []any{from, end}
+		if deviceID != 0 {
+			args = append(args, deviceID)
+		}
+		return raw(width, "m.timestamp >= ? AND m.timestamp <= ?"+deviceWhere), args
+	}
+
+	query := fmt.Sprintf("SELECT device_id, bucket / %d * %d AS bucket, %s FROM %s WHERE resolution = ? AND bucket >= ? AND bucket <= ?", width, width, columns, table)
+	args := []any{resolution, from, end}
+	if deviceID != 0 {
+		query += " AND device_id = ?"
+		args = append(args, deviceID)
+	}
+	query += " UNION ALL " + raw(width, "m.id > (SELECT last_measurement_id FROM rollup_progress) AND m.timestamp >= ? AND m.timestamp <= ?"+deviceWhere)
+	args = append(args, from, end)
+	if deviceID != 0 {
+		args = append(args, deviceID)
+	}
+	return query, args
+}
+
+// queryBuckets averages the measurements from since to end into buckets of
+// intervalSeconds, one series per device, including the extra metrics.
+func queryBuckets(db *sql.DB, deviceID, since, end, intervalSeconds int64) ([]Result, error) {
+	sources, args := bucketSources("rollups", `count, temperature_count, humidity_count,
+		temperature_sum, temperature_min, temperature_max, humidity_sum, humidity_min, humidity_max,
+		weather_count, weather_temp_sum, weather_humidity_sum, wind_speed_sum, wind_deg_sum, clouds_sum, weather_code_sum, weather_id`,
+		rollupSelectSQL, deviceID, since, end, intervalSeconds)
+
+	rows, err := db.Query(`
+		SELECT NULL AS measurement_id,
+			b.device_id AS device_id,
+			devices.name AS device,
+			b.bucket AS aggregated_timestamp,
+			b.temperature_sum / NULLIF(b.temperature_count, 0) AS avg_temperature,
+			b.temperature_min AS min_temperature,
+			b.temperature_max AS max_temperature,
+			b.humidity_sum / NULLIF(b.humidity_count, 0) AS avg_humidity,
+			b.humidity_min AS min_humidity,
+			b.humidity_max AS max_humidity,
+			weather.city AS city,
+			b.weather_temp_sum / NULLIF(b.weather_count, 0) AS avg_weather_temp,
+			b.weather_humidity_sum / NULLIF(b.weather_count, 0) AS avg_weather_humidity,
+			b.wind_speed_sum / NULLIF(b.weather_count, 0) AS avg_wind_speed,
+			b.wind_deg_sum / NULLIF(b.weather_count, 0) AS avg_wind_deg,
+			b.clouds_sum / NULLIF(b.weather_count, 0) AS avg_clouds,
+			b.weather_code_sum / NULLIF(b.weather_count, 0) AS avg_weather_code,
+			weather.description AS description
+		FROM (
+			SELECT device_id, bucket, SUM(count) AS count,
+				SUM(temperature_count) AS temperature_count, SUM(humidity_count) AS humidity_count,
+				SUM(temperature_sum) AS temperature_sum, MIN(temperature_min) AS temperature_min, MAX(temperature_max) AS temperature_max,
+				SUM(humidity_sum) AS humidity_sum, MIN(humidity_min) AS humidity_min, MAX(humidity_max) AS humidity_max,
+				SUM(weather_count) AS weather_count, SUM(weather_temp_sum) AS weather_temp_sum, SUM(weather_humidity_sum) AS weather_humidity_sum,
+				SUM(wind_speed_sum) AS wind_speed_sum, SUM(wind_deg_sum) AS wind_deg_sum, SUM(clouds_sum) AS clouds_sum,
+				SUM(weather_code_sum) AS weather_code_sum, MAX(weather_id) AS weather_id
+			FROM (`+sources+`)
+			GROUP BY device_id, bucket
+		) b
+		LEFT JOIN devices ON devices.id = b.device_id
+		LEFT JOIN weather ON weather.id = b.weather_id
+		ORDER BY b.device_id, b.bucket
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	results, err := scanResults(rows)
+	if err != nil || len(results) == 0 {
+		return results, err
+	}
+
+	type bucketKey struct {
+		deviceID  int64
+		timestamp int64
+	}
+	index := make(map[bucketKey]*Result, len(results))
+	for i := range results {
+		index[bucketKey{results[i].DeviceID, results[i].AggregatedTimestamp}] = &results[i]
+	}
+
+	sources, args = bucketSources("rollup_values", "metric, count, sum, min, max", rollupValuesSelectSQL, deviceID, since, end, intervalSeconds)
+	rows, err = db.Query(`
+		SELECT device_id, bucket, metric, SUM(sum) / SUM(count)
+		FROM (`+sources+`)
+		GROUP BY device_id, bucket, metric
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key bucketKey
+		var deviceID sql.NullInt64
+		var metric string
+		var value float64
+		if err := rows.Scan(&deviceID, &key.timestamp, &metric, &value); err != nil {
+			return nil, err
+		}
+		key.deviceID = deviceID.Int64
+		result, ok := index[key]
+		if !ok {
+			continue
+		}
+		if result.Metrics == nil {
+			result.Metrics = make(map[string]float64)
+		}
+		result.Metrics[metric] = value
+	}
+	return results, rows.Err()
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// rollupTestBase is midnight UTC, so it starts a bucket of every resolution.
+const rollupTestBase = int64(1_700_006_400_000)
+
+func insertRollupTestMeasurement(t *testing.T, db *sql.DB, deviceID, offsetSeconds int64, temperature float64, metrics map[string]float64) {
+	t.Helper()
+	timestamp := rollupTestBase + offsetSeconds*1000
+	m := Measurement{UnixTimestamp: timestamp, DeviceID: deviceID, TemperatureCelsius: temperature, HumidityPercentage: 50, Metrics: metrics}
+	if err := insertMeasurement(db, m, timestamp); err != nil {
+		t.Fatalf("Failed to insert measurement: %v", err)
+	}
+}
+
+func rollupCount(t *testing.T, db *sql.DB, resolution, bucket int64) (count int64, min, max float64) {
+	t.Helper()
+	err := db.QueryRow("SELECT count, temperature_min, temperature_max FROM rollups WHERE resolution = ? AND bucket = ?", resolution, bucket).Scan(&count, &min, &max)
+	if err != nil && err != sql.ErrNoRows {
+		t.Fatalf("Query failed: %v", err)
+	}
+	return count, min, max
+}
+
+func TestRetentionPeriod(t *testing.T) {
+	var p retentionPeriod
+	if err := p.Set("90d"); err != nil || time.Duration(p) != 90*24*time.Hour || p.String() != "90d" {
+		t.Errorf("Expected 90 days, got %v, %v", time.Duration(p), err)
+	}
+	if err := p.Set("36h"); err != nil || time.Duration(p) != 36*time.Hour || p.String() != "36h0m0s" {
+		t.Errorf("Expected 36 hours, got %v, %v", time.Duration(p), err)
+	}
+	for _, value := range []string{"", "d", "ninety", "-1d", "-5m"} {
+		if err := p.Set(value); err == nil {
+			t.Errorf("Expected error for %q", value)
+		}
+	}
+}
+
+func TestRollUpMeasurements(t *testing.T) {
+	db, device := openCalibrationTestDB(t, filepath.Join(t.TempDir(), "rollup.db"))
+	insertRollupTestMeasurement(t, db, device.ID, 10, 20, map[string]float64{"lux": 100})
+	insertRollupTestMeasurement(t, db, device.ID, 50, 22, map[string]float64{"lux": 300})
+	insertRollupTestMeasurement(t, db, device.ID, 70, 30, nil)
+	insertRollupTestMeasurement(t, db, device.ID, 3605, 10, nil)
+
+	if err := rollUpMeasurements(db); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if count, min, max := rollupCount(t, db, 60, rollupTestBase); count != 2 || min != 20 || max != 22 {
+		t.Errorf("Expected the first minute to hold 2 measurements from 20 to 22, got %d from %v to %v", count, min, max)
+	}
+	if count, _, _ := rollupCount(t, db, 3600, rollupTestBase); count != 3 {
+		t.Errorf("Expected the first hour to hold 3 measurements, got %d", count)
+	}
+	if count, min, max := rollupCount(t, db, 86400, rollupTestBase); count != 4 || min != 10 || max != 30 {
+		t.Errorf("Expected the day to hold 4 measurements from 10 to 30, got %d from %v to %v", count, min, max)
+	}
+	var lux float64
+	db.QueryRow("SELECT sum / count FROM rollup_values WHERE resolution = 60 AND bucket = ? AND metric = 'lux'", rollupTestBase).Scan(&lux)
+	if lux != 200 {
+		t.Errorf("Expected an average lux of 200, got %v", lux)
+	}
+
+	// A late arrival is merged into its existing buckets
+	insertRollupTestMeasurement(t, db, device.ID, 20, 18, nil)
+	if err := rollUpMeasurements(db); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if count, min, _ := rollupCount(t, db, 60, rollupTestBase); count != 3 || min != 18 {
+		t.Errorf("Expected the late measurement in the first minute, got %d with min %v", count, min)
+	}
+	if count, _, _ := rollupCount(t, db, 86400, rollupTestBase); count != 5 {
+		t.Errorf("Expected each measurement to be counted once, got %d", count)
+	}
+}
+
+func TestQueryBuckets(t *testing.T) {
+	db, device := openCalibrationTestDB(t, filepath.Join(t.TempDir(), "buckets.db"))
+	db.Exec("INSERT INTO weather (timestamp, city, temp, humidity, description) VALUES (?, 'Umeå', 4, 90, 'fog')", rollupTestBase)
+
+	insertRollupTestMeasurement(t, db, device.ID, 10, 20, map[string]float64{"lux": 100})
+	insertRollupTestMeasurement(t, db, device.ID, 50, 22, map[string]float64{"lux": 300})
+	insertRollupTestMeasurement(t, db, device.ID, 20, 18, nil)
+	insertRollupTestMeasurement(t, db, device.ID, 7200, 10, nil)
+	rollUpMeasurements(db)
+	// Stored since the last rollup, so still read from the raw table
+	insertRollupTestMeasurement(t, db, device.ID, 30, 26, map[string]float64{"lux": 500})
+
+	end := rollupTestBase + 86_400_000
+	results, err := queryBuckets(db, 0, rollupTestBase, end, 60)
+	if err != nil || len(results) != 2 {
+		t.Fatalf("Expected 2 minute buckets, got %+v, %v", results, err)
+	}
+	first := results[0]
+	if first.AggregatedTimestamp != rollupTestBase || first.Device != "greenhouse" || first.AvgTemperature != 21.5 ||
+		first.MinTemperature != 18 || first.MaxTemperature != 26 || first.Metrics["lux"] != 300 {
+		t.Errorf("Unexpected first bucket %+v", first)
+	}
+	if first.City != "Umeå" || first.Description != "fog" || first.AvgWeatherTemp != 4 || first.AvgWeatherHumidity != 90 {
+		t.Errorf("Expected the weather of the first bucket, got %+v", first)
+	}
+	if results[1].AggregatedTimestamp != rollupTestBase+7_200_000 || results[1].AvgTemperature != 10 || results[1].City != "" {
+		t.Errorf("Unexpected second bucket %+v", results[1])
+	}
+
+	// Coarser buckets are built from the rollups that divide them
+	for _, interval := range []int64{7200, 86400} {
+		results, err := queryBuckets(db, device.ID, rollupTestBase+1000, end, interval)
+		if err != nil || len(results) == 0 || results[0].AggregatedTimestamp != rollupTestBase {
+			t.Fatalf("Expected buckets from the start of the day for %ds, got %+v, %v", interval, results, err)
+		}
+		if interval == 86400 && (results[0].AvgTemperature != 19.2 || results[0].Metrics["lux"] != 300) {
+			t.Errorf("Expected the daily average of 19.2, got %+v", results[0])
+		}
+	}
+
+	// Buckets no rollup fits are read from the raw table
+	results, err = queryBuckets(db, 0, rollupTestBase, rollupTestBase+59_999, 30)
+	if err != nil || len(results) != 2 || results[0].AvgTemperature != 19 || results[1].AvgTemperature != 24 {
+		t.Errorf("Expected 30 second buckets of 19 and 24, got %+v, %v", results, err)
+	}
+
+	results, err = queryBuckets(db, device.ID+1, rollupTestBase, end, 60)
+	if err != nil || len(results) != 0 {
+		t.Errorf("Expected no buckets for another device, got %+v, %v", results, err)
+	}
+}
+
+func TestRollUpMeasurements_WithoutHumidity(t *testing.T) {
+	db, device := openCalibrationTestDB(t, filepath.Join(t.TempDir(), "rollup.db"))
+	insertRollupTestMeasurement(t, db, device.ID, 10, 20, nil)
+	m := Measurement{UnixTimestamp: rollupTestBase + 20_000, DeviceID: device.ID, TemperatureCelsius: 22}
+	m.setMissing(humidityField)
+	if err := insertMeasurement(db, m, m.UnixTimestamp); err != nil {
+		t.Fatalf("Failed to insert measurement: %v", err)
+	}
+
+	var humidity sql.NullFloat64
+	db.QueryRow("SELECT humidity FROM measurements WHERE timestamp = ?", m.UnixTimestamp).Scan(&humidity)
+	if humidity.Valid {
+		t.Errorf("Expected NULL humidity for a reading without one, got %v", humidity.Float64)
+	}
+
+	if err := rollUpMeasurements(db); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	var count, humidityCount int64
+	var humidityMin sql.NullFloat64
+	db.QueryRow("SELECT count, humidity_count, humidity_min FROM rollups WHERE resolution = 60 AND bucket = ?", rollupTestBase).
+		Scan(&count, &humidityCount, &humidityMin)
+	if count != 2 || humidityCount != 1 || humidityMin.Float64 != 50 {
+		t.Errorf("Expected 2 measurements with 1 humidity of 50, got %d, %d, %v", count, humidityCount, humidityMin)
+	}
+	results, err := queryBuckets(db, device.ID, rollupTestBase, rollupTestBase+86_400_000, 60)
+	if err != nil || len(results) != 1 || results[0].AvgHumidity != 50 || results[0].AvgTemperature != 21 {
+		t.Errorf("Expected the missing humidity left out of the average, got %+v, %v", results, err)
+	}
+
+	// A bucket of readings without humidity has none
+	m.UnixTimestamp += 60_000
+	insertMeasurement(db, m, m.UnixTimestamp)
+	rollUpMeasurements(db)
+	db.QueryRow("SELECT humidity_count, humidity_min FROM rollups WHERE resolution = 60 AND bucket = ?", rollupTestBase+60_000).
+		Scan(&humidityCount, &humidityMin)
+	if humidityCount != 0 || humidityMin.Valid {
+		t.Errorf("Expected no humidity in the second minute, got %d, %v", humidityCount, humidityMin)
+	}
+}
+
+func TestPruneRawMeasurements(t *testing.T) {
+	db, device := openCalibrationTestDB(t, filepath.Join(t.TempDir(), "prune.db"))
+	insertRollupTestMeasurement(t, db, device.ID, 10, 20, map[string]float64{"lux": 100})
+	insertRollupTestMeasurement(t, db, device.ID, 86400, 30, nil)
+	rollUpMeasurements(db)
+	// Not rolled up yet, so kept whatever its age
+	insertRollupTestMeasurement(t, db, device.ID, 20, 22, nil)
+
+	deleted, err := pruneRawMeasurements(db, rollupTestBase+86_400_000)
+	if err != nil || deleted != 1 {
+		t.Fatalf("Expected 1 deleted measurement, got %d, %v", deleted, err)
+	}
+	var measurements, values int
+	db.QueryRow("SELECT COUNT(*), (SELECT COUNT(*) FROM measurement_values) FROM measurements").Scan(&measurements, &values)
+	if measurements != 2 || values != 0 {
+		t.Errorf("Expected 2 measurements and no values left, got %d and %d", measurements, values)
+	}
+
+	results, err := queryBuckets(db, 0, rollupTestBase, rollupTestBase+2*86_400_000, 86400)
+	if err != nil || len(results) != 2 || results[0].AvgTemperature != 21 || results[0].Metrics["lux"] != 100 {
+		t.Errorf("Expected the deleted measurement to remain in the rollups, got %+v, %v", results, err)
+	}
+}
+
+func TestRebuildRollups_AfterRecompute(t *testing.T) {
+	db, device := openCalibrationTestDB(t, filepath.Join(t.TempDir(), "rebuild.db"))
+	insertRollupTestMeasurement(t, db, device.ID, 10, 20, nil)
+	insertRollupTestMeasurement(t, db, device.ID, 86400+10, 30, nil)
+	rollUpMeasurements(db)
+	pruneRawMeasurements(db, rollupTestBase+3_600_000)
+
+	addCalibration(db, Calibration{DeviceID: device.ID, Metric: temperatureField, Gain: 1, Offset: -1, ValidFrom: 0})
+	if _, err := recomputeCalibration(db, device.ID, ""); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if count, min, _ := rollupCount(t, db, 60, rollupTestBase+86_400_000); count != 1 || min != 29 {
+		t.Errorf("Expected the rollup to follow the recomputed value, got %d with %v", count, min)
+	}
+	if count, min, _ := rollupCount(t, db, 60, rollupTestBase); count != 1 || min != 20 {
+		t.Errorf("Expected the rollup of a deleted measurement to be kept, got %d with %v", count, min)
+	}
+	if count, _, _ := rollupCount(t, db, 86400, rollupTestBase); count != 1 {
+		t.Errorf("Expected the partly deleted day to be kept, got %d", count)
+	}
+}
+
+func TestMaintainRollups(t *testing.T) {
+	quietWriterLogs(t)
+	db, device := openCalibrationTestDB(t, filepath.Join(t.TempDir(), "maintain.db"))
+	defer func() { retainRaw, retainMinutes = 0, 0 }()
+	insertRollupTestMeasurement(t, db, device.ID, 10, 20, nil)
+	insertRollupTestMeasurement(t, db, device.ID, 10*86400, 30, nil)
+
+	now := time.UnixMilli(rollupTestBase + 10*86_400_000)
+	retainRaw.Set("7d")
+	retainMinutes.Set("9d")
+	maintainRollups(db, now)
+
+	var measurements, minutes, days int
+	db.QueryRow("SELECT COUNT(*) FROM measurements").Scan(&measurements)
+	db.QueryRow("SELECT COUNT(*) FROM rollups WHERE resolution = 60").Scan(&minutes)
+	db.QueryRow("SELECT COUNT(*) FROM rollups WHERE resolution = 86400").Scan(&days)
+	if measurements != 1 || minutes != 1 || days != 2 {
+		t.Errorf("Expected 1 measurement, 1 minute and 2 day rollups, got %d, %d and %d", measurements, minutes, days)
+	}
+}
+
+func TestBestRollup(t *testing.T) {
+	for interval, expected := range map[int64]int64{60: 60, 300: 60, 3600: 3600, 7200: 3600, 86400: 86400, 30: 0, 90: 0} {
+		if got := bestRollup(interval); got != expected {
+			t.Errorf("Expected %d for %ds, got %d", expected, interval, got)
+		}
+	}
+}
@@ -1,12 +1,65 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
 	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"go.bug.st/serial"
 	"go.bug.st/serial/enumerator"
 )
 
+const autoPortName = "auto"
+
+var serialProbeTimeout = 12 * time.Second
+
+// portClaims tracks which device holds each serial port so that auto
+// detection never probes a port another device is reading.
+type portClaims struct {
+	mu     sync.Mutex
+	owners map[string]string
+}
+
+var serialPortClaims = &portClaims{owners: make(map[string]string)}
+
+// claim assigns port to device. It fails and returns the current owner if
+// another device already holds it.
+func (c *portClaims) claim(port, device string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if owner, ok := c.owners[port]; ok && owner != device {
+		return owner, false
+	}
+	c.owners[port] = device
+	return device, true
+}
+
+// claimedByOther reports whether a device other than device holds port.
+func (c *portClaims) claimedByOther(port, device string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	owner, ok := c.owners[port]
+	return ok && owner != device
+}
+
+func (c *portClaims) release(port, device string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.owners[port] == device {
+		delete(c.owners, port)
+	}
+}
+
 // Allow both *bufio.Scanner and your *errorScanner can be used.
 type Scanner interface {
 	Scan() bool
@@ -14,34 +67,213 @@ type Scanner interface {
 	Err() error
 }
 
-var initSerialPort = initSerialPortImpl
+var openSerialPort = openSerialPortImpl
+var openAutoDetectedPort = openAutoDetectedPortImpl
+var probeSerialPort = probeSerialPortImpl
+var superviseDevice = superviseDeviceImpl
 var serialOpen = serial.Open
 var getSerialPort = getSerialPortImpl
+var matchingSerialPorts = matchingSerialPortsImpl
 var readFromSerial = readFromSerialImpl
 var enumeratorGetDetailedPortsList = enumerator.GetDetailedPortsList
 
-func initSerialPortImpl() serial.Port {
-	logInfo("Initializing serial connection...")
+// openSerialPortImpl resolves the device's port, opens it and claims it for
+// the device. It returns the open port and its resolved name.
+func openSerialPortImpl(device Device) (serial.Port, string, error) {
+	logInfo("Initializing serial connection for device %s...", device.Name)
+
+	if device.autoDetect() {
+		return openAutoDetectedPort(device)
+	}
 
-	portDetails, err := getSerialPort()
+	portDetails, err := getSerialPort(device)
 	if err != nil {
-		logError(err.Error())
-		osExit(1)
-		return nil
+		return nil, "", err
+	}
+	if owner, ok := serialPortClaims.claim(portDetails.Name, device.Name); !ok {
+		return nil, "", fmt.Errorf("port %s is already in use by device %s", portDetails.Name, owner)
 	}
 
-	mode := &serial.Mode{BaudRate: *baudRate}
-	serialPort, err := serialOpen(portDetails.Name, mode)
+	serialPort, err := serialOpen(portDetails.Name, serialMode(device))
 	if err != nil {
-		logError(fmt.Sprintf("Failed to open serial port: %v", err))
-		osExit(1)
-		return nil
+		serialPortClaims.release(portDetails.Name, device.Name)
+		return nil, "", fmt.Errorf("failed to open serial port: %w", err)
 	}
 
-	return serialPort
+	return serialPort, portDetails.Name, nil
 }
 
-func getSerialPortImpl() (*enumerator.PortDetails, error) {
+// openAutoDetectedPortImpl opens each matching port that no other device has
+// claimed and keeps the first one that sends a valid measurement.
+func openAutoDetectedPortImpl(device Device) (serial.Port, string, error) {
+	ports, err := matchingSerialPorts(device)
+	if err != nil {
+		return nil, "", err
+	}
+
+	for _, port := range ports {
+		if _, ok := serialPortClaims.claim(port.Name, device.Name); !ok {
+			continue
+		}
+
+		logInfo("Probing port %s for measurements...", port.Name)
+		serialPort, err := serialOpen(port.Name, serialMode(device))
+		if err != nil {
+			serialPortClaims.release(port.Name, device.Name)
+			logWarn("Failed to open %s while probing: %v", port.Name, err)
+			continue
+		}
+		if probeSerialPort(serialPort, serialProbeTimeout) {
+			logInfo("Using port: %s", port.Name)
+			return serialPort, port.Name, nil
+		}
+
+		serialPort.Close()
+		serialPortClaims.release(port.Name, device.Name)
+	}
+
+	return nil, "", fmt.Errorf("no port sending measurements found")
+}
+
+// probeSerialPortImpl reads from the port until a valid measurement line
+// arrives or the timeout expires. The port is left in blocking mode.
+func probeSerialPortImpl(serialPort serial.Port, timeout time.Duration) bool {
+	if err := serialPort.SetReadTimeout(serialProbeReadTimeout); err != nil {
+		return false
+	}
+	defer serialPort.SetReadTimeout(serial.NoTimeout)
+
+	const maxPending = 4096
+	var pending []byte
+	buf := make([]byte, 256)
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		n, err := serialPort.Read(buf)
+		if err != nil {
+			return false
+		}
+		pending = append(pending, buf[:n]...)
+
+		for {
+			i := bytes.IndexByte(pending, '\n')
+			if i < 0 {
+				break
+			}
+			line := strings.TrimSpace(string(pending[:i]))
+			pending = pending[i+1:]
+			if isMeasurementLine(line) {
+				return true
+			}
+		}
+		if len(pending) > maxPending {
+			pending = pending[len(pending)-maxPending:]
+		}
+	}
+
+	return false
+}
+
+// isMeasurementLine reports whether line, plain or framed, deserializes into
+// a measurement and carries at least one numeric reading.
+func isMeasurementLine(line string) bool {
+	if strings.HasPrefix(line, "$") {
+		payload, err := decodeFrame(line)
+		if err != nil {
+			return false
+		}
+		line = payload
+	}
+	if _, err := deserializeData(line); err != nil {
+		return false
+	}
+	var fields map[string]any
+	if err := json.Unmarshal([]byte(line), &fields); err != nil {
+		return false
+	}
+	for _, value := range fields {
+		if _, ok := value.(float64); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func serialMode(device Device) *serial.Mode {
+	baud := device.Baud
+	if baud == 0 {
+		baud = *baudRate
+	}
+	return &serial.Mode{BaudRate: baud}
+}
+
+// superviseDeviceImpl keeps a device connected until ctx is cancelled. When
+// the port cannot be opened or stops delivering data it is closed, the ports
+// are re-enumerated and the open is retried with exponential backoff.
+func superviseDeviceImpl(ctx context.Context, device Device, db *sql.DB, latestWeather *Weather) {
+	backoff := serialRetryDelay
+	for ctx.Err() == nil {
+		serialPort, name, err := openSerialPort(device)
+		if err != nil {
+			deviceStatuses.setLink(device, LinkReconnecting, err)
+			if !sleepContext(ctx, backoff) {
+				return
+			}
+			backoff = min(backoff*2, serialMaxRetryDelay)
+			continue
+		}
+
+		connected := device
+		connected.Port = name
+		deviceStatuses.setLink(connected, LinkConnected, nil)
+		backoff = serialRetryDelay
+
+		// Closing the port is the only way to interrupt a blocking read
+		connectionDone := make(chan struct{})
+		go func() {
+			select {
+			case <-ctx.Done():
+				serialPort.Close()
+			case <-connectionDone:
+			}
+		}()
+
+		err = readDeviceLoop(ctx, connected, serialPort, db, latestWeather)
+		close(connectionDone)
+		serialPort.Close()
+		serialPortClaims.release(name, device.Name)
+		if ctx.Err() != nil {
+			return
+		}
+
+		deviceStatuses.setLink(connected, LinkLost, err)
+		if !sleepContext(ctx, backoff) {
+			return
+		}
+	}
+}
+
+// getSerialPortImpl returns the first available port matching the device's
+// port name and USB selectors that no other device has claimed, so identical
+// boards without -usb-serial each get their own port. When every match is
+// claimed it returns the first, for the claim to report its owner.
+func getSerialPortImpl(device Device) (*enumerator.PortDetails, error) {
+	ports, err := matchingSerialPorts(device)
+	if err != nil {
+		return nil, err
+	}
+
+	port := ports[0]
+	for _, candidate := range ports {
+		if !serialPortClaims.claimedByOther(candidate.Name, device.Name) {
+			port = candidate
+			break
+		}
+	}
+	logInfo("Using port: %s", port.Name)
+	return port, nil
+}
+
+func matchingSerialPortsImpl(device Device) ([]*enumerator.PortDetails, error) {
 	ports, err := enumeratorGetDetailedPortsList()
 	if err != nil {
 		return nil, fmt.Errorf("enumerator error: %w", err)
@@ -52,17 +284,63 @@ func getSerialPortImpl() (*enumerator.PortDetails, error) {
 
 	logInfo("Available ports:")
 	for _, port := range ports {
-		logInfo("- %s", port.Name)
+		if port.IsUSB {
+			logInfo("- %s (usb vid=%s pid=%s serial=%s)", port.Name, port.VID, port.PID, port.SerialNumber)
+		} else {
+			logInfo("- %s", port.Name)
+		}
 	}
 
+	var matches []*enumerator.PortDetails
 	for _, port := range ports {
-		if port.Name == *portName {
-			logInfo("Using port: %s", port.Name)
-			return port, nil
+		if portMatches(device, port) {
+			matches = append(matches, port)
 		}
 	}
+	if len(matches) > 0 {
+		return matches, nil
+	}
+
+	if device.hasUSBSelector() || device.autoDetect() {
+		return nil, fmt.Errorf("no serial port matching %s found", device.portSpec())
+	}
+	return nil, fmt.Errorf("specified port %s not found in available ports", device.Port)
+}
+
+// portMatches reports whether port satisfies every selector set on the
+// device. USB IDs are compared as hex numbers, so "2341" matches "0x2341".
+func portMatches(device Device, port *enumerator.PortDetails) bool {
+	if device.Port != "" && !device.autoDetect() && port.Name != device.Port {
+		return false
+	}
+	if !device.hasUSBSelector() {
+		return true
+	}
+	if !port.IsUSB {
+		return false
+	}
+	if device.VID != "" && !sameUSBID(device.VID, port.VID) {
+		return false
+	}
+	if device.PID != "" && !sameUSBID(device.PID, port.PID) {
+		return false
+	}
+	if device.SerialNumber != "" && device.SerialNumber != port.SerialNumber {
+		return false
+	}
+	return true
+}
 
-	return nil, fmt.Errorf("specified port %s not found in available ports", *portName)
+func sameUSBID(want, got string) bool {
+	w, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(want), "0x"), 16, 16)
+	if err != nil {
+		return false
+	}
+	g, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(got), "0x"), 16, 16)
+	if err != nil {
+		return false
+	}
+	return w == g
 }
 
 func readFromSerialImpl(scanner Scanner) (string, error) {
@@ -73,5 +351,7 @@ func readFromSerialImpl(scanner Scanner) (string, error) {
 		return "", fmt.Errorf("error reading from serial: %w", err)
 	}
 
-	return "", nil
+	// The scanner stops without an error only at EOF, which means the
+	// device has gone away.
+	return "", io.EOF
 }
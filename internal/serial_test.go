@@ -2,7 +2,10 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"database/sql"
 	"errors"
+	"io"
 	"strings"
 	"testing"
 	"time"
@@ -63,95 +66,171 @@ func (e *errorScanner) Scan() bool   { return false }
 func (e *errorScanner) Text() string { return "" }
 func (e *errorScanner) Err() error   { return errors.New("scan error") }
 
-func TestInitSerialPort_Success(t *testing.T) {
+func TestOpenSerialPort_Success(t *testing.T) {
 	origGetSerialPort := getSerialPort
 	origSerialOpen := serialOpen
 	origLogInfo := logInfo
-	origLogError := logError
-	origOsExit := osExit
 
-	getSerialPort = func() (*enumerator.PortDetails, error) {
+	var openedBaud int
+	getSerialPort = func(device Device) (*enumerator.PortDetails, error) {
 		return &enumerator.PortDetails{Name: "/dev/ttyACM0"}, nil
 	}
 	serialOpen = func(name string, mode *serial.Mode) (serial.Port, error) {
+		openedBaud = mode.BaudRate
 		return &mockPort{}, nil
 	}
 	logInfo = func(format string, args ...interface{}) {}
-	logError = func(format string, args ...interface{}) {}
-	osExit = func(code int) { t.Fatalf("osExit called unexpectedly") }
 
 	defer func() {
 		getSerialPort = origGetSerialPort
 		serialOpen = origSerialOpen
 		logInfo = origLogInfo
-		logError = origLogError
-		osExit = origOsExit
 	}()
 
-	port := initSerialPort()
+	port, name, err := openSerialPort(Device{Name: "test", Port: "/dev/ttyACM0", Baud: 115200})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	defer serialPortClaims.release(name, "test")
 	if port == nil {
 		t.Error("Expected serial port, got nil")
 	}
+	if name != "/dev/ttyACM0" {
+		t.Errorf("Expected resolved port /dev/ttyACM0, got %s", name)
+	}
+	if openedBaud != 115200 {
+		t.Errorf("Expected baud 115200, got %d", openedBaud)
+	}
 }
 
-func TestInitSerialPort_GetSerialPortError(t *testing.T) {
+func TestOpenSerialPort_GetSerialPortError(t *testing.T) {
 	origGetSerialPort := getSerialPort
-	origLogError := logError
-	origOsExit := osExit
+	origLogInfo := logInfo
 
-	getSerialPort = func() (*enumerator.PortDetails, error) {
+	getSerialPort = func(device Device) (*enumerator.PortDetails, error) {
 		return nil, errors.New("no ports")
 	}
-	logError = func(format string, args ...interface{}) {}
-	osExit = func(code int) { panic("osExit called") }
+	logInfo = func(format string, args ...interface{}) {}
 
 	defer func() {
 		getSerialPort = origGetSerialPort
-		logError = origLogError
-		osExit = origOsExit
-	}()
-
-	defer func() {
-		if r := recover(); r == nil {
-			t.Error("Expected osExit to be called on getSerialPort error")
-		}
+		logInfo = origLogInfo
 	}()
 
-	initSerialPort()
+	if _, _, err := openSerialPort(Device{Name: "test", Port: "/dev/ttyACM0"}); err == nil || err.Error() != "no ports" {
+		t.Errorf("Expected 'no ports' error, got %v", err)
+	}
 }
 
-func TestInitSerialPort_SerialOpenError(t *testing.T) {
+func TestOpenSerialPort_SerialOpenError(t *testing.T) {
 	origGetSerialPort := getSerialPort
 	origSerialOpen := serialOpen
 	origLogInfo := logInfo
-	origLogError := logError
-	origOsExit := osExit
 
-	getSerialPort = func() (*enumerator.PortDetails, error) {
+	getSerialPort = func(device Device) (*enumerator.PortDetails, error) {
 		return &enumerator.PortDetails{Name: "/dev/tty/AMC0"}, nil
 	}
 	serialOpen = func(name string, mode *serial.Mode) (serial.Port, error) {
 		return nil, errors.New("open error")
 	}
 	logInfo = func(format string, args ...interface{}) {}
-	logError = func(format string, args ...interface{}) {}
-	osExit = func(code int) { panic("osExit called") }
 
 	defer func() {
 		getSerialPort = origGetSerialPort
 		serialOpen = origSerialOpen
 		logInfo = origLogInfo
-		logError = origLogError
-		osExit = origOsExit
 	}()
 
-	defer func() {
-		if r := recover(); r == nil {
-			t.Error("Expected osExit to be called on serial.Open error")
+	_, _, err := openSerialPort(Device{Name: "test", Port: "/dev/tty/AMC0"})
+	if err == nil || err.Error() != "failed to open serial port: open error" {
+		t.Errorf("Expected open error, got %v", err)
+	}
+}
+
+func TestSuperviseDevice_ReconnectsAfterLoss(t *testing.T) {
+	origOpenSerialPort := openSerialPort
+	origReadDeviceLoop := readDeviceLoop
+	origStatuses := deviceStatuses
+	origLogInfo := logInfo
+	origLogWarn := logWarn
+
+	deviceStatuses = newStatusRegistry()
+	logInfo = func(format string, args ...interface{}) {}
+	logWarn = func(format string, args ...interface{}) {}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	opens := 0
+	openSerialPort = func(device Device) (serial.Port, string, error) {
+		opens++
+		if opens == 2 {
+			return nil, "", errors.New("device unplugged")
+		}
+		return &mockPort{}, "/dev/ttyACM0", nil
+	}
+	loops := 0
+	readDeviceLoop = func(ctx context.Context, device Device, serialPort serial.Port, db *sql.DB, latestWeather *Weather) error {
+		loops++
+		if loops == 2 {
+			cancel()
+			return nil
 		}
+		return io.EOF
+	}
+
+	defer func() {
+		openSerialPort = origOpenSerialPort
+		readDeviceLoop = origReadDeviceLoop
+		deviceStatuses = origStatuses
+		logInfo = origLogInfo
+		logWarn = origLogWarn
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		superviseDevice(ctx, Device{Name: "test", Port: "/dev/ttyACM0"}, nil, nil)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Supervisor did not return after cancellation")
+	}
+
+	if opens != 3 {
+		t.Errorf("Expected 3 open attempts (connect, failed reopen, reopen), got %d", opens)
+	}
+	statuses := deviceStatuses.snapshot()
+	if len(statuses) != 1 || statuses[0].Link != LinkConnected || statuses[0].Reconnects != 1 {
+		t.Errorf("Unexpected device status: %+v", statuses)
+	}
+}
+
+func TestSuperviseDevice_StopsWhileReconnecting(t *testing.T) {
+	origOpenSerialPort := openSerialPort
+	origStatuses := deviceStatuses
+	origLogInfo := logInfo
+
+	deviceStatuses = newStatusRegistry()
+	logInfo = func(format string, args ...interface{}) {}
+	openSerialPort = func(device Device) (serial.Port, string, error) {
+		return nil, "", errors.New("no serial ports found")
+	}
+
+	defer func() {
+		openSerialPort = origOpenSerialPort
+		deviceStatuses = origStatuses
+		logInfo = origLogInfo
 	}()
 
-	initSerialPort()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	superviseDevice(ctx, Device{Name: "test", Port: "/dev/ttyACM0"}, nil, nil)
+
+	statuses := deviceStatuses.snapshot()
+	if len(statuses) != 1 || statuses[0].Link != LinkReconnecting || statuses[0].LastError != "no serial ports found" {
+		t.Errorf("Unexpected device status: %+v", statuses)
+	}
 }
 
 func TestGetSerialPortImpl_EnumeratorError(t *testing.T) {
@@ -161,7 +240,7 @@ func TestGetSerialPortImpl_EnumeratorError(t *testing.T) {
 	}
 	defer func() { enumeratorGetDetailedPortsList = origGetDetailedPortsList }()
 
-	_, err := getSerialPortImpl()
+	_, err := getSerialPortImpl(Device{Port: "/dev/ttyACM0"})
 	if err == nil || err.Error() != "enumerator error: enumerator error" {
 		t.Errorf("Expected enumerator error, got: %v", err)
 	}
@@ -174,7 +253,7 @@ func TestGetSerialPortImpl_NoPorts(t *testing.T) {
 	}
 	defer func() { enumeratorGetDetailedPortsList = origGetDetailedPortsList }()
 
-	_, err := getSerialPortImpl()
+	_, err := getSerialPortImpl(Device{Port: "/dev/ttyACM0"})
 	if err == nil || err.Error() != "no serial ports found" {
 		t.Errorf("Expected no serial ports found error, got: %v", err)
 	}
@@ -182,9 +261,6 @@ func TestGetSerialPortImpl_NoPorts(t *testing.T) {
 
 func TestGetSerialPortImpl_PortFound(t *testing.T) {
 	origGetDetailedPortsList := enumeratorGetDetailedPortsList
-	origPortName := portName
-	testPort := "COM1"
-	portName = &testPort
 	enumeratorGetDetailedPortsList = func() ([]*enumerator.PortDetails, error) {
 		return []*enumerator.PortDetails{
 			{Name: "COM1"},
@@ -193,10 +269,9 @@ func TestGetSerialPortImpl_PortFound(t *testing.T) {
 	}
 	defer func() {
 		enumeratorGetDetailedPortsList = origGetDetailedPortsList
-		portName = origPortName
 	}()
 
-	port, err := getSerialPortImpl()
+	port, err := getSerialPortImpl(Device{Port: "COM1"})
 	if err != nil {
 		t.Fatalf("Expected port, got error: %v", err)
 	}
@@ -205,11 +280,44 @@ func TestGetSerialPortImpl_PortFound(t *testing.T) {
 	}
 }
 
+func TestGetSerialPortImpl_SkipsClaimedPorts(t *testing.T) {
+	origGetDetailedPortsList := enumeratorGetDetailedPortsList
+	origLogInfo := logInfo
+	enumeratorGetDetailedPortsList = func() ([]*enumerator.PortDetails, error) {
+		return []*enumerator.PortDetails{
+			{Name: "/dev/ttyACM0", IsUSB: true, VID: "2341", PID: "0043"},
+			{Name: "/dev/ttyACM1", IsUSB: true, VID: "2341", PID: "0043"},
+		}, nil
+	}
+	logInfo = func(format string, args ...interface{}) {}
+	defer func() {
+		enumeratorGetDetailedPortsList = origGetDetailedPortsList
+		logInfo = origLogInfo
+	}()
+
+	// Two identical boards: the second device gets the port the first did not claim
+	serialPortClaims.claim("/dev/ttyACM0", "greenhouse")
+	defer serialPortClaims.release("/dev/ttyACM0", "greenhouse")
+
+	port, err := getSerialPortImpl(Device{Name: "cellar", VID: "2341", PID: "0043"})
+	if err != nil || port.Name != "/dev/ttyACM1" {
+		t.Errorf("Expected the unclaimed /dev/ttyACM1, got %+v, %v", port, err)
+	}
+	port, err = getSerialPortImpl(Device{Name: "greenhouse", VID: "2341", PID: "0043"})
+	if err != nil || port.Name != "/dev/ttyACM0" {
+		t.Errorf("Expected the device to keep its own /dev/ttyACM0, got %+v, %v", port, err)
+	}
+
+	serialPortClaims.claim("/dev/ttyACM1", "cellar")
+	defer serialPortClaims.release("/dev/ttyACM1", "cellar")
+	port, err = getSerialPortImpl(Device{Name: "sauna", VID: "2341", PID: "0043"})
+	if err != nil || port.Name != "/dev/ttyACM0" {
+		t.Errorf("Expected the first match when all are claimed, got %+v, %v", port, err)
+	}
+}
+
 func TestGetSerialPortImpl_PortNotFound(t *testing.T) {
 	origGetDetailedPortsList := enumeratorGetDetailedPortsList
-	origPortName := portName
-	testPort := "COM3"
-	portName = &testPort
 	enumeratorGetDetailedPortsList = func() ([]*enumerator.PortDetails, error) {
 		return []*enumerator.PortDetails{
 			{Name: "COM1"},
@@ -218,10 +326,9 @@ func TestGetSerialPortImpl_PortNotFound(t *testing.T) {
 	}
 	defer func() {
 		enumeratorGetDetailedPortsList = origGetDetailedPortsList
-		portName = origPortName
 	}()
 
-	_, err := getSerialPortImpl()
+	_, err := getSerialPortImpl(Device{Port: "COM3"})
 	if err == nil || err.Error() != "specified port COM3 not found in available ports" {
 		t.Errorf("Expected port not found error, got: %v", err)
 	}
@@ -252,10 +359,174 @@ func TestReadFromSerial_Error(t *testing.T) {
 func TestReadFromSerial_EOF(t *testing.T) {
 	scanner := bufio.NewScanner(strings.NewReader(""))
 	line, err := readFromSerial(scanner)
-	if err != nil {
-		t.Fatalf("Expected no error, got: %v", err)
+	if err != io.EOF {
+		t.Fatalf("Expected io.EOF, got: %v", err)
 	}
 	if line != "" {
 		t.Errorf("Expected empty string at EOF, got: %s", line)
 	}
 }
+
+// probePort is a serial.Port that returns its chunks one read at a time and
+// then behaves like a read timeout.
+type probePort struct {
+	mockPort
+	chunks []string
+	closed bool
+}
+
+func (p *probePort) SetReadTimeout(t time.Duration) error { return nil }
+func (p *probePort) Close() error                         { p.closed = true; return nil }
+func (p *probePort) Read(b []byte) (int, error) {
+	if len(p.chunks) == 0 {
+		time.Sleep(time.Millisecond)
+		return 0, nil
+	}
+	n := copy(b, p.chunks[0])
+	p.chunks = p.chunks[1:]
+	return n, nil
+}
+
+func TestMatchingSerialPorts_USBSelectors(t *testing.T) {
+	origGetDetailedPortsList := enumeratorGetDetailedPortsList
+	origLogInfo := logInfo
+	enumeratorGetDetailedPortsList = func() ([]*enumerator.PortDetails, error) {
+		return []*enumerator.PortDetails{
+			{Name: "/dev/ttyS0"},
+			{Name: "/dev/ttyACM0", IsUSB: true, VID: "2341", PID: "0043", SerialNumber: "AAA"},
+			{Name: "/dev/ttyACM1", IsUSB: true, VID: "2341", PID: "0043", SerialNumber: "BBB"},
+			{Name: "/dev/ttyUSB0", IsUSB: true, VID: "1A86", PID: "7523", SerialNumber: ""},
+		}, nil
+	}
+	logInfo = func(format string, args ...interface{}) {}
+	defer func() {
+		enumeratorGetDetailedPortsList = origGetDetailedPortsList
+		logInfo = origLogInfo
+	}()
+
+	tests := []struct {
+		device Device
+		want   []string
+	}{
+		{Device{VID: "2341", PID: "0043"}, []string{"/dev/ttyACM0", "/dev/ttyACM1"}},
+		{Device{VID: "0x2341", SerialNumber: "BBB"}, []string{"/dev/ttyACM1"}},
+		{Device{VID: "1a86"}, []string{"/dev/ttyUSB0"}},
+		{Device{Port: "/dev/ttyACM0", PID: "0043"}, []string{"/dev/ttyACM0"}},
+		{Device{Port: "auto"}, []string{"/dev/ttyS0", "/dev/ttyACM0", "/dev/ttyACM1", "/dev/ttyUSB0"}},
+	}
+	for _, tc := range tests {
+		ports, err := matchingSerialPorts(tc.device)
+		if err != nil {
+			t.Errorf("%+v: unexpected error %v", tc.device, err)
+			continue
+		}
+		var got []string
+		for _, port := range ports {
+			got = append(got, port.Name)
+		}
+		if strings.Join(got, ",") != strings.Join(tc.want, ",") {
+			t.Errorf("%+v: expected %v, got %v", tc.device, tc.want, got)
+		}
+	}
+
+	_, err := matchingSerialPorts(Device{VID: "2341", SerialNumber: "CCC"})
+	if err == nil || err.Error() != "no serial port matching usb vid=2341 serial=CCC found" {
+		t.Errorf("Expected no matching port error, got %v", err)
+	}
+}
+
+func TestSameUSBID(t *testing.T) {
+	if !sameUSBID("0x2341", "2341") || !sameUSBID("1a86", "1A86") {
+		t.Error("Expected USB ids to match regardless of case and prefix")
+	}
+	if sameUSBID("2341", "2342") || sameUSBID("zz", "zz") {
+		t.Error("Expected different or invalid USB ids not to match")
+	}
+}
+
+func TestProbeSerialPort(t *testing.T) {
+	port := &probePort{chunks: []string{"\x00\xffgarbage\n{\"temper", "ature_celcius\":21.5,\"humidity\":40.0}\n"}}
+	if !probeSerialPort(port, time.Second) {
+		t.Error("Expected probe to find a measurement split across reads")
+	}
+
+	framed := &probePort{chunks: []string{encodeFrame(`{"temperature_celcius":21.5}`) + "\r\n"}}
+	if !probeSerialPort(framed, time.Second) {
+		t.Error("Expected probe to accept a framed measurement")
+	}
+
+	silent := &probePort{chunks: []string{"hello\n", "{}\n", "$" + `{"lux":1}` + "*00\n"}}
+	if probeSerialPort(silent, 50*time.Millisecond) {
+		t.Error("Expected probe to fail without a measurement line")
+	}
+}
+
+func TestOpenAutoDetectedPort(t *testing.T) {
+	origMatchingSerialPorts := matchingSerialPorts
+	origSerialOpen := serialOpen
+	origLogInfo := logInfo
+	origProbeTimeout := serialProbeTimeout
+
+	matchingSerialPorts = func(device Device) ([]*enumerator.PortDetails, error) {
+		return []*enumerator.PortDetails{{Name: "/dev/ttyACM0"}, {Name: "/dev/ttyACM1"}, {Name: "/dev/ttyACM2"}}, nil
+	}
+	opened := map[string]*probePort{}
+	serialOpen = func(name string, mode *serial.Mode) (serial.Port, error) {
+		port := &probePort{}
+		if name == "/dev/ttyACM2" {
+			port.chunks = []string{"{\"temperature_celcius\":21.5,\"humidity\":40.0}\n"}
+		}
+		opened[name] = port
+		return port, nil
+	}
+	logInfo = func(format string, args ...interface{}) {}
+	serialProbeTimeout = 50 * time.Millisecond
+
+	defer func() {
+		matchingSerialPorts = origMatchingSerialPorts
+		serialOpen = origSerialOpen
+		logInfo = origLogInfo
+		serialProbeTimeout = origProbeTimeout
+	}()
+
+	// Another device already reads ACM0, so it must not be probed
+	serialPortClaims.claim("/dev/ttyACM0", "greenhouse")
+	defer serialPortClaims.release("/dev/ttyACM0", "greenhouse")
+
+	_, name, err := openAutoDetectedPort(Device{Name: "cellar", Port: "auto"})
+	if err != nil {
+		t.Fatalf("Expected auto detection to succeed, got %v", err)
+	}
+	defer serialPortClaims.release(name, "cellar")
+
+	if name != "/dev/ttyACM2" {
+		t.Errorf("Expected /dev/ttyACM2, got %s", name)
+	}
+	if _, ok := opened["/dev/ttyACM0"]; ok {
+		t.Error("Expected claimed port not to be probed")
+	}
+	if !opened["/dev/ttyACM1"].closed {
+		t.Error("Expected silent port to be closed after probing")
+	}
+	if owner, ok := serialPortClaims.claim("/dev/ttyACM2", "sauna"); ok || owner != "cellar" {
+		t.Errorf("Expected /dev/ttyACM2 to be claimed by cellar, got %s", owner)
+	}
+}
+
+func TestPortClaims(t *testing.T) {
+	claims := &portClaims{owners: make(map[string]string)}
+	if _, ok := claims.claim("/dev/ttyACM0", "greenhouse"); !ok {
+		t.Fatal("Expected first claim to succeed")
+	}
+	if _, ok := claims.claim("/dev/ttyACM0", "greenhouse"); !ok {
+		t.Error("Expected re-claim by the same device to succeed")
+	}
+	if owner, ok := claims.claim("/dev/ttyACM0", "cellar"); ok || owner != "greenhouse" {
+		t.Errorf("Expected claim by another device to fail, got %s, %v", owner, ok)
+	}
+	claims.release("/dev/ttyACM0", "cellar")
+	claims.release("/dev/ttyACM0", "greenhouse")
+	if _, ok := claims.claim("/dev/ttyACM0", "cellar"); !ok {
+		t.Error("Expected claim to succeed after release")
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"math/rand/v2"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	sourceSerial = "serial"
+	sourceSim    = "sim"
+	sourceTCP    = "tcp"
+	sourceUDP    = "udp"
+	sourceMQTT   = "mqtt"
+	replayPrefix = "replay:"
+)
+
+// simInterval matches the sample interval of the Arduino sketch.
+var simInterval = 5 * time.Second
+
+var errReplayFinished = errors.New("replay finished")
+
+var configuredSources = configuredSourcesImpl
+
+// Source delivers measurement lines from one or more devices through
+// handleDeviceLine until ctx is done.
+type Source interface {
+	Run(ctx context.Context, db *sql.DB, latestWeather *Weather)
+}
+
+type serialSource struct{ device Device }
+
+type simSource struct{ device Device }
+
+type replaySource struct{ device Device }
+
+func (s serialSource) Run(ctx context.Context, db *sql.DB, latestWeather *Weather) {
+	superviseDevice(ctx, s.device, db, latestWeather)
+}
+
+func (s simSource) Run(ctx context.Context, db *sql.DB, latestWeather *Weather) {
+	runSimulatedDevice(ctx, s.device, db, latestWeather)
+}
+
+func (s replaySource) Run(ctx context.Context, db *sql.DB, latestWeather *Weather) {
+	runReplayDevice(ctx, s.device, db, latestWeather)
+}
+
+// CSV export columns that describe the device or the weather rather than
+// the sensor.
+var replaySkippedColumns = map[string]bool{
+	"device":              true,
+	"city":                true,
+	"weather_temp":        true,
+	"weather_humidity":    true,
+	"wind_speed":          true,
+	"wind_deg":            true,
+	"clouds":              true,
+	"weather_code":        true,
+	"weather_description": true,
+}
+
+func validateSource(source string) error {
+	switch {
+	case source == sourceSerial, source == sourceSim, source == sourceTCP, source == sourceUDP, source == sourceMQTT,
+		source == sourceW1, source == sourceHwmon:
+		return nil
+	case strings.HasPrefix(source, replayPrefix) && len(source) > len(replayPrefix):
+		return nil
+	}
+	return fmt.Errorf("unknown source %q, expected %s, %s, %s, %s, %s, %s, %s or %sFILE.csv", source, sourceSerial, sourceSim, sourceTCP, sourceUDP, sourceMQTT, sourceW1, sourceHwmon, replayPrefix)
+}
+
+// configuredSourcesImpl returns a source for every configured device read
+// on its own, plus the network listeners enabled with -listen-tcp and
+// -listen-udp, the MQTT subscriber configured with -mqtt-config, a poller
+// for every device in -modbus-config and the sysfs pollers enabled with -w1
+// and -hwmon. Devices sending over the network are read by the listener or
+// subscriber, and 1-Wire and hwmon devices by their poller.
+func configuredSourcesImpl(devices []Device) []Source {
+	var sources []Source
+	for _, device := range devices {
+		switch {
+		case device.Source == sourceSim:
+			sources = append(sources, simSource{device})
+		case strings.HasPrefix(device.Source, replayPrefix):
+			sources = append(sources, replaySource{device})
+		case device.networked():
+			switch {
+			case device.Source == sourceTCP && *listenTCP == "", device.Source == sourceUDP && *listenUDP == "":
+				logWarn("Device %s expects %s but -listen-%s is not set", device.Name, device.Source, device.Source)
+			case device.Source == sourceMQTT && mqttSettings == nil:
+				logWarn("Device %s expects mqtt but -mqtt-config is not set", device.Name)
+			}
+		case device.sysfs():
+			if (device.Source == sourceW1 && !*pollW1) || (device.Source == sourceHwmon && !*pollHwmon) {
+				logWarn("Device %s expects %s but -%s is not set", device.Name, device.Source, device.Source)
+			}
+		default:
+			sources = append(sources, serialSource{device})
+		}
+	}
+
+	if *listenTCP != "" {
+		sources = append(sources, &tcpSource{addr: *listenTCP, devices: newNetworkDevices(sourceTCP, devices)})
+	}
+	if *listenUDP != "" {
+		sources = append(sources, &udpSource{addr: *listenUDP, devices: newNetworkDevices(sourceUDP, devices)})
+	}
+	if mqttSettings != nil {
+		sources = append(sources, &mqttSource{config: *mqttSettings, devices: newNetworkDevices(sourceMQTT, devices)})
+	}
+	if *pollW1 {
+		sources = append(sources, newSysfsSource(sourceW1, devices))
+	}
+	if *pollHwmon {
+		sources = append(sources, newSysfsSource(sourceHwmon, devices))
+	}
+	if modbusSettings != nil {
+		for _, device := range modbusSettings.Devices {
+			sources = append(sources, modbusSource{device})
+		}
+	}
+	return sources
+}
+
+// simProfile describes the climate a simulated device lives in.
+type simProfile struct {
+	baseTemp          float64
+	tempAmplitude     float64
+	baseHumidity      float64
+	humidityAmplitude float64
+}
+
+// simProfileFor derives a stable profile from the device name, so several
+// simulated devices produce distinguishable curves.
+func simProfileFor(name string) simProfile {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	spread := float64(h.Sum32()%600)/100 - 3 // -3 .. +3
+
+	return simProfile{
+		baseTemp:          18 + spread,
+		tempAmplitude:     4 + spread/2,
+		baseHumidity:      55 - spread*2,
+		humidityAmplitude: 15,
+	}
+}
+
+// simulatedReading returns a device line for time t. Temperature peaks mid
+// afternoon and humidity moves the opposite way, both with sensor noise;
+// light follows the sun between 06 and 20.
+func simulatedReading(t time.Time, profile simProfile, seq int64, rng *rand.Rand) string {
+	hours := float64(t.Hour()) + float64(t.Minute())/60 + float64(t.Second())/3600
+	daily := math.Cos(2 * math.Pi * (hours - 15) / 24)
+
+	temperature := profile.baseTemp + profile.tempAmplitude*daily + rng.NormFloat64()*0.15
+	humidity := profile.baseHumidity - profile.humidityAmplitude*daily + rng.NormFloat64()*0.8
+	humidity = math.Max(0, math.Min(100, humidity))
+
+	lux := 0.0
+	if hours > 6 && hours < 20 {
+		lux = 20000*math.Sin(math.Pi*(hours-6)/14) + rng.NormFloat64()*200
+		lux = math.Max(0, lux)
+	}
+
+	line, _ := json.Marshal(map[string]any{
+		temperatureField: math.Round(temperature*100) / 100,
+		humidityField:    math.Round(humidity*100) / 100,
+		"lux":            math.Round(lux),
+		sequenceField:    seq,
+	})
+	return string(line)
+}
+
+// runSimulatedDevice feeds generated readings through the same path as
+// serial lines every simInterval.
+func runSimulatedDevice(ctx context.Context, device Device, db *sql.DB, latestWeather *Weather) {
+	device.Port = device.Source
+	device.Framing = framingNone
+	deviceStatuses.setLink(device, LinkConnected, nil)
+
+	profile := simProfileFor(device.Name)
+	rng := rand.New(rand.NewPCG(uint64(time.Now().UnixNano()), uint64(device.ID)))
+	for seq := int64(0); ; seq++ {
+		handleDeviceLine(device, simulatedReading(time.Now(), profile, seq, rng), db, latestWeather, nil)
+		if !sleepContext(ctx, simInterval) {
+			return
+		}
+	}
+}
+
+// runReplayDevice feeds the rows of a CSV export through the same path as
+// serial lines, paced by their original timestamps divided by -replay-speed.
+func runReplayDevice(ctx context.Context, device Device, db *sql.DB, latestWeather *Weather) {
+	device.Port = device.Source
+	device.Framing = framingNone
+	path := strings.TrimPrefix(device.Source, replayPrefix)
+
+	file, err := os.Open(path)
+	if err != nil {
+		logError("Cannot replay %s for %s: %v", path, device.Name, err)
+		deviceStatuses.setLink(device, LinkLost, err)
+		return
+	}
+	defer file.Close()
+
+	deviceStatuses.setLink(device, LinkConnected, nil)
+	count, err := replayCSV(ctx, file, *replaySpeed, func(line string) {
+		handleDeviceLine(device, line, db, latestWeather, nil)
+	})
+	if err != nil {
+		logError("Replay of %s for %s failed: %v", path, device.Name, err)
+		deviceStatuses.setLink(device, LinkLost, err)
+		return
+	}
+	if ctx.Err() == nil {
+		logInfo("Replay of %s for %s finished after %d measurements", path, device.Name, count)
+		deviceStatuses.setLink(device, LinkLost, errReplayFinished)
+	}
+}
+
+// parseReplayTimestamp parses Unix milliseconds or an ISO 8601 time, as
+// written by -export-time.
+func parseReplayTimestamp(s string) (int64, error) {
+	if timestamp, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return timestamp, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return 0, err
+	}
+	return t.UnixMilli(), nil
+}
+
+// replayCSV reads measurements in the format written by a CSV export and
+// emits each as a device line, waiting between rows for the time that passed
+// between them divided by speed. A speed of 0 replays without waiting. It
+// returns the number of rows emitted.
+func replayCSV(ctx context.Context, r io.Reader, speed float64, emit func(line string)) (int, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err != nil {
+		return 0, fmt.Errorf("failed to read header: %w", err)
+	}
+	timestampColumn := -1
+	for i, name := range header {
+		if name == "timestamp" {
+			timestampColumn = i
+		}
+	}
+	if timestampColumn < 0 {
+		return 0, errors.New("missing timestamp column")
+	}
+
+	var previous int64
+	count := 0
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil {
+			return count, err
+		}
+
+		timestamp, err := parseReplayTimestamp(record[timestampColumn])
+		if err != nil {
+			return count, fmt.Errorf("line %d: invalid timestamp %q", count+2, record[timestampColumn])
+		}
+		if count > 0 && speed > 0 && timestamp > previous {
+			delay := time.Duration(float64(timestamp-previous) / speed * float64(time.Millisecond))
+			if !sleepContext(ctx, delay) {
+				return count, nil
+			}
+		}
+		if ctx.Err() != nil {
+			return count, nil
+		}
+		previous = timestamp
+
+		fields := make(map[string]float64)
+		for i, name := range header {
+			if i == timestampColumn || i >= len(record) || replaySkippedColumns[name] {
+				continue
+			}
+			value, err := strconv.ParseFloat(record[i], 64)
+			if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+				continue // empty or non-numeric cell
+			}
+			switch {
+			case name == "temperature":
+				name = temperatureField
+			case name == "humidity":
+				name = humidityField
+			case strings.HasPrefix(name, exportMetricPrefix):
+				name = exportColumnMetric(name)
+			}
+			fields[name] = value
+		}
+
+		line, err := json.Marshal(fields)
+		if err != nil {
+			return count, err
+		}
+		emit(string(line))
+		count++
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"math/rand/v2"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestValidateSource(t *testing.T) {
+	for _, source := range []string{"serial", "sim", "tcp", "udp", "mqtt", "w1", "hwmon", "replay:export.csv"} {
+		if err := validateSource(source); err != nil {
+			t.Errorf("Expected %q to be valid, got %v", source, err)
+		}
+	}
+	for _, source := range []string{"", "replay:", "zigbee", "Sim"} {
+		if err := validateSource(source); err == nil {
+			t.Errorf("Expected %q to be invalid", source)
+		}
+	}
+}
+
+func TestSimProfileFor(t *testing.T) {
+	if simProfileFor("greenhouse") != simProfileFor("greenhouse") {
+		t.Error("Expected the same profile for the same device")
+	}
+	if simProfileFor("greenhouse") == simProfileFor("cellar") {
+		t.Error("Expected different devices to get different profiles")
+	}
+}
+
+func TestSimulatedReading(t *testing.T) {
+	profile := simProfileFor("greenhouse")
+	rng := rand.New(rand.NewPCG(1, 2))
+	day := time.Date(2025, 7, 15, 0, 0, 0, 0, time.Local)
+
+	afternoon, err := deserializeData(simulatedReading(day.Add(15*time.Hour), profile, 7, rng))
+	if err != nil {
+		t.Fatalf("Expected simulated reading to deserialize, got %v", err)
+	}
+	night, err := deserializeData(simulatedReading(day.Add(3*time.Hour), profile, 8, rng))
+	if err != nil {
+		t.Fatalf("Expected simulated reading to deserialize, got %v", err)
+	}
+
+	if afternoon.TemperatureCelsius <= night.TemperatureCelsius {
+		t.Errorf("Expected afternoon (%.2f) warmer than night (%.2f)", afternoon.TemperatureCelsius, night.TemperatureCelsius)
+	}
+	if afternoon.HumidityPercentage >= night.HumidityPercentage {
+		t.Errorf("Expected afternoon (%.2f) drier than night (%.2f)", afternoon.HumidityPercentage, night.HumidityPercentage)
+	}
+	if afternoon.Metrics["lux"] <= 0 || night.Metrics["lux"] != 0 {
+		t.Errorf("Expected daylight only in the afternoon, got %v and %v", afternoon.Metrics, night.Metrics)
+	}
+	if afternoon.Sequence == nil || *afternoon.Sequence != 7 {
+		t.Errorf("Expected seq 7, got %v", afternoon.Sequence)
+	}
+}
+
+func TestReplayCSV_ExportRoundTrip(t *testing.T) {
+	tmpDB := "test_replay_source.db"
+	defer os.Remove(tmpDB)
+	db, err := openDatabase(tmpDB)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	insertMeasurement(db, Measurement{TemperatureCelsius: 20.5, HumidityPercentage: 50.0, Metrics: map[string]float64{"lux": 120}}, 1000)
+	insertMeasurement(db, Measurement{TemperatureCelsius: 21.5, HumidityPercentage: 51.0}, 2000)
+	insertWeather(db, Weather{Name: "Helsinki"}, 2000)
+
+	csvFile := "test_replay_source.csv"
+	defer os.Remove(csvFile)
+	if err := exportMeasurements(sqliteStorage{db}, csvFile, exportOptions{}); err != nil {
+		t.Fatalf("Failed to export: %v", err)
+	}
+	file, err := os.Open(csvFile)
+	if err != nil {
+		t.Fatalf("Failed to open export: %v", err)
+	}
+	defer file.Close()
+
+	var lines []string
+	count, err := replayCSV(context.Background(), file, 0, func(line string) { lines = append(lines, line) })
+	if err != nil || count != 2 {
+		t.Fatalf("Expected 2 rows replayed, got %d, %v", count, err)
+	}
+
+	first, err := deserializeData(lines[0])
+	if err != nil {
+		t.Fatalf("Expected replayed line to deserialize, got %v", err)
+	}
+	if first.TemperatureCelsius != 20.5 || first.HumidityPercentage != 50.0 || first.Metrics["lux"] != 120 || len(first.Metrics) != 1 {
+		t.Errorf("Unexpected replayed measurement: %+v", first)
+	}
+	if strings.Contains(lines[1], "weather") || strings.Contains(lines[1], "lux") {
+		t.Errorf("Expected weather columns and empty metrics to be skipped, got %s", lines[1])
+	}
+}
+
+func TestReplayCSV_Pacing(t *testing.T) {
+	data := "timestamp,temperature,humidity\n0,20.0,50.0\n2000,20.1,50.0\n4000,20.2,50.0\n"
+
+	start := time.Now()
+	count, err := replayCSV(context.Background(), strings.NewReader(data), 20, func(string) {})
+	elapsed := time.Since(start)
+	if err != nil || count != 3 {
+		t.Fatalf("Expected 3 rows, got %d, %v", count, err)
+	}
+	// 4 seconds of data at 20x speed take 200ms
+	if elapsed < 150*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("Expected replay to take about 200ms, took %v", elapsed)
+	}
+
+	// ISO 8601 timestamps of -export-time iso are paced the same way
+	iso := "timestamp,device,temperature\n2026-01-01T00:00:00.000Z,,20.0\n2026-01-01T00:00:04.000Z,,20.2\n"
+	start = time.Now()
+	var lines []string
+	count, err = replayCSV(context.Background(), strings.NewReader(iso), 20, func(line string) { lines = append(lines, line) })
+	if elapsed := time.Since(start); err != nil || count != 2 || elapsed < 150*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("Expected 2 ISO rows in about 200ms, got %d, %v in %v", count, err, elapsed)
+	}
+	if len(lines) != 2 || lines[1] != `{"temperature_celcius":20.2}` {
+		t.Errorf("Expected only the temperature replayed, got %q", lines)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	count, err = replayCSV(ctx, strings.NewReader(data), 1, func(string) {})
+	if err != nil || count != 0 {
+		t.Errorf("Expected nothing replayed when cancelled, got %d, %v", count, err)
+	}
+}
+
+func TestReplayCSV_Errors(t *testing.T) {
+	inputs := []string{
+		"",
+		"temperature,humidity\n20.0,50.0\n",
+		"timestamp,temperature\nyesterday,20.0\n",
+	}
+	for _, input := range inputs {
+		if _, err := replayCSV(context.Background(), strings.NewReader(input), 0, func(string) {}); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func TestSimSource(t *testing.T) {
+	origInsertMeasurement := insertMeasurement
+	origPrintToConsole := printToConsole
+	origSimInterval := simInterval
+	origStatuses := deviceStatuses
+	origLogInfo := logInfo
+	var mu sync.Mutex
+	var stored []Measurement
+	insertMeasurement = func(db *sql.DB, m Measurement, ts int64) error {
+		mu.Lock()
+		stored = append(stored, m)
+		mu.Unlock()
+		return nil
+	}
+	printToConsole = func(m Measurement, w *Weather) {}
+	simInterval = 10 * time.Millisecond
+	deviceStatuses = newStatusRegistry()
+	logInfo = func(format string, v ...any) {}
+	defer func() {
+		insertMeasurement = origInsertMeasurement
+		printToConsole = origPrintToConsole
+		simInterval = origSimInterval
+		deviceStatuses = origStatuses
+		logInfo = origLogInfo
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	simSource{Device{ID: 3, Name: "simulated", Source: sourceSim, Framing: framingCRC8}}.Run(ctx, nil, nil)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(stored) < 3 {
+		t.Fatalf("Expected several simulated measurements, got %d", len(stored))
+	}
+	if stored[0].DeviceID != 3 || stored[0].TemperatureCelsius == 0 {
+		t.Errorf("Unexpected simulated measurement: %+v", stored[0])
+	}
+	status := deviceStatuses.snapshot()[0]
+	if status.Link != LinkConnected || status.Port != sourceSim {
+		t.Errorf("Unexpected status: %+v", status)
+	}
+}
+
+func TestReplaySource(t *testing.T) {
+	origInsertMeasurement := insertMeasurement
+	origPrintToConsole := printToConsole
+	origSpeed := *replaySpeed
+	origStatuses := deviceStatuses
+	origLogInfo := logInfo
+	origLogWarn := logWarn
+	var stored []Measurement
+	insertMeasurement = func(db *sql.DB, m Measurement, ts int64) error {
+		stored = append(stored, m)
+		return nil
+	}
+	printToConsole = func(m Measurement, w *Weather) {}
+	*replaySpeed = 0
+	deviceStatuses = newStatusRegistry()
+	logInfo = func(format string, v ...any) {}
+	logWarn = func(format string, v ...any) {}
+	defer func() {
+		insertMeasurement = origInsertMeasurement
+		printToConsole = origPrintToConsole
+		*replaySpeed = origSpeed
+		deviceStatuses = origStatuses
+		logInfo = origLogInfo
+		logWarn = origLogWarn
+	}()
+
+	csvFile := "test_replay_device.csv"
+	defer os.Remove(csvFile)
+	os.WriteFile(csvFile, []byte("timestamp,temperature,humidity,co2\n1000,20.0,50.0,600\n2000,20.5,49.0,\n"), 0644)
+
+	replaySource{Device{Name: "replayed", Source: replayPrefix + csvFile}}.Run(context.Background(), nil, nil)
+
+	if len(stored) != 2 || stored[0].Metrics["co2"] != 600 || stored[1].TemperatureCelsius != 20.5 {
+		t.Errorf("Unexpected replayed measurements: %+v", stored)
+	}
+	status := deviceStatuses.snapshot()[0]
+	if status.Link != LinkLost || status.LastError != errReplayFinished.Error() {
+		t.Errorf("Expected finished replay to be reported, got %+v", status)
+	}
+}
+
+func TestReplaySource_MissingFile(t *testing.T) {
+	origStatuses := deviceStatuses
+	origLogError := logError
+	origLogWarn := logWarn
+	deviceStatuses = newStatusRegistry()
+	logError = func(format string, v ...any) {}
+	logWarn = func(format string, v ...any) {}
+	defer func() {
+		deviceStatuses = origStatuses
+		logError = origLogError
+		logWarn = origLogWarn
+	}()
+
+	replaySource{Device{Name: "replayed", Source: "replay:does-not-exist.csv"}}.Run(context.Background(), nil, nil)
+
+	status := deviceStatuses.snapshot()[0]
+	if status.Link != LinkLost || status.LastError == "" {
+		t.Errorf("Expected missing file to be reported, got %+v", status)
+	}
+}
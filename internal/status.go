@@ -0,0 +1,201 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+type LinkState string
+
+const (
+	LinkConnected    LinkState = "connected"
+	LinkLost         LinkState = "lost"
+	LinkReconnecting LinkState = "reconnecting"
+)
+
+type frameKind int
+
+const (
+	frameGood    frameKind = iota // decoded into a measurement
+	frameBad                      // intact, but not a valid measurement
+	frameCorrupt                  // failed the framing or checksum check
+)
+
+// FrameCounts counts the lines received from a device by outcome.
+type FrameCounts struct {
+	Good    int64 `json:"good"`
+	Bad     int64 `json:"bad"`
+	Corrupt int64 `json:"corrupt"`
+}
+
+// RejectCounts counts the readings of a device rejected by validation, by
+// rule.
+type RejectCounts struct {
+	Range int64 `json:"range"`
+	Rate  int64 `json:"rate"`
+	Spike int64 `json:"spike"`
+}
+
+// DeviceStatus is the live state of a device as reported by /api/status.
+type DeviceStatus struct {
+	Device     string    `json:"device"`
+	Port       string    `json:"port"`
+	Link       LinkState `json:"link"`
+	LinkSince  int64     `json:"link_since"`
+	Reconnects int       `json:"reconnects"`
+	LastError  string    `json:"last_error,omitempty"`
+
+	Frames   FrameCounts  `json:"frames"`
+	Rejected RejectCounts `json:"rejected"`
+
+	// Filled in when the device sends seq and ts
+	Missed      int64  `json:"missed"`
+	Duplicates  int64  `json:"duplicates"`
+	Reboots     int    `json:"reboots"`
+	ClockOffset *int64 `json:"clock_offset_ms,omitempty"`
+}
+
+type statusRegistry struct {
+	mu      sync.Mutex
+	devices map[string]*DeviceStatus
+}
+
+var deviceStatuses = newStatusRegistry()
+
+func newStatusRegistry() *statusRegistry {
+	return &statusRegistry{devices: make(map[string]*DeviceStatus)}
+}
+
+func (r *statusRegistry) get(device Device) *DeviceStatus {
+	status, ok := r.devices[device.Name]
+	if !ok {
+		status = &DeviceStatus{Device: device.Name}
+		r.devices[device.Name] = status
+	}
+	status.Port = device.Port
+	return status
+}
+
+// setLink records a link state transition for the device and logs it. Repeated
+// reports of the same state only update the last error.
+func (r *statusRegistry) setLink(device Device, state LinkState, err error) {
+	if !r.updateLink(device, state, err) {
+		return
+	}
+	// Outside the lock, so a slow broker doesn't hold up the status
+	publishAvailability(device, state)
+
+	switch state {
+	case LinkConnected:
+		logInfo("Device %s connected on %s", device.Name, device.Port)
+	case LinkLost:
+		logWarn("Device %s lost on %s: %v", device.Name, device.Port, err)
+	case LinkReconnecting:
+		logInfo("Device %s reconnecting: %v", device.Name, err)
+	}
+}
+
+// updateLink records the link state and reports whether it changed.
+func (r *statusRegistry) updateLink(device Device, state LinkState, err error) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	status := r.get(device)
+	if err != nil {
+		status.LastError = err.Error()
+	}
+	if status.Link == state {
+		return false
+	}
+	if state == LinkConnected {
+		if status.Link != "" {
+			status.Reconnects++
+		}
+		status.LastError = ""
+	}
+	status.Link = state
+	status.LinkSince = time.Now().UnixMilli()
+	return true
+}
+
+// hasLink reports whether a link state was ever reported for the device.
+// Devices posting over HTTP have none.
+func (r *statusRegistry) hasLink(device Device) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	status, ok := r.devices[device.Name]
+	return ok && status.Link != ""
+}
+
+// countFrame counts a received line by outcome, so bad cables show up as a
+// growing share of corrupt frames.
+func (r *statusRegistry) countFrame(device Device, kind frameKind) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	frames := &r.get(device).Frames
+	switch kind {
+	case frameGood:
+		frames.Good++
+	case frameBad:
+		frames.Bad++
+	case frameCorrupt:
+		frames.Corrupt++
+	}
+}
+
+// countRejected counts a reading rejected by the given validation rule.
+func (r *statusRegistry) countRejected(device Device, rule string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	rejected := &r.get(device).Rejected
+	switch rule {
+	case rejectRange:
+		rejected.Range++
+	case rejectRate:
+		rejected.Rate++
+	case rejectSpike:
+		rejected.Spike++
+	}
+}
+
+// recordSeq counts missed measurements, duplicates and reboots detected from
+// the device's seq counter.
+func (r *statusRegistry) recordSeq(device Device, event seqEvent, missed int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	status := r.get(device)
+	switch event {
+	case seqGap:
+		status.Missed += missed
+	case seqDuplicate:
+		status.Duplicates++
+	case seqReboot:
+		status.Reboots++
+	}
+}
+
+// setClockOffset records the current local minus device clock offset.
+func (r *statusRegistry) setClockOffset(device Device, offset int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.get(device).ClockOffset = &offset
+}
+
+// snapshot returns a copy of all device statuses ordered by device name.
+func (r *statusRegistry) snapshot() []DeviceStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	statuses := make([]DeviceStatus, 0, len(r.devices))
+	for _, status := range r.devices {
+		statuses = append(statuses, *status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Device < statuses[j].Device })
+	return statuses
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestStatusRegistry_LinkTransitions(t *testing.T) {
+	origLogInfo := logInfo
+	origLogWarn := logWarn
+	var logged []string
+	logInfo = func(format string, args ...interface{}) { logged = append(logged, format) }
+	logWarn = func(format string, args ...interface{}) { logged = append(logged, format) }
+	defer func() {
+		logInfo = origLogInfo
+		logWarn = origLogWarn
+	}()
+
+	registry := newStatusRegistry()
+	device := Device{Name: "greenhouse", Port: "/dev/ttyACM0"}
+
+	registry.setLink(device, LinkConnected, nil)
+	registry.setLink(device, LinkLost, errors.New("EOF"))
+	registry.setLink(device, LinkReconnecting, errors.New("port not found"))
+	registry.setLink(device, LinkReconnecting, errors.New("still not found"))
+	registry.setLink(device, LinkConnected, nil)
+
+	if len(logged) != 4 {
+		t.Errorf("Expected 4 logged transitions, got %d: %v", len(logged), logged)
+	}
+
+	statuses := registry.snapshot()
+	if len(statuses) != 1 {
+		t.Fatalf("Expected 1 status, got %d", len(statuses))
+	}
+	status := statuses[0]
+	if status.Link != LinkConnected || status.Reconnects != 1 || status.LastError != "" || status.LinkSince == 0 {
+		t.Errorf("Unexpected status: %+v", status)
+	}
+}
+
+func TestStatusRegistry_SnapshotOrder(t *testing.T) {
+	origLogInfo := logInfo
+	logInfo = func(format string, args ...interface{}) {}
+	defer func() { logInfo = origLogInfo }()
+
+	registry := newStatusRegistry()
+	registry.setLink(Device{Name: "sauna"}, LinkConnected, nil)
+	registry.setLink(Device{Name: "cellar"}, LinkConnected, nil)
+
+	statuses := registry.snapshot()
+	if len(statuses) != 2 || statuses[0].Device != "cellar" || statuses[1].Device != "sauna" {
+		t.Errorf("Expected statuses ordered by device name, got %+v", statuses)
+	}
+}
+
+func TestStatusRegistry_RecordSeq(t *testing.T) {
+	registry := newStatusRegistry()
+	device := Device{Name: "cellar"}
+
+	registry.recordSeq(device, seqGap, 3)
+	registry.recordSeq(device, seqGap, 2)
+	registry.recordSeq(device, seqDuplicate, 0)
+	registry.recordSeq(device, seqReboot, 0)
+	registry.recordSeq(device, seqInOrder, 0)
+	registry.setClockOffset(device, -1500)
+
+	status := registry.snapshot()[0]
+	if status.Missed != 5 || status.Duplicates != 1 || status.Reboots != 1 {
+		t.Errorf("Unexpected counters: %+v", status)
+	}
+	if status.ClockOffset == nil || *status.ClockOffset != -1500 {
+		t.Errorf("Expected clock offset -1500, got %v", status.ClockOffset)
+	}
+}
+
+func TestStatusRegistry_CountFrame(t *testing.T) {
+	registry := newStatusRegistry()
+	device := Device{Name: "sauna"}
+
+	for _, kind := range []frameKind{frameGood, frameGood, frameBad, frameCorrupt, frameCorrupt, frameCorrupt} {
+		registry.countFrame(device, kind)
+	}
+
+	frames := registry.snapshot()[0].Frames
+	if frames != (FrameCounts{Good: 2, Bad: 1, Corrupt: 3}) {
+		t.Errorf("Unexpected frame counts: %+v", frames)
+	}
+}
+
+func TestStatusRegistry_CountRejected(t *testing.T) {
+	registry := newStatusRegistry()
+	device := Device{Name: "sauna"}
+
+	for _, rule := range []string{rejectRange, rejectRange, rejectRate, rejectSpike, rejectSpike, rejectSpike} {
+		registry.countRejected(device, rule)
+	}
+
+	rejected := registry.snapshot()[0].Rejected
+	if rejected != (RejectCounts{Range: 2, Rate: 1, Spike: 3}) {
+		t.Errorf("Unexpected reject counts: %+v", rejected)
+	}
+}
+
+func TestStatusRegistry_PublishesOutsideLock(t *testing.T) {
+	origPublish := publishAvailability
+	origLogInfo := logInfo
+	logInfo = func(format string, args ...interface{}) {}
+	defer func() {
+		publishAvailability = origPublish
+		logInfo = origLogInfo
+	}()
+
+	registry := newStatusRegistry()
+	release := make(chan struct{})
+	publishing := make(chan struct{})
+	publishAvailability = func(device Device, state LinkState) {
+		close(publishing)
+		<-release // a broker that does not answer
+	}
+
+	device := Device{Name: "greenhouse"}
+	go registry.setLink(device, LinkConnected, nil)
+	<-publishing
+
+	done := make(chan []DeviceStatus)
+	go func() { done <- registry.snapshot() }()
+	select {
+	case statuses := <-done:
+		if len(statuses) != 1 || statuses[0].Link != LinkConnected {
+			t.Errorf("Unexpected statuses: %+v", statuses)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("Expected the status to be readable while availability is published")
+	}
+	close(release)
+}
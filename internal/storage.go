@@ -0,0 +1,190 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"os"
+	"sync"
+)
+
+const (
+	driverSQLite   = "sqlite"
+	driverPostgres = "postgres"
+)
+
+var (
+	dbDriver = flag.String("db-driver", driverSQLite, "Where measurements and weather are stored: sqlite in -db, or postgres at -db-url")
+	dbURL    = flag.String("db-url", "", "PostgreSQL connection URL for -db-driver postgres, e.g. postgres://skogsnet@db.example.com/skogsnet (default from the PG* environment variables)")
+	dbSite   = flag.String("db-site", "", "Site name this installation stores its measurements and weather under with -db-driver postgres (default the host name)")
+)
+
+var openStorage = openStorageImpl
+
+// Storage keeps the measurements and weather and answers the queries of the
+// dashboard and exports. Devices, tokens, calibrations and rejected
+// readings always stay in the SQLite database of the site.
+type Storage interface {
+	InsertMeasurement(m Measurement, timestamp int64) error
+	// InsertMeasurementBatch stores all measurements at their UnixTimestamp,
+	// either all or none of them.
+	InsertMeasurementBatch(measurements []Measurement) error
+	InsertWeather(w Weather, timestamp int64) error
+	// Export passes the measurements selected by filter to w, oldest first.
+	Export(filter exportFilter, w exportWriter) error
+	// QueryBuckets averages the measurements of device, every device when
+	// nil, from since to end into buckets of intervalSeconds.
+	QueryBuckets(device *Device, since, end, intervalSeconds int64) ([]Result, error)
+	// LatestMeasurements returns the newest measurements of device, every
+	// device when nil, newest first. Only the first has its Metrics.
+	LatestMeasurements(device *Device, limit int) ([]Result, error)
+	Close() error
+}
+
+var (
+	storageMu     sync.RWMutex
+	activeStorage Storage // nil while measurements are stored in the SQLite database
+)
+
+// storageFor returns the storage measurements go to: the one opened by
+// -db-driver, or db itself.
+func storageFor(db *sql.DB) Storage {
+	storageMu.RLock()
+	defer storageMu.RUnlock()
+	if activeStorage != nil {
+		return activeStorage
+	}
+	return sqliteStorage{db}
+}
+
+func setActiveStorage(s Storage) {
+	storageMu.Lock()
+	defer storageMu.Unlock()
+	activeStorage = s
+}
+
+// openStorageImpl opens the storage selected by -db-driver. The SQLite
+// storage is db itself and closing it leaves db open.
+func openStorageImpl(db *sql.DB) (Storage, error) {
+	switch *dbDriver {
+	case driverSQLite:
+		return sqliteStorage{db}, nil
+	case driverPostgres:
+		site := *dbSite
+		if site == "" {
+			hostname, err := os.Hostname()
+			if err != nil {
+				return nil, fmt.Errorf("could not name the site, set -db-site: %w", err)
+			}
+			site = hostname
+		}
+		s, err := openPostgresStorage(*dbURL, site)
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	default:
+		return nil, fmt.Errorf("invalid -db-driver %q, expected %s or %s", *dbDriver, driverSQLite, driverPostgres)
+	}
+}
+
+// sqliteStorage stores measurements in the SQLite database next to the
+// devices, with rollups for the dashboard.
+type sqliteStorage struct {
+	db *sql.DB
+}
+
+func (s sqliteStorage) InsertMeasurement(m Measurement, timestamp int64) error {
+	return insertMeasurement(s.db, m, timestamp)
+}
+
+func (s sqliteStorage) InsertMeasurementBatch(measurements []Measurement) error {
+	return insertMeasurementBatch(s.db, measurements)
+}
+
+func (s sqliteStorage) InsertWeather(w Weather, timestamp int64) error {
+	return insertWeather(s.db, w, timestamp)
+}
+
+func (s sqliteStorage) Export(filter exportFilter, w exportWriter) error {
+	return exportMeasurementsSQLite(s.db, filter, w)
+}
+
+func (s sqliteStorage) QueryBuckets(device *Device, since, end, intervalSeconds int64) ([]Result, error) {
+	var deviceID int64
+	if device != nil {
+		deviceID = device.ID
+	}
+	return queryBuckets(s.db, deviceID, since, end, intervalSeconds)
+}
+
+func (s sqliteStorage) LatestMeasurements(device *Device, limit int) ([]Result, error) {
+	var deviceID int64
+	if device != nil {
+		deviceID = device.ID
+	}
+	return latestMeasurements(s.db, deviceID, limit)
+}
+
+func (s sqliteStorage) Close() error {
+	return nil
+}
+
+// resultRow scans a row of the bucket and latest queries into a Result. The
+// queries of every storage select the columns of dest in the same order.
+type resultRow struct {
+	measurementID, deviceID   sql.NullInt64
+	device, city, description sql.NullString
+	timestamp                 int64
+	values                    [12]sql.NullFloat64
+}
+
+func (row *resultRow) dest() []any {
+	dest := []any{&row.measurementID, &row.deviceID, &row.device, &row.timestamp}
+	for i := range row.values[:6] {
+		dest = append(dest, &row.values[i])
+	}
+	dest = append(dest, &row.city)
+	for i := range row.values[6:] {
+		dest = append(dest, &row.values[6+i])
+	}
+	return append(dest, &row.description)
+}
+
+func (row *resultRow) result() Result {
+	v := row.values
+	return Result{
+		MeasurementID:       row.measurementID.Int64,
+		DeviceID:            row.deviceID.Int64,
+		Device:              row.device.String,
+		AggregatedTimestamp: row.timestamp,
+		AvgTemperature:      v[0].Float64,
+		MinTemperature:      v[1].Float64,
+		MaxTemperature:      v[2].Float64,
+		AvgHumidity:         v[3].Float64,
+		MinHumidity:         v[4].Float64,
+		MaxHumidity:         v[5].Float64,
+		City:                row.city.String,
+		AvgWeatherTemp:      v[6].Float64,
+		AvgWeatherHumidity:  v[7].Float64,
+		AvgWindSpeed:        v[8].Float64,
+		AvgWindDeg:          v[9].Float64,
+		AvgClouds:           v[10].Float64,
+		AvgWeatherCode:      v[11].Float64,
+		Description:         row.description.String,
+	}
+}
+
+// scanResults reads rows of resultRow columns.
+func scanResults(rows *sql.Rows) ([]Result, error) {
+	defer rows.Close()
+	var results []Result
+	for rows.Next() {
+		var row resultRow
+		if err := rows.Scan(row.dest()...); err != nil {
+			return nil, err
+		}
+		results = append(results, row.result())
+	}
+	return results, rows.Err()
+}
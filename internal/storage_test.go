@@ -0,0 +1,134 @@
+package main
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// recordingStorage is a Storage that remembers what it was given.
+type recordingStorage struct {
+	mu           sync.Mutex
+	measurements []Measurement
+	weather      []Weather
+}
+
+func (s *recordingStorage) InsertMeasurement(m Measurement, timestamp int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m.UnixTimestamp = timestamp
+	s.measurements = append(s.measurements, m)
+	return nil
+}
+
+func (s *recordingStorage) InsertMeasurementBatch(measurements []Measurement) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.measurements = append(s.measurements, measurements...)
+	return nil
+}
+
+func (s *recordingStorage) InsertWeather(w Weather, timestamp int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.weather = append(s.weather, w)
+	return nil
+}
+
+func (s *recordingStorage) Export(filter exportFilter, w exportWriter) error { return w.begin(nil) }
+
+func (s *recordingStorage) QueryBuckets(device *Device, since, end, intervalSeconds int64) ([]Result, error) {
+	return nil, nil
+}
+
+func (s *recordingStorage) LatestMeasurements(device *Device, limit int) ([]Result, error) {
+	return nil, nil
+}
+
+func (s *recordingStorage) Close() error { return nil }
+
+func TestStorageFor(t *testing.T) {
+	db, _ := sql.Open("sqlite3", ":memory:")
+	defer db.Close()
+	if s, ok := storageFor(db).(sqliteStorage); !ok || s.db != db {
+		t.Errorf("Expected the SQLite storage of db, got %#v", storageFor(db))
+	}
+
+	recording := &recordingStorage{}
+	setActiveStorage(recording)
+	defer setActiveStorage(nil)
+	if storageFor(db) != Storage(recording) {
+		t.Errorf("Expected the active storage, got %#v", storageFor(db))
+	}
+
+	// Measurements stored without the batched writer go to it too
+	if err := storeMeasurement(db, Measurement{UnixTimestamp: 1000, TemperatureCelsius: 20}); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(recording.measurements) != 1 || recording.measurements[0].UnixTimestamp != 1000 {
+		t.Errorf("Expected the measurement in the active storage, got %+v", recording.measurements)
+	}
+}
+
+func TestOpenStorage(t *testing.T) {
+	db, _ := sql.Open("sqlite3", ":memory:")
+	defer db.Close()
+	origDriver, origURL := *dbDriver, *dbURL
+	defer func() { *dbDriver, *dbURL = origDriver, origURL }()
+
+	s, err := openStorage(db)
+	if _, ok := s.(sqliteStorage); !ok || err != nil {
+		t.Errorf("Expected the SQLite storage by default, got %#v, %v", s, err)
+	}
+	if err := s.Close(); err != nil || db.Ping() != nil {
+		t.Errorf("Expected closing the SQLite storage to leave db open, got %v", err)
+	}
+
+	*dbDriver = "mysql"
+	if s, err := openStorage(db); err == nil || s != nil || !strings.Contains(err.Error(), "invalid -db-driver") {
+		t.Errorf("Expected an invalid driver error, got %#v, %v", s, err)
+	}
+
+	*dbDriver, *dbURL = driverPostgres, "postgres://skogsnet@127.0.0.1:1/skogsnet?connect_timeout=2"
+	if s, err := openStorage(db); err == nil || s != nil {
+		t.Errorf("Expected an error for an unreachable server, got %#v, %v", s, err)
+	}
+}
+
+func TestSQLiteStorage(t *testing.T) {
+	db, device := openCalibrationTestDB(t, filepath.Join(t.TempDir(), "storage.db"))
+	var s Storage = sqliteStorage{db}
+
+	s.InsertWeather(Weather{Name: "Umeå"}, rollupTestBase)
+	batch := []Measurement{
+		{UnixTimestamp: rollupTestBase + 1000, DeviceID: device.ID, TemperatureCelsius: 20, Metrics: map[string]float64{"lux": 100}},
+		{UnixTimestamp: rollupTestBase + 2000, DeviceID: device.ID, TemperatureCelsius: 22},
+	}
+	if err := s.InsertMeasurementBatch(batch); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err := s.InsertMeasurement(Measurement{DeviceID: device.ID, TemperatureCelsius: 24, Metrics: map[string]float64{"lux": 300}}, rollupTestBase+3000); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	latest, err := s.LatestMeasurements(&device, 2)
+	if err != nil || len(latest) != 2 || latest[0].AvgTemperature != 24 || latest[0].Metrics["lux"] != 300 || latest[0].City != "Umeå" {
+		t.Errorf("Unexpected latest measurements %+v, %v", latest, err)
+	}
+	buckets, err := s.QueryBuckets(nil, rollupTestBase, rollupTestBase+60_000, 60)
+	if err != nil || len(buckets) != 1 || buckets[0].AvgTemperature != 22 || buckets[0].Metrics["lux"] != 200 {
+		t.Errorf("Unexpected buckets %+v, %v", buckets, err)
+	}
+
+	csvFile := filepath.Join(t.TempDir(), "export.csv")
+	if err := exportMeasurements(s, csvFile, exportOptions{}); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	data, _ := os.ReadFile(csvFile)
+	if lines := strings.Split(strings.TrimSpace(string(data)), "\n"); len(lines) != 4 || !strings.HasSuffix(lines[0], ",lux") {
+		t.Errorf("Unexpected export %q", data)
+	}
+}
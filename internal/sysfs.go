@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	sourceW1    = "w1"
+	sourceHwmon = "hwmon"
+
+	// ds18b20PowerOnReset is the value a DS18B20 reports when it lost power
+	// before finishing a conversion.
+	ds18b20PowerOnReset = 85000
+)
+
+var (
+	sysfsRoot     = flag.String("sysfs-root", "/sys", "Root of the sysfs tree read by -w1 and -hwmon")
+	pollW1        = flag.Bool("w1", false, "Poll DS18B20 1-Wire temperature probes under <sysfs-root>/bus/w1/devices")
+	pollHwmon     = flag.Bool("hwmon", false, "Poll board sensors under <sysfs-root>/class/hwmon")
+	sysfsInterval = flag.Duration("sysfs-interval", 30*time.Second, "Poll interval for -w1 and -hwmon")
+)
+
+var errW1CRC = errors.New("1-Wire CRC check failed")
+
+var (
+	hwmonInputPattern = regexp.MustCompile(`^(temp|humidity)(\d+)_input$`)
+	labelSeparators   = regexp.MustCompile(`[^a-z0-9]+`)
+)
+
+// sysfsSensor is one probe or chip found under the sysfs root. Its id is the
+// 1-Wire slave id, e.g. 28-0316a2795aff, or the hwmon chip name.
+type sysfsSensor struct {
+	id   string
+	path string
+}
+
+// sysfsSource polls the 1-Wire probes or hwmon chips under the sysfs root.
+// Every sensor is stored as its own device, named w1-<id> or hwmon-<chip>
+// unless a -device with the same source gives the id as its port.
+type sysfsSource struct {
+	kind    string // sourceW1 or sourceHwmon
+	root    string
+	devices *networkDevices
+	names   map[string]string // sensor id -> configured device name
+}
+
+func newSysfsSource(kind string, configured []Device) *sysfsSource {
+	s := &sysfsSource{
+		kind:    kind,
+		root:    *sysfsRoot,
+		devices: newNetworkDevices(kind, configured),
+		names:   make(map[string]string),
+	}
+	for _, device := range configured {
+		if device.Source == kind && device.Port != "" {
+			s.names[device.Port] = device.Name
+		}
+	}
+	return s
+}
+
+func (s *sysfsSource) deviceName(id string) string {
+	if name, ok := s.names[id]; ok {
+		return name
+	}
+	return s.kind + "-" + id
+}
+
+// discover returns the sensors present now, so probes plugged in while
+// running are picked up.
+func (s *sysfsSource) discover() ([]sysfsSensor, error) {
+	if s.kind == sourceW1 {
+		return discoverW1(s.root)
+	}
+	return discoverHwmon(s.root)
+}
+
+func (s *sysfsSource) read(sensor sysfsSensor) (string, error) {
+	if s.kind == sourceW1 {
+		return readW1(sensor.path)
+	}
+	return readHwmon(sensor.path)
+}
+
+func discoverW1(root string) ([]sysfsSensor, error) {
+	paths, err := filepath.Glob(filepath.Join(root, "bus", "w1", "devices", "*", "w1_slave"))
+	if err != nil {
+		return nil, err
+	}
+	sensors := make([]sysfsSensor, 0, len(paths))
+	for _, path := range paths {
+		sensors = append(sensors, sysfsSensor{id: filepath.Base(filepath.Dir(path)), path: path})
+	}
+	return sensors, nil
+}
+
+// discoverHwmon returns the hwmon chips by name. The hwmonN numbering can
+// change between boots, so it only tells chips with the same name apart.
+func discoverHwmon(root string) ([]sysfsSensor, error) {
+	dirs, err := filepath.Glob(filepath.Join(root, "class", "hwmon", "hwmon*"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(dirs)
+
+	var sensors []sysfsSensor
+	seen := make(map[string]bool)
+	for _, dir := range dirs {
+		name, err := os.ReadFile(filepath.Join(dir, "name"))
+		if err != nil {
+			continue
+		}
+		id := strings.TrimSpace(string(name))
+		if seen[id] {
+			id += "-" + filepath.Base(dir)
+		}
+		seen[id] = true
+		sensors = append(sensors, sysfsSensor{id: id, path: dir})
+	}
+	return sensors, nil
+}
+
+// readW1 parses the w1_slave file of a DS18B20, e.g.
+//
+//	72 01 4b 46 7f ff 0e 10 57 : crc=57 YES
+//	72 01 4b 46 7f ff 0e 10 57 t=23125
+func readW1(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) < 2 {
+		return "", fmt.Errorf("unexpected w1_slave content %q", data)
+	}
+	if !strings.HasSuffix(strings.TrimSpace(lines[0]), "YES") {
+		return "", errW1CRC
+	}
+	_, raw, ok := strings.Cut(lines[1], "t=")
+	if !ok {
+		return "", fmt.Errorf("missing temperature in %q", lines[1])
+	}
+	milli, err := strconv.ParseInt(strings.TrimSpace(raw), 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid temperature %q", raw)
+	}
+	if milli == ds18b20PowerOnReset {
+		return "", errors.New("probe reported its power-on reset value")
+	}
+
+	line, err := json.Marshal(map[string]float64{temperatureField: float64(milli) / 1000})
+	return string(line), err
+}
+
+// readHwmon reads the temperature and humidity inputs of a chip, given in
+// milli-degrees and milli-percent. The first input of each kind is stored as
+// temperature or humidity, the others as metrics named after their label,
+// e.g. core_0, or else after the input, e.g. temp2.
+func readHwmon(dir string) (string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+
+	type input struct {
+		kind  string
+		index int
+		name  string
+	}
+	var inputs []input
+	for _, entry := range entries {
+		match := hwmonInputPattern.FindStringSubmatch(entry.Name())
+		if match == nil {
+			continue
+		}
+		index, _ := strconv.Atoi(match[2])
+		inputs = append(inputs, input{kind: match[1], index: index, name: entry.Name()})
+	}
+	sort.Slice(inputs, func(i, j int) bool {
+		if inputs[i].kind != inputs[j].kind {
+			return inputs[i].kind > inputs[j].kind // temp before humidity
+		}
+		return inputs[i].index < inputs[j].index
+	})
+
+	fields := make(map[string]float64)
+	for _, in := range inputs {
+		data, err := os.ReadFile(filepath.Join(dir, in.name))
+		if err != nil {
+			continue // some drivers fail single inputs, e.g. with ENODATA
+		}
+		milli, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		field := temperatureField
+		if in.kind == "humidity" {
+			field = humidityField
+		}
+		if _, taken := fields[field]; taken {
+			field = hwmonMetricName(dir, in.kind, in.index)
+		}
+		fields[field] = float64(milli) / 1000
+	}
+	if len(fields) == 0 {
+		return "", errors.New("no readable temperature or humidity inputs")
+	}
+
+	line, err := json.Marshal(fields)
+	return string(line), err
+}
+
+// hwmonMetricName names an input after its label when the chip has one.
+func hwmonMetricName(dir, kind string, index int) string {
+	prefix := kind + strconv.Itoa(index)
+	label, err := os.ReadFile(filepath.Join(dir, prefix+"_label"))
+	if err != nil {
+		return prefix
+	}
+	name := strings.Trim(labelSeparators.ReplaceAllString(strings.ToLower(string(label)), "_"), "_")
+	if !validMetricName(name) {
+		return prefix
+	}
+	return name
+}
+
+// poll reads every sensor once. Sensors that fail or disappeared since the
+// last poll are reported lost.
+func (s *sysfsSource) poll(db *sql.DB, latestWeather *Weather, present map[string]Device) map[string]Device {
+	sensors, err := s.discover()
+	if err != nil {
+		throttledLogError(&lastSysfsErr, "Failed to list %s sensors under %s: %v", s.kind, s.root, err)
+	}
+
+	current := make(map[string]Device)
+	for _, sensor := range sensors {
+		name := s.deviceName(sensor.id)
+		line, err := s.read(sensor)
+		if err != nil {
+			device, resolveErr := s.devices.resolve(db, name, sensor.id)
+			if resolveErr == nil {
+				deviceStatuses.setLink(device, LinkLost, err)
+			}
+			throttledLogWarn(&lastSysfsErr, "Failed to read %s sensor %s: %v", s.kind, sensor.id, err)
+			continue
+		}
+		if device, ok := s.devices.store(db, name, sensor.id, line, latestWeather); ok {
+			current[sensor.id] = device
+		}
+	}
+
+	for id, device := range present {
+		if !containsSensor(sensors, id) {
+			deviceStatuses.setLink(device, LinkLost, fmt.Errorf("%s sensor %s disappeared", s.kind, id))
+		}
+	}
+	return current
+}
+
+func containsSensor(sensors []sysfsSensor, id string) bool {
+	for _, sensor := range sensors {
+		if sensor.id == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *sysfsSource) Run(ctx context.Context, db *sql.DB, latestWeather *Weather) {
+	logInfo("Polling %s sensors under %s every %v", s.kind, s.root, *sysfsInterval)
+	present := make(map[string]Device)
+	for {
+		present = s.poll(db, latestWeather, present)
+		if !sleepContext(ctx, *sysfsInterval) {
+			return
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeSysfsFile creates a file below a fake sysfs root.
+func writeSysfsFile(t *testing.T, root, path, content string) {
+	t.Helper()
+	full := filepath.Join(root, path)
+	if err := os.MkdirAll(filepath.Dir(full), 0o755); err != nil {
+		t.Fatalf("Failed to create %s: %v", filepath.Dir(full), err)
+	}
+	if err := os.WriteFile(full, []byte(content), 0o644); err != nil {
+		t.Fatalf("Failed to write %s: %v", full, err)
+	}
+}
+
+func w1Slave(crcOK bool, milli string) string {
+	status := "YES"
+	if !crcOK {
+		status = "NO"
+	}
+	return "72 01 4b 46 7f ff 0e 10 57 : crc=57 " + status + "\n72 01 4b 46 7f ff 0e 10 57 t=" + milli + "\n"
+}
+
+func TestReadW1(t *testing.T) {
+	root := t.TempDir()
+	cases := map[string]struct {
+		content  string
+		expected string
+		err      string
+	}{
+		"ok":       {w1Slave(true, "23125"), `{"temperature_celcius":23.125}`, ""},
+		"negative": {w1Slave(true, "-1062"), `{"temperature_celcius":-1.062}`, ""},
+		"crc":      {w1Slave(false, "23125"), "", "CRC"},
+		"reset":    {w1Slave(true, "85000"), "", "power-on reset"},
+		"garbage":  {"00 00\n", "", "unexpected"},
+	}
+	for name, c := range cases {
+		path := filepath.Join(root, name)
+		os.WriteFile(path, []byte(c.content), 0o644)
+		line, err := readW1(path)
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("%s: expected error containing %q, got %v", name, c.err, err)
+			}
+			continue
+		}
+		if err != nil || line != c.expected {
+			t.Errorf("%s: expected %s, got %s, %v", name, c.expected, line, err)
+		}
+	}
+}
+
+func TestReadHwmon(t *testing.T) {
+	root := t.TempDir()
+	writeSysfsFile(t, root, "hwmon0/temp1_input", "48250\n")
+	writeSysfsFile(t, root, "hwmon0/temp2_input", "51000\n")
+	writeSysfsFile(t, root, "hwmon0/temp2_label", "Core 0\n")
+	writeSysfsFile(t, root, "hwmon0/temp3_input", "39000\n")
+	writeSysfsFile(t, root, "hwmon0/humidity1_input", "45300\n")
+	writeSysfsFile(t, root, "hwmon0/fan1_input", "1200\n")
+	writeSysfsFile(t, root, "hwmon0/temp4_input", "not a number\n")
+
+	line, err := readHwmon(filepath.Join(root, "hwmon0"))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	m, err := deserializeData(line)
+	if err != nil {
+		t.Fatalf("Expected a valid line, got %q: %v", line, err)
+	}
+	if m.TemperatureCelsius != 48.25 || m.HumidityPercentage != 45.3 || m.Metrics["core_0"] != 51 || m.Metrics["temp3"] != 39 {
+		t.Errorf("Unexpected measurement from %s: %+v", line, m)
+	}
+	if len(m.Metrics) != 2 {
+		t.Errorf("Expected only temperature and humidity inputs, got %v", m.Metrics)
+	}
+
+	writeSysfsFile(t, root, "hwmon1/fan1_input", "1200\n")
+	if _, err := readHwmon(filepath.Join(root, "hwmon1")); err == nil {
+		t.Error("Expected error for a chip without temperature or humidity inputs")
+	}
+}
+
+func TestDiscoverHwmon(t *testing.T) {
+	root := t.TempDir()
+	writeSysfsFile(t, root, "class/hwmon/hwmon0/name", "cpu_thermal\n")
+	writeSysfsFile(t, root, "class/hwmon/hwmon1/name", "coretemp\n")
+	writeSysfsFile(t, root, "class/hwmon/hwmon2/name", "coretemp\n")
+	writeSysfsFile(t, root, "class/hwmon/hwmon3/temp1_input", "1000\n") // no name
+
+	sensors, err := discoverHwmon(root)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	var ids []string
+	for _, sensor := range sensors {
+		ids = append(ids, sensor.id)
+	}
+	if strings.Join(ids, ",") != "cpu_thermal,coretemp,coretemp-hwmon2" {
+		t.Errorf("Unexpected chips %v", ids)
+	}
+}
+
+func TestSysfsSource_Poll(t *testing.T) {
+	db, stored := networkTestSetup(t)
+	root := t.TempDir()
+	writeSysfsFile(t, root, "bus/w1/devices/28-0316a2795aff/w1_slave", w1Slave(true, "-18500"))
+	writeSysfsFile(t, root, "bus/w1/devices/28-0417c1d0b2ff/w1_slave", w1Slave(true, "4250"))
+	writeSysfsFile(t, root, "bus/w1/devices/w1_bus_master1/name", "w1_bus_master1\n")
+
+	origRoot := *sysfsRoot
+	*sysfsRoot = root
+	defer func() { *sysfsRoot = origRoot }()
+
+	source := newSysfsSource(sourceW1, []Device{
+		{Name: "freezer", Source: sourceW1, Port: "28-0316a2795aff", Location: "Kitchen"},
+		{Name: "greenhouse", Source: sourceSerial, Port: "/dev/ttyACM0"},
+	})
+	present := source.poll(db, &Weather{}, nil)
+
+	measurements := stored()
+	if len(measurements) != 2 || len(present) != 2 {
+		t.Fatalf("Expected 2 measurements from 2 probes, got %d, %d", len(measurements), len(present))
+	}
+	freezer, err := lookupDevice(db, "freezer")
+	if err != nil || freezer.Location != "Kitchen" || freezer.Port != "w1:28-0316a2795aff" {
+		t.Errorf("Expected configured freezer probe, got %+v, %v", freezer, err)
+	}
+	if _, err := lookupDevice(db, "w1-28-0417c1d0b2ff"); err != nil {
+		t.Errorf("Expected unnamed probe as w1-<id>, got %v", err)
+	}
+	for _, m := range measurements {
+		if m.DeviceID == freezer.ID && m.TemperatureCelsius != -18.5 {
+			t.Errorf("Unexpected freezer temperature %v", m.TemperatureCelsius)
+		}
+	}
+
+	// One probe fails its CRC, the other is unplugged
+	writeSysfsFile(t, root, "bus/w1/devices/28-0316a2795aff/w1_slave", w1Slave(false, "-18500"))
+	os.RemoveAll(filepath.Join(root, "bus/w1/devices/28-0417c1d0b2ff"))
+	present = source.poll(db, &Weather{}, present)
+
+	if len(stored()) != 2 || len(present) != 0 {
+		t.Errorf("Expected nothing stored, got %d measurements, %d present", len(stored()), len(present))
+	}
+	links := make(map[string]DeviceStatus)
+	for _, status := range deviceStatuses.snapshot() {
+		links[status.Device] = status
+	}
+	if status := links["freezer"]; status.Link != LinkLost || !strings.Contains(status.LastError, "CRC") {
+		t.Errorf("Expected freezer lost with CRC error, got %+v", status)
+	}
+	if status := links["w1-28-0417c1d0b2ff"]; status.Link != LinkLost || !strings.Contains(status.LastError, "disappeared") {
+		t.Errorf("Expected unplugged probe lost, got %+v", status)
+	}
+}
+
+func TestConfiguredSources_Sysfs(t *testing.T) {
+	origW1 := *pollW1
+	origHwmon := *pollHwmon
+	origLogWarn := logWarn
+	var warned int
+	logWarn = func(format string, v ...any) { warned++ }
+	defer func() {
+		*pollW1 = origW1
+		*pollHwmon = origHwmon
+		logWarn = origLogWarn
+	}()
+
+	*pollW1 = true
+	*pollHwmon = false
+	sources := configuredSources([]Device{
+		{Name: "freezer", Source: sourceW1, Port: "28-0316a2795aff"},
+		{Name: "pi", Source: sourceHwmon, Port: "cpu_thermal"},
+	})
+	if len(sources) != 1 {
+		t.Fatalf("Expected only the 1-Wire poller, got %d sources", len(sources))
+	}
+	if source, ok := sources[0].(*sysfsSource); !ok || source.kind != sourceW1 || source.names["28-0316a2795aff"] != "freezer" {
+		t.Errorf("Expected 1-Wire poller naming the freezer probe, got %#v", sources[0])
+	}
+	if warned != 1 {
+		t.Errorf("Expected a warning for the hwmon device without -hwmon, got %d", warned)
+	}
+}
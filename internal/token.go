@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	sourceHTTP     = "http"
+	tokenUsage     = "token <device>"
+	tokenByteCount = 24
+)
+
+var errInvalidToken = errors.New("invalid token")
+
+var issueDeviceToken = issueDeviceTokenImpl
+var deviceForToken = deviceForTokenImpl
+
+// hashToken returns the form a token is stored in. Tokens are random, so a
+// plain SHA-256 is enough to keep the database from holding usable secrets.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// issueDeviceTokenImpl creates a new ingest token for the device, replacing
+// any previous one, and registers the device if it does not exist yet. Only
+// the hash is stored, so the token is returned once.
+func issueDeviceTokenImpl(db *sql.DB, name string) (string, error) {
+	if db == nil {
+		return "", errors.New("db is nil")
+	}
+	if strings.TrimSpace(name) == "" {
+		return "", errors.New("device name is required")
+	}
+
+	secret := make([]byte, tokenByteCount)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(secret)
+
+	_, err := db.Exec(`
+		INSERT INTO devices (name, port, created_at) VALUES (?, ?, ?)
+		ON CONFLICT(name) DO NOTHING
+	`, name, sourceHTTP, time.Now().UnixMilli())
+	if err != nil {
+		return "", err
+	}
+	if _, err := db.Exec("UPDATE devices SET token_hash = ? WHERE name = ?", hashToken(token), name); err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// deviceForTokenImpl returns the device the token was issued for.
+func deviceForTokenImpl(db *sql.DB, token string) (Device, error) {
+	if db == nil {
+		return Device{}, errors.New("db is nil")
+	}
+	if token == "" {
+		return Device{}, errInvalidToken
+	}
+
+	var device Device
+	var port, location sql.NullString
+	err := db.QueryRow("SELECT id, name, port, location, created_at FROM devices WHERE token_hash = ?", hashToken(token)).
+		Scan(&device.ID, &device.Name, &port, &location, &device.CreatedAt)
+	if err == sql.ErrNoRows {
+		return Device{}, errInvalidToken
+	}
+	if err != nil {
+		return Device{}, err
+	}
+	device.Port = port.String
+	device.Location = location.String
+
+	return device, nil
+}
+
+// runTokenCommand implements the token subcommand, which prints a new ingest
+// token for a device.
+func runTokenCommand(args []string) error {
+	fs := newSubcommandFlagSet("token", tokenUsage)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("device name is required")
+	}
+
+	db, err := openDatabase(*dbFileName)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	token, err := issueDeviceToken(db, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	fmt.Println(token)
+	return nil
+}
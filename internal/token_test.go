@@ -0,0 +1,117 @@
+package main
+
+import (
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestIssueDeviceToken(t *testing.T) {
+	tmpDB := "test_device_token.db"
+	defer os.Remove(tmpDB)
+	db, err := openDatabase(tmpDB)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	existing := Device{Name: "greenhouse", Port: "/dev/ttyACM0", Location: "Garden"}
+	if err := registerDevice(db, &existing); err != nil {
+		t.Fatalf("Failed to register device: %v", err)
+	}
+
+	token, err := issueDeviceToken(db, "greenhouse")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(token) != 2*tokenByteCount {
+		t.Errorf("Unexpected token length %d", len(token))
+	}
+
+	device, err := deviceForToken(db, token)
+	if err != nil {
+		t.Fatalf("Expected token to resolve, got %v", err)
+	}
+	if device.ID != existing.ID || device.Port != "/dev/ttyACM0" || device.Location != "Garden" {
+		t.Errorf("Expected the existing device to be unchanged, got %+v", device)
+	}
+
+	// A new token replaces the old one
+	newToken, _ := issueDeviceToken(db, "greenhouse")
+	if _, err := deviceForToken(db, token); err != errInvalidToken {
+		t.Errorf("Expected old token to be revoked, got %v", err)
+	}
+	if _, err := deviceForToken(db, newToken); err != nil {
+		t.Errorf("Expected new token to resolve, got %v", err)
+	}
+
+	var stored string
+	db.QueryRow("SELECT token_hash FROM devices WHERE name = 'greenhouse'").Scan(&stored)
+	if stored == newToken || stored != hashToken(newToken) {
+		t.Error("Expected only the token hash to be stored")
+	}
+}
+
+func TestIssueDeviceToken_NewDevice(t *testing.T) {
+	tmpDB := "test_device_token_new.db"
+	defer os.Remove(tmpDB)
+	db, err := openDatabase(tmpDB)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	token, err := issueDeviceToken(db, "pi-zero")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	device, err := deviceForToken(db, token)
+	if err != nil || device.Name != "pi-zero" || device.Port != sourceHTTP {
+		t.Errorf("Expected new http device, got %+v, %v", device, err)
+	}
+
+	if _, err := issueDeviceToken(db, " "); err == nil {
+		t.Error("Expected error for empty device name")
+	}
+	if _, err := deviceForToken(db, ""); err != errInvalidToken {
+		t.Errorf("Expected empty token to be invalid, got %v", err)
+	}
+}
+
+func TestRunTokenCommand(t *testing.T) {
+	tmpDB := "test_token_command.db"
+	defer os.Remove(tmpDB)
+	origDB := *dbFileName
+	*dbFileName = tmpDB
+	defer func() { *dbFileName = origDB }()
+
+	stdout := os.Stdout
+	r, w, _ := os.Pipe()
+	os.Stdout = w
+	err := runTokenCommand([]string{"balcony"})
+	w.Close()
+	os.Stdout = stdout
+	output, _ := io.ReadAll(r)
+
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	token := strings.TrimSpace(string(output))
+
+	db, err := openDatabase(tmpDB)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+	if device, err := deviceForToken(db, token); err != nil || device.Name != "balcony" {
+		t.Errorf("Expected printed token to belong to balcony, got %+v, %v", device, err)
+	}
+
+	stderr := os.Stderr
+	os.Stderr, _ = os.Open(os.DevNull)
+	defer func() { os.Stderr = stderr }()
+	if err := runTokenCommand(nil); err == nil {
+		t.Error("Expected error without device name")
+	}
+}
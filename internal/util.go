@@ -1,5 +1,35 @@
 package main
 
-import "os"
+import (
+	"context"
+	"flag"
+	"os"
+	"time"
+)
 
 var osExit = os.Exit
+
+// sleepContext waits for d or until ctx is cancelled and reports whether the
+// full duration elapsed.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// flagWasSet reports whether the named flag was given on the command line.
+func flagWasSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
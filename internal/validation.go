@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Rules a reading can be rejected by
+const (
+	rejectRange = "range"
+	rejectRate  = "rate"
+	rejectSpike = "spike"
+)
+
+var validateMeasurement = validateMeasurementImpl
+var insertRejectedMeasurement = insertRejectedMeasurementImpl
+
+// validationSettings holds the rules loaded from -validation-config, nil
+// when readings are stored unchecked.
+var validationSettings *validationConfig
+
+// validationConfig is the JSON file given with -validation-config, e.g.
+//
+//	{
+//	  "rules": {
+//	    "temperature": {"min": -30, "max": 60, "max_rate": 2, "spike_window": 5, "spike_delta": 3},
+//	    "humidity": {"min": 1, "max": 100}
+//	  },
+//	  "devices": {
+//	    "freezer": {"temperature": {"min": -40, "max": 10}}
+//	  }
+//	}
+type validationConfig struct {
+	Rules   map[string]validationRule            `json:"rules"`
+	Devices map[string]map[string]validationRule `json:"devices"`
+}
+
+// validationRule describes the plausible readings of one metric. A device
+// rule replaces the default rule of the same metric.
+type validationRule struct {
+	Min         *float64 `json:"min"`
+	Max         *float64 `json:"max"`
+	MaxRate     float64  `json:"max_rate"`     // largest change per minute from the last accepted reading
+	SpikeWindow int      `json:"spike_window"` // number of previous readings the median is taken of
+	SpikeDelta  float64  `json:"spike_delta"`  // largest distance from that median
+}
+
+// rejection tells why a reading was not stored.
+type rejection struct {
+	Metric string
+	Value  float64
+	Rule   string
+	Reason string
+}
+
+// RejectedCount is the number of rejected readings of a device by rule, as
+// reported by /api/measurements/rejected.
+type RejectedCount struct {
+	Device string `json:"device"`
+	Rule   string `json:"rule"`
+	Count  int64  `json:"count"`
+	Last   int64  `json:"last"`
+}
+
+func loadValidationConfig(path string) (*validationConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config validationConfig
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&config); err != nil {
+		return nil, fmt.Errorf("invalid validation config %s: %w", path, err)
+	}
+	if err := config.normalize(); err != nil {
+		return nil, fmt.Errorf("invalid validation config %s: %w", path, err)
+	}
+	return &config, nil
+}
+
+// normalize checks the rules and stores them under the field names used in
+// measurements, so "temperature" may be written for temperature_celcius.
+func (c *validationConfig) normalize() error {
+	if len(c.Rules) == 0 && len(c.Devices) == 0 {
+		return errors.New("at least one rule is required")
+	}
+	rules, err := normalizeRules(c.Rules)
+	if err != nil {
+		return err
+	}
+	c.Rules = rules
+	for device, deviceRules := range c.Devices {
+		rules, err := normalizeRules(deviceRules)
+		if err != nil {
+			return fmt.Errorf("device %s: %w", device, err)
+		}
+		c.Devices[device] = rules
+	}
+	return nil
+}
+
+func normalizeRules(rules map[string]validationRule) (map[string]validationRule, error) {
+	normalized := make(map[string]validationRule, len(rules))
+	for name, rule := range rules {
+		metric, err := metricField(name)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := normalized[metric]; ok {
+			return nil, fmt.Errorf("duplicate rule for %s", metric)
+		}
+		if err := rule.validate(); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		normalized[metric] = rule
+	}
+	return normalized, nil
+}
+
+func (r validationRule) validate() error {
+	if r.Min != nil && r.Max != nil && *r.Min > *r.Max {
+		return errors.New("min is above max")
+	}
+	if r.MaxRate < 0 {
+		return errors.New("max_rate must not be negative")
+	}
+	if r.SpikeWindow < 0 || r.SpikeWindow == 1 || r.SpikeWindow > 50 {
+		return errors.New("spike_window must be between 2 and 50")
+	}
+	if (r.SpikeWindow > 0) != (r.SpikeDelta > 0) {
+		return errors.New("spike_window and spike_delta must be given together")
+	}
+	return nil
+}
+
+// rule returns the rule of a metric for the device.
+func (c *validationConfig) rule(device, metric string) (validationRule, bool) {
+	if rules, ok := c.Devices[device]; ok {
+		if rule, ok := rules[metric]; ok {
+			return rule, true
+		}
+	}
+	rule, ok := c.Rules[metric]
+	return rule, ok
+}
+
+// readingHistory is what the rate and spike rules remember of a metric.
+type readingHistory struct {
+	lastValue     float64
+	lastTimestamp int64
+	accepted      bool
+	window        []float64 // previous in-range readings, oldest first
+}
+
+type readingFilter struct {
+	mu      sync.Mutex
+	history map[string]*readingHistory // device name + "/" + metric
+}
+
+var readingHistories = &readingFilter{history: make(map[string]*readingHistory)}
+
+// validateMeasurementImpl checks every field the measurement carries against
+// the rules of its device and returns the first violation, or nil. A
+// measurement is stored or rejected as a whole. Readings outside the range
+// are ignored by the spike filter, so a run of them can't pull the median
+// along; other rejected readings do count, so a genuine jump is accepted once
+// it lasts.
+func validateMeasurementImpl(device Device, m Measurement) *rejection {
+	config := validationSettings
+	if config == nil {
+		return nil
+	}
+
+	fields := m.readings()
+	metrics := make([]string, 0, len(fields))
+	for metric := range fields {
+		if _, ok := config.rule(device.Name, metric); ok {
+			metrics = append(metrics, metric)
+		}
+	}
+	sort.Strings(metrics)
+
+	readingHistories.mu.Lock()
+	defer readingHistories.mu.Unlock()
+
+	var first *rejection
+	var passed []string
+	for _, metric := range metrics {
+		rule, _ := config.rule(device.Name, metric)
+		value := fields[metric]
+		if r := checkRange(rule, metric, value); r != nil {
+			if first == nil {
+				first = r
+			}
+			continue
+		}
+
+		history := readingHistories.get(device.Name, metric)
+		r := checkRate(rule, history, metric, value, m.UnixTimestamp)
+		if r == nil {
+			r = checkSpike(rule, history, metric, value)
+		}
+		if rule.SpikeWindow > 0 {
+			history.window = append(history.window, value)
+			if len(history.window) > rule.SpikeWindow {
+				history.window = history.window[1:]
+			}
+		}
+		if r != nil {
+			if first == nil {
+				first = r
+			}
+			continue
+		}
+		passed = append(passed, metric)
+	}
+
+	// Only a stored measurement moves the rate baseline
+	if first == nil {
+		for _, metric := range passed {
+			history := readingHistories.get(device.Name, metric)
+			history.lastValue = fields[metric]
+			history.lastTimestamp = m.UnixTimestamp
+			history.accepted = true
+		}
+	}
+	return first
+}
+
+func (f *readingFilter) get(device, metric string) *readingHistory {
+	key := device + "/" + metric
+	history, ok := f.history[key]
+	if !ok {
+		history = &readingHistory{}
+		f.history[key] = history
+	}
+	return history
+}
+
+func checkRange(rule validationRule, metric string, value float64) *rejection {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return &rejection{Metric: metric, Value: value, Rule: rejectRange, Reason: fmt.Sprintf("%s is not a number", metric)}
+	}
+	if rule.Min != nil && value < *rule.Min {
+		return &rejection{Metric: metric, Value: value, Rule: rejectRange, Reason: fmt.Sprintf("%s %g is below %g", metric, value, *rule.Min)}
+	}
+	if rule.Max != nil && value > *rule.Max {
+		return &rejection{Metric: metric, Value: value, Rule: rejectRange, Reason: fmt.Sprintf("%s %g is above %g", metric, value, *rule.Max)}
+	}
+	return nil
+}
+
+// checkRate compares the reading with the last accepted one. The allowed
+// change grows with the time since, so the filter can't get stuck on a value
+// that really changed while readings were rejected.
+func checkRate(rule validationRule, history *readingHistory, metric string, value float64, timestamp int64) *rejection {
+	if rule.MaxRate == 0 || !history.accepted || timestamp <= history.lastTimestamp {
+		return nil
+	}
+	minutes := float64(timestamp-history.lastTimestamp) / float64(time.Minute.Milliseconds())
+	rate := math.Abs(value-history.lastValue) / minutes
+	if rate <= rule.MaxRate {
+		return nil
+	}
+	return &rejection{
+		Metric: metric,
+		Value:  value,
+		Rule:   rejectRate,
+		Reason: fmt.Sprintf("%s changed from %g to %g, %.3g per minute exceeds %g", metric, history.lastValue, value, rate, rule.MaxRate),
+	}
+}
+
+// checkSpike compares the reading with the median of the previous readings
+// once the window is full.
+func checkSpike(rule validationRule, history *readingHistory, metric string, value float64) *rejection {
+	if rule.SpikeWindow == 0 || len(history.window) < rule.SpikeWindow {
+		return nil
+	}
+	m := median(history.window)
+	if math.Abs(value-m) <= rule.SpikeDelta {
+		return nil
+	}
+	return &rejection{
+		Metric: metric,
+		Value:  value,
+		Rule:   rejectSpike,
+		Reason: fmt.Sprintf("%s %g is more than %g from the median %g of the last %d readings", metric, value, rule.SpikeDelta, m, len(history.window)),
+	}
+}
+
+func median(values []float64) float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
+
+// insertRejectedMeasurementImpl keeps a rejected reading with the reason and
+// the line it came from, so the rules can be tuned later.
+func insertRejectedMeasurementImpl(db *sql.DB, m Measurement, payload string, r *rejection) error {
+	if db == nil {
+		return errors.New("db is nil")
+	}
+	deviceID := sql.NullInt64{Int64: m.DeviceID, Valid: m.DeviceID != 0}
+	value := sql.NullFloat64{Float64: r.Value, Valid: !math.IsNaN(r.Value) && !math.IsInf(r.Value, 0)}
+	_, err := db.Exec(
+		"INSERT INTO rejected_measurements (timestamp, device_id, metric, value, rule, reason, payload) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		m.UnixTimestamp, deviceID, r.Metric, value, r.Rule, r.Reason, payload,
+	)
+	return err
+}
+
+// rejectMeasurement counts and stores a reading that failed validation.
+func rejectMeasurement(db *sql.DB, device Device, m Measurement, payload string, r *rejection) {
+	deviceStatuses.countRejected(device, r.Rule)
+	throttledLogWarn(&lastRejectWarn, "Rejected measurement from %s: %s", device.Name, r.Reason)
+	if err := insertRejectedMeasurement(db, m, payload, r); err != nil {
+		throttledLogError(&lastInsertErr, "Failed to store rejected measurement: %v", err)
+	}
+}
+
+// countRejectedMeasurements returns the stored rejections between since and
+// until by device and rule, of one device when deviceID is not 0.
+func countRejectedMeasurements(db *sql.DB, deviceID, since, until int64) ([]RejectedCount, error) {
+	rows, err := db.Query(`
+		SELECT COALESCE(d.name, ''), r.rule, COUNT(*), MAX(r.timestamp)
+		FROM rejected_measurements r LEFT JOIN devices d ON d.id = r.device_id
+		WHERE r.timestamp >= ? AND r.timestamp <= ? AND (? = 0 OR r.device_id = ?)
+		GROUP BY r.device_id, r.rule
+		ORDER BY 1, 2
+	`, since, until, deviceID, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := []RejectedCount{}
+	for rows.Next() {
+		var c RejectedCount
+		if err := rows.Scan(&c.Device, &c.Rule, &c.Count, &c.Last); err != nil {
+			return nil, err
+		}
+		counts = append(counts, c)
+	}
+	return counts, rows.Err()
+}
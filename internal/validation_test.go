@@ -0,0 +1,307 @@
+package main
+
+import (
+	"database/sql"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func withValidationRules(t *testing.T, config *validationConfig) {
+	t.Helper()
+	if err := config.normalize(); err != nil {
+		t.Fatalf("Invalid test config: %v", err)
+	}
+	origSettings := validationSettings
+	origHistories := readingHistories
+	validationSettings = config
+	readingHistories = &readingFilter{history: make(map[string]*readingHistory)}
+	t.Cleanup(func() {
+		validationSettings = origSettings
+		readingHistories = origHistories
+	})
+}
+
+func float(v float64) *float64 { return &v }
+
+func TestLoadValidationConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "validation.json")
+	os.WriteFile(path, []byte(`{
+		"rules": {
+			"temperature": {"min": -30, "max": 60, "max_rate": 2, "spike_window": 5, "spike_delta": 3},
+			"humidity": {"min": 1, "max": 100}
+		},
+		"devices": {"freezer": {"temperature": {"min": -40, "max": 10}}}
+	}`), 0o644)
+
+	config, err := loadValidationConfig(path)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	rule, ok := config.rule("greenhouse", temperatureField)
+	if !ok || *rule.Min != -30 || rule.MaxRate != 2 || rule.SpikeWindow != 5 {
+		t.Errorf("Unexpected default temperature rule %+v", rule)
+	}
+	rule, ok = config.rule("freezer", temperatureField)
+	if !ok || *rule.Min != -40 || rule.MaxRate != 0 {
+		t.Errorf("Expected the device rule to replace the default, got %+v", rule)
+	}
+	if rule, ok := config.rule("freezer", humidityField); !ok || *rule.Min != 1 {
+		t.Errorf("Expected the default humidity rule for freezer, got %+v", rule)
+	}
+	if _, ok := config.rule("freezer", "lux"); ok {
+		t.Error("Expected no rule for lux")
+	}
+
+	for _, content := range []string{
+		`{}`,
+		`{"rules": {"temperature": {"min": 5, "max": 1}}}`,
+		`{"rules": {"temperature": {"max_rate": -1}}}`,
+		`{"rules": {"temperature": {"spike_window": 5}}}`,
+		`{"rules": {"temperature": {"spike_window": 1, "spike_delta": 2}}}`,
+		`{"rules": {"temperature": {"min": 1}, "temperature_celcius": {"min": 2}}}`,
+		`{"rules": {"seq": {"min": 1}}}`,
+		`{"rules": {"temperature": {"minimum": 1}}}`,
+		`{"devices": {"freezer": {"bad name": {"min": 1}}}}`,
+	} {
+		os.WriteFile(path, []byte(content), 0o644)
+		if _, err := loadValidationConfig(path); err == nil {
+			t.Errorf("Expected error for %s", content)
+		}
+	}
+	if _, err := loadValidationConfig(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("Expected error for missing file")
+	}
+}
+
+func TestValidateMeasurement_Disabled(t *testing.T) {
+	withValidationRules(t, &validationConfig{Rules: map[string]validationRule{humidityField: {Min: float(1)}}})
+	validationSettings = nil
+	if r := validateMeasurement(Device{Name: "greenhouse"}, Measurement{}); r != nil {
+		t.Errorf("Expected no validation without config, got %+v", r)
+	}
+}
+
+func TestValidateMeasurement_Range(t *testing.T) {
+	withValidationRules(t, &validationConfig{
+		Rules: map[string]validationRule{
+			"temperature": {Min: float(-30), Max: float(60)},
+			"humidity":    {Min: float(1), Max: float(100)},
+			"lux":         {Max: float(100000)},
+		},
+		Devices: map[string]map[string]validationRule{"freezer": {"temperature": {Min: float(-45)}}},
+	})
+	device := Device{Name: "greenhouse"}
+
+	if r := validateMeasurement(device, Measurement{TemperatureCelsius: 21, HumidityPercentage: 40, Metrics: map[string]float64{"lux": 500}}); r != nil {
+		t.Errorf("Expected a plausible reading to pass, got %+v", r)
+	}
+	r := validateMeasurement(device, Measurement{TemperatureCelsius: -40, HumidityPercentage: 40})
+	if r == nil || r.Rule != rejectRange || r.Metric != temperatureField || r.Value != -40 || !strings.Contains(r.Reason, "below -30") {
+		t.Errorf("Expected -40 °C to be rejected, got %+v", r)
+	}
+	if r := validateMeasurement(device, Measurement{TemperatureCelsius: 21, HumidityPercentage: 0}); r == nil || r.Metric != humidityField {
+		t.Errorf("Expected 0 %% humidity to be rejected, got %+v", r)
+	}
+	if r := validateMeasurement(device, Measurement{TemperatureCelsius: 21, HumidityPercentage: 40, Metrics: map[string]float64{"lux": 200000}}); r == nil || r.Metric != "lux" || !strings.Contains(r.Reason, "above") {
+		t.Errorf("Expected lux above the range to be rejected, got %+v", r)
+	}
+	if r := validateMeasurement(device, Measurement{TemperatureCelsius: math.NaN(), HumidityPercentage: 40}); r == nil || r.Rule != rejectRange {
+		t.Errorf("Expected NaN to be rejected, got %+v", r)
+	}
+	if r := validateMeasurement(Device{Name: "freezer"}, Measurement{TemperatureCelsius: -40, HumidityPercentage: 40}); r != nil {
+		t.Errorf("Expected the freezer rule to allow -40 °C, got %+v", r)
+	}
+
+	temperatureOnly, err := deserializeData(`{"temperature_celcius":21}`)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if r := validateMeasurement(device, temperatureOnly); r != nil {
+		t.Errorf("Expected the humidity rule to skip a reading without humidity, got %+v", r)
+	}
+}
+
+func TestValidateMeasurement_Rate(t *testing.T) {
+	withValidationRules(t, &validationConfig{Rules: map[string]validationRule{"temperature": {MaxRate: 1}}})
+	device := Device{Name: "greenhouse"}
+	at := func(minutes float64, temperature float64) *rejection {
+		return validateMeasurement(device, Measurement{UnixTimestamp: int64(minutes * 60000), TemperatureCelsius: temperature})
+	}
+
+	if r := at(0, 20); r != nil {
+		t.Fatalf("Expected the first reading to pass, got %+v", r)
+	}
+	if r := at(1, 20.8); r != nil {
+		t.Errorf("Expected 0.8 °C per minute to pass, got %+v", r)
+	}
+	if r := at(2, 25); r == nil || r.Rule != rejectRate {
+		t.Errorf("Expected 4.2 °C per minute to be rejected, got %+v", r)
+	}
+	// Compared with the last accepted reading, the allowed change grows with time
+	if r := at(6, 25); r != nil {
+		t.Errorf("Expected 25 °C after 5 minutes to pass, got %+v", r)
+	}
+	// Readings out of order are not rate checked
+	if r := at(3, 10); r != nil {
+		t.Errorf("Expected an earlier reading to pass, got %+v", r)
+	}
+}
+
+func TestValidateMeasurement_Spike(t *testing.T) {
+	withValidationRules(t, &validationConfig{Rules: map[string]validationRule{"humidity": {SpikeWindow: 3, SpikeDelta: 5}}})
+	device := Device{Name: "greenhouse"}
+	check := func(humidity float64) *rejection {
+		return validateMeasurement(device, Measurement{HumidityPercentage: humidity})
+	}
+
+	for _, h := range []float64{50, 51, 52} {
+		if r := check(h); r != nil {
+			t.Fatalf("Expected %v to pass while the window fills, got %+v", h, r)
+		}
+	}
+	if r := check(80); r == nil || r.Rule != rejectSpike || !strings.Contains(r.Reason, "median 51") {
+		t.Errorf("Expected a spike to be rejected, got %+v", r)
+	}
+	if r := check(53); r != nil {
+		t.Errorf("Expected the reading after the spike to pass, got %+v", r)
+	}
+	// A lasting jump moves the median and is accepted
+	check(75)
+	check(75)
+	if r := check(75); r != nil {
+		t.Errorf("Expected a lasting jump to be accepted, got %+v", r)
+	}
+
+	// Other devices have their own window
+	if r := validateMeasurement(Device{Name: "cellar"}, Measurement{HumidityPercentage: 20}); r != nil {
+		t.Errorf("Expected another device to be unaffected, got %+v", r)
+	}
+}
+
+func TestValidateMeasurement_RejectedMeasurementKeepsBaseline(t *testing.T) {
+	withValidationRules(t, &validationConfig{Rules: map[string]validationRule{
+		"temperature": {MaxRate: 1},
+		"humidity":    {Min: float(1)},
+	}})
+	device := Device{Name: "greenhouse"}
+
+	validateMeasurement(device, Measurement{UnixTimestamp: 0, TemperatureCelsius: 20, HumidityPercentage: 40})
+	if r := validateMeasurement(device, Measurement{UnixTimestamp: 60000, TemperatureCelsius: 20.5, HumidityPercentage: 0}); r == nil || r.Metric != humidityField {
+		t.Fatalf("Expected humidity to be rejected, got %+v", r)
+	}
+	// 20.5 was not stored, so 21.5 is compared with 20 over two minutes
+	if r := validateMeasurement(device, Measurement{UnixTimestamp: 120000, TemperatureCelsius: 21.5, HumidityPercentage: 40}); r != nil {
+		t.Errorf("Expected 0.75 °C per minute from the stored reading to pass, got %+v", r)
+	}
+}
+
+func TestRejectedMeasurements(t *testing.T) {
+	tmpDB := "test_rejected_measurements.db"
+	defer os.Remove(tmpDB)
+	db, err := openDatabase(tmpDB)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	greenhouse := Device{Name: "greenhouse", Port: "/dev/ttyACM0"}
+	cellar := Device{Name: "cellar", Port: "/dev/ttyUSB0"}
+	registerDevice(db, &greenhouse)
+	registerDevice(db, &cellar)
+
+	for _, row := range []struct {
+		device    Device
+		timestamp int64
+		rule      string
+		value     float64
+	}{
+		{greenhouse, 1000, rejectRange, -40},
+		{greenhouse, 2000, rejectRange, math.NaN()},
+		{greenhouse, 3000, rejectSpike, 80},
+		{cellar, 4000, rejectRate, 30},
+	} {
+		m := Measurement{UnixTimestamp: row.timestamp, DeviceID: row.device.ID}
+		r := &rejection{Metric: temperatureField, Value: row.value, Rule: row.rule, Reason: "test"}
+		if err := insertRejectedMeasurement(db, m, `{"temperature_celcius":-40}`, r); err != nil {
+			t.Fatalf("Failed to store rejected measurement: %v", err)
+		}
+	}
+
+	var payload string
+	var value sql.NullFloat64
+	db.QueryRow("SELECT payload, value FROM rejected_measurements WHERE timestamp = 2000").Scan(&payload, &value)
+	if payload != `{"temperature_celcius":-40}` || value.Valid {
+		t.Errorf("Unexpected stored rejection %q %v", payload, value)
+	}
+
+	counts, err := countRejectedMeasurements(db, 0, 0, math.MaxInt64)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	expected := []RejectedCount{
+		{Device: "cellar", Rule: rejectRate, Count: 1, Last: 4000},
+		{Device: "greenhouse", Rule: rejectRange, Count: 2, Last: 2000},
+		{Device: "greenhouse", Rule: rejectSpike, Count: 1, Last: 3000},
+	}
+	if len(counts) != len(expected) {
+		t.Fatalf("Expected %d counts, got %+v", len(expected), counts)
+	}
+	for i := range expected {
+		if counts[i] != expected[i] {
+			t.Errorf("Count %d: expected %+v, got %+v", i, expected[i], counts[i])
+		}
+	}
+
+	counts, _ = countRejectedMeasurements(db, greenhouse.ID, 1500, 5000)
+	if len(counts) != 2 || counts[0].Count != 1 || counts[1].Rule != rejectSpike {
+		t.Errorf("Unexpected filtered counts %+v", counts)
+	}
+	if err := insertRejectedMeasurement(nil, Measurement{}, "", &rejection{}); err == nil {
+		t.Error("Expected error for nil db")
+	}
+}
+
+func TestHandleDeviceLine_RejectsImplausible(t *testing.T) {
+	withValidationRules(t, &validationConfig{Rules: map[string]validationRule{"humidity": {Min: float(1)}}})
+	origStatuses := deviceStatuses
+	deviceStatuses = newStatusRegistry()
+	origLogWarn := logWarn
+	logWarn = func(format string, v ...any) {}
+	origPrint := printToConsole
+	printToConsole = func(m Measurement, w *Weather) {}
+	defer func() {
+		deviceStatuses = origStatuses
+		logWarn = origLogWarn
+		printToConsole = origPrint
+	}()
+
+	tmpDB := "test_handle_rejected.db"
+	defer os.Remove(tmpDB)
+	db, err := openDatabase(tmpDB)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+	device := Device{Name: "greenhouse", Port: "/dev/ttyACM0"}
+	registerDevice(db, &device)
+
+	handleDeviceLine(device, `{"temperature_celcius":21.0,"humidity":40.0}`, db, &Weather{}, nil)
+	handleDeviceLine(device, `{"temperature_celcius":-40.0,"humidity":0.0}`, db, &Weather{}, nil)
+
+	var stored, rejected int
+	var reason, payload string
+	db.QueryRow("SELECT COUNT(*) FROM measurements").Scan(&stored)
+	db.QueryRow("SELECT COUNT(*), MAX(reason), MAX(payload) FROM rejected_measurements").Scan(&rejected, &reason, &payload)
+	if stored != 1 || rejected != 1 {
+		t.Errorf("Expected 1 stored and 1 rejected measurement, got %d and %d", stored, rejected)
+	}
+	if !strings.Contains(reason, "humidity 0 is below 1") || payload != `{"temperature_celcius":-40.0,"humidity":0.0}` {
+		t.Errorf("Unexpected rejection %q for %q", reason, payload)
+	}
+	if counts := deviceStatuses.snapshot()[0].Rejected; counts != (RejectCounts{Range: 1}) {
+		t.Errorf("Unexpected reject counts %+v", counts)
+	}
+}
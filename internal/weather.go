@@ -89,15 +89,20 @@ weatherInit:
 			if err == nil {
 				*latestWeather = w
 				*latestWeatherTimestamp = time.Now().UnixMilli()
-				err := insertWeather(db, *latestWeather, *latestWeatherTimestamp)
+				err := storageFor(db).InsertWeather(*latestWeather, *latestWeatherTimestamp)
 				if err != nil {
+					daemonMetrics.countInsertFailures(1)
 					logError("Failed to insert initial weather data: %v", err)
 				} else {
 					logInfo("Initial weather data fetched and stored successfully")
+					publishWeather(*latestWeather, *latestWeatherTimestamp)
+					pushWeatherToInflux(*latestWeather, *latestWeatherTimestamp)
+					daemonMetrics.recordWeather(*latestWeather, *latestWeatherTimestamp)
 				}
 
 				break weatherInit
 			}
+			daemonMetrics.countWeatherFetchFailure()
 			logError("Initial weather fetch failed, retrying in 5s: %v", err)
 			time.Sleep(weatherFetchRetryDelay)
 		}
@@ -117,11 +122,17 @@ weatherInit:
 				if err == nil {
 					*latestWeather = w
 					*latestWeatherTimestamp = ts
-					err := insertWeather(db, *latestWeather, *latestWeatherTimestamp)
+					err := storageFor(db).InsertWeather(*latestWeather, *latestWeatherTimestamp)
 					if err != nil {
+						daemonMetrics.countInsertFailures(1)
 						throttledLogError(&lastWeatherErr, "Failed to insert weather data: %v", err)
+					} else {
+						publishWeather(*latestWeather, *latestWeatherTimestamp)
+						pushWeatherToInflux(*latestWeather, *latestWeatherTimestamp)
+						daemonMetrics.recordWeather(*latestWeather, *latestWeatherTimestamp)
 					}
 				} else {
+					daemonMetrics.countWeatherFetchFailure()
 					throttledLogError(&lastWeatherErr, "Failed to get weather data for city %s: %v", city, err)
 				}
 			}
@@ -4,8 +4,15 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"math"
+	"mime"
 	"net/http"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -14,9 +21,15 @@ import (
 )
 
 type Result struct {
+	DeviceID            int64
+	Device              string
 	AggregatedTimestamp int64
 	AvgTemperature      float64
+	MinTemperature      float64
+	MaxTemperature      float64
 	AvgHumidity         float64
+	MinHumidity         float64
+	MaxHumidity         float64
 	City                string
 	AvgWeatherTemp      float64
 	AvgWeatherHumidity  float64
@@ -25,6 +38,8 @@ type Result struct {
 	AvgClouds           float64
 	AvgWeatherCode      float64
 	Description         string
+	MeasurementID       int64              `json:"-"`
+	Metrics             map[string]float64 `json:"Metrics,omitempty" gorm:"-"`
 }
 
 var startDashboardServer = startDashboardServerImpl
@@ -58,30 +73,293 @@ func startDashboardServerImpl(ctx context.Context, db *sql.DB, wg *sync.WaitGrou
 	}()
 }
 
+// deviceParam returns the device named by the "device" query parameter,
+// nil when there is none. It returns false after writing an error response
+// when the device does not exist.
+func deviceParam(db *sql.DB, w http.ResponseWriter, r *http.Request) (*Device, bool) {
+	key := r.URL.Query().Get("device")
+	if key == "" {
+		return nil, true
+	}
+
+	device, err := lookupDevice(db, key)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Unknown device", http.StatusNotFound)
+		return nil, false
+	}
+	if err != nil {
+		http.Error(w, "DB query error", 500)
+		logError("DB query error: %v", err)
+		return nil, false
+	}
+	return &device, true
+}
+
+// bearerDevice returns the device the request's bearer token was issued for.
+// It returns false after writing an error response when there is no valid
+// token.
+func bearerDevice(db *sql.DB, w http.ResponseWriter, r *http.Request) (Device, bool) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		http.Error(w, "Missing bearer token", http.StatusUnauthorized)
+		return Device{}, false
+	}
+	device, err := deviceForToken(db, strings.TrimSpace(token))
+	if errors.Is(err, errInvalidToken) {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return Device{}, false
+	}
+	if err != nil {
+		http.Error(w, "DB query error", 500)
+		logError("DB query error: %v", err)
+		return Device{}, false
+	}
+	return device, true
+}
+
+// millisParam parses an optional Unix milliseconds query parameter.
+func millisParam(r *http.Request, name string, fallback int64) (int64, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return fallback, nil
+	}
+	ms, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q, expected Unix milliseconds", name, value)
+	}
+	return ms, nil
+}
+
 func serveAPI(db *gorm.DB, mux *http.ServeMux) {
+	mux.HandleFunc("/api/devices", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Content-Type", "application/json")
+
+		devices := []Device{}
+		err := db.Table("devices").
+			Select("id, name, COALESCE(port, '') AS port, COALESCE(location, '') AS location, created_at").
+			Order("id").
+			Scan(&devices).Error
+		if err != nil {
+			http.Error(w, "DB query error", 500)
+			logError("DB query error: %v", err)
+			return
+		}
+
+		json.NewEncoder(w).Encode(devices)
+	})
+
+	// Commands change what devices do, so unlike the read-only routes this
+	// one sends no CORS header and needs the device's token
+	mux.HandleFunc("POST /api/devices/{device}/commands", func(w http.ResponseWriter, r *http.Request) {
+		if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+			http.Error(w, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		var cmd DeviceCommand
+		if err := json.NewDecoder(r.Body).Decode(&cmd); err != nil {
+			http.Error(w, "Invalid command: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := cmd.validate(); err != nil {
+			http.Error(w, "Invalid command: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		sqlDB, err := db.DB()
+		if err != nil {
+			http.Error(w, "DB query error", 500)
+			logError("DB query error: %v", err)
+			return
+		}
+		authorized, ok := bearerDevice(sqlDB, w, r)
+		if !ok {
+			return
+		}
+		device, err := lookupDevice(sqlDB, r.PathValue("device"))
+		if err == sql.ErrNoRows {
+			http.Error(w, "Unknown device", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "DB query error", 500)
+			logError("DB query error: %v", err)
+			return
+		}
+		if authorized.ID != device.ID {
+			http.Error(w, "Token is not valid for this device", http.StatusForbidden)
+			return
+		}
+
+		reply, err := sendDeviceCommand(r.Context(), device.Name, cmd)
+		switch {
+		case errors.Is(err, errDeviceNotConnected):
+			http.Error(w, "Device not connected", http.StatusServiceUnavailable)
+			return
+		case errors.Is(err, errCommandTimeout):
+			http.Error(w, "Device did not answer in time", http.StatusGatewayTimeout)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"device":  device.Name,
+			"command": cmd.Command,
+			"reply":   reply,
+		})
+	})
+
+	mux.HandleFunc("/metrics", serveMetrics)
+
+	mux.HandleFunc("/api/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Content-Type", "application/json")
+
+		response := map[string]any{
+			"devices": deviceStatuses.snapshot(),
+		}
+		if writer := activeWriter.Load(); writer != nil {
+			response["writer"] = writer.status()
+		}
+
+		json.NewEncoder(w).Encode(response)
+	})
+
+	mux.HandleFunc("POST /api/measurements", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		sqlDB, err := db.DB()
+		if err != nil {
+			http.Error(w, "DB query error", 500)
+			logError("DB query error: %v", err)
+			return
+		}
+
+		device, ok := bearerDevice(sqlDB, w, r)
+		if !ok {
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxIngestBodyBytes))
+		if err != nil {
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		measurements, err := parseIngestBody(body, device, time.Now().UnixMilli())
+		if err != nil {
+			http.Error(w, "Invalid measurements: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		accepted := measurements[:0]
+		for i, m := range measurements {
+			if err := calibrateMeasurement(sqlDB, &m); err != nil {
+				http.Error(w, "DB query error", 500)
+				// Every measurement not rejected so far is lost
+				daemonMetrics.countInsertFailures(len(measurements) - i + len(accepted))
+				logError("Failed to load calibrations of %s: %v", device.Name, err)
+				return
+			}
+			if r := validateMeasurement(device, m); r != nil {
+				payload, _ := json.Marshal(measurementState(m))
+				rejectMeasurement(sqlDB, device, m, string(payload), r)
+				continue
+			}
+			accepted = append(accepted, m)
+		}
+		rejected := len(measurements) - len(accepted)
+
+		if len(accepted) > 0 {
+			if err := storageFor(sqlDB).InsertMeasurementBatch(accepted); err != nil {
+				http.Error(w, "DB insert error", 500)
+				daemonMetrics.countInsertFailures(len(accepted))
+				logError("Failed to insert pushed measurements from %s: %v", device.Name, err)
+				return
+			}
+		}
+		logInfo("Stored %d measurement(s) pushed by %s", len(accepted), device.Name)
+		for _, m := range accepted {
+			publishMeasurement(device, m)
+			pushMeasurementToInflux(device, m)
+			daemonMetrics.recordMeasurement(device, m)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]any{
+			"device":   device.Name,
+			"stored":   len(accepted),
+			"rejected": rejected,
+		})
+	})
+
+	mux.HandleFunc("/api/measurements/rejected", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Content-Type", "application/json")
+
+		sqlDB, err := db.DB()
+		if err != nil {
+			http.Error(w, "DB query error", 500)
+			logError("DB query error: %v", err)
+			return
+		}
+		var deviceID int64
+		if key := r.URL.Query().Get("device"); key != "" {
+			device, err := lookupDevice(sqlDB, key)
+			if err == sql.ErrNoRows {
+				http.Error(w, "Unknown device", http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				http.Error(w, "DB query error", 500)
+				logError("DB query error: %v", err)
+				return
+			}
+			deviceID = device.ID
+		}
+		since, err := millisParam(r, "from", 0)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		until, err := millisParam(r, "to", math.MaxInt64)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		counts, err := countRejectedMeasurements(sqlDB, deviceID, since, until)
+		if err != nil {
+			http.Error(w, "DB query error", 500)
+			logError("DB query error: %v", err)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{
+			"rejected": counts,
+		})
+	})
+
 	mux.HandleFunc("/api/measurements/latest", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Content-Type", "application/json")
 
+		sqlDB, err := db.DB()
+		if err != nil {
+			http.Error(w, "DB query error", 500)
+			logError("DB query error: %v", err)
+			return
+		}
+		device, ok := deviceParam(sqlDB, w, r)
+		if !ok {
+			return
+		}
+
 		derivativeLastMeasurementCount := 10
 
-		var results []Result
-		err := db.Model(&Measurement{}).
-			Select(`measurements.timestamp AS aggregated_timestamp,
-            measurements.temperature AS avg_temperature,
-            measurements.humidity AS avg_humidity,
-            weather.city AS city,
-            weather.temp AS avg_weather_temp,
-            weather.humidity AS avg_weather_humidity,
-            weather.wind_speed AS avg_wind_speed,
-            weather.wind_deg AS avg_wind_deg,
-            weather.clouds AS avg_clouds,
-            weather.weather_code AS avg_weather_code,
-            weather.description AS description`).
-			Joins("LEFT JOIN weather ON measurements.weather_id = weather.id").
-			Order("measurements.timestamp DESC").
-			Limit(derivativeLastMeasurementCount).
-			Scan(&results).Error
+		results, err := storageFor(sqlDB).LatestMeasurements(device, derivativeLastMeasurementCount)
 		if err != nil || len(results) == 0 {
 			http.Error(w, "DB query error", 500)
 			logError("DB query error: %v", err)
@@ -107,6 +385,17 @@ func serveAPI(db *gorm.DB, mux *http.ServeMux) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Content-Type", "application/json")
 
+		sqlDB, err := db.DB()
+		if err != nil {
+			http.Error(w, "DB query error", 500)
+			logError("DB query error: %v", err)
+			return
+		}
+		device, ok := deviceParam(sqlDB, w, r)
+		if !ok {
+			return
+		}
+
 		rangeParam := r.URL.Query().Get("range")
 		now := time.Now()
 		var since int64
@@ -141,9 +430,7 @@ func serveAPI(db *gorm.DB, mux *http.ServeMux) {
 			intervalSeconds = 60
 		case "12h", "24h", "today":
 			intervalSeconds = 60
-		case "week":
-			intervalSeconds = 3600
-		case "month", "year":
+		case "week", "month", "year":
 			intervalSeconds = 86400
 		default:
 			intervalSeconds = 86400
@@ -151,56 +438,11 @@ func serveAPI(db *gorm.DB, mux *http.ServeMux) {
 
 		end := now.UnixMilli()
 
-		var results []Result
-
-		if rangeParam == "week" || rangeParam == "month" || rangeParam == "year" {
-			// Daily bucket
-			err := db.Model(&Measurement{}).
-				Select(`CAST((measurements.timestamp / 1000) / 86400 AS INTEGER) * 86400 * 1000 AS aggregated_timestamp,
-                AVG(measurements.temperature) AS avg_temperature,
-                AVG(measurements.humidity) AS avg_humidity,
-                MAX(weather.city) AS city,
-                AVG(weather.temp) AS avg_weather_temp,
-                AVG(weather.humidity) AS avg_weather_humidity,
-                AVG(weather.wind_speed) AS avg_wind_speed,
-                AVG(weather.wind_deg) AS avg_wind_deg,
-                AVG(weather.clouds) AS avg_clouds,
-                AVG(weather.weather_code) AS avg_weather_code,
-                MAX(weather.description) AS description`).
-				Joins("LEFT JOIN weather ON measurements.weather_id = weather.id").
-				Where("measurements.timestamp >= ? AND measurements.timestamp <= ?", since, end).
-				Group("aggregated_timestamp").
-				Having("COUNT(temperature) > 0").
-				Scan(&results).Error
-			if err != nil {
-				http.Error(w, "DB query error", 500)
-				logError("DB query error: %v", err)
-				return
-			}
-		} else {
-			// Flexible bucket using intervalSeconds
-			err := db.Model(&Measurement{}).
-				Select(`(strftime('%s', datetime(measurements.timestamp / 1000, 'unixepoch')) / ? ) * ? * 1000 AS aggregated_timestamp,
-                AVG(measurements.temperature) AS avg_temperature,
-                AVG(measurements.humidity) AS avg_humidity,
-                MAX(weather.city) AS city,
-                AVG(weather.temp) AS avg_weather_temp,
-                AVG(weather.humidity) AS avg_weather_humidity,
-                AVG(weather.wind_speed) AS avg_wind_speed,
-                AVG(weather.wind_deg) AS avg_wind_deg,
-                AVG(weather.clouds) AS avg_clouds,
-                AVG(weather.weather_code) AS avg_weather_code,
-                MAX(weather.description) AS description`, intervalSeconds, intervalSeconds).
-				Joins("LEFT JOIN weather ON measurements.weather_id = weather.id").
-				Where("measurements.timestamp >= ? AND measurements.timestamp <= ?", since, end).
-				Group("aggregated_timestamp").
-				Having("COUNT(temperature) > 0").
-				Scan(&results).Error
-			if err != nil {
-				http.Error(w, "DB query error", 500)
-				logError("DB query error: %v", err)
-				return
-			}
+		results, err := storageFor(sqlDB).QueryBuckets(device, since, end, int64(intervalSeconds))
+		if err != nil {
+			http.Error(w, "DB query error", 500)
+			logError("DB query error: %v", err)
+			return
 		}
 
 		w.Header().Set("Content-Type", "application/json")
@@ -7,6 +7,7 @@ import (
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"strings"
 	"sync"
 	"testing"
@@ -26,15 +27,14 @@ func TestStartDashboardServer(t *testing.T) {
 	// Use a random port for testing
 	port := 8080
 
-	// Start the server in a goroutine
-	ctx := context.Background()
+	// Start the server and shut it down when the test ends
+	ctx, cancel := context.WithCancel(context.Background())
 	var wg sync.WaitGroup
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		startDashboardServer(ctx, db, &wg)
+	defer func() {
+		cancel()
+		wg.Wait()
 	}()
-	wg.Wait()
+	startDashboardServer(ctx, db, &wg)
 
 	// Give the server a moment to start
 	time.Sleep(200 * time.Millisecond)
@@ -353,3 +353,501 @@ func TestGetLatestMeasurement(t *testing.T) {
 		t.Error("Expected latest measurement in response")
 	}
 }
+
+func TestServeAPI_DeviceFilter(t *testing.T) {
+	db, err := openDatabase(":memory:")
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	greenhouse := Device{Name: "greenhouse", Port: "/dev/ttyACM0"}
+	cellar := Device{Name: "cellar", Port: "/dev/ttyACM1"}
+	for _, d := range []*Device{&greenhouse, &cellar} {
+		if err := registerDevice(db, d); err != nil {
+			t.Fatalf("Failed to register device: %v", err)
+		}
+	}
+
+	now := time.Now().UnixMilli()
+	if err := insertMeasurement(db, Measurement{TemperatureCelsius: 30.5, HumidityPercentage: 70, DeviceID: greenhouse.ID}, now); err != nil {
+		t.Fatalf("Failed to insert measurement: %v", err)
+	}
+	if err := insertMeasurement(db, Measurement{TemperatureCelsius: 4.5, HumidityPercentage: 90, DeviceID: cellar.ID}, now); err != nil {
+		t.Fatalf("Failed to insert measurement: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	gormDB, err := gorm.Open(sqlite.Dialector{Conn: db}, &gorm.Config{})
+	if err != nil {
+		t.Fatalf("Failed to initialize GORM DB: %v", err)
+	}
+	serveAPI(gormDB, mux)
+
+	// Without a filter there is one series per device
+	req := httptest.NewRequest("GET", "/api/measurements?range=1h", nil)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	var all []Result
+	if err := json.Unmarshal(w.Body.Bytes(), &all); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	if len(all) != 2 {
+		t.Fatalf("Expected 2 buckets (one per device), got %d: %s", len(all), w.Body.String())
+	}
+
+	req = httptest.NewRequest("GET", "/api/measurements?range=1h&device=cellar", nil)
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	var filtered []Result
+	if err := json.Unmarshal(w.Body.Bytes(), &filtered); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	if len(filtered) != 1 || filtered[0].Device != "cellar" || filtered[0].AvgTemperature != 4.5 {
+		t.Errorf("Expected only cellar data, got %+v", filtered)
+	}
+
+	req = httptest.NewRequest("GET", "/api/measurements/latest?device=greenhouse", nil)
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	var latest struct {
+		Latest Result `json:"latest"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &latest); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	if latest.Latest.Device != "greenhouse" || latest.Latest.AvgTemperature != 30.5 {
+		t.Errorf("Expected latest greenhouse measurement, got %+v", latest.Latest)
+	}
+
+	req = httptest.NewRequest("GET", "/api/measurements?device=sauna", nil)
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for unknown device, got %d", w.Code)
+	}
+}
+
+func TestServeAPI_Devices(t *testing.T) {
+	db, err := openDatabase(":memory:")
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	device := Device{Name: "sauna", Port: "/dev/ttyACM2", Location: "Basement"}
+	if err := registerDevice(db, &device); err != nil {
+		t.Fatalf("Failed to register device: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	gormDB, err := gorm.Open(sqlite.Dialector{Conn: db}, &gorm.Config{})
+	if err != nil {
+		t.Fatalf("Failed to initialize GORM DB: %v", err)
+	}
+	serveAPI(gormDB, mux)
+
+	req := httptest.NewRequest("GET", "/api/devices", nil)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+
+	var devices []Device
+	if err := json.Unmarshal(w.Body.Bytes(), &devices); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	if len(devices) != 1 || devices[0].Name != "sauna" || devices[0].Location != "Basement" {
+		t.Errorf("Unexpected devices: %+v", devices)
+	}
+}
+
+func TestServeAPI_Status(t *testing.T) {
+	origStatuses := deviceStatuses
+	origLogInfo := logInfo
+	deviceStatuses = newStatusRegistry()
+	logInfo = func(format string, args ...interface{}) {}
+	defer func() {
+		deviceStatuses = origStatuses
+		logInfo = origLogInfo
+	}()
+
+	deviceStatuses.setLink(Device{Name: "cellar", Port: "/dev/ttyACM1"}, LinkReconnecting, fmt.Errorf("no serial ports found"))
+
+	db, err := openDatabase(":memory:")
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	mux := http.NewServeMux()
+	gormDB, err := gorm.Open(sqlite.Dialector{Conn: db}, &gorm.Config{})
+	if err != nil {
+		t.Fatalf("Failed to initialize GORM DB: %v", err)
+	}
+	serveAPI(gormDB, mux)
+
+	req := httptest.NewRequest("GET", "/api/status", nil)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+
+	var resp struct {
+		Devices []DeviceStatus `json:"devices"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	if len(resp.Devices) != 1 || resp.Devices[0].Link != LinkReconnecting || resp.Devices[0].Port != "/dev/ttyACM1" {
+		t.Errorf("Unexpected status response: %s", w.Body.String())
+	}
+}
+
+func TestServeAPI_Metrics(t *testing.T) {
+	db, err := openDatabase(":memory:")
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	now := time.Now().UnixMilli()
+	for i, lux := range []float64{100, 200} {
+		m := Measurement{TemperatureCelsius: 21.0, HumidityPercentage: 40.0, Metrics: map[string]float64{"lux": lux}}
+		if err := insertMeasurement(db, m, now-int64(1-i)*1000); err != nil {
+			t.Fatalf("Failed to insert measurement: %v", err)
+		}
+	}
+
+	mux := http.NewServeMux()
+	gormDB, err := gorm.Open(sqlite.Dialector{Conn: db}, &gorm.Config{})
+	if err != nil {
+		t.Fatalf("Failed to initialize GORM DB: %v", err)
+	}
+	serveAPI(gormDB, mux)
+
+	for _, r := range []string{"1h", "week"} {
+		req := httptest.NewRequest("GET", "/api/measurements?range="+r, nil)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+
+		var results []Result
+		if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil {
+			t.Fatalf("Failed to unmarshal response: %v", err)
+		}
+		if len(results) != 1 || results[0].Metrics["lux"] != 150 {
+			t.Errorf("Expected averaged lux of 150 for range %s, got %s", r, w.Body.String())
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/api/measurements/latest", nil)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	var latest struct {
+		Latest Result `json:"latest"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &latest); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	if latest.Latest.Metrics["lux"] != 200 {
+		t.Errorf("Expected latest lux 200, got %s", w.Body.String())
+	}
+}
+
+func TestServeAPI_DeviceCommand(t *testing.T) {
+	origSendDeviceCommand := sendDeviceCommand
+	var sent DeviceCommand
+	sendDeviceCommand = func(ctx context.Context, device string, cmd DeviceCommand) (map[string]any, error) {
+		sent = cmd
+		switch device {
+		case "greenhouse":
+			return map[string]any{"ok": true, "version": "1.2.0"}, nil
+		case "cellar":
+			return nil, errDeviceNotConnected
+		default:
+			return nil, errCommandTimeout
+		}
+	}
+	defer func() { sendDeviceCommand = origSendDeviceCommand }()
+
+	tmpDB := "test_device_command.db"
+	defer os.Remove(tmpDB)
+	db, err := openDatabase(tmpDB)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+	tokens := map[string]string{}
+	for _, name := range []string{"greenhouse", "cellar", "sauna"} {
+		if err := registerDevice(db, &Device{Name: name, Port: "/dev/null"}); err != nil {
+			t.Fatalf("Failed to register device: %v", err)
+		}
+		token, err := issueDeviceToken(db, name)
+		if err != nil {
+			t.Fatalf("Failed to issue token: %v", err)
+		}
+		tokens[name] = token
+	}
+
+	mux := http.NewServeMux()
+	gormDB, err := gorm.Open(sqlite.Dialector{Conn: db}, &gorm.Config{})
+	if err != nil {
+		t.Fatalf("Failed to initialize GORM DB: %v", err)
+	}
+	serveAPI(gormDB, mux)
+
+	cases := []struct {
+		device      string
+		token       string
+		contentType string
+		body        string
+		status      int
+	}{
+		{"greenhouse", tokens["greenhouse"], "application/json", `{"command":"version"}`, http.StatusOK},
+		{"1", tokens["greenhouse"], "application/json; charset=utf-8", `{"command":"interval","value":60}`, http.StatusOK},
+		{"cellar", tokens["cellar"], "application/json", `{"command":"read"}`, http.StatusServiceUnavailable},
+		{"sauna", tokens["sauna"], "application/json", `{"command":"reboot"}`, http.StatusGatewayTimeout},
+		{"attic", tokens["greenhouse"], "application/json", `{"command":"read"}`, http.StatusNotFound},
+		{"greenhouse", tokens["greenhouse"], "application/json", `{"command":"interval"}`, http.StatusBadRequest},
+		{"greenhouse", tokens["greenhouse"], "application/json", `not json`, http.StatusBadRequest},
+		{"greenhouse", "", "application/json", `{"command":"read"}`, http.StatusUnauthorized},
+		{"greenhouse", "wrong", "application/json", `{"command":"read"}`, http.StatusUnauthorized},
+		{"greenhouse", tokens["cellar"], "application/json", `{"command":"read"}`, http.StatusForbidden},
+		{"greenhouse", tokens["greenhouse"], "text/plain", `{"command":"reboot"}`, http.StatusUnsupportedMediaType},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("POST", "/api/devices/"+c.device+"/commands", strings.NewReader(c.body))
+		req.Header.Set("Content-Type", c.contentType)
+		if c.token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.token)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		if w.Code != c.status {
+			t.Errorf("%s %s: expected status %d, got %d (%s)", c.device, c.body, c.status, w.Code, w.Body.String())
+		}
+		if origin := w.Header().Get("Access-Control-Allow-Origin"); origin != "" {
+			t.Errorf("Expected no CORS header on commands, got %q", origin)
+		}
+	}
+	if sent.Command != commandReboot {
+		t.Errorf("Expected last command sent to be reboot, got %+v", sent)
+	}
+
+	req := httptest.NewRequest("POST", "/api/devices/greenhouse/commands", strings.NewReader(`{"command":"version"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+tokens["greenhouse"])
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	var resp struct {
+		Device string         `json:"device"`
+		Reply  map[string]any `json:"reply"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	if resp.Device != "greenhouse" || resp.Reply["version"] != "1.2.0" {
+		t.Errorf("Unexpected response: %s", w.Body.String())
+	}
+}
+
+func TestServeAPI_IngestMeasurements(t *testing.T) {
+	origLogInfo := logInfo
+	logInfo = func(format string, v ...any) {}
+	defer func() { logInfo = origLogInfo }()
+
+	tmpDB := "test_ingest_measurements.db"
+	defer os.Remove(tmpDB)
+	db, err := openDatabase(tmpDB)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	token, err := issueDeviceToken(db, "pi-zero")
+	if err != nil {
+		t.Fatalf("Failed to issue token: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	gormDB, err := gorm.Open(sqlite.Dialector{Conn: db}, &gorm.Config{})
+	if err != nil {
+		t.Fatalf("Failed to initialize GORM DB: %v", err)
+	}
+	serveAPI(gormDB, mux)
+
+	post := func(authorization, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/measurements", strings.NewReader(body))
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+
+	batch := `{"temperature_celcius":20.0,"humidity":40.0,"lux":12}
+{"temperature_celcius":20.5,"humidity":41.0}`
+	w := post("Bearer "+token, batch)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		Device string `json:"device"`
+		Stored int    `json:"stored"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp.Device != "pi-zero" || resp.Stored != 2 {
+		t.Errorf("Unexpected response: %s", w.Body.String())
+	}
+
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM measurements m JOIN devices d ON d.id = m.device_id WHERE d.name = 'pi-zero'").Scan(&count)
+	if count != 2 {
+		t.Errorf("Expected 2 stored measurements for pi-zero, got %d", count)
+	}
+
+	if w := post("", batch); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without token, got %d", w.Code)
+	}
+	if w := post("Bearer not-a-token", batch); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for wrong token, got %d", w.Code)
+	}
+
+	// One invalid line rejects the whole batch
+	if w := post("Bearer "+token, batch+"\n{\"humidity\":\"wet\"}"); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for invalid measurement, got %d", w.Code)
+	}
+	db.QueryRow("SELECT COUNT(*) FROM measurements").Scan(&count)
+	if count != 2 {
+		t.Errorf("Expected nothing stored from the rejected batch, got %d rows", count)
+	}
+
+	if w := post("Bearer "+token, strings.Repeat(" ", maxIngestBodyBytes+1)); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413 for oversized body, got %d", w.Code)
+	}
+}
+
+func TestServeAPI_RejectedMeasurements(t *testing.T) {
+	withValidationRules(t, &validationConfig{Rules: map[string]validationRule{"humidity": {Min: float(1), Max: float(100)}}})
+	origLogInfo, origLogWarn := logInfo, logWarn
+	logInfo = func(format string, v ...any) {}
+	logWarn = func(format string, v ...any) {}
+	defer func() { logInfo, logWarn = origLogInfo, origLogWarn }()
+
+	tmpDB := "test_rejected_api.db"
+	defer os.Remove(tmpDB)
+	db, err := openDatabase(tmpDB)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	token, err := issueDeviceToken(db, "pi-zero")
+	if err != nil {
+		t.Fatalf("Failed to issue token: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	gormDB, err := gorm.Open(sqlite.Dialector{Conn: db}, &gorm.Config{})
+	if err != nil {
+		t.Fatalf("Failed to initialize GORM DB: %v", err)
+	}
+	serveAPI(gormDB, mux)
+
+	req := httptest.NewRequest("POST", "/api/measurements", strings.NewReader(`{"temperature_celcius":20.0,"humidity":40.0,"ts":1000}
+{"temperature_celcius":-40.0,"humidity":0.0,"ts":2000}
+{"temperature_celcius":20.5,"humidity":41.0,"ts":3000}`))
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		Stored   int `json:"stored"`
+		Rejected int `json:"rejected"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp.Stored != 2 || resp.Rejected != 1 {
+		t.Errorf("Unexpected response: %s", w.Body.String())
+	}
+
+	get := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", "/api/measurements/rejected"+query, nil))
+		return w
+	}
+	w = get("?device=pi-zero")
+	var counts struct {
+		Rejected []RejectedCount `json:"rejected"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &counts)
+	if w.Code != http.StatusOK || len(counts.Rejected) != 1 || counts.Rejected[0] != (RejectedCount{Device: "pi-zero", Rule: rejectRange, Count: 1, Last: 2000}) {
+		t.Errorf("Unexpected rejected counts %d: %s", w.Code, w.Body.String())
+	}
+	w = get("?from=2500")
+	if !strings.Contains(w.Body.String(), `"rejected":[]`) {
+		t.Errorf("Expected no rejections after 2500, got %s", w.Body.String())
+	}
+	if w := get("?device=nowhere"); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for unknown device, got %d", w.Code)
+	}
+	if w := get("?to=yesterday"); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for invalid to, got %d", w.Code)
+	}
+}
+
+func TestServeAPI_IngestPushesToInflux(t *testing.T) {
+	origLogInfo := logInfo
+	logInfo = func(format string, v ...any) {}
+	defer func() { logInfo = origLogInfo }()
+
+	var pushed []string
+	origPush := pushMeasurementToInflux
+	pushMeasurementToInflux = func(device Device, m Measurement) {
+		pushed = append(pushed, fmt.Sprintf("%s %.1f", device.Name, m.TemperatureCelsius))
+	}
+	defer func() { pushMeasurementToInflux = origPush }()
+
+	tmpDB := "test_ingest_influx.db"
+	defer os.Remove(tmpDB)
+	db, err := openDatabase(tmpDB)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	token, err := issueDeviceToken(db, "pi-zero")
+	if err != nil {
+		t.Fatalf("Failed to issue token: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	gormDB, err := gorm.Open(sqlite.Dialector{Conn: db}, &gorm.Config{})
+	if err != nil {
+		t.Fatalf("Failed to initialize GORM DB: %v", err)
+	}
+	serveAPI(gormDB, mux)
+
+	post := func(body string) int {
+		req := httptest.NewRequest("POST", "/api/measurements", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if code := post(`{"temperature_celcius":20.0,"humidity":40.0}
+{"temperature_celcius":20.5,"humidity":41.0}`); code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d", code)
+	}
+	if strings.Join(pushed, "|") != "pi-zero 20.0|pi-zero 20.5" {
+		t.Errorf("Expected both stored measurements pushed to InfluxDB, got %q", pushed)
+	}
+
+	// Nothing is pushed from a batch that is not stored
+	pushed = nil
+	if code := post(`{"humidity":"wet"}`); code != http.StatusBadRequest {
+		t.Fatalf("Expected 400, got %d", code)
+	}
+	if len(pushed) != 0 {
+		t.Errorf("Expected nothing pushed from the refused batch, got %q", pushed)
+	}
+}
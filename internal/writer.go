@@ -0,0 +1,466 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/mattn/go-sqlite3"
+)
+
+var (
+	writeBatch    = flag.Int("write-batch", 100, "Write measurements to the database in transactions of up to this many rows")
+	writeInterval = flag.Duration("write-interval", 2*time.Second, "Longest time a measurement waits for its batch to be written")
+	spillJournal  = flag.String("spill-journal", "", "Journal for measurements the database could not take, replayed once it recovers (default <db>.spill)")
+)
+
+// writerQueueBatches is how many batches the queue holds before new
+// measurements go straight to the journal.
+const writerQueueBatches = 10
+
+var startMeasurementWriter = startMeasurementWriterImpl
+var storeMeasurement = storeMeasurementImpl
+
+// activeWriter is set while the batched writer accepts measurements.
+var activeWriter atomic.Pointer[measurementWriter]
+
+// WriterStatus is the state of the batched writer as reported by
+// /api/status.
+type WriterStatus struct {
+	Queued    int    `json:"queued"`
+	Spilled   int    `json:"spilled"` // waiting in the journal for the database
+	LastError string `json:"last_error,omitempty"`
+}
+
+// measurementWriter collects measurements and writes them in batches, so a
+// busy device costs one transaction every few seconds instead of one per
+// line. Batches the database refuses are spilled to the journal and written
+// before the next batch.
+type measurementWriter struct {
+	db        *sql.DB
+	journal   *journal
+	batchSize int
+	interval  time.Duration
+
+	mu     sync.Mutex // guards queue sends against close
+	queue  chan Measurement
+	closed bool
+
+	lastError atomic.Pointer[string]
+}
+
+func newMeasurementWriter(db *sql.DB, journal *journal, batchSize int, interval time.Duration) *measurementWriter {
+	return &measurementWriter{
+		db:        db,
+		journal:   journal,
+		batchSize: batchSize,
+		interval:  interval,
+		queue:     make(chan Measurement, batchSize*writerQueueBatches),
+	}
+}
+
+// enqueue hands the measurement to the writer. It returns false once the
+// writer is shutting down. A full queue spills to the journal rather than
+// blocking the source.
+func (w *measurementWriter) enqueue(m Measurement) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return false
+	}
+	select {
+	case w.queue <- m:
+	default:
+		w.spill([]Measurement{m}, errors.New("write queue is full"))
+	}
+	return true
+}
+
+func (w *measurementWriter) close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if !w.closed {
+		w.closed = true
+		close(w.queue)
+	}
+}
+
+// run writes a batch whenever it is full or the interval passed, until the
+// queue is closed and drained.
+func (w *measurementWriter) run(ctx context.Context) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	done := ctx.Done()
+	batch := make([]Measurement, 0, w.batchSize)
+	for {
+		select {
+		case m, ok := <-w.queue:
+			if !ok {
+				w.flush(batch)
+				return
+			}
+			batch = append(batch, m)
+			if len(batch) >= w.batchSize {
+				w.flush(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			w.flush(batch)
+			batch = batch[:0]
+		case <-done:
+			// Sources still running write directly from now on
+			activeWriter.CompareAndSwap(w, nil)
+			w.close()
+			done = nil
+		}
+	}
+}
+
+// flush writes the spilled measurements and then the batch, keeping their
+// order. Whatever can't be written goes to the journal.
+func (w *measurementWriter) flush(batch []Measurement) {
+	if n, err := w.journal.replay(w.db); err != nil {
+		w.spill(batch, err)
+		return
+	} else if n > 0 {
+		logInfo("Database recovered, wrote %d spilled measurement(s)", n)
+	}
+	if len(batch) == 0 {
+		return
+	}
+	if err := storageFor(w.db).InsertMeasurementBatch(batch); err != nil {
+		w.spill(batch, err)
+		return
+	}
+	w.lastError.Store(nil)
+}
+
+func (w *measurementWriter) spill(batch []Measurement, cause error) {
+	message := cause.Error()
+	w.lastError.Store(&message)
+	if len(batch) == 0 {
+		return
+	}
+	if err := w.journal.append(batch); err != nil {
+		daemonMetrics.countInsertFailures(len(batch))
+		logError("Lost %d measurement(s): database failed with %v and journal %s with %v", len(batch), cause, w.journal.path, err)
+		return
+	}
+	daemonMetrics.countSpilled(len(batch))
+	throttledLogError(&lastInsertErr, "Failed to write %d measurement(s), spilled to %s: %v", len(batch), w.journal.path, cause)
+}
+
+func (w *measurementWriter) status() WriterStatus {
+	status := WriterStatus{Queued: len(w.queue), Spilled: w.journal.size()}
+	if message := w.lastError.Load(); message != nil {
+		status.LastError = *message
+	}
+	return status
+}
+
+// storeMeasurementImpl queues the measurement for the batched writer, or
+// inserts it right away when no writer is running for db.
+func storeMeasurementImpl(db *sql.DB, m Measurement) error {
+	if w := activeWriter.Load(); w != nil && w.db == db && w.enqueue(m) {
+		return nil
+	}
+	return storageFor(db).InsertMeasurement(m, m.UnixTimestamp)
+}
+
+// startMeasurementWriterImpl writes what an earlier run left in the journal
+// and starts the batched writer. On shutdown the queued measurements are
+// written before it returns.
+func startMeasurementWriterImpl(ctx context.Context, db *sql.DB, wg *sync.WaitGroup) error {
+	if *writeBatch < 1 {
+		return fmt.Errorf("invalid -write-batch %d, expected at least 1", *writeBatch)
+	}
+	if *writeInterval <= 0 {
+		return fmt.Errorf("invalid -write-interval %v, expected a positive duration", *writeInterval)
+	}
+	path := *spillJournal
+	if path == "" {
+		path = *dbFileName + ".spill"
+	}
+	journal, err := openJournal(path)
+	if err != nil {
+		return err
+	}
+	if n, err := journal.replay(db); err != nil {
+		logWarn("Could not write %d spilled measurement(s) from %s yet: %v", journal.size(), path, err)
+	} else if n > 0 {
+		logInfo("Wrote %d measurement(s) spilled by an earlier run from %s", n, path)
+	}
+
+	w := newMeasurementWriter(db, journal, *writeBatch, *writeInterval)
+	activeWriter.Store(w)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		w.run(ctx)
+		if pending := journal.size(); pending > 0 {
+			logWarn("%d measurement(s) remain in %s and will be written on the next start", pending, path)
+		}
+	}()
+	return nil
+}
+
+const (
+	// journalReplayChunk is the most spilled measurements written in one
+	// transaction, so a long outage doesn't come back as one huge write.
+	journalReplayChunk = 500
+	// journalMaxAttempts is how often a chunk may fail before its rows are
+	// written one by one, and how often the database may then refuse a row
+	// before it is moved to the dead-letter file.
+	journalMaxAttempts = 5
+)
+
+// journal is an append-only file of measurements, one JSON object per
+// line, that the database could not take. Rows the database keeps refusing
+// are moved to deadPath in the same format, so they don't hold up the rest.
+// A row is only taken as refused when the error is about its data or a
+// later row goes in, so an outage never moves good rows.
+type journal struct {
+	mu       sync.Mutex
+	path     string
+	deadPath string
+	pending  int
+
+	chunkFailures int // consecutive failed writes of the first chunk
+	rowFailures   int // consecutive refusals of the first row on its own
+}
+
+// openJournal counts the measurements an earlier run left in the journal.
+func openJournal(path string) (*journal, error) {
+	j := &journal{path: path, deadPath: path + ".dead"}
+	measurements, err := j.read()
+	if err != nil {
+		return nil, err
+	}
+	j.pending = len(measurements)
+	return j, nil
+}
+
+func (j *journal) size() int {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.pending
+}
+
+// append writes the measurements and syncs them to disk.
+func (j *journal) append(measurements []Measurement) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if err := appendMeasurements(j.path, measurements); err != nil {
+		return err
+	}
+	j.pending += len(measurements)
+	return nil
+}
+
+// appendMeasurements appends the measurements to the file at path, one JSON
+// object per line, and syncs them to disk.
+func appendMeasurements(path string, measurements []Measurement) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+	for _, m := range measurements {
+		if err := encoder.Encode(m); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// replay writes the journal to the database in chunks of up to
+// journalReplayChunk measurements, one transaction each, and removes what
+// was written. It stops at the first chunk that fails. It returns the number
+// of measurements written.
+func (j *journal) replay(db *sql.DB) (int, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.pending == 0 {
+		return 0, nil
+	}
+	measurements, err := j.read()
+	if err != nil {
+		return 0, err
+	}
+
+	done, stored := 0, 0
+	var kept []Measurement // rows to keep in front of measurements[done:]
+	for done < len(measurements) {
+		chunk := measurements[done:min(done+journalReplayChunk, len(measurements))]
+		if j.chunkFailures < journalMaxAttempts {
+			if err = storageFor(db).InsertMeasurementBatch(chunk); err != nil {
+				j.chunkFailures++
+				break
+			}
+			j.chunkFailures = 0
+			done += len(chunk)
+			stored += len(chunk)
+			continue
+		}
+
+		// The chunk keeps failing: find the row the database refuses
+		n, rowErr := insertEach(db, chunk)
+		done += n
+		stored += n
+		if rowErr == nil {
+			j.chunkFailures = 0
+			continue
+		}
+		if n > 0 {
+			j.rowFailures = 0
+		}
+		if !rowRefused(rowErr) {
+			// The database may just be down: only a later row going in
+			// shows that it is this row it won't take
+			if done+1 == len(measurements) {
+				err = rowErr
+				break
+			}
+			if next, _ := insertEach(db, measurements[done+1:done+2]); next == 0 {
+				err = rowErr
+				break
+			}
+			stored++
+			if err = appendMeasurements(j.deadPath, measurements[done:done+1]); err != nil {
+				// Keep it in the journal, without the row stored after it
+				kept = append(kept, measurements[done])
+				done += 2
+				break
+			}
+			logError("Moved a measurement from %s to %s, the database refused it but took the next: %v", j.path, j.deadPath, rowErr)
+			done += 2
+			j.chunkFailures, j.rowFailures = 0, 0
+			continue
+		}
+		j.rowFailures++
+		if j.rowFailures < journalMaxAttempts {
+			err = rowErr
+			break
+		}
+		if err = appendMeasurements(j.deadPath, chunk[n:n+1]); err != nil {
+			break
+		}
+		logError("Moved a measurement from %s to %s after %d failed writes: %v", j.path, j.deadPath, j.rowFailures, rowErr)
+		done++
+		j.chunkFailures, j.rowFailures = 0, 0
+	}
+
+	if done > 0 {
+		if removeErr := j.truncate(append(kept, measurements[done:]...)); removeErr != nil {
+			return stored, removeErr
+		}
+	}
+	return stored, err
+}
+
+// insertEach writes the measurements one at a time up to the first that
+// fails, and returns how many were written.
+func insertEach(db *sql.DB, measurements []Measurement) (int, error) {
+	for i, m := range measurements {
+		if err := storageFor(db).InsertMeasurementBatch([]Measurement{m}); err != nil {
+			return i, err
+		}
+	}
+	return len(measurements), nil
+}
+
+// rowRefused reports whether err is the database refusing the row itself,
+// a constraint or data error, rather than being unreachable, busy or locked.
+func rowRefused(err error) bool {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		switch sqliteErr.Code {
+		case sqlite3.ErrConstraint, sqlite3.ErrMismatch, sqlite3.ErrTooBig, sqlite3.ErrRange:
+			return true
+		}
+		return false
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		// Class 22 is data exception, 23 integrity constraint violation
+		return strings.HasPrefix(pgErr.Code, "22") || strings.HasPrefix(pgErr.Code, "23")
+	}
+	return false
+}
+
+// truncate replaces the journal with the measurements still to be written,
+// through a synced temporary file so a crash leaves either version whole.
+func (j *journal) truncate(remaining []Measurement) error {
+	if len(remaining) == 0 {
+		if err := os.Remove(j.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		j.pending = 0
+		return nil
+	}
+
+	tmp := j.path + ".tmp"
+	os.Remove(tmp)
+	if err := appendMeasurements(tmp, remaining); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, j.path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	j.pending = len(remaining)
+	return nil
+}
+
+// read returns the measurements in the journal. A line cut short by a crash
+// while appending is skipped.
+func (j *journal) read() ([]Measurement, error) {
+	file, err := os.Open(j.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var measurements []Measurement
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		var m Measurement
+		if err := json.Unmarshal(scanner.Bytes(), &m); err != nil {
+			logWarn("Skipping unreadable line %d of %s: %v", line, j.path, err)
+			continue
+		}
+		measurements = append(measurements, m)
+	}
+	return measurements, scanner.Err()
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/mattn/go-sqlite3"
+)
+
+// recordBatches replaces insertMeasurementBatch with a fake that fails while
+// *failing is set and records the timestamps of every written batch.
+func recordBatches(t *testing.T, failing *bool) (*sync.Mutex, *[][]int64) {
+	t.Helper()
+	var mu sync.Mutex
+	var batches [][]int64
+	orig := insertMeasurementBatch
+	insertMeasurementBatch = func(db *sql.DB, measurements []Measurement) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if *failing {
+			return errors.New("database is locked")
+		}
+		var timestamps []int64
+		for _, m := range measurements {
+			timestamps = append(timestamps, m.UnixTimestamp)
+		}
+		batches = append(batches, timestamps)
+		return nil
+	}
+	t.Cleanup(func() { insertMeasurementBatch = orig })
+	return &mu, &batches
+}
+
+func quietWriterLogs(t *testing.T) {
+	t.Helper()
+	origInfo, origWarn, origError := logInfo, logWarn, logError
+	origThrottledError := throttledLogError
+	logInfo = func(format string, v ...any) {}
+	logWarn = func(format string, v ...any) {}
+	logError = func(format string, v ...any) {}
+	throttledLogError = func(last *time.Time, format string, v ...any) {}
+	t.Cleanup(func() {
+		logInfo, logWarn, logError = origInfo, origWarn, origError
+		throttledLogError = origThrottledError
+	})
+}
+
+func TestJournal_AppendReplay(t *testing.T) {
+	quietWriterLogs(t)
+	failing := false
+	mu, batches := recordBatches(t, &failing)
+	path := filepath.Join(t.TempDir(), "measurements.db.spill")
+
+	j, err := openJournal(path)
+	if err != nil || j.size() != 0 {
+		t.Fatalf("Expected an empty journal, got %d, %v", j.size(), err)
+	}
+	seq := int64(7)
+	if err := j.append([]Measurement{{UnixTimestamp: 1, TemperatureCelsius: 20.5, Metrics: map[string]float64{"lux": 3}, Sequence: &seq}}); err != nil {
+		t.Fatalf("Failed to append: %v", err)
+	}
+	j.append([]Measurement{{UnixTimestamp: 2}, {UnixTimestamp: 3}})
+
+	// A line cut short by a crash is skipped
+	file, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+	file.WriteString(`{"UnixTimestamp":4,"Tempera`)
+	file.Close()
+
+	reopened, err := openJournal(path)
+	if err != nil || reopened.size() != 3 {
+		t.Fatalf("Expected 3 pending measurements after reopening, got %d, %v", reopened.size(), err)
+	}
+	measurements, _ := reopened.read()
+	if measurements[0].TemperatureCelsius != 20.5 || measurements[0].Metrics["lux"] != 3 || *measurements[0].Sequence != 7 {
+		t.Errorf("Expected fields to survive the journal, got %+v", measurements[0])
+	}
+
+	failing = true
+	if n, err := reopened.replay(nil); err == nil || n != 0 || reopened.size() != 3 {
+		t.Errorf("Expected a failed replay to keep the journal, got %d, %v", n, err)
+	}
+	failing = false
+	if n, err := reopened.replay(nil); err != nil || n != 3 {
+		t.Errorf("Expected 3 replayed measurements, got %d, %v", n, err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) || reopened.size() != 0 {
+		t.Errorf("Expected the journal to be removed after replay, got %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(*batches) != 1 || len((*batches)[0]) != 3 {
+		t.Errorf("Expected one batch of 3, got %v", *batches)
+	}
+}
+
+func TestJournal_ReplayChunksAndDeadLetters(t *testing.T) {
+	quietWriterLogs(t)
+	var sizes []int
+	stored := make(map[int64]bool)
+	orig := insertMeasurementBatch
+	insertMeasurementBatch = func(db *sql.DB, measurements []Measurement) error {
+		for _, m := range measurements {
+			if m.UnixTimestamp == 700 {
+				return errors.New("constraint failed")
+			}
+		}
+		sizes = append(sizes, len(measurements))
+		for _, m := range measurements {
+			stored[m.UnixTimestamp] = true
+		}
+		return nil
+	}
+	defer func() { insertMeasurementBatch = orig }()
+
+	path := filepath.Join(t.TempDir(), "measurements.db.spill")
+	j, _ := openJournal(path)
+	var measurements []Measurement
+	for ts := int64(1); ts <= 1200; ts++ {
+		measurements = append(measurements, Measurement{UnixTimestamp: ts})
+	}
+	j.append(measurements)
+
+	n, err := j.replay(nil)
+	if err == nil || n != journalReplayChunk || j.size() != 1200-journalReplayChunk {
+		t.Fatalf("Expected the first chunk to be written before the failing one, got %d, %v, %d pending", n, err, j.size())
+	}
+	if reopened, _ := openJournal(path); reopened.size() != j.size() {
+		t.Errorf("Expected the written chunk to be removed from the file, %d pending", reopened.size())
+	}
+
+	total := n
+	for range 4 * journalMaxAttempts {
+		n, err = j.replay(nil)
+		total += n
+		if err == nil {
+			break
+		}
+	}
+	if err != nil || total != 1199 || j.size() != 0 || len(stored) != 1199 {
+		t.Fatalf("Expected all but the refused row to be written, got %d, %v, %d pending", total, err, j.size())
+	}
+	for _, size := range sizes {
+		if size > journalReplayChunk {
+			t.Errorf("Expected chunks of at most %d, got %d", journalReplayChunk, size)
+		}
+	}
+	dead, err := (&journal{path: path + ".dead"}).read()
+	if err != nil || len(dead) != 1 || dead[0].UnixTimestamp != 700 {
+		t.Errorf("Expected the refused row in the dead-letter file, got %+v, %v", dead, err)
+	}
+}
+
+func TestJournal_OutageKeepsRows(t *testing.T) {
+	quietWriterLogs(t)
+	dir := t.TempDir()
+	db, err := openDatabase(filepath.Join(dir, "measurements.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	db.Close()
+
+	path := filepath.Join(dir, "measurements.db.spill")
+	j, _ := openJournal(path)
+	w := newMeasurementWriter(db, j, 2, time.Hour)
+	for ts := int64(1); ts <= 3*journalMaxAttempts; ts++ {
+		w.flush([]Measurement{{UnixTimestamp: ts}})
+	}
+
+	if j.size() != 3*journalMaxAttempts {
+		t.Errorf("Expected every measurement kept in the journal, got %d", j.size())
+	}
+	if dead, err := (&journal{path: j.deadPath}).read(); err != nil || len(dead) != 0 {
+		t.Errorf("Expected nothing dead-lettered while the database is down, got %+v, %v", dead, err)
+	}
+}
+
+func TestRowRefused(t *testing.T) {
+	for _, test := range []struct {
+		err     error
+		refused bool
+	}{
+		{sqlite3.Error{Code: sqlite3.ErrConstraint}, true},
+		{fmt.Errorf("insert: %w", sqlite3.Error{Code: sqlite3.ErrMismatch}), true},
+		{&pgconn.PgError{Code: "23505"}, true},
+		{&pgconn.PgError{Code: "22003"}, true},
+		{sqlite3.Error{Code: sqlite3.ErrBusy}, false},
+		{sqlite3.Error{Code: sqlite3.ErrLocked}, false},
+		{&pgconn.PgError{Code: "57P01"}, false},
+		{sql.ErrConnDone, false},
+		{errors.New("sql: database is closed"), false},
+	} {
+		if got := rowRefused(test.err); got != test.refused {
+			t.Errorf("%v: expected refused %v, got %v", test.err, test.refused, got)
+		}
+	}
+}
+
+func TestMeasurementWriter_Batches(t *testing.T) {
+	quietWriterLogs(t)
+	failing := false
+	mu, batches := recordBatches(t, &failing)
+	j, _ := openJournal(filepath.Join(t.TempDir(), "spill"))
+	w := newMeasurementWriter(nil, j, 3, time.Hour)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		w.run(ctx)
+		close(done)
+	}()
+
+	for ts := int64(1); ts <= 5; ts++ {
+		if !w.enqueue(Measurement{UnixTimestamp: ts}) {
+			t.Fatal("Expected the writer to accept measurements")
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	mu.Lock()
+	if len(*batches) != 1 || len((*batches)[0]) != 3 {
+		t.Errorf("Expected a full batch of 3 to be written, got %v", *batches)
+	}
+	mu.Unlock()
+
+	// Shutdown writes the rest and stops accepting
+	cancel()
+	<-done
+	mu.Lock()
+	defer mu.Unlock()
+	if len(*batches) != 2 || (*batches)[1][0] != 4 || (*batches)[1][1] != 5 {
+		t.Errorf("Expected the remaining 2 to be written on shutdown, got %v", *batches)
+	}
+	if w.enqueue(Measurement{}) {
+		t.Error("Expected a closed writer to refuse measurements")
+	}
+}
+
+func TestMeasurementWriter_Interval(t *testing.T) {
+	quietWriterLogs(t)
+	failing := false
+	mu, batches := recordBatches(t, &failing)
+	j, _ := openJournal(filepath.Join(t.TempDir(), "spill"))
+	w := newMeasurementWriter(nil, j, 100, 20*time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.run(ctx)
+
+	w.enqueue(Measurement{UnixTimestamp: 1})
+	time.Sleep(100 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	if len(*batches) != 1 || (*batches)[0][0] != 1 {
+		t.Errorf("Expected the measurement to be written after the interval, got %v", *batches)
+	}
+}
+
+func TestMeasurementWriter_SpillsAndRecovers(t *testing.T) {
+	quietWriterLogs(t)
+	origMetrics := daemonMetrics
+	daemonMetrics = newMetricsRegistry()
+	defer func() { daemonMetrics = origMetrics }()
+	failing := true
+	mu, batches := recordBatches(t, &failing)
+	path := filepath.Join(t.TempDir(), "spill")
+	j, _ := openJournal(path)
+	w := newMeasurementWriter(nil, j, 2, time.Hour)
+
+	w.flush([]Measurement{{UnixTimestamp: 1}, {UnixTimestamp: 2}})
+	w.flush([]Measurement{{UnixTimestamp: 3}})
+	if status := w.status(); status.Spilled != 3 || status.LastError != "database is locked" {
+		t.Errorf("Expected 3 spilled measurements, got %+v", status)
+	}
+	if spilled, failures := daemonMetrics.spilled.Load(), daemonMetrics.insertFailures.Load(); spilled != 3 || failures != 0 {
+		t.Errorf("Expected 3 spilled and no lost measurements counted, got %d and %d", spilled, failures)
+	}
+
+	failing = false
+	w.flush([]Measurement{{UnixTimestamp: 4}})
+	mu.Lock()
+	defer mu.Unlock()
+	if len(*batches) != 2 || len((*batches)[0]) != 3 || (*batches)[0][0] != 1 || (*batches)[1][0] != 4 {
+		t.Errorf("Expected the spilled measurements before the new batch, got %v", *batches)
+	}
+	if status := w.status(); status.Spilled != 0 || status.LastError != "" {
+		t.Errorf("Expected the journal to be empty after recovery, got %+v", status)
+	}
+}
+
+func TestMeasurementWriter_CountsLostMeasurements(t *testing.T) {
+	quietWriterLogs(t)
+	origMetrics := daemonMetrics
+	daemonMetrics = newMetricsRegistry()
+	defer func() { daemonMetrics = origMetrics }()
+	failing := true
+	recordBatches(t, &failing)
+	j, _ := openJournal(filepath.Join(t.TempDir(), "missing", "spill"))
+	w := newMeasurementWriter(nil, j, 2, time.Hour)
+
+	// Neither the database nor the journal takes them
+	w.flush([]Measurement{{UnixTimestamp: 1}, {UnixTimestamp: 2}})
+	if spilled, failures := daemonMetrics.spilled.Load(), daemonMetrics.insertFailures.Load(); spilled != 0 || failures != 2 {
+		t.Errorf("Expected 2 lost and no spilled measurements counted, got %d and %d", failures, spilled)
+	}
+}
+
+func TestMeasurementWriter_FullQueueSpills(t *testing.T) {
+	quietWriterLogs(t)
+	j, _ := openJournal(filepath.Join(t.TempDir(), "spill"))
+	w := newMeasurementWriter(nil, j, 1, time.Hour)
+
+	for ts := int64(0); ts < writerQueueBatches+2; ts++ {
+		w.enqueue(Measurement{UnixTimestamp: ts})
+	}
+	if status := w.status(); status.Queued != writerQueueBatches || status.Spilled != 2 {
+		t.Errorf("Expected the overflow to be spilled, got %+v", status)
+	}
+}
+
+func TestStoreMeasurement_WithoutWriter(t *testing.T) {
+	origInsert := insertMeasurement
+	var inserted []Measurement
+	insertMeasurement = func(db *sql.DB, m Measurement, timestamp int64) error {
+		if timestamp != m.UnixTimestamp {
+			t.Errorf("Expected the measurement timestamp, got %d", timestamp)
+		}
+		inserted = append(inserted, m)
+		return nil
+	}
+	defer func() { insertMeasurement = origInsert }()
+
+	if err := storeMeasurement(nil, Measurement{UnixTimestamp: 42}); err != nil || len(inserted) != 1 {
+		t.Errorf("Expected a direct insert, got %v, %d", err, len(inserted))
+	}
+
+	// A writer that is shutting down falls back to direct inserts too
+	j, _ := openJournal(filepath.Join(t.TempDir(), "spill"))
+	w := newMeasurementWriter(nil, j, 10, time.Hour)
+	w.close()
+	activeWriter.Store(w)
+	defer activeWriter.Store(nil)
+	if err := storeMeasurement(nil, Measurement{UnixTimestamp: 43}); err != nil || len(inserted) != 2 {
+		t.Errorf("Expected a direct insert while closing, got %v, %d", err, len(inserted))
+	}
+}
+
+func TestStartMeasurementWriter(t *testing.T) {
+	quietWriterLogs(t)
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "writer.db")
+	db, err := openDatabase(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	origDB, origBatch, origInterval := *dbFileName, *writeBatch, *writeInterval
+	*dbFileName = dbPath
+	defer func() { *dbFileName, *writeBatch, *writeInterval = origDB, origBatch, origInterval }()
+
+	// Left over by an earlier run
+	leftover, _ := openJournal(dbPath + ".spill")
+	leftover.append([]Measurement{{UnixTimestamp: 1000, TemperatureCelsius: 11}})
+
+	*writeBatch = 0
+	var wg sync.WaitGroup
+	if err := startMeasurementWriter(context.Background(), db, &wg); err == nil {
+		t.Error("Expected error for -write-batch 0")
+	}
+	*writeBatch = 10
+	*writeInterval = time.Hour
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := startMeasurementWriter(ctx, db, &wg); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if activeWriter.Load() == nil {
+		t.Fatal("Expected the writer to be active")
+	}
+	if err := storeMeasurement(db, Measurement{UnixTimestamp: 2000, TemperatureCelsius: 22}); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	cancel()
+	wg.Wait()
+	if activeWriter.Load() != nil {
+		t.Error("Expected the writer to be inactive after shutdown")
+	}
+
+	var count int
+	var temperatures float64
+	db.QueryRow("SELECT COUNT(*), SUM(temperature) FROM measurements").Scan(&count, &temperatures)
+	if count != 2 || temperatures != 33 {
+		t.Errorf("Expected the spilled and the queued measurement to be stored, got %d rows summing %v", count, temperatures)
+	}
+	if _, err := os.Stat(dbPath + ".spill"); !os.IsNotExist(err) {
+		t.Errorf("Expected the journal to be removed, got %v", err)
+	}
+}